@@ -2,22 +2,40 @@ package alby
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"math"
+	"math/rand/v2"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
 	decodepay "github.com/nbd-wtf/ln-decodepay"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/oauth2"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 	"gorm.io/gorm"
 
 	"github.com/getAlby/hub/config"
@@ -29,16 +47,76 @@ import (
 	"github.com/getAlby/hub/nip47/permissions"
 	"github.com/getAlby/hub/service/keys"
 	"github.com/getAlby/hub/transactions"
-	"github.com/getAlby/hub/utils"
 	"github.com/getAlby/hub/version"
 )
 
 type albyOAuthService struct {
-	cfg            config.Config
-	oauthConf      *oauth2.Config
+	cfg       config.Config
+	oauthConf *oauth2.Config
+	// ALBY_API_URL without its trailing slash, see normalizeAlbyURLs
+	albyAPIURL     string
 	db             *gorm.DB
 	keys           keys.Keys
 	eventPublisher events.EventPublisher
+	logger         *logrus.Logger
+	priceProvider  PriceProvider
+	// optional client whose transport the OAuth clients are built on, see WithHTTPClient
+	httpClient *http.Client
+	// events which are currently being sent to the Alby API. Once Shutdown started
+	// no new events are accepted and pendingEventsDone is closed when the last one is done.
+	pendingEventsMutex  sync.Mutex
+	pendingEventsCount  int
+	pendingEventsClosed bool
+	pendingEventsDone   chan struct{}
+	// closed once Shutdown started, stops the background work of the service
+	shutdownStarted chan struct{}
+	// at-least-once events which could not be delivered yet, oldest first
+	queuedEvents      [][]byte
+	queuedEventsMutex sync.Mutex
+	queuedEventsFlush sync.Once
+	eventBatch        eventBatch
+	eventWorkers      eventWorkers
+
+	drainInProgress atomic.Bool
+
+	// the last /me response, to avoid repeated requests from the UI
+	cachedMe        *AlbyMe
+	cachedMeAccount string
+	cachedMeAt      time.Time
+	cachedMeMutex   sync.Mutex
+
+	backupVersionMutex sync.Mutex
+	// accounts whose backup version was compared with the backups on the server since the hub started
+	backupVersionSeeded map[string]bool
+
+	// serializes linking so concurrent requests cannot create multiple NWC nodes and apps.
+	// It only covers this process, a second hub on the same database is not serialized.
+	linkAccountMutex sync.Mutex
+
+	oauthStatesMutex sync.Mutex
+
+	// accounts for which alby_auth_expired was published, until they are linked again
+	authExpiredAccounts map[string]bool
+	authExpiredMutex    sync.Mutex
+
+	// in-flight balance requests by account
+	balanceRequests singleflight.Group
+
+	apiBreaker *circuitBreaker
+	// the LSP endpoints can be served by third parties, their failures must not open the API breaker
+	lspBreaker *circuitBreaker
+
+	apiMetrics            *apiMetrics
+	metricsCollector      MetricsCollector
+	metricsCollectorMutex sync.Mutex
+
+	// network of the node, sent in the User-Agent of Alby API requests
+	nodeNetwork      string
+	nodeNetworkMutex sync.Mutex
+
+	// LSP info by get_info url, which rarely changes
+	lspInfoCache      map[string]cachedLSPInfo
+	lspInfoCacheMutex sync.Mutex
 }
 
 const (
@@ -47,18 +125,188 @@ const (
 	refreshTokenKey      = "AlbyOAuthRefreshToken"
 	userIdentifierKey    = "AlbyUserIdentifier"
 	lightningAddressKey  = "AlbyLightningAddress"
+	grantedScopesKey     = "AlbyOAuthGrantedScopes"
+	autoLinkStatusKey    = "AlbyAutoLinkStatus"
+	activeAccountKey     = "AlbyActiveAccount"
+	linkedAccountsKey    = "AlbyLinkedAccounts"
+	backupVersionKey     = "AlbyChannelsBackupVersion"
+	lastBalanceKey       = "AlbyLastBalance"
+	oauthStatesKey       = "AlbyOAuthStates"
 )
 
+// config keys stored once per linked Alby account, see accountConfigKey.
+// They are cleared when the account is unlinked.
+var accountConfigKeys = []string{
+	accessTokenKey,
+	accessTokenExpiryKey,
+	refreshTokenKey,
+	userIdentifierKey,
+	lightningAddressKey,
+	grantedScopesKey,
+	lastBalanceKey,
+}
+
+// account config keys which are kept when the account is unlinked. The channels backup
+// version must keep increasing, otherwise new backups reuse versions of older backups.
+var persistentAccountConfigKeys = []string{
+	backupVersionKey,
+}
+
+// config keys shared by all linked Alby accounts
+var globalConfigKeys = []string{
+	autoLinkStatusKey,
+	activeAccountKey,
+	linkedAccountsKey,
+	oauthStatesKey,
+}
+
+// accounts linked before multiple accounts were supported are migrated to this name
+const defaultAccountName = "default"
+
+var accountNameRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+const (
+	AutoLinkStatusNotAttempted = "not_attempted"
+	AutoLinkStatusFailed       = "failed"
+	AutoLinkStatusSucceeded    = "succeeded"
+)
+
+const localChannelsBackupPrefix = "channels-backup-"
+
+const channelsBackupDescription = "channels"
+
 const ALBY_ACCOUNT_APP_NAME = "getalby.com"
 
-func NewAlbyOAuthService(db *gorm.DB, cfg config.Config, keys keys.Keys, eventPublisher events.EventPublisher) *albyOAuthService {
+var (
+	ErrBackupNotFound         = errors.New("channels backup not found")
+	ErrBackupDecryptionFailed = errors.New("failed to decrypt channels backup")
+	ErrBackupCorrupt          = errors.New("channels backup checksum does not match")
+	ErrConfirmationRequired   = errors.New("unlinking the Alby account must be confirmed")
+	ErrLSPPubkeyMismatch      = errors.New("LSP pubkey does not match the pinned pubkey")
+	ErrNotConnected           = errors.New("no Alby account connected")
+	ErrTokenRefreshFailed     = errors.New("failed to refresh Alby OAuth token")
+	ErrInvalidAccountName     = errors.New("account names may only contain letters, numbers, - and _")
+	ErrDrainBalanceTooLow     = errors.New("Not enough balance remaining")
+	ErrDrainInProgress        = errors.New("a shared wallet drain is already in progress")
+	ErrAccountNotLinked       = errors.New("Alby Account is not linked to this hub")
+	ErrAutoLinkNotFailed      = errors.New("auto-link can only be retried after it failed")
+	ErrUnexpectedBalanceUnit  = errors.New("unexpected balance unit")
+	ErrInsufficientBalance    = errors.New("insufficient shared wallet balance")
+	ErrNetworkMismatch        = errors.New("invoice is for a different network")
+	ErrAutoChannelOrderFailed = errors.New("auto channel order failed")
+	ErrLSPFeeMismatch         = errors.New("invoice amount does not match LSP fee")
+	ErrPaymentHashMismatch    = errors.New("paid payment hash does not match the invoice")
+	ErrInvalidPreimage        = errors.New("preimage does not match the payment hash")
+	ErrChannelTooLarge        = errors.New("channel size exceeds the configured maximum")
+	ErrInvalidDestination     = errors.New("keysend destination must be a 33 byte hex encoded pubkey")
+	ErrInvalidKeysendAmount   = errors.New("keysend amount must be a whole number of sats")
+	ErrInvalidPaymentMethod   = errors.New("payment method must be lightning or onchain")
+	ErrPaymentMethodMissing   = errors.New("LSP did not offer the requested payment method")
+	ErrInvalidOnchainAddress  = errors.New("invalid onchain payment address")
+	ErrNoLastKnownBalance     = errors.New("no Alby balance has been fetched yet")
+	ErrInvalidSuggestionSort  = errors.New("unknown channel peer suggestion sort order")
+	ErrInvalidCursor          = errors.New("invalid transaction history cursor")
+	ErrInvalidBudgetRenewal   = errors.New("unknown budget renewal period")
+	ErrNoOAuthCredentials     = errors.New("no ALBY_OAUTH_CLIENT_ID or ALBY_OAUTH_CLIENT_SECRET set")
+	ErrOAuthStateMissing      = errors.New("OAuth state must not be empty")
+	ErrOAuthStateMismatch     = errors.New("OAuth state does not match, please try to connect again")
+	ErrOAuthStateExpired      = errors.New("OAuth state expired, please try to connect again")
+	ErrPeerNotConnected       = errors.New("peer is not connected after connecting to it")
+	ErrTokenExpired           = errors.New("Alby OAuth token expired and automatic refresh is disabled")
+	ErrChannelTooSmall        = errors.New("LSP channel size is smaller than requested")
+	ErrUnlinkIncomplete       = errors.New("account was unlinked, but cleaning up its connection failed")
+)
+
+// channelsBackup is the payload stored by the Alby API. Data has one of these formats:
+//
+//   - salt-nonce-ciphertext: the original format, encrypted with the encrypted mnemonic
+//     from the config as the password. It cannot be decrypted once the unlock password
+//     changes, because that re-encrypts the mnemonic.
+//   - v2:salt-nonce-ciphertext: encrypted with the backup encryption key derived from the
+//     master seed (see keys.Keys). New backups are always written in this format, older
+//     ones stay decryptable as long as the mnemonic has not been re-encrypted.
+type channelsBackup struct {
+	Description string `json:"description"`
+	Data        string `json:"data"`
+	Checksum    string `json:"checksum,omitempty"` // hex SHA-256 of the unencrypted data
+	Version     uint64 `json:"version,omitempty"`
+	CreatedAt   int64  `json:"created_at,omitempty"` // unix timestamp
+}
+
+var defaultOAuthScopes = []string{"account:read", "balance:read", "payments:send"}
+
+// scopes needed by the features of this service, in the order they are checked
+var requiredOAuthScopes = []struct {
+	scope   string
+	feature string
+}{
+	{"account:read", "linking the Alby account"},
+	{"balance:read", "reading the shared wallet balance"},
+	{"payments:send", "paying from and draining the shared wallet"},
+}
+
+// oauthScopes parses a space or comma separated scope list, falling back to the default scopes
+func oauthScopes(scopeList string) []string {
+	scopes := strings.FieldsFunc(scopeList, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	if len(scopes) == 0 {
+		return defaultOAuthScopes
+	}
+	return scopes
+}
+
+// checkOAuthScopes warns about features which will not work with the requested scopes
+func (svc *albyOAuthService) checkOAuthScopes() {
+	for _, required := range requiredOAuthScopes {
+		if !slices.Contains(svc.oauthConf.Scopes, required.scope) {
+			svc.logger.WithFields(logrus.Fields{
+				"scope":   required.scope,
+				"scopes":  svc.oauthConf.Scopes,
+				"feature": required.feature,
+			}).Warn("Alby OAuth scope is not requested, the feature will not work")
+		}
+	}
+}
+
+// WithHTTPClient sends the Alby API and token requests through the transport of
+// httpClient, e.g. to use a custom TLS config or to capture requests in tests.
+// A configured SOCKS5 proxy still takes precedence for LSP requests.
+func WithHTTPClient(httpClient *http.Client) AlbyOAuthServiceOption {
+	return func(svc *albyOAuthService) {
+		svc.httpClient = httpClient
+	}
+}
+
+// NewAlbyOAuthService creates the service even if the configured Alby URLs are invalid,
+// the requests to the Alby API then fail. Use NewAlbyOAuthServiceWithError to fail early.
+func NewAlbyOAuthService(db *gorm.DB, cfg config.Config, keys keys.Keys, eventPublisher events.EventPublisher, opts ...AlbyOAuthServiceOption) *albyOAuthService {
+	urls, err := normalizeAlbyURLs(cfg.GetEnv())
+	if err != nil {
+		logger.Logger.WithError(err).Error("Invalid Alby URL configuration, Alby API requests will fail")
+		urls = configuredAlbyURLs(cfg.GetEnv())
+	}
+	return newAlbyOAuthService(db, cfg, keys, eventPublisher, urls, opts...)
+}
+
+// NewAlbyOAuthServiceWithError validates the configured Alby URLs and removes their trailing slashes
+// before creating the service
+func NewAlbyOAuthServiceWithError(db *gorm.DB, cfg config.Config, keys keys.Keys, eventPublisher events.EventPublisher, opts ...AlbyOAuthServiceOption) (*albyOAuthService, error) {
+	urls, err := normalizeAlbyURLs(cfg.GetEnv())
+	if err != nil {
+		return nil, err
+	}
+	return newAlbyOAuthService(db, cfg, keys, eventPublisher, urls, opts...), nil
+}
+
+func newAlbyOAuthService(db *gorm.DB, cfg config.Config, keys keys.Keys, eventPublisher events.EventPublisher, urls *albyURLs, opts ...AlbyOAuthServiceOption) *albyOAuthService {
 	conf := &oauth2.Config{
 		ClientID:     cfg.GetEnv().AlbyClientId,
 		ClientSecret: cfg.GetEnv().AlbyClientSecret,
-		Scopes:       []string{"account:read", "balance:read", "payments:send"},
+		Scopes:       oauthScopes(cfg.GetEnv().AlbyOAuthScopes),
 		Endpoint: oauth2.Endpoint{
-			TokenURL:  cfg.GetEnv().AlbyAPIURL + "/oauth/token",
-			AuthURL:   cfg.GetEnv().AlbyOAuthAuthUrl,
+			TokenURL:  urls.apiURL + "/oauth/token",
+			AuthURL:   urls.authURL,
 			AuthStyle: 2, // use HTTP Basic Authorization https://pkg.go.dev/golang.org/x/oauth2#AuthStyle
 		},
 	}
@@ -66,100 +314,369 @@ func NewAlbyOAuthService(db *gorm.DB, cfg config.Config, keys keys.Keys, eventPu
 	if cfg.GetEnv().IsDefaultClientId() {
 		conf.RedirectURL = "https://getalby.com/hub/callback"
 	} else {
-		conf.RedirectURL = cfg.GetEnv().BaseUrl + "/api/alby/callback"
+		conf.RedirectURL = urls.baseURL + "/api/alby/callback"
 	}
 
 	albyOAuthSvc := &albyOAuthService{
 		oauthConf:      conf,
+		albyAPIURL:     urls.apiURL,
 		cfg:            cfg,
 		db:             db,
 		keys:           keys,
 		eventPublisher: eventPublisher,
+		logger:         logger.NewComponentLogger(cfg.GetEnv().AlbyLogLevel),
+		priceProvider:  NewCachingPriceProvider(NewAlbyPriceProvider(albyRatesUrl), 5*time.Minute),
+
+		authExpiredAccounts: map[string]bool{},
+		backupVersionSeeded: map[string]bool{},
+		pendingEventsDone:   make(chan struct{}),
+		shutdownStarted:     make(chan struct{}),
+		apiBreaker:          newCircuitBreaker(cfg.GetEnv().AlbyBreakerThreshold, time.Duration(cfg.GetEnv().AlbyBreakerCooldownMs)*time.Millisecond),
+		lspBreaker:          newCircuitBreaker(cfg.GetEnv().AlbyBreakerThreshold, time.Duration(cfg.GetEnv().AlbyBreakerCooldownMs)*time.Millisecond),
+		apiMetrics:          newAPIMetrics(),
 	}
+	for _, opt := range opts {
+		opt(albyOAuthSvc)
+	}
+	albyOAuthSvc.migrateLegacyAccountKeys()
+	albyOAuthSvc.checkOAuthScopes()
 	return albyOAuthSvc
 }
 
-func (svc *albyOAuthService) CallbackHandler(ctx context.Context, code string, lnClient lnclient.LNClient) error {
-	token, err := svc.oauthConf.Exchange(ctx, code)
+// migrateLegacyAccountKeys moves the account keys saved before multiple
+// accounts were supported into the default account
+func (svc *albyOAuthService) migrateLegacyAccountKeys() {
+	accessToken, err := svc.cfg.Get(accessTokenKey, "")
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to fetch legacy access token from user configs")
+		return
+	}
+	if accessToken == "" {
+		return
+	}
+
+	for _, key := range slices.Concat(accountConfigKeys, persistentAccountConfigKeys) {
+		value, err := svc.cfg.Get(key, "")
+		if err != nil {
+			svc.logger.WithError(err).WithField("key", key).Error("Failed to fetch legacy account key from user configs")
+			return
+		}
+		svc.cfg.SetUpdate(accountConfigKey(key, defaultAccountName), value, "")
+	}
+	for _, key := range slices.Concat(accountConfigKeys, persistentAccountConfigKeys) {
+		// the legacy user identifier is still used to check if setup was completed
+		if key != userIdentifierKey {
+			svc.cfg.SetUpdate(key, "", "")
+		}
+	}
+	svc.addLinkedAccount(defaultAccountName)
+	svc.logger.Info("Migrated linked Alby account to the default account")
+}
+
+func accountConfigKey(key string, account string) string {
+	return key + ":" + account
+}
+
+// accountKey returns the config key for the active account
+func (svc *albyOAuthService) accountKey(key string) string {
+	return accountConfigKey(key, svc.ActiveAccount())
+}
+
+// ActiveAccount returns the name of the Alby account which GetMe, GetBalance etc. operate on
+func (svc *albyOAuthService) ActiveAccount() string {
+	activeAccount, err := svc.cfg.Get(activeAccountKey, "")
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to fetch active account from user configs")
+	}
+	if activeAccount == "" {
+		return defaultAccountName
+	}
+	return activeAccount
+}
+
+// ListLinkedAccounts returns the names of the Alby accounts which have been linked
+func (svc *albyOAuthService) ListLinkedAccounts() ([]string, error) {
+	linkedAccounts, err := svc.cfg.Get(linkedAccountsKey, "")
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to fetch linked accounts from user configs")
+		return nil, err
+	}
+	if linkedAccounts == "" {
+		return []string{}, nil
+	}
+	return strings.Split(linkedAccounts, ","), nil
+}
+
+// SwitchActiveAccount makes name the active account. name does not have to be
+// linked yet, the next OAuth callback saves its token.
+func (svc *albyOAuthService) SwitchActiveAccount(name string) error {
+	if !accountNameRegex.MatchString(name) {
+		return fmt.Errorf("%w: %q", ErrInvalidAccountName, name)
+	}
+
+	// do not switch while a token is being refreshed for the previous account
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+	svc.cfg.SetUpdate(activeAccountKey, name, "")
+	return nil
+}
+
+func (svc *albyOAuthService) addLinkedAccount(name string) {
+	linkedAccounts, err := svc.ListLinkedAccounts()
+	if err != nil || slices.Contains(linkedAccounts, name) {
+		return
+	}
+	svc.cfg.SetUpdate(linkedAccountsKey, strings.Join(append(linkedAccounts, name), ","), "")
+}
+
+func (svc *albyOAuthService) removeLinkedAccount(name string) []string {
+	linkedAccounts, err := svc.ListLinkedAccounts()
+	if err != nil {
+		return nil
+	}
+	linkedAccounts = slices.DeleteFunc(linkedAccounts, func(account string) bool {
+		return account == name
+	})
+	svc.cfg.SetUpdate(linkedAccountsKey, strings.Join(linkedAccounts, ","), "")
+	return linkedAccounts
+}
+
+func (svc *albyOAuthService) CallbackHandler(ctx context.Context, code string, state string, lnClient lnclient.LNClient) error {
+	ctx = withRequestId(ctx)
+	err := svc.verifyOAuthState(state)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to exchange token")
+		svc.loggerFor(ctx).WithError(err).Error("Rejected Alby OAuth callback")
+		return err
+	}
+
+	token, err := svc.oauthConf.Exchange(svc.oauthContext(ctx), code)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to exchange token")
 		return err
 	}
 	svc.saveToken(token)
+	svc.loadNodeNetwork(ctx, lnClient)
 
-	me, err := svc.GetMe(ctx)
+	// the server may grant fewer scopes than requested. If no scope is returned,
+	// the granted scopes are identical to the requested ones (RFC 6749 section 5.1)
+	if _, ok := token.Extra("scope").(string); !ok {
+		svc.cfg.SetUpdate(svc.accountKey(grantedScopesKey), strings.Join(svc.oauthConf.Scopes, " "), "")
+	}
+
+	me, err := svc.getMeAfterLogin(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user me")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch user me")
 		// remove token so user can retry
-		svc.cfg.SetUpdate(accessTokenKey, "", "")
+		svc.cfg.SetUpdate(svc.accountKey(accessTokenKey), "", "")
 		return err
 	}
 
 	existingUserIdentifier, err := svc.GetUserIdentifier()
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to get alby user identifier")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to get alby user identifier")
 		return err
 	}
 
 	// save the user's alby account ID on first time login
 	if existingUserIdentifier == "" {
-		svc.cfg.SetUpdate(userIdentifierKey, me.Identifier, "")
+		svc.cfg.SetUpdate(svc.accountKey(userIdentifierKey), me.Identifier, "")
 
 		if svc.cfg.GetEnv().AutoLinkAlbyAccount {
 			// link account on first login
-			err := svc.LinkAccount(ctx, lnClient, 1_000_000, constants.BUDGET_RENEWAL_MONTHLY)
+			err := svc.autoLink(ctx, lnClient)
 			if err != nil {
-				logger.Logger.WithError(err).Error("Failed to link account on first auth callback")
+				svc.loggerFor(ctx).WithError(err).Error("Failed to link account on first auth callback")
 			}
 		}
 
 	} else if me.Identifier != existingUserIdentifier {
 		// remove token so user can retry with correct account
-		svc.cfg.SetUpdate(accessTokenKey, "", "")
+		svc.cfg.SetUpdate(svc.accountKey(accessTokenKey), "", "")
 		return errors.New("Alby Hub is connected to a different alby account. Please log out of your Alby Account at getalby.com and try again.")
 	}
 
 	return nil
 }
 
+const (
+	defaultAutoLinkBudgetSat = 1_000_000
+	defaultAutoLinkRenewal   = constants.BUDGET_RENEWAL_MONTHLY
+)
+
+// BudgetRenewalKeepExisting can be passed to LinkAccount instead of a renewal period to keep
+// the budget and renewal of the existing Alby Account app, e.g. when relinking after the
+// token expired. The default auto-link budget is used if the account was not linked yet.
+const BudgetRenewalKeepExisting = "keep_existing"
+
+var budgetRenewals = []string{
+	constants.BUDGET_RENEWAL_DAILY,
+	constants.BUDGET_RENEWAL_WEEKLY,
+	constants.BUDGET_RENEWAL_MONTHLY,
+	constants.BUDGET_RENEWAL_YEARLY,
+	constants.BUDGET_RENEWAL_NEVER,
+}
+
+// autoLinkBudget returns the configured budget of automatically linked accounts
+func (svc *albyOAuthService) autoLinkBudget() (uint64, string, error) {
+	budget := svc.cfg.GetEnv().AutoLinkBudgetSat
+	if budget == 0 {
+		budget = defaultAutoLinkBudgetSat
+	}
+	renewal := svc.cfg.GetEnv().AutoLinkRenewal
+	if renewal == "" {
+		renewal = defaultAutoLinkRenewal
+	}
+	if !slices.Contains(budgetRenewals, renewal) {
+		return 0, "", fmt.Errorf("%w %q in AUTO_LINK_RENEWAL, expected one of %s", ErrInvalidBudgetRenewal, renewal, strings.Join(budgetRenewals, ", "))
+	}
+	return budget, renewal, nil
+}
+
+func (svc *albyOAuthService) autoLink(ctx context.Context, lnClient lnclient.LNClient) error {
+	budget, renewal, err := svc.autoLinkBudget()
+	if err == nil {
+		err = svc.LinkAccount(ctx, lnClient, budget, renewal)
+	}
+	if err != nil {
+		svc.cfg.SetUpdate(autoLinkStatusKey, AutoLinkStatusFailed, "")
+		return err
+	}
+	svc.cfg.SetUpdate(autoLinkStatusKey, AutoLinkStatusSucceeded, "")
+	return nil
+}
+
+// GetAutoLinkStatus returns whether the account was automatically linked on first login
+func (svc *albyOAuthService) GetAutoLinkStatus() (string, error) {
+	autoLinkStatus, err := svc.cfg.Get(autoLinkStatusKey, "")
+	if err != nil {
+		return "", err
+	}
+	if autoLinkStatus == "" {
+		return AutoLinkStatusNotAttempted, nil
+	}
+	return autoLinkStatus, nil
+}
+
+// RetryAutoLink re-runs the first login auto-link if it failed
+func (svc *albyOAuthService) RetryAutoLink(ctx context.Context, lnClient lnclient.LNClient) error {
+	autoLinkStatus, err := svc.GetAutoLinkStatus()
+	if err != nil {
+		return err
+	}
+	if autoLinkStatus != AutoLinkStatusFailed {
+		return fmt.Errorf("%w: %s", ErrAutoLinkNotFailed, autoLinkStatus)
+	}
+
+	err = svc.autoLink(ctx, lnClient)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to retry auto-link")
+		return err
+	}
+	return nil
+}
+
 func (svc *albyOAuthService) GetUserIdentifier() (string, error) {
-	userIdentifier, err := svc.cfg.Get(userIdentifierKey, "")
+	userIdentifier, err := svc.cfg.Get(svc.accountKey(userIdentifierKey), "")
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user identifier from user configs")
+		svc.logger.WithError(err).Error("Failed to fetch user identifier from user configs")
 		return "", err
 	}
 	return userIdentifier, nil
 }
 
 func (svc *albyOAuthService) GetLightningAddress() (string, error) {
-	lightningAddress, err := svc.cfg.Get(lightningAddressKey, "")
+	lightningAddress, err := svc.cfg.Get(svc.accountKey(lightningAddressKey), "")
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch lightning address from user configs")
+		svc.logger.WithError(err).Error("Failed to fetch lightning address from user configs")
 		return "", err
 	}
 	return lightningAddress, nil
 }
 
+func (svc *albyOAuthService) GrantedScopes() ([]string, error) {
+	grantedScopes, err := svc.cfg.Get(svc.accountKey(grantedScopesKey), "")
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to fetch granted scopes from user configs")
+		return nil, err
+	}
+	return strings.Fields(grantedScopes), nil
+}
+
 func (svc *albyOAuthService) IsConnected(ctx context.Context) bool {
 	token, err := svc.fetchUserToken(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to check fetch token")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to check fetch token")
 	}
 	return token != nil
 }
 
+// GetTokenStatus returns the expiry and scopes of the stored token. It only reads the
+// user configs, so unlike fetchUserToken it never refreshes the token.
+func (svc *albyOAuthService) GetTokenStatus() (*TokenStatus, error) {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+
+	grantedScopes, err := svc.GrantedScopes()
+	if err != nil {
+		return nil, err
+	}
+	status := &TokenStatus{
+		GrantedScopes: grantedScopes,
+	}
+
+	accessToken, err := svc.cfg.Get(svc.accountKey(accessTokenKey), "")
+	if err != nil {
+		return nil, err
+	}
+	if accessToken == "" {
+		return status, nil
+	}
+	status.TokenPresent = true
+
+	refreshToken, err := svc.cfg.Get(svc.accountKey(refreshTokenKey), "")
+	if err != nil {
+		return nil, err
+	}
+	status.HasRefreshToken = refreshToken != ""
+
+	expiry, err := svc.cfg.Get(svc.accountKey(accessTokenExpiryKey), "")
+	if err != nil {
+		return nil, err
+	}
+	if expiry == "" {
+		return status, nil
+	}
+	expiry64, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Unix(expiry64, 0)
+	status.ExpiresAt = &expiresAt
+	status.ExpiresInSeconds = int64(time.Until(expiresAt).Seconds())
+	status.Expired = !expiresAt.After(time.Now())
+	return status, nil
+}
+
 func (svc *albyOAuthService) saveToken(token *oauth2.Token) {
-	svc.cfg.SetUpdate(accessTokenExpiryKey, strconv.FormatInt(token.Expiry.Unix(), 10), "")
-	svc.cfg.SetUpdate(accessTokenKey, token.AccessToken, "")
-	svc.cfg.SetUpdate(refreshTokenKey, token.RefreshToken, "")
+	svc.authExpiredMutex.Lock()
+	delete(svc.authExpiredAccounts, svc.ActiveAccount())
+	svc.authExpiredMutex.Unlock()
+
+	svc.addLinkedAccount(svc.ActiveAccount())
+	svc.cfg.SetUpdate(svc.accountKey(accessTokenExpiryKey), strconv.FormatInt(token.Expiry.Unix(), 10), "")
+	svc.cfg.SetUpdate(svc.accountKey(accessTokenKey), token.AccessToken, "")
+	svc.cfg.SetUpdate(svc.accountKey(refreshTokenKey), token.RefreshToken, "")
+	if scope, ok := token.Extra("scope").(string); ok {
+		svc.cfg.SetUpdate(svc.accountKey(grantedScopesKey), scope, "")
+	}
 }
 
 var tokenMutex sync.Mutex
 
-func (svc *albyOAuthService) fetchUserToken(ctx context.Context) (*oauth2.Token, error) {
-	tokenMutex.Lock()
-	defer tokenMutex.Unlock()
-	accessToken, err := svc.cfg.Get(accessTokenKey, "")
+// loadToken reads the persisted token from the user configs.
+// It returns nil if the user has not authed with their Alby account.
+func (svc *albyOAuthService) loadToken() (*oauth2.Token, error) {
+	accessToken, err := svc.cfg.Get(svc.accountKey(accessTokenKey), "")
 	if err != nil {
 		return nil, err
 	}
@@ -168,7 +685,7 @@ func (svc *albyOAuthService) fetchUserToken(ctx context.Context) (*oauth2.Token,
 		return nil, nil
 	}
 
-	expiry, err := svc.cfg.Get(accessTokenExpiryKey, "")
+	expiry, err := svc.cfg.Get(svc.accountKey(accessTokenExpiryKey), "")
 	if err != nil {
 		return nil, err
 	}
@@ -181,7 +698,7 @@ func (svc *albyOAuthService) fetchUserToken(ctx context.Context) (*oauth2.Token,
 	if err != nil {
 		return nil, err
 	}
-	refreshToken, err := svc.cfg.Get(refreshTokenKey, "")
+	refreshToken, err := svc.cfg.Get(svc.accountKey(refreshTokenKey), "")
 	if err != nil {
 		return nil, err
 	}
@@ -190,21 +707,38 @@ func (svc *albyOAuthService) fetchUserToken(ctx context.Context) (*oauth2.Token,
 		return nil, nil
 	}
 
-	currentToken := &oauth2.Token{
+	return &oauth2.Token{
 		AccessToken:  accessToken,
 		Expiry:       time.Unix(expiry64, 0),
 		RefreshToken: refreshToken,
+	}, nil
+}
+
+func (svc *albyOAuthService) fetchUserToken(ctx context.Context) (*oauth2.Token, error) {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+	currentToken, err := svc.loadToken()
+	if err != nil || currentToken == nil {
+		return nil, err
 	}
 
-	// only use the current token if it has at least 20 seconds before expiry
+	// only use the current token if it has at least 20 seconds before expiry.
+	// This is also longer than the expiry margin of the oauth2 client, so the
+	// client does not refresh the token by itself if automatic refresh is disabled.
 	if currentToken.Expiry.After(time.Now().Add(time.Duration(20) * time.Second)) {
-		logger.Logger.Debug("Using existing Alby OAuth token")
+		svc.loggerFor(ctx).Debug("Using existing Alby OAuth token")
 		return currentToken, nil
 	}
 
-	newToken, err := svc.oauthConf.TokenSource(ctx, currentToken).Token()
+	if svc.cfg.GetEnv().DisableTokenRefresh {
+		return nil, ErrTokenExpired
+	}
+
+	newToken, err := svc.refreshUserToken(ctx, currentToken)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to refresh existing token")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to refresh existing token")
+		svc.invalidateMeCache()
+		svc.notifyAuthExpired(err)
 		return nil, err
 	}
 
@@ -212,238 +746,1672 @@ func (svc *albyOAuthService) fetchUserToken(ctx context.Context) (*oauth2.Token,
 	return newToken, nil
 }
 
-func (svc *albyOAuthService) GetMe(ctx context.Context) (*AlbyMe, error) {
-	token, err := svc.fetchUserToken(ctx)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
-		return nil, err
-	}
-
-	client := svc.oauthConf.Client(ctx, token)
+// refreshUserToken refreshes an expired token, retrying transient failures
+// with exponential backoff (e.g. 1s, 2s, 4s)
+func (svc *albyOAuthService) refreshUserToken(ctx context.Context, currentToken *oauth2.Token) (*oauth2.Token, error) {
+	retries := svc.cfg.GetEnv().TokenRefreshRetries
+	backoff := time.Duration(svc.cfg.GetEnv().TokenRefreshBackoffMs) * time.Millisecond
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/internal/users", svc.cfg.GetEnv().AlbyAPIURL), nil)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Error creating request /me")
-		return nil, err
-	}
+	for attempt := 0; ; attempt++ {
+		newToken, err := svc.oauthConf.TokenSource(svc.oauthContext(ctx), currentToken).Token()
+		if err == nil || attempt >= retries || !isTransientTokenError(err) {
+			return newToken, err
+		}
 
-	setDefaultRequestHeaders(req)
+		delay := backoff << attempt
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt + 1,
+			"delay":   delay,
+		}).Warn("Failed to refresh token, retrying")
 
-	res, err := client.Do(req)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch /me")
-		return nil, err
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
 	}
+}
 
-	me := &AlbyMe{}
-	err = json.NewDecoder(res.Body).Decode(me)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to decode API response")
-		return nil, err
+// isTransientTokenError returns false for errors returned by the token endpoint
+// which will not go away on retry, e.g. invalid_grant when the refresh token was revoked
+func isTransientTokenError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		// network errors and timeouts
+		return true
 	}
-
-	svc.cfg.SetUpdate(lightningAddressKey, me.LightningAddress, "")
-
-	logger.Logger.WithFields(logrus.Fields{"me": me}).Info("Alby me response")
-	return me, nil
+	if retrieveErr.Response == nil {
+		return false
+	}
+	statusCode := retrieveErr.Response.StatusCode
+	return statusCode >= 500 || statusCode == http.StatusTooManyRequests
 }
 
-func (svc *albyOAuthService) GetBalance(ctx context.Context) (*AlbyBalance, error) {
+// isRevokedTokenError returns true if the token endpoint rejected the refresh token,
+// e.g. as it expired or the user revoked the access. Other permanent errors such as
+// invalid_client are configuration errors, linking the account again would not fix them.
+func isRevokedTokenError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant"
+}
 
-	token, err := svc.fetchUserToken(ctx)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
-		return nil, err
+// notifyAuthExpired publishes alby_auth_expired if the refresh token was rejected,
+// so the user can be asked to link their Alby account again. It is published once per account.
+func (svc *albyOAuthService) notifyAuthExpired(refreshErr error) {
+	if !isRevokedTokenError(refreshErr) {
+		return
 	}
 
-	client := svc.oauthConf.Client(ctx, token)
-
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/internal/lndhub/balance", svc.cfg.GetEnv().AlbyAPIURL), nil)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Error creating request to balance endpoint")
-		return nil, err
+	account := svc.ActiveAccount()
+	svc.authExpiredMutex.Lock()
+	alreadyNotified := svc.authExpiredAccounts[account]
+	svc.authExpiredAccounts[account] = true
+	svc.authExpiredMutex.Unlock()
+	if alreadyNotified {
+		return
 	}
 
-	setDefaultRequestHeaders(req)
-
-	res, err := client.Do(req)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch balance endpoint")
-		return nil, err
-	}
-	balance := &AlbyBalance{}
-	err = json.NewDecoder(res.Body).Decode(balance)
+	userIdentifier, err := svc.GetUserIdentifier()
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to decode API response")
-		return nil, err
+		svc.logger.WithError(err).Error("Failed to fetch user identifier for auth expired event")
 	}
 
-	logger.Logger.WithFields(logrus.Fields{"balance": balance}).Debug("Alby balance response")
-	return balance, nil
+	svc.eventPublisher.Publish(&events.Event{
+		Event: "alby_auth_expired",
+		Properties: map[string]interface{}{
+			"account":         account,
+			"user_identifier": userIdentifier,
+		},
+	})
 }
 
-func (svc *albyOAuthService) DrainSharedWallet(ctx context.Context, lnClient lnclient.LNClient) error {
-	balance, err := svc.GetBalance(ctx)
+// RefreshToken refreshes the token regardless of its expiry, e.g. to pick up
+// permissions which were changed on getalby.com. It also refreshes tokens
+// when automatic refresh is disabled with DISABLE_TOKEN_REFRESH.
+func (svc *albyOAuthService) RefreshToken(ctx context.Context) error {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+	currentToken, err := svc.loadToken()
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch shared balance")
 		return err
 	}
-
-	balanceSat := float64(balance.Balance)
-
-	amountSat := int64(math.Floor(
-		balanceSat- // Alby shared node balance in sats
-			(balanceSat*(8.0/1000.0))- // Alby service fee (0.8%)
-			(balanceSat*0.01))) - // Maximum potential routing fees (1%)
-		10 // Alby fee reserve (10 sats)
-
-	if amountSat < 1 {
-		return errors.New("Not enough balance remaining")
+	if currentToken == nil {
+		return ErrNotConnected
 	}
-	amount := amountSat * 1000
-
-	logger.Logger.WithField("amount", amount).WithError(err).Error("Draining Alby shared wallet funds")
 
-	transaction, err := transactions.NewTransactionsService(svc.db, svc.eventPublisher).MakeInvoice(ctx, amount, "Send shared wallet funds to Alby Hub", "", 120, nil, lnClient, nil, nil)
+	// a token without an access token is never valid, so the token source always refreshes it
+	newToken, err := svc.oauthConf.TokenSource(svc.oauthContext(ctx), &oauth2.Token{RefreshToken: currentToken.RefreshToken}).Token()
 	if err != nil {
-		logger.Logger.WithField("amount", amount).WithError(err).Error("Failed to make invoice")
-		return err
+		svc.loggerFor(ctx).WithError(err).Error("Failed to refresh token")
+		svc.invalidateMeCache()
+		svc.notifyAuthExpired(err)
+		return fmt.Errorf("%w: %w", ErrTokenRefreshFailed, err)
 	}
 
-	err = svc.SendPayment(ctx, transaction.PaymentRequest)
-	if err != nil {
-		logger.Logger.WithField("amount", amount).WithError(err).Error("Failed to pay invoice from shared node")
-		return err
-	}
+	svc.saveToken(newToken)
 	return nil
 }
 
-func (svc *albyOAuthService) SendPayment(ctx context.Context, invoice string) error {
-	token, err := svc.fetchUserToken(ctx)
+// TokenTimeToExpiry returns how long until the stored access token expires,
+// negative if it has already expired. The token is not refreshed.
+func (svc *albyOAuthService) TokenTimeToExpiry(ctx context.Context) (time.Duration, error) {
+	tokenMutex.Lock()
+	defer tokenMutex.Unlock()
+	token, err := svc.loadToken()
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
-		return err
+		return 0, err
+	}
+	if token == nil {
+		return 0, ErrNotConnected
 	}
+	return time.Until(token.Expiry), nil
+}
 
-	client := svc.oauthConf.Client(ctx, token)
+// timeout of the authenticated request made by HealthCheck
+var albyHealthProbeTimeout = 5 * time.Second
 
-	type payRequest struct {
-		Invoice string `json:"invoice"`
+// HealthCheck reports whether the Alby integration of the active account works.
+// Unlike the other methods it never refreshes the token or updates any state.
+func (svc *albyOAuthService) HealthCheck(ctx context.Context) (*AlbyHealth, error) {
+	tokenMutex.Lock()
+	token, err := svc.loadToken()
+	tokenMutex.Unlock()
+	if err != nil {
+		return nil, err
 	}
 
-	body := bytes.NewBuffer([]byte{})
-	payload := payRequest{
-		Invoice: invoice,
+	grantedScopes, err := svc.GrantedScopes()
+	if err != nil {
+		return nil, err
 	}
-	err = json.NewEncoder(body).Encode(&payload)
 
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to encode request payload")
-		return err
+	health := &AlbyHealth{
+		GrantedScopes:   grantedScopes,
+		MissingScopes:   []string{},
+		CircuitState:    svc.apiBreaker.State(),
+		LSPCircuitState: svc.lspBreaker.State(),
+	}
+	for _, required := range requiredOAuthScopes {
+		if !slices.Contains(grantedScopes, required.scope) {
+			health.MissingScopes = append(health.MissingScopes, required.scope)
+		}
 	}
+	health.ScopesSufficient = len(health.MissingScopes) == 0
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/internal/lndhub/bolt11", svc.cfg.GetEnv().AlbyAPIURL), body)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Error creating request bolt11 endpoint")
-		return err
+	if token == nil {
+		return health, nil
 	}
+	health.TokenPresent = true
+	health.TokenExpiresInSeconds = int64(time.Until(token.Expiry).Seconds())
+	health.TokenExpired = !token.Expiry.After(time.Now())
 
-	setDefaultRequestHeaders(req)
+	// a static token source, so an expired token is reported rather than refreshed
+	probeCtx, cancel := context.WithTimeout(ctx, albyHealthProbeTimeout)
+	defer cancel()
+	client := oauth2.NewClient(svc.oauthContext(probeCtx), oauth2.StaticTokenSource(token))
 
-	resp, err := client.Do(req)
+	req, err := http.NewRequestWithContext(probeCtx, http.MethodGet, fmt.Sprintf("%s/internal/users", svc.albyAPIURL), nil)
 	if err != nil {
-		logger.Logger.WithFields(logrus.Fields{
+		return nil, err
+	}
+	svc.setDefaultRequestHeaders(req)
+
+	start := time.Now()
+	res, err := client.Do(req)
+	health.ProbeLatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		health.ProbeError = err.Error()
+	} else {
+		res.Body.Close()
+		health.APIReachable = true
+		health.Authenticated = res.StatusCode < 300
+		if !health.Authenticated {
+			health.ProbeError = fmt.Sprintf("unexpected status: %d", res.StatusCode)
+		}
+	}
+
+	health.Healthy = health.TokenPresent && !health.TokenExpired && health.Authenticated && health.ScopesSufficient
+	return health, nil
+}
+
+// GetMe returns the Alby account of the active account, cached for ALBY_ME_CACHE_SECONDS
+func (svc *albyOAuthService) GetMe(ctx context.Context) (*AlbyMe, error) {
+	ttl := time.Duration(svc.cfg.GetEnv().AlbyMeCacheSeconds) * time.Second
+	account := svc.ActiveAccount()
+
+	svc.cachedMeMutex.Lock()
+	if svc.cachedMe != nil && svc.cachedMeAccount == account && time.Since(svc.cachedMeAt) < ttl {
+		// copy so callers cannot modify the cached response
+		me := *svc.cachedMe
+		svc.cachedMeMutex.Unlock()
+		return &me, nil
+	}
+	svc.cachedMeMutex.Unlock()
+
+	return svc.GetMeFresh(ctx)
+}
+
+// GetSubscriptionTier returns the plan of the Alby account subscription, e.g. SubscriptionTierBuzz,
+// or SubscriptionTierFree if the account has none. Unknown plans are returned as they are.
+func (svc *albyOAuthService) GetSubscriptionTier(ctx context.Context) (string, error) {
+	me, err := svc.GetMe(ctx)
+	if err != nil {
+		return "", err
+	}
+	if me.Subscription.PlanCode == "" {
+		return SubscriptionTierFree, nil
+	}
+	return me.Subscription.PlanCode, nil
+}
+
+func (svc *albyOAuthService) invalidateMeCache() {
+	svc.cachedMeMutex.Lock()
+	defer svc.cachedMeMutex.Unlock()
+	svc.cachedMe = nil
+}
+
+// the lightning address of a new account can be provisioned after its first /me response
+var (
+	meLightningAddressRetries    = 2
+	meLightningAddressRetryDelay = 1 * time.Second
+)
+
+// GetMeFresh requests the Alby account of the active account, bypassing the cache
+func (svc *albyOAuthService) GetMeFresh(ctx context.Context) (*AlbyMe, error) {
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return svc.fetchMe(ctx, client, svc.ActiveAccount())
+}
+
+// getMeAfterLogin requests the Alby account on login. If the account has no lightning
+// address yet, e.g. as it was just created, the request is retried a few times.
+func (svc *albyOAuthService) getMeAfterLogin(ctx context.Context) (*AlbyMe, error) {
+	account := svc.ActiveAccount()
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	me, err := svc.fetchMe(ctx, client, account)
+	for retry := 1; err == nil && me.LightningAddress == "" && retry <= meLightningAddressRetries; retry++ {
+		select {
+		case <-ctx.Done():
+			return me, nil
+		case <-time.After(meLightningAddressRetryDelay):
+		}
+		svc.loggerFor(ctx).WithField("retry", retry).Debug("Alby account has no lightning address yet, requesting /me again")
+		me, err = svc.fetchMe(ctx, client, account)
+	}
+	return me, err
+}
+
+func (svc *albyOAuthService) fetchMe(ctx context.Context, client *albyAPIClient, account string) (*AlbyMe, error) {
+	me := &AlbyMe{}
+	err := client.get(ctx, "/internal/users", me)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch /me")
+		return nil, err
+	}
+
+	// an address which is not provisioned yet must not replace the known one
+	if me.LightningAddress != "" {
+		svc.cfg.SetUpdate(svc.accountKey(lightningAddressKey), me.LightningAddress, "")
+	}
+
+	cachedMe := *me
+	svc.cachedMeMutex.Lock()
+	svc.cachedMe = &cachedMe
+	svc.cachedMeAccount = account
+	svc.cachedMeAt = time.Now()
+	svc.cachedMeMutex.Unlock()
+
+	svc.loggerFor(ctx).WithFields(logrus.Fields{"me": me}).Info("Alby me response")
+	return me, nil
+}
+
+// GetBalance returns the shared wallet balance. Concurrent calls for the same
+// account share a single request.
+func (svc *albyOAuthService) GetBalance(ctx context.Context) (*AlbyBalance, error) {
+	// the request must not fail for every caller if the caller which started it goes away
+	resultChan := svc.balanceRequests.DoChan(svc.ActiveAccount(), func() (interface{}, error) {
+		return svc.getBalance(context.WithoutCancel(ctx))
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-resultChan:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		// copy so callers cannot modify each other's result
+		balance := *result.Val.(*AlbyBalance)
+		return &balance, nil
+	}
+}
+
+func (svc *albyOAuthService) getBalance(ctx context.Context) (*AlbyBalance, error) {
+	// the cached balance must not end up on another account if it is switched during the request
+	account := svc.ActiveAccount()
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	balance, err := svc.fetchBalance(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	svc.saveLastKnownBalance(account, balance)
+	return balance, nil
+}
+
+// lastKnownBalance is the last successfully fetched balance, stored so it can
+// still be shown while the Alby API is unreachable
+type lastKnownBalance struct {
+	AlbyBalance
+	UpdatedAt int64 `json:"updatedAt"` // unix timestamp
+}
+
+func (svc *albyOAuthService) saveLastKnownBalance(account string, balance *AlbyBalance) {
+	value, err := json.Marshal(lastKnownBalance{
+		AlbyBalance: *balance,
+		UpdatedAt:   time.Now().Unix(),
+	})
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to serialize last known balance")
+		return
+	}
+	svc.cfg.SetUpdate(accountConfigKey(lastBalanceKey, account), string(value), "")
+}
+
+// GetLastKnownBalance returns the balance of the last successful GetBalance call
+// and when it was fetched, without requesting the Alby API
+func (svc *albyOAuthService) GetLastKnownBalance() (*AlbyBalance, time.Time, error) {
+	value, err := svc.cfg.Get(svc.accountKey(lastBalanceKey), "")
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if value == "" {
+		return nil, time.Time{}, ErrNoLastKnownBalance
+	}
+
+	var cached lastKnownBalance
+	err = json.Unmarshal([]byte(value), &cached)
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to deserialize last known balance")
+		return nil, time.Time{}, err
+	}
+	return &cached.AlbyBalance, time.Unix(cached.UpdatedAt, 0), nil
+}
+
+func (svc *albyOAuthService) fetchBalance(ctx context.Context, client *albyAPIClient) (*AlbyBalance, error) {
+	balance := &AlbyBalance{}
+	err := client.get(ctx, "/internal/lndhub/balance", balance)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch balance endpoint")
+		return nil, err
+	}
+
+	err = normalizeBalanceUnit(balance)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).WithField("balance", balance).Error("Failed to normalize balance unit")
+		return nil, err
+	}
+
+	svc.loggerFor(ctx).WithFields(logrus.Fields{"balance": balance}).Debug("Alby balance response")
+	return balance, nil
+}
+
+// GetAccountSummary fetches the Alby account and shared wallet balance concurrently,
+// sharing one token fetch. If only one of the requests fails, the other result is
+// still returned and the failure is recorded on the summary.
+func (svc *albyOAuthService) GetAccountSummary(ctx context.Context) (*AccountSummary, error) {
+	account := svc.ActiveAccount()
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &AccountSummary{}
+	// each request records its own error so one failure does not cancel the other
+	var group errgroup.Group
+	group.Go(func() error {
+		summary.Me, summary.MeErr = svc.fetchMe(ctx, client, account)
+		return nil
+	})
+	group.Go(func() error {
+		summary.Balance, summary.BalanceErr = svc.fetchBalance(ctx, client)
+		return nil
+	})
+	group.Wait()
+
+	if summary.MeErr != nil {
+		summary.MeError = summary.MeErr.Error()
+	}
+	if summary.BalanceErr != nil {
+		summary.BalanceError = summary.BalanceErr.Error()
+	}
+	if summary.MeErr != nil && summary.BalanceErr != nil {
+		return nil, errors.Join(summary.MeErr, summary.BalanceErr)
+	}
+
+	return summary, nil
+}
+
+// GetNodeAndAccountInfo combines the node info with the Alby account of the hub. The Alby
+// fields are empty if no account is linked, the stored account details are returned
+// without requesting the Alby API.
+func (svc *albyOAuthService) GetNodeAndAccountInfo(ctx context.Context, lnClient lnclient.LNClient) (*NodeAccountInfo, error) {
+	if lnClient == nil {
+		return nil, errors.New("LNClient not started")
+	}
+
+	nodeInfo, err := lnClient.GetInfo(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to get node info")
+		return nil, err
+	}
+
+	info := &NodeAccountInfo{
+		Node:          nodeInfo,
+		AlbyConnected: svc.IsConnected(ctx),
+	}
+	if !info.AlbyConnected {
+		return info, nil
+	}
+
+	info.AlbyAccount = svc.ActiveAccount()
+	info.UserIdentifier, err = svc.GetUserIdentifier()
+	if err != nil {
+		return nil, err
+	}
+	info.LightningAddress, err = svc.GetLightningAddress()
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// normalizeBalanceUnit converts the balance to sats, which the drain calculation relies on.
+// lndhub reports balances in sats and leaves the unit empty, msat balances are rounded down.
+func normalizeBalanceUnit(balance *AlbyBalance) error {
+	switch strings.ToLower(balance.Unit) {
+	case "", "sat", "sats":
+	case "msat", "msats":
+		balance.Balance /= 1000
+	default:
+		return fmt.Errorf("%w: %q", ErrUnexpectedBalanceUnit, balance.Unit)
+	}
+	balance.Unit = "sat"
+	return nil
+}
+
+// GetBalanceWithFiat returns the shared wallet balance along with its value in currency
+// and the rate used. Unknown currencies fail with ErrUnsupportedCurrency.
+func (svc *albyOAuthService) GetBalanceWithFiat(ctx context.Context, currency string) (*AlbyBalanceWithFiat, error) {
+	balance, err := svc.GetBalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rate, rateFetchedAt, err := svc.priceProvider.RateWithFetchTime(ctx, currency)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).WithField("currency", currency).Error("Failed to fetch fiat rate")
+		return nil, err
+	}
+
+	return &AlbyBalanceWithFiat{
+		AlbyBalance:   *balance,
+		FiatCurrency:  strings.ToUpper(currency),
+		FiatBalance:   float64(balance.BalanceSat()) / 100_000_000 * rate,
+		Rate:          rate,
+		RateFetchedAt: rateFetchedAt,
+	}, nil
+}
+
+// GetInvoices lists the shared wallet (lndhub account) transactions, newest first.
+// Incoming invoices and outgoing payments are fetched separately and merged,
+// so both endpoints are asked for enough items to cover the requested page.
+func (svc *albyOAuthService) GetInvoices(ctx context.Context, params AlbyTransactionsParams) ([]AlbyTransaction, error) {
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// offset is applied after merging, so each endpoint must return everything up to the end of the page
+	fetchLimit := uint64(0)
+	if params.Limit > 0 {
+		fetchLimit = params.Offset + params.Limit
+	}
+
+	invoices, err := svc.fetchLndhubTransactions(ctx, client, "invoices", fetchLimit)
+	if err != nil {
+		return nil, err
+	}
+	payments, err := svc.fetchLndhubTransactions(ctx, client, "payments", fetchLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := make([]AlbyTransaction, 0, len(invoices)+len(payments))
+	for _, invoice := range invoices {
+		transactions = append(transactions, invoice.toAlbyTransaction(constants.TRANSACTION_TYPE_INCOMING))
+	}
+	for _, payment := range payments {
+		transactions = append(transactions, payment.toAlbyTransaction(constants.TRANSACTION_TYPE_OUTGOING))
+	}
+
+	sort.SliceStable(transactions, func(i, j int) bool {
+		return transactions[i].sortTime().After(transactions[j].sortTime())
+	})
+
+	if params.Offset >= uint64(len(transactions)) {
+		return []AlbyTransaction{}, nil
+	}
+	transactions = transactions[params.Offset:]
+	if params.Limit > 0 && params.Limit < uint64(len(transactions)) {
+		transactions = transactions[:params.Limit]
+	}
+
+	return transactions, nil
+}
+
+const defaultTransactionHistoryLimit = 50
+
+// historyCursor is the position of a transaction in the merged transaction history.
+// Transactions are ordered by creation time, then Alby before hub transactions, then
+// by hub transaction ID or Alby payment hash.
+type historyCursor struct {
+	CreatedAt int64  `json:"t"` // unix nanoseconds
+	Source    string `json:"s"`
+	Id        string `json:"id"`
+}
+
+func newHistoryCursor(transaction *HistoryTransaction) historyCursor {
+	return historyCursor{
+		CreatedAt: transaction.CreatedAt.UnixNano(),
+		Source:    transaction.Source,
+		Id:        transaction.Id,
+	}
+}
+
+func (cursor historyCursor) encode() string {
+	// marshalling the cursor cannot fail
+	value, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(value)
+}
+
+func decodeHistoryCursor(encoded string) (*historyCursor, error) {
+	value, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	cursor := &historyCursor{}
+	err = json.Unmarshal(value, cursor)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	switch cursor.Source {
+	case TransactionSourceAlby:
+	case TransactionSourceHub:
+		_, err = strconv.ParseUint(cursor.Id, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: unknown source %q", ErrInvalidCursor, cursor.Source)
+	}
+	return cursor, nil
+}
+
+// compareHistoryCursors returns a positive number if a is newer than b
+func compareHistoryCursors(a, b historyCursor) int {
+	if a.CreatedAt != b.CreatedAt {
+		return cmp.Compare(a.CreatedAt, b.CreatedAt)
+	}
+	if a.Source != b.Source {
+		if a.Source == TransactionSourceAlby {
+			return 1
+		}
+		return -1
+	}
+	if a.Source == TransactionSourceHub {
+		// validated when the cursor is decoded
+		aId, _ := strconv.ParseUint(a.Id, 10, 64)
+		bId, _ := strconv.ParseUint(b.Id, 10, 64)
+		return cmp.Compare(aId, bId)
+	}
+	return strings.Compare(a.Id, b.Id)
+}
+
+// hubTransactionsCursor converts cursor to a position in the hub transactions
+func hubTransactionsCursor(cursor *historyCursor) *transactions.TransactionsCursor {
+	if cursor == nil {
+		return nil
+	}
+	hubCursor := &transactions.TransactionsCursor{
+		CreatedAt: time.Unix(0, cursor.CreatedAt),
+		// Alby transactions are newer than hub transactions created at the same time. The
+		// largest ID which fits both uint and the signed IDs of the database, SQLite would
+		// compare math.MaxUint as -1.
+		ID: math.MaxInt,
+	}
+	if cursor.Source == TransactionSourceHub {
+		id, _ := strconv.ParseUint(cursor.Id, 10, 64)
+		hubCursor.ID = uint(id)
+	}
+	return hubCursor
+}
+
+// GetTransactions lists the settled transactions of the hub and the Alby shared wallet,
+// merged into one history ordered by creation time. Pages are requested with the cursors
+// of the previous page, which stay valid as new transactions are added.
+func (svc *albyOAuthService) GetTransactions(ctx context.Context, params TransactionHistoryParams) (*TransactionHistoryPage, error) {
+	limit := params.Limit
+	if limit == 0 {
+		limit = defaultTransactionHistoryLimit
+	}
+
+	var cursor *historyCursor
+	if params.Cursor != "" {
+		var err error
+		cursor, err = decodeHistoryCursor(params.Cursor)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// one more than the limit is fetched to know whether there is another page
+	hubTransactions, err := transactions.NewTransactionsService(svc.db, svc.eventPublisher).ListTransactionsPage(ctx, hubTransactionsCursor(cursor), params.Newer, limit+1)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to list hub transactions")
+		return nil, err
+	}
+
+	albyTransactions, err := svc.fetchSettledAlbyTransactions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]HistoryTransaction, 0, len(hubTransactions)+len(albyTransactions))
+	for _, transaction := range hubTransactions {
+		history = append(history, HistoryTransaction{
+			Source:      TransactionSourceHub,
+			Id:          strconv.FormatUint(uint64(transaction.ID), 10),
+			Type:        transaction.Type,
+			AmountSat:   int64(transaction.AmountMsat / 1000),
+			FeeSat:      int64(transaction.FeeMsat / 1000),
+			PaymentHash: transaction.PaymentHash,
+			Description: transaction.Description,
+			CreatedAt:   transaction.CreatedAt,
+			SettledAt:   transaction.SettledAt,
+		})
+	}
+	for _, transaction := range albyTransactions {
+		// the Alby API cannot be queried by cursor, so its transactions are filtered here
+		if cursor != nil {
+			comparison := compareHistoryCursors(newHistoryCursor(&transaction), *cursor)
+			if (params.Newer && comparison <= 0) || (!params.Newer && comparison >= 0) {
+				continue
+			}
+		}
+		history = append(history, transaction)
+	}
+
+	slices.SortFunc(history, func(a, b HistoryTransaction) int {
+		comparison := compareHistoryCursors(newHistoryCursor(&a), newHistoryCursor(&b))
+		if params.Newer {
+			return comparison
+		}
+		return -comparison
+	})
+
+	hasMore := uint64(len(history)) > limit
+	if hasMore {
+		history = history[:limit]
+	}
+	if params.Newer {
+		slices.Reverse(history)
+	}
+
+	page := &TransactionHistoryPage{
+		Transactions: history,
+	}
+	if len(history) == 0 {
+		return page, nil
+	}
+	// paging in one direction always leaves at least the cursor transaction in the other
+	if hasMore || (params.Newer && cursor != nil) {
+		page.NextCursor = newHistoryCursor(&history[len(history)-1]).encode()
+	}
+	if (hasMore && params.Newer) || (!params.Newer && cursor != nil) {
+		page.PrevCursor = newHistoryCursor(&history[0]).encode()
+	}
+	return page, nil
+}
+
+func (svc *albyOAuthService) fetchSettledAlbyTransactions(ctx context.Context) ([]HistoryTransaction, error) {
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	history := []HistoryTransaction{}
+	for _, kind := range []struct {
+		path            string
+		transactionType string
+	}{
+		{"invoices", constants.TRANSACTION_TYPE_INCOMING},
+		{"payments", constants.TRANSACTION_TYPE_OUTGOING},
+	} {
+		lndhubTransactions, err := svc.fetchLndhubTransactions(ctx, client, kind.path, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, lndhubTransaction := range lndhubTransactions {
+			if !lndhubTransaction.IsPaid {
+				continue
+			}
+			transaction := lndhubTransaction.toAlbyTransaction(kind.transactionType)
+			history = append(history, HistoryTransaction{
+				Source:      TransactionSourceAlby,
+				Id:          transaction.PaymentHash,
+				Type:        transaction.Type,
+				AmountSat:   transaction.AmountSat,
+				FeeSat:      transaction.FeeSat,
+				PaymentHash: transaction.PaymentHash,
+				Description: transaction.Memo,
+				CreatedAt:   transaction.CreatedAt,
+				SettledAt:   transaction.SettledAt,
+			})
+		}
+	}
+	return history, nil
+}
+
+// lndhub invoice or payment, as returned by the internal lndhub endpoints
+type lndhubTransaction struct {
+	PaymentHash string     `json:"payment_hash"`
+	Amount      int64      `json:"amount"`
+	Fee         int64      `json:"fee"`
+	Description string     `json:"description"`
+	IsPaid      bool       `json:"is_paid"`
+	CreatedAt   time.Time  `json:"created_at"`
+	SettledAt   *time.Time `json:"settled_at"`
+}
+
+func (transaction *lndhubTransaction) toAlbyTransaction(transactionType string) AlbyTransaction {
+	albyTransaction := AlbyTransaction{
+		Type:        transactionType,
+		AmountSat:   transaction.Amount,
+		FeeSat:      transaction.Fee,
+		PaymentHash: transaction.PaymentHash,
+		Memo:        transaction.Description,
+		CreatedAt:   transaction.CreatedAt,
+	}
+	if transaction.IsPaid {
+		albyTransaction.SettledAt = transaction.SettledAt
+	}
+	return albyTransaction
+}
+
+func (svc *albyOAuthService) fetchLndhubTransactions(ctx context.Context, client *albyAPIClient, kind string, limit uint64) ([]lndhubTransaction, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.FormatUint(limit, 10))
+		query.Set("offset", "0")
+	}
+
+	path := "/internal/lndhub/" + kind
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	transactions := []lndhubTransaction{}
+	err := client.get(ctx, path, &transactions)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).WithField("kind", kind).Error("Failed to fetch lndhub transactions endpoint")
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+// PreviewDrainSharedWallet returns how much a drain would move to the hub
+// and the balance it is projected to leave on the shared node
+func (svc *albyOAuthService) PreviewDrainSharedWallet(ctx context.Context) (*DrainSharedWalletPreview, error) {
+	balance, err := svc.GetBalance(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch shared balance")
+		return nil, err
+	}
+
+	return previewDrain(balance.BalanceSat(), svc.drainOptions(nil))
+}
+
+func previewDrain(balanceSat int64, opts DrainOptions) (*DrainSharedWalletPreview, error) {
+	amountSat, err := CalculateDrainAmount(balanceSat, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &DrainSharedWalletPreview{
+		AmountSat:    amountSat,
+		RemainingSat: balanceSat - amountSat,
+	}, nil
+}
+
+// DefaultDrainOptions returns the fees Alby charges when paying from the shared wallet
+func DefaultDrainOptions() DrainOptions {
+	return DrainOptions{
+		ServiceFeeBps:     80,  // Alby service fee (0.8%)
+		RoutingReserveBps: 100, // Maximum potential routing fees (1%), raised if a drain fails because of the fees
+		FlatReserveSat:    10,  // Alby fee reserve (10 sats)
+	}
+}
+
+// drainOptions returns the default fees with the configured minimum balance,
+// replaced by the fields which are set in override
+func (svc *albyOAuthService) drainOptions(override *DrainOptionsOverride) DrainOptions {
+	opts := DefaultDrainOptions()
+	opts.MinBalanceSat = int64(svc.cfg.GetEnv().AlbyMinBalanceSat)
+	if override == nil {
+		return opts
+	}
+	if override.ServiceFeeBps != nil {
+		opts.ServiceFeeBps = *override.ServiceFeeBps
+	}
+	if override.RoutingReserveBps != nil {
+		opts.RoutingReserveBps = *override.RoutingReserveBps
+	}
+	if override.FlatReserveSat != nil {
+		opts.FlatReserveSat = *override.FlatReserveSat
+	}
+	if override.MinBalanceSat != nil {
+		opts.MinBalanceSat = *override.MinBalanceSat
+	}
+	return opts
+}
+
+// CalculateDrainAmount returns the amount which can be drained from a shared
+// wallet balance of balanceSat once the fee reserves in opts are deducted
+func CalculateDrainAmount(balanceSat int64, opts DrainOptions) (int64, error) {
+	balance := float64(balanceSat)
+
+	amountSat := int64(math.Floor(
+		balance-
+			(balance*float64(opts.ServiceFeeBps)/10000.0)-
+			(balance*float64(opts.RoutingReserveBps)/10000.0))) -
+		opts.FlatReserveSat
+
+	// some shared nodes lock balances below a minimum, so rather than stranding
+	// unusable dust keep at least the minimum once the fees have been paid
+	amountSat -= opts.MinBalanceSat
+
+	if amountSat < 1 {
+		return 0, fmt.Errorf("%w: balance %d sats, drainable %d sats", ErrDrainBalanceTooLow, balanceSat, amountSat)
+	}
+
+	return amountSat, nil
+}
+
+const defaultDrainDescription = "Send shared wallet funds to Alby Hub"
+
+// DrainSharedWallet moves the shared wallet balance to lnClient. The fields set in override
+// replace the default fee reserves, pass nil to use the defaults. memo is
+// set on the hub invoices of the drain, pass nil for the default description.
+func (svc *albyOAuthService) DrainSharedWallet(ctx context.Context, lnClient lnclient.LNClient, override *DrainOptionsOverride, memo *DrainMemo) (*DrainSharedWalletResult, error) {
+	ctx = withRequestId(ctx)
+	// a second drain would race the first one on the same shared balance
+	// while its self-invoice is still waiting to be paid
+	if !svc.drainInProgress.CompareAndSwap(false, true) {
+		return nil, ErrDrainInProgress
+	}
+	defer svc.drainInProgress.Store(false)
+	svc.loadNodeNetwork(ctx, lnClient)
+
+	balance, err := svc.GetBalance(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch shared balance")
+		return nil, err
+	}
+
+	opts := svc.drainOptions(override)
+	for {
+		result, err := svc.drain(ctx, lnClient, balance.BalanceSat(), opts, memo)
+		// only retry if nothing was drained yet, otherwise the balance has changed
+		if err == nil || result == nil || result.PartsCompleted > 0 || !isFeeRelatedPaymentError(err) {
+			return result, err
+		}
+		if opts.RoutingReserveBps >= int64(svc.cfg.GetEnv().AlbyDrainMaxFeePct)*100 {
+			return result, err
+		}
+		opts.RoutingReserveBps += 100
+		if sendPaymentErrorClass(err) == SendPaymentErrorInsufficientBalance {
+			// the shared wallet requires part of the balance to be kept for fees
+			svc.loggerFor(ctx).WithField("routing_reserve_bps", opts.RoutingReserveBps).WithError(err).Warn("Drain amount exceeds the spendable shared wallet balance, retrying with a larger fee reserve")
+			continue
+		}
+		svc.loggerFor(ctx).WithField("routing_reserve_bps", opts.RoutingReserveBps).WithError(err).Warn("Drain failed due to routing fees, retrying with a larger fee reserve")
+	}
+}
+
+func (svc *albyOAuthService) drain(ctx context.Context, lnClient lnclient.LNClient, balanceSat int64, opts DrainOptions, memo *DrainMemo) (*DrainSharedWalletResult, error) {
+	amountSat, err := CalculateDrainAmount(balanceSat, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// large balances can exceed what the node can receive in a single payment
+	parts := splitDrainAmount(amountSat, int64(svc.cfg.GetEnv().AlbyDrainMaxPartSat))
+	result := &DrainSharedWalletResult{
+		AttemptedSat: amountSat,
+		PartsTotal:   len(parts),
+		Preimages:    []string{},
+	}
+
+	svc.loggerFor(ctx).WithField("amount", amountSat*1000).Info("Draining Alby shared wallet funds")
+
+	description := defaultDrainDescription
+	var metadata map[string]interface{}
+	if memo != nil {
+		if memo.Description != "" {
+			description = memo.Description
+		}
+		metadata = memo.Metadata
+	}
+
+	for i, partSat := range parts {
+		amount := partSat * 1000
+
+		transaction, err := transactions.NewTransactionsService(svc.db, svc.eventPublisher).MakeInvoice(ctx, amount, description, "", 120, metadata, lnClient, nil, nil)
+		if err != nil {
+			svc.loggerFor(ctx).WithField("amount", amount).WithField("part", i+1).WithError(err).Error("Failed to make invoice")
+			return result, err
+		}
+
+		payment, err := svc.SendPayment(ctx, transaction.PaymentRequest)
+		if err != nil {
+			svc.loggerFor(ctx).WithField("amount", amount).WithField("part", i+1).WithError(err).Error("Failed to pay invoice from shared node")
+			return result, err
+		}
+
+		result.DrainedSat += partSat
+		result.PartsCompleted++
+		result.Preimages = append(result.Preimages, payment.Preimage)
+	}
+	return result, nil
+}
+
+// isFeeRelatedPaymentError returns true if a payment failed because the fee reserve was
+// too small, either to find a route or for the shared wallet to cover the fees from the balance
+func isFeeRelatedPaymentError(err error) bool {
+	switch sendPaymentErrorClass(err) {
+	case SendPaymentErrorRouteNotFound, SendPaymentErrorInsufficientBalance:
+		return true
+	}
+	return false
+}
+
+// splitDrainAmount splits amountSat into parts of at most maxPartSat.
+// A maxPartSat of 0 drains in a single payment.
+func splitDrainAmount(amountSat int64, maxPartSat int64) []int64 {
+	if maxPartSat <= 0 || amountSat <= maxPartSat {
+		return []int64{amountSat}
+	}
+	parts := []int64{}
+	for remaining := amountSat; remaining > 0; remaining -= maxPartSat {
+		parts = append(parts, min(remaining, maxPartSat))
+	}
+	return parts
+}
+
+// SendPayment pays invoice from the shared wallet and returns the verified preimage
+func (svc *albyOAuthService) SendPayment(ctx context.Context, invoice string) (*AlbyPayResponse, error) {
+	ctx = withRequestId(ctx)
+	return svc.sendPayment(ctx, invoice)
+}
+
+// SendPayments pays each invoice from the shared wallet. Failed payments do not
+// stop the batch; each result carries either the preimage or the error.
+func (svc *albyOAuthService) SendPayments(ctx context.Context, invoices []string) []PayResult {
+	ctx = withRequestId(ctx)
+	results := make([]PayResult, 0, len(invoices))
+	for _, invoice := range invoices {
+		result := PayResult{
+			Invoice: invoice,
+		}
+		payment, err := svc.sendPayment(ctx, invoice)
+		if err != nil {
+			result.Err = err
+			result.Error = err.Error()
+		} else {
+			result.Preimage = payment.Preimage
+			result.FeeSat = payment.FeeSat
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func (svc *albyOAuthService) sendPayment(ctx context.Context, invoice string) (*AlbyPayResponse, error) {
+	paymentRequest, err := decodepay.Decodepay(invoice)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode invoice: %w", err)
+	}
+
+	// the shared wallet pays invoices of any network, so a mainnet invoice could be paid from a testnet hub
+	err = validateInvoiceNetwork(&paymentRequest, svc.getNodeNetwork())
+	if err != nil {
+		svc.loggerFor(ctx).WithField("invoice", invoice).WithError(err).Error("Refusing to pay invoice")
+		return nil, err
+	}
+
+	if svc.cfg.GetEnv().AlbyPayBalanceCheck {
+		err := svc.checkBalanceForInvoice(ctx, &paymentRequest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type payRequest struct {
+		Invoice string `json:"invoice"`
+	}
+
+	type PayResponse struct {
+		Preimage     string `json:"payment_preimage"`
+		PaymentHash  string `json:"payment_hash"`
+		PaymentRoute *struct {
+			TotalFees int64 `json:"total_fees"`
+		} `json:"payment_route"`
+	}
+
+	responsePayload := &PayResponse{}
+	err = client.post(ctx, "/internal/lndhub/bolt11", &payRequest{Invoice: invoice}, responsePayload)
+
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) {
+		errorPayload := &sendPaymentErrorResponse{}
+		err = json.Unmarshal(statusErr.body, errorPayload)
+		if err != nil {
+			svc.loggerFor(ctx).WithFields(logrus.Fields{
+				"status": statusErr.statusCode,
+			}).WithError(err).Error("Failed to decode payment error response payload")
+			return nil, err
+		}
+
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"invoice": invoice,
+			"status":  statusErr.statusCode,
+			"code":    errorPayload.Code,
+			"message": errorPayload.Message,
+		}).Error("Payment failed")
+		return nil, newSendPaymentError(errorPayload.Code, errorPayload.Message)
+	}
+	if err != nil {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
 			"invoice": invoice,
 		}).WithError(err).Error("Failed to pay invoice")
-		return err
+		return nil, err
 	}
 
-	type PayResponse struct {
+	// do not trust the shared wallet's proof of payment without checking it
+	err = verifyPaymentPreimage(invoice, responsePayload.PaymentHash, responsePayload.Preimage)
+	if err != nil {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"invoice":     invoice,
+			"paymentHash": responsePayload.PaymentHash,
+			"preimage":    responsePayload.Preimage,
+		}).WithError(err).Error("Shared wallet returned an invalid proof of payment")
+		return nil, err
+	}
+
+	// the fee is not included in every lndhub response
+	var feeSat int64
+	if responsePayload.PaymentRoute != nil {
+		feeSat = responsePayload.PaymentRoute.TotalFees
+	}
+
+	svc.loggerFor(ctx).WithFields(logrus.Fields{
+		"invoice":     invoice,
+		"paymentHash": responsePayload.PaymentHash,
+		"preimage":    responsePayload.Preimage,
+		"fee":         feeSat,
+	}).Info("Alby Payment successful")
+	return &AlbyPayResponse{
+		Preimage: responsePayload.Preimage,
+		FeeSat:   feeSat,
+	}, nil
+}
+
+// SendKeysend sends a spontaneous payment from the shared wallet to destination.
+// The shared wallet only supports whole sat amounts.
+func (svc *albyOAuthService) SendKeysend(ctx context.Context, destination string, amountMsat uint64, tlvRecords map[uint64]string) (*KeysendResult, error) {
+	ctx = withRequestId(ctx)
+	if !isValidPubkey(destination) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidDestination, destination)
+	}
+	if amountMsat == 0 || amountMsat%1000 != 0 {
+		return nil, fmt.Errorf("%w: %d msat", ErrInvalidKeysendAmount, amountMsat)
+	}
+
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type keysendRequest struct {
+		Amount        uint64            `json:"amount"`
+		Destination   string            `json:"destination"`
+		CustomRecords map[string]string `json:"customRecords,omitempty"`
+	}
+
+	payload := keysendRequest{
+		Amount:      amountMsat / 1000,
+		Destination: destination,
+	}
+	if len(tlvRecords) > 0 {
+		payload.CustomRecords = make(map[string]string, len(tlvRecords))
+		for tlvType, value := range tlvRecords {
+			payload.CustomRecords[strconv.FormatUint(tlvType, 10)] = value
+		}
+	}
+
+	type KeysendResponse struct {
 		Preimage    string `json:"payment_preimage"`
 		PaymentHash string `json:"payment_hash"`
 	}
 
-	if resp.StatusCode >= 300 {
+	responsePayload := &KeysendResponse{}
+	err = client.post(ctx, "/internal/lndhub/keysend", &payload, responsePayload)
+
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) {
+		errorPayload := &sendPaymentErrorResponse{}
+		err = json.Unmarshal(statusErr.body, errorPayload)
+		if err != nil {
+			svc.loggerFor(ctx).WithFields(logrus.Fields{
+				"status": statusErr.statusCode,
+			}).WithError(err).Error("Failed to decode keysend error response payload")
+			return nil, err
+		}
+
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"destination": destination,
+			"status":      statusErr.statusCode,
+			"code":        errorPayload.Code,
+			"message":     errorPayload.Message,
+		}).Error("Keysend payment failed")
+		return nil, newSendPaymentError(errorPayload.Code, errorPayload.Message)
+	}
+	if err != nil {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"destination": destination,
+		}).WithError(err).Error("Failed to send keysend payment")
+		return nil, err
+	}
+
+	// there is no invoice to check the payment hash against, but the preimage must still match it
+	err = verifyPreimageHash(responsePayload.PaymentHash, responsePayload.Preimage)
+	if err != nil {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"destination": destination,
+			"paymentHash": responsePayload.PaymentHash,
+			"preimage":    responsePayload.Preimage,
+		}).WithError(err).Error("Shared wallet returned an invalid proof of payment")
+		return nil, err
+	}
+
+	svc.loggerFor(ctx).WithFields(logrus.Fields{
+		"destination": destination,
+		"amountMsat":  amountMsat,
+		"paymentHash": responsePayload.PaymentHash,
+	}).Info("Alby keysend payment successful")
+
+	return &KeysendResult{
+		Preimage:    responsePayload.Preimage,
+		PaymentHash: responsePayload.PaymentHash,
+	}, nil
+}
+
+// isValidPubkey checks pubkey is a hex encoded 33 byte compressed public key
+func isValidPubkey(pubkey string) bool {
+	pubkeyBytes, err := hex.DecodeString(pubkey)
+	return err == nil && len(pubkeyBytes) == 33 && (pubkeyBytes[0] == 0x02 || pubkeyBytes[0] == 0x03)
+}
+
+// verifyPaymentPreimage checks that the paid payment hash is the one of invoice,
+// and that preimage hashes to it
+func verifyPaymentPreimage(invoice string, paymentHash string, preimage string) error {
+	paymentRequest, err := decodepay.Decodepay(invoice)
+	if err != nil {
+		return fmt.Errorf("failed to decode invoice: %w", err)
+	}
+
+	if !strings.EqualFold(paymentHash, paymentRequest.PaymentHash) {
+		return fmt.Errorf("%w: paid %q, invoice %q", ErrPaymentHashMismatch, paymentHash, paymentRequest.PaymentHash)
+	}
+
+	return verifyPreimageHash(paymentRequest.PaymentHash, preimage)
+}
+
+// verifyPreimageHash checks that preimage hashes to paymentHash
+func verifyPreimageHash(paymentHash string, preimage string) error {
+	preimageBytes, err := hex.DecodeString(preimage)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidPreimage, err)
+	}
+	preimageHash := sha256.Sum256(preimageBytes)
+	if !strings.EqualFold(hex.EncodeToString(preimageHash[:]), paymentHash) {
+		return ErrInvalidPreimage
+	}
+
+	return nil
+}
+
+// invoice bech32 prefixes by the network names reported by the LNClients
+var invoiceNetworkPrefixes = map[string]string{
+	"bitcoin": "bc",
+	"mainnet": "bc",
+	"testnet": "tb",
+	"signet":  "tbs",
+	"regtest": "bcrt",
+}
+
+// validateInvoiceNetwork rejects invoices which cannot be paid on network.
+// Unknown networks are not checked.
+func validateInvoiceNetwork(paymentRequest *decodepay.Bolt11, network string) error {
+	expectedPrefix, ok := invoiceNetworkPrefixes[network]
+	if !ok {
+		return nil
+	}
+	if paymentRequest.Currency != expectedPrefix {
+		return fmt.Errorf("%w: %s invoice on %s", ErrNetworkMismatch, paymentRequest.Currency, network)
+	}
+	return nil
+}
+
+// checkBalanceForInvoice fails fast if the shared wallet balance clearly cannot
+// cover the invoice, rather than waiting for the payment to be rejected
+func (svc *albyOAuthService) checkBalanceForInvoice(ctx context.Context, paymentRequest *decodepay.Bolt11) error {
+	// the amount of amountless invoices is only known by the Alby API
+	if paymentRequest.MSatoshi == 0 {
+		return nil
+	}
+
+	balance, err := svc.GetBalance(ctx)
+	if err != nil {
+		return err
+	}
+
+	amountSat := paymentRequest.MSatoshi / 1000
+	// same routing fee estimate as when draining the shared wallet
+	requiredSat := amountSat + int64(math.Ceil(float64(amountSat)*0.01)) + 10
+	if balance.BalanceSat() < requiredSat {
+		return fmt.Errorf("%w: balance %d sats, required %d sats", ErrInsufficientBalance, balance.BalanceSat(), requiredSat)
+	}
+	return nil
+}
+
+func (svc *albyOAuthService) SendToLightningAddress(ctx context.Context, lightningAddress string, amountSat uint64, comment string) error {
+	ctx = withRequestId(ctx)
+	lnurlPayUrl, err := lightningAddressToLNURLPayUrl(lightningAddress)
+	if err != nil {
+		return err
+	}
+
+	params, err := fetchLNURLPayParams(ctx, lnurlPayUrl)
+	if err != nil {
+		svc.loggerFor(ctx).WithField("lightning_address", lightningAddress).WithError(err).Error("Failed to fetch lnurl-pay params")
+		return err
+	}
+
+	invoice, err := fetchLNURLPayInvoice(ctx, params, amountSat*1000, comment)
+	if err != nil {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"lightning_address": lightningAddress,
+			"amount":            amountSat,
+		}).WithError(err).Error("Failed to fetch lnurl-pay invoice")
+		return err
+	}
+
+	_, err = svc.SendPayment(ctx, invoice)
+	return err
+}
+
+// RequestLightningAddressInvoice requests an invoice for amountSat from the lightning address
+// of the Alby account, which is paid into the shared wallet
+func (svc *albyOAuthService) RequestLightningAddressInvoice(ctx context.Context, amountSat uint64, comment string) (string, error) {
+	ctx = withRequestId(ctx)
+	lightningAddress, err := svc.GetLightningAddress()
+	if err != nil {
+		return "", err
+	}
+	if lightningAddress == "" {
+		return "", ErrNoLightningAddress
+	}
+
+	lnurlPayUrl, err := lightningAddressToLNURLPayUrl(lightningAddress)
+	if err != nil {
+		return "", err
+	}
+
+	params, err := fetchLNURLPayParams(ctx, lnurlPayUrl)
+	if err != nil {
+		svc.loggerFor(ctx).WithField("lightning_address", lightningAddress).WithError(err).Error("Failed to fetch lnurl-pay params")
+		return "", err
+	}
+
+	invoice, err := fetchLNURLPayInvoice(ctx, params, amountSat*1000, comment)
+	if err != nil {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"lightning_address": lightningAddress,
+			"amount":            amountSat,
+		}).WithError(err).Error("Failed to fetch lnurl-pay invoice")
+		return "", err
+	}
+	return invoice, nil
+}
+
+// GetAuthUrl returns the Alby OAuth authorization URL with a state CallbackHandler
+// accepts, or an empty string if it cannot be built. The state is persisted, so it is
+// only called when the login flow starts.
+func (svc *albyOAuthService) GetAuthUrl() string {
+	state, err := svc.issueOAuthState()
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to issue Alby OAuth state")
+		return ""
+	}
+	authUrl, err := svc.GetAuthUrlWithState(state)
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to build Alby auth URL")
+		return ""
+	}
+	return authUrl
+}
+
+// how long an OAuth state is accepted by CallbackHandler
+var oauthStateTTL = 10 * time.Minute
+
+type oauthState struct {
+	State     string `json:"state"`
+	ExpiresAt int64  `json:"expiresAt"` // unix timestamp
+}
+
+func (svc *albyOAuthService) loadOAuthStates() ([]oauthState, error) {
+	value, err := svc.cfg.Get(oauthStatesKey, "")
+	if err != nil {
+		return nil, err
+	}
+	states := []oauthState{}
+	if value == "" {
+		return states, nil
+	}
+	err = json.Unmarshal([]byte(value), &states)
+	if err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (svc *albyOAuthService) saveOAuthStates(states []oauthState) error {
+	value, err := json.Marshal(states)
+	if err != nil {
+		return err
+	}
+	svc.cfg.SetUpdate(oauthStatesKey, string(value), "")
+	return nil
+}
+
+// issueOAuthState returns a random state for the auth URL. The auth URL is requested
+// again when the login page is reloaded, so a recent state is reused rather than issuing
+// a new one each time, and older ones stay valid until they expire.
+func (svc *albyOAuthService) issueOAuthState() (string, error) {
+	svc.oauthStatesMutex.Lock()
+	defer svc.oauthStatesMutex.Unlock()
+
+	states, err := svc.loadOAuthStates()
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	states = slices.DeleteFunc(states, func(state oauthState) bool {
+		return now.Unix() >= state.ExpiresAt
+	})
+	if len(states) > 0 {
+		newest := states[len(states)-1]
+		if time.Unix(newest.ExpiresAt, 0).Sub(now) > oauthStateTTL/2 {
+			return newest.State, nil
+		}
+	}
+
+	stateBytes := make([]byte, 16)
+	_, err = cryptorand.Read(stateBytes)
+	if err != nil {
+		return "", err
+	}
+	state := hex.EncodeToString(stateBytes)
+	states = append(states, oauthState{
+		State:     state,
+		ExpiresAt: now.Add(oauthStateTTL).Unix(),
+	})
+	err = svc.saveOAuthStates(states)
+	if err != nil {
+		return "", err
+	}
+	return state, nil
+}
+
+// verifyOAuthState checks the state of an OAuth callback was issued by issueOAuthState
+// and has not expired. A state can only be used once.
+func (svc *albyOAuthService) verifyOAuthState(state string) error {
+	svc.oauthStatesMutex.Lock()
+	defer svc.oauthStatesMutex.Unlock()
+
+	states, err := svc.loadOAuthStates()
+	if err != nil {
+		return err
+	}
+
+	index := slices.IndexFunc(states, func(issued oauthState) bool {
+		return state != "" && issued.State == state
+	})
+	if index < 0 {
+		return ErrOAuthStateMismatch
+	}
+	expired := time.Now().Unix() >= states[index].ExpiresAt
+
+	err = svc.saveOAuthStates(slices.Delete(states, index, index+1))
+	if err != nil {
+		return err
+	}
+	if expired {
+		return ErrOAuthStateExpired
+	}
+	return nil
+}
+
+// GetAuthUrlWithState returns the Alby OAuth authorization URL, which passes state
+// back to the callback so the caller can verify it
+func (svc *albyOAuthService) GetAuthUrlWithState(state string) (string, error) {
+	if svc.cfg.GetEnv().AlbyClientId == "" || svc.cfg.GetEnv().AlbyClientSecret == "" {
+		return "", ErrNoOAuthCredentials
+	}
+	if state == "" {
+		return "", ErrOAuthStateMissing
+	}
+	return svc.oauthConf.AuthCodeURL(state), nil
+}
+
+// ConfigKeys returns the config keys this service reads and writes, including
+// the account keys of every linked account
+func (svc *albyOAuthService) ConfigKeys() []string {
+	accounts, _ := svc.ListLinkedAccounts()
+	if !slices.Contains(accounts, defaultAccountName) {
+		accounts = append(accounts, defaultAccountName)
+	}
 
-		type ErrorResponse struct {
-			Error   bool   `json:"error"`
-			Code    int    `json:"code"`
-			Message string `json:"message"`
+	keys := slices.Clone(globalConfigKeys)
+	for _, account := range accounts {
+		for _, key := range slices.Concat(accountConfigKeys, persistentAccountConfigKeys) {
+			keys = append(keys, accountConfigKey(key, account))
 		}
+	}
+	return keys
+}
+
+// RedirectURL returns the OAuth redirect URI, which must match the one configured on the Alby OAuth client
+func (svc *albyOAuthService) RedirectURL() string {
+	return svc.oauthConf.RedirectURL
+}
+
+func (svc *albyOAuthService) UnlinkAccount(ctx context.Context, confirmed bool) error {
+	ctx = withRequestId(ctx)
+	// opt-in guardrail against accidental unlinks, which remove the remote NWC node
+	if svc.cfg.GetEnv().AlbyUnlinkConfirm && !confirmed {
+		return ErrConfirmationRequired
+	}
+
+	// the local config is still cleared if the cleanup fails, so the account can be linked again
+	var cleanupErrs []error
+	err := svc.destroyAlbyAccountNWCNode(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to destroy Alby Account NWC node")
+		cleanupErrs = append(cleanupErrs, fmt.Errorf("failed to destroy Alby Account NWC node: %w", err))
+	}
+	err = svc.deleteAlbyAccountApps()
+	if err != nil {
+		cleanupErrs = append(cleanupErrs, fmt.Errorf("failed to delete Alby Account apps: %w", err))
+	}
+
+	svc.invalidateMeCache()
+
+	// only the active account is unlinked, other linked accounts keep their tokens
+	activeAccount := svc.ActiveAccount()
+	for _, key := range accountConfigKeys {
+		svc.cfg.SetUpdate(accountConfigKey(key, activeAccount), "", "")
+	}
+	if activeAccount == defaultAccountName {
+		// kept by migrateLegacyAccountKeys, it would otherwise still mark the setup as completed
+		svc.cfg.SetUpdate(userIdentifierKey, "", "")
+	}
+	svc.cfg.SetUpdate(autoLinkStatusKey, "", "")
+
+	remainingAccounts := svc.removeLinkedAccount(activeAccount)
+	if len(remainingAccounts) > 0 {
+		svc.cfg.SetUpdate(activeAccountKey, remainingAccounts[0], "")
+	} else {
+		svc.cfg.SetUpdate(activeAccountKey, "", "")
+	}
+
+	if len(cleanupErrs) > 0 {
+		return fmt.Errorf("%w: %w", ErrUnlinkIncomplete, errors.Join(cleanupErrs...))
+	}
+	return nil
+}
 
-		errorPayload := &ErrorResponse{}
-		err = json.NewDecoder(resp.Body).Decode(errorPayload)
+func (svc *albyOAuthService) LinkAccount(ctx context.Context, lnClient lnclient.LNClient, budget uint64, renewal string) error {
+	ctx = withRequestId(ctx)
+	svc.linkAccountMutex.Lock()
+	defer svc.linkAccountMutex.Unlock()
+	svc.loadNodeNetwork(ctx, lnClient)
+
+	if renewal == BudgetRenewalKeepExisting {
+		// read before the existing apps are deleted below
+		var err error
+		budget, renewal, err = svc.albyAccountAppBudget()
+		if errors.Is(err, ErrAccountNotLinked) {
+			budget, renewal, err = svc.autoLinkBudget()
+		}
 		if err != nil {
-			logger.Logger.WithFields(logrus.Fields{
-				"status": resp.StatusCode,
-			}).WithError(err).Error("Failed to decode payment error response payload")
+			svc.loggerFor(ctx).WithError(err).Error("Failed to fetch existing Alby Account app budget")
 			return err
 		}
+	}
+
+	scopes, err := albyAccountScopes(lnClient)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to get scopes from LNClient request methods")
+		return err
+	}
+
+	// e.g. a repeated request from a double click, relinking would only replace the app with an identical one
+	linked, err := svc.isAccountLinkedWith(budget, renewal, scopes)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to check existing Alby Account app")
+		return err
+	}
+	if linked {
+		svc.loggerFor(ctx).Info("Alby Account is already linked with the same budget and scopes, skipping")
+		return nil
+	}
+
+	// deleteAlbyAccountApps logs the error
+	err = svc.deleteAlbyAccountApps()
+	if err != nil {
+		return err
+	}
+
+	connectionPubkey, err := svc.createAlbyAccountNWCNode(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to create alby account nwc node")
+		return err
+	}
+
+	app, _, err := db.NewDBService(svc.db, svc.eventPublisher).CreateApp(
+		ALBY_ACCOUNT_APP_NAME,
+		connectionPubkey,
+		budget,
+		renewal,
+		nil,
+		scopes,
+		false,
+		svc.albyAccountAppMetadata(),
+	)
 
-		logger.Logger.WithFields(logrus.Fields{
-			"invoice": invoice,
-			"status":  resp.StatusCode,
-			"message": errorPayload.Message,
-		}).Error("Payment failed")
-		return errors.New(errorPayload.Message)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to create app connection")
+		svc.rollbackAlbyAccountNWCNode(ctx)
+		return err
 	}
 
-	responsePayload := &PayResponse{}
-	err = json.NewDecoder(resp.Body).Decode(responsePayload)
+	svc.loggerFor(ctx).WithFields(logrus.Fields{
+		"app": app,
+	}).Info("Created alby app connection")
+
+	err = svc.activateAlbyAccountNWCNode(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to decode response payload")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to activate alby account nwc node")
+		// otherwise retrying would find the account already linked
+		deleteErr := svc.deleteAlbyAccountApps()
+		svc.rollbackAlbyAccountNWCNode(ctx)
+		if deleteErr != nil {
+			return errors.Join(err, fmt.Errorf("failed to delete Alby Account apps: %w", deleteErr))
+		}
 		return err
 	}
-	logger.Logger.WithFields(logrus.Fields{
-		"invoice":     invoice,
-		"paymentHash": responsePayload.PaymentHash,
-		"preimage":    responsePayload.Preimage,
-	}).Info("Alby Payment successful")
+
 	return nil
 }
 
-func (svc *albyOAuthService) GetAuthUrl() string {
-	if svc.cfg.GetEnv().AlbyClientId == "" || svc.cfg.GetEnv().AlbyClientSecret == "" {
-		logger.Logger.Fatalf("No ALBY_OAUTH_CLIENT_ID or ALBY_OAUTH_CLIENT_SECRET set")
+// rollbackAlbyAccountNWCNode destroys the NWC node created by a failed LinkAccount,
+// so no node is left on the Alby side without a matching app
+func (svc *albyOAuthService) rollbackAlbyAccountNWCNode(ctx context.Context) {
+	// the rollback must also happen if the link request was cancelled
+	err := svc.destroyAlbyAccountNWCNode(context.WithoutCancel(ctx))
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to roll back alby account nwc node, it has to be removed at getalby.com")
+		return
 	}
-	return svc.oauthConf.AuthCodeURL("unused")
+	svc.loggerFor(ctx).Info("Rolled back alby account nwc node")
 }
 
-func (svc *albyOAuthService) UnlinkAccount(ctx context.Context) error {
-	err := svc.destroyAlbyAccountNWCNode(ctx)
+// RotateNWCConnection replaces the NWC connection of the Alby Account without unlinking it.
+// The new node and app are activated before the old app is deleted, so the account stays
+// connected, and the budget and renewal of the old app are kept.
+func (svc *albyOAuthService) RotateNWCConnection(ctx context.Context, lnClient lnclient.LNClient) error {
+	ctx = withRequestId(ctx)
+	svc.linkAccountMutex.Lock()
+	defer svc.linkAccountMutex.Unlock()
+	svc.loadNodeNetwork(ctx, lnClient)
+
+	oldAppIds, err := svc.albyAccountAppIds()
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to destroy Alby Account NWC node")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch existing Alby Account apps")
+		return err
+	}
+	if len(oldAppIds) == 0 {
+		return ErrAccountNotLinked
 	}
-	svc.deleteAlbyAccountApps()
-
-	svc.cfg.SetUpdate(userIdentifierKey, "", "")
-	svc.cfg.SetUpdate(accessTokenKey, "", "")
-	svc.cfg.SetUpdate(accessTokenExpiryKey, "", "")
-	svc.cfg.SetUpdate(refreshTokenKey, "", "")
-	svc.cfg.SetUpdate(lightningAddressKey, "", "")
-
-	return nil
-}
-
-func (svc *albyOAuthService) LinkAccount(ctx context.Context, lnClient lnclient.LNClient, budget uint64, renewal string) error {
-	svc.deleteAlbyAccountApps()
 
-	connectionPubkey, err := svc.createAlbyAccountNWCNode(ctx)
+	budget, renewal, err := svc.albyAccountAppBudget()
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to create alby account nwc node")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch existing Alby Account app budget")
 		return err
 	}
 
-	scopes, err := permissions.RequestMethodsToScopes(lnClient.GetSupportedNIP47Methods())
+	scopes, err := albyAccountScopes(lnClient)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to get scopes from LNClient request methods")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to get scopes from LNClient request methods")
 		return err
 	}
-	notificationTypes := lnClient.GetSupportedNIP47NotificationTypes()
-	if len(notificationTypes) > 0 {
-		scopes = append(scopes, constants.NOTIFICATIONS_SCOPE)
+
+	connectionPubkey, err := svc.createAlbyAccountNWCNode(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to create alby account nwc node")
+		return err
 	}
 
+	// the new node is not destroyed if a later step fails, as that could remove the active node
 	app, _, err := db.NewDBService(svc.db, svc.eventPublisher).CreateApp(
 		ALBY_ACCOUNT_APP_NAME,
 		connectionPubkey,
@@ -452,69 +2420,499 @@ func (svc *albyOAuthService) LinkAccount(ctx context.Context, lnClient lnclient.
 		nil,
 		scopes,
 		false,
-		nil,
+		svc.albyAccountAppMetadata(),
 	)
-
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to create app connection")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to create app connection")
 		return err
 	}
 
-	logger.Logger.WithFields(logrus.Fields{
-		"app": app,
-	}).Info("Created alby app connection")
-
 	err = svc.activateAlbyAccountNWCNode(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to activate alby account nwc node")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to activate alby account nwc node, keeping the current connection")
+		if err := svc.db.Delete(&db.App{}, app.ID).Error; err != nil {
+			svc.loggerFor(ctx).WithError(err).Error("Failed to delete new Alby Account app")
+		}
+		return err
+	}
+
+	err = svc.db.Delete(&db.App{}, oldAppIds).Error
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to delete previous Alby Account apps")
 		return err
 	}
 
+	svc.loggerFor(ctx).WithFields(logrus.Fields{
+		"app": app,
+	}).Info("Rotated alby account nwc connection")
 	return nil
 }
 
-func (svc *albyOAuthService) ConsumeEvent(ctx context.Context, event *events.Event, globalProperties map[string]interface{}) {
-	defer func() {
-		// ensure the app cannot panic if firing events to Alby API fails
-		if r := recover(); r != nil {
-			logger.Logger.WithField("event", event).WithField("r", r).Error("Failed to consume event in alby oauth service")
+// albyAccountAppBudget returns the budget and renewal of the pay_invoice permission of the
+// latest Alby Account app. Both are empty if the app cannot pay invoices, ErrAccountNotLinked
+// is returned if there is no app.
+func (svc *albyOAuthService) albyAccountAppBudget() (uint64, string, error) {
+	appIds, err := svc.albyAccountAppIds()
+	if err != nil {
+		return 0, "", err
+	}
+	if len(appIds) == 0 {
+		return 0, "", ErrAccountNotLinked
+	}
+
+	var permissions []db.AppPermission
+	err = svc.db.
+		Where("app_id IN ? AND scope = ?", appIds, constants.PAY_INVOICE_SCOPE).
+		Order("app_id DESC").
+		Limit(1).
+		Find(&permissions).Error
+	if err != nil {
+		return 0, "", err
+	}
+	if len(permissions) == 0 {
+		return 0, "", nil
+	}
+	return uint64(permissions[0].MaxAmountSat), permissions[0].BudgetRenewal, nil
+}
+
+// isAccountLinkedWith returns whether the active account has a single Alby Account app which
+// grants exactly scopes, with budget and renewal on its pay_invoice permission
+func (svc *albyOAuthService) isAccountLinkedWith(budget uint64, renewal string, scopes []string) (bool, error) {
+	appIds, err := svc.albyAccountAppIds()
+	if err != nil {
+		return false, err
+	}
+	if len(appIds) != 1 {
+		return false, nil
+	}
+
+	var permissions []db.AppPermission
+	err = svc.db.Where("app_id = ?", appIds[0]).Find(&permissions).Error
+	if err != nil {
+		return false, err
+	}
+	if len(permissions) != len(scopes) {
+		return false, nil
+	}
+	for _, permission := range permissions {
+		if !slices.Contains(scopes, permission.Scope) {
+			return false, nil
 		}
-	}()
+		if permission.Scope == constants.PAY_INVOICE_SCOPE && (uint64(permission.MaxAmountSat) != budget || permission.BudgetRenewal != renewal) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
 
-	accessToken, err := svc.cfg.Get(accessTokenKey, "")
+// PreviewLinkAccount returns what LinkAccount would grant the Alby Account app,
+// without creating the app or touching existing ones
+func (svc *albyOAuthService) PreviewLinkAccount(ctx context.Context, lnClient lnclient.LNClient) (*LinkAccountPreview, error) {
+	scopes, err := albyAccountScopes(lnClient)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to get scopes from LNClient request methods")
+		return nil, err
+	}
+
+	notificationTypes := lnClient.GetSupportedNIP47NotificationTypes()
+	if notificationTypes == nil {
+		notificationTypes = []string{}
+	}
+
+	return &LinkAccountPreview{
+		Scopes:               scopes,
+		NotificationTypes:    notificationTypes,
+		NotificationsEnabled: slices.Contains(scopes, constants.NOTIFICATIONS_SCOPE),
+	}, nil
+}
+
+// ReconcileAccountScopes compares the scopes granted to the linked Alby Account
+// app with the scopes the LNClient currently supports
+func (svc *albyOAuthService) ReconcileAccountScopes(ctx context.Context, lnClient lnclient.LNClient) (*AlbyAccountScopeDiscrepancies, error) {
+	appIds, err := svc.albyAccountAppIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Alby Account app: %w", err)
+	}
+	if len(appIds) == 0 {
+		return nil, ErrAccountNotLinked
+	}
+	appId := appIds[0]
+
+	var grantedScopes []string
+	err = svc.db.Model(&db.AppPermission{}).Where("app_id = ?", appId).Pluck("scope", &grantedScopes).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch Alby Account app permissions: %w", err)
+	}
+
+	supportedScopes, err := albyAccountScopes(lnClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get scopes from LNClient request methods: %w", err)
+	}
+
+	discrepancies := &AlbyAccountScopeDiscrepancies{
+		Missing:     []string{},
+		Unsupported: []string{},
+	}
+	for _, scope := range supportedScopes {
+		if !slices.Contains(grantedScopes, scope) {
+			discrepancies.Missing = append(discrepancies.Missing, scope)
+		}
+	}
+	for _, scope := range grantedScopes {
+		if !slices.Contains(supportedScopes, scope) {
+			discrepancies.Unsupported = append(discrepancies.Unsupported, scope)
+		}
+	}
+
+	if len(discrepancies.Missing) > 0 || len(discrepancies.Unsupported) > 0 {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"app_id":      appId,
+			"missing":     discrepancies.Missing,
+			"unsupported": discrepancies.Unsupported,
+		}).Warn("Alby Account app scopes do not match the LNClient capabilities")
+	}
+
+	return discrepancies, nil
+}
+
+// albyAccountScopes returns the scopes an Alby Account app should be granted for lnClient
+func albyAccountScopes(lnClient lnclient.LNClient) ([]string, error) {
+	scopes, err := permissions.RequestMethodsToScopes(lnClient.GetSupportedNIP47Methods())
 	if err != nil {
-		logger.Logger.WithError(err).Error("failed to get access token from config")
+		return nil, err
+	}
+	notificationTypes := lnClient.GetSupportedNIP47NotificationTypes()
+	if len(notificationTypes) > 0 {
+		scopes = append(scopes, constants.NOTIFICATIONS_SCOPE)
+	}
+	return scopes, nil
+}
+
+func (svc *albyOAuthService) ConsumeEvent(ctx context.Context, event *events.Event, globalProperties map[string]interface{}) {
+	// filtered first, so skipped events do not take up space in the worker queue
+	if !svc.acceptEvent(ctx, event) {
+		return
+	}
+
+	if svc.cfg.GetEnv().EventsWorkers > 0 {
+		svc.enqueueEvent(ctx, event, globalProperties)
 		return
 	}
 
+	if !svc.addPendingEvent() {
+		svc.loggerFor(ctx).WithField("event", event.Event).Warn("Alby OAuth service is shutting down, skipping event")
+		return
+	}
+	defer svc.donePendingEvents(1)
+	svc.consumeEvent(ctx, event, globalProperties)
+}
+
+// addPendingEvent tracks an event until donePendingEvents is called.
+// It returns false once Shutdown started, then the event must not be consumed.
+func (svc *albyOAuthService) addPendingEvent() bool {
+	svc.pendingEventsMutex.Lock()
+	defer svc.pendingEventsMutex.Unlock()
+	if svc.pendingEventsClosed {
+		return false
+	}
+	svc.pendingEventsCount++
+	return true
+}
+
+func (svc *albyOAuthService) donePendingEvents(count int) {
+	svc.pendingEventsMutex.Lock()
+	defer svc.pendingEventsMutex.Unlock()
+	svc.pendingEventsCount -= count
+	if svc.pendingEventsClosed && svc.pendingEventsCount == 0 {
+		close(svc.pendingEventsDone)
+	}
+}
+
+func (svc *albyOAuthService) pendingEventsLen() int {
+	svc.pendingEventsMutex.Lock()
+	defer svc.pendingEventsMutex.Unlock()
+	return svc.pendingEventsCount
+}
+
+// closePendingEvents stops accepting new events, the returned channel is closed
+// once all pending events are done
+func (svc *albyOAuthService) closePendingEvents() <-chan struct{} {
+	svc.pendingEventsMutex.Lock()
+	defer svc.pendingEventsMutex.Unlock()
+	if !svc.pendingEventsClosed {
+		svc.pendingEventsClosed = true
+		close(svc.shutdownStarted)
+		if svc.pendingEventsCount == 0 {
+			close(svc.pendingEventsDone)
+		}
+	}
+	return svc.pendingEventsDone
+}
+
+// acceptEvent returns false if the event is not sent to the Alby API
+func (svc *albyOAuthService) acceptEvent(ctx context.Context, event *events.Event) bool {
+	accessToken, err := svc.cfg.Get(svc.accountKey(accessTokenKey), "")
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("failed to get access token from config")
+		return false
+	}
+
 	if accessToken == "" {
-		logger.Logger.WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
 			"event": event,
 		}).Debug("user has not authed yet, skipping event")
-		return
+		return false
 	}
 
-	// TODO: we should have a whitelist rather than a blacklist, so new events are not automatically sent
-
 	// TODO: rename this config option to be specific to the alby API
 	if !svc.cfg.GetEnv().LogEvents {
-		logger.Logger.WithField("event", event).Debug("Skipped sending to alby events API")
-		return
+		svc.loggerFor(ctx).WithField("event", event).Debug("Skipped sending to alby events API")
+		return false
+	}
+
+	if !slices.Contains(svc.getAllowedEvents(), event.Event) {
+		svc.loggerFor(ctx).WithField("event", event.Event).Debug("Event not in allow list, skipped sending to alby events API")
+		return false
+	}
+
+	if strings.HasPrefix(event.Event, "nwc_lnclient_") {
+		// don't consume internal LNClient events
+		return false
 	}
 
+	if sampleRate := svc.getEventSampleRate(event.Event); sampleRate < 1 && rand.Float64() >= sampleRate {
+		svc.loggerFor(ctx).WithField("event", event.Event).Debug("Event not sampled, skipped sending to alby events API")
+		return false
+	}
+	return true
+}
+
+// consumeEvent sends an event accepted by acceptEvent to the Alby API, the caller tracks it as pending
+func (svc *albyOAuthService) consumeEvent(ctx context.Context, event *events.Event, globalProperties map[string]interface{}) {
+	defer func() {
+		// ensure the app cannot panic if firing events to Alby API fails
+		if r := recover(); r != nil {
+			svc.loggerFor(ctx).WithField("event", event).WithField("r", r).Error("Failed to consume event in alby oauth service")
+		}
+	}()
+
 	if event.Event == "nwc_backup_channels" {
 		if err := svc.backupChannels(ctx, event); err != nil {
-			logger.Logger.WithError(err).Error("Failed to backup channels")
+			svc.loggerFor(ctx).WithError(err).Error("Failed to backup channels")
 		}
 		return
 	}
 
-	if strings.HasPrefix(event.Event, "nwc_lnclient_") {
-		// don't consume internal LNClient events
+	// copy so the hub instance id does not leak into the properties shared with other consumers
+	eventGlobalProperties := make(map[string]interface{}, len(globalProperties)+1)
+	maps.Copy(eventGlobalProperties, globalProperties)
+	if hubInstanceId := svc.getHubInstanceId(); hubInstanceId != "" {
+		eventGlobalProperties["hub_instance_id"] = hubInstanceId
+	}
+
+	payload, err := svc.buildEventPayload(ctx, event, eventGlobalProperties, svc.cfg.GetEnv().GetEventsRedactFields())
+	if err != nil {
+		svc.loggerFor(ctx).WithField("event", event).WithError(err).Error("Failed to build event payload")
+		return
+	}
+
+	maxEventSize := svc.cfg.GetEnv().LogEventsMaxSize
+	if maxEventSize > 0 && len(payload) > maxEventSize {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"event":    event.Event,
+			"size":     len(payload),
+			"max_size": maxEventSize,
+		}).Warn("Event payload too large, skipped sending to alby events API")
+		return
+	}
+
+	switch svc.cfg.GetEnv().EventsDeliveryMode {
+	case config.EventsDeliveryFireAndForget:
+		// not tracked as pending, so shutdown does not wait for it either
+		go func() {
+			err := svc.sendEvent(ctx, payload)
+			if err != nil {
+				svc.loggerFor(ctx).WithField("event", event.Event).WithError(err).Debug("Failed to send event to alby events API")
+			}
+		}()
+	case config.EventsDeliveryAtLeastOnce:
+		for attempt := 0; ; attempt++ {
+			err = svc.sendEvent(ctx, payload)
+			if err == nil {
+				// the API is reachable again
+				svc.sendQueuedEvents(ctx)
+				return
+			}
+			var statusErr *apiStatusError
+			rejected := errors.As(err, &statusErr) && !statusErr.retryable()
+			if attempt >= len(eventRetryDelays) || rejected {
+				svc.loggerFor(ctx).WithFields(logrus.Fields{
+					"event":    string(payload),
+					"attempts": attempt + 1,
+				}).WithError(err).Error("Failed to deliver event to alby events API")
+				if !rejected {
+					svc.queueEvent(ctx, payload)
+				}
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(eventRetryDelays[attempt]):
+			}
+		}
+	case config.EventsDeliveryBatch:
+		svc.batchEvent(ctx, payload)
+	default:
+		err = svc.sendEvent(ctx, payload)
+		if err == nil {
+			svc.sendQueuedEvents(ctx)
+			return
+		}
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"event": string(payload),
+		}).WithError(err).Error("Failed to send event to alby events API")
+		// not retried right away, but kept so the event survives a short outage
+		var statusErr *apiStatusError
+		if !errors.As(err, &statusErr) || statusErr.retryable() {
+			svc.queueEvent(ctx, payload)
+		}
+	}
+}
+
+// delays between attempts when delivering events at least once
+var eventRetryDelays = []time.Duration{1 * time.Second, 5 * time.Second, 30 * time.Second}
+
+// interval in which queued events are sent, even if no further event is delivered
+var queuedEventsFlushInterval = 1 * time.Minute
+
+func (svc *albyOAuthService) sendEvent(ctx context.Context, payload []byte) error {
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch user token: %w", err)
+	}
+
+	return client.post(ctx, "/events", json.RawMessage(payload), nil)
+}
+
+// queueEvent keeps an event which could not be delivered, so it is sent after the next
+// delivered event or by the periodic flush. The oldest event is dropped if the queue is full.
+func (svc *albyOAuthService) queueEvent(ctx context.Context, payload []byte) {
+	maxQueuedEvents := svc.cfg.GetEnv().EventsQueueSize
+	if maxQueuedEvents <= 0 {
 		return
 	}
 
-	if event.Event == "nwc_payment_received" {
+	svc.queuedEventsFlush.Do(func() {
+		go svc.flushQueuedEvents(queuedEventsFlushInterval)
+	})
+
+	svc.queuedEventsMutex.Lock()
+	defer svc.queuedEventsMutex.Unlock()
+	if len(svc.queuedEvents) >= maxQueuedEvents {
+		svc.loggerFor(ctx).WithField("event", string(svc.queuedEvents[0])).Warn("Event queue is full, dropped the oldest event")
+		svc.queuedEvents = svc.queuedEvents[1:]
+	}
+	svc.queuedEvents = append(svc.queuedEvents, payload)
+}
+
+// sendQueuedEvents sends the queued events in order until one fails, which stays queued
+func (svc *albyOAuthService) sendQueuedEvents(ctx context.Context) {
+	for {
+		svc.queuedEventsMutex.Lock()
+		if len(svc.queuedEvents) == 0 {
+			svc.queuedEventsMutex.Unlock()
+			return
+		}
+		payload := svc.queuedEvents[0]
+		svc.queuedEvents = svc.queuedEvents[1:]
+		svc.queuedEventsMutex.Unlock()
+
+		err := svc.sendEvent(ctx, payload)
+		var statusErr *apiStatusError
+		if errors.As(err, &statusErr) && !statusErr.retryable() {
+			svc.loggerFor(ctx).WithField("event", string(payload)).WithError(err).Error("Failed to deliver queued event to alby events API")
+			continue
+		}
+		if err != nil {
+			svc.queuedEventsMutex.Lock()
+			svc.queuedEvents = append([][]byte{payload}, svc.queuedEvents...)
+			svc.queuedEventsMutex.Unlock()
+			return
+		}
+	}
+}
+
+// flushQueuedEvents periodically sends the queued events until Shutdown started
+func (svc *albyOAuthService) flushQueuedEvents(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-svc.shutdownStarted:
+			return
+		case <-ticker.C:
+			if svc.queuedEventsCount() == 0 {
+				continue
+			}
+			// tracked as pending, so Shutdown waits for the events being sent
+			if !svc.addPendingEvent() {
+				return
+			}
+			svc.sendQueuedEvents(context.Background())
+			svc.donePendingEvents(1)
+		}
+	}
+}
+
+func (svc *albyOAuthService) queuedEventsCount() int {
+	svc.queuedEventsMutex.Lock()
+	defer svc.queuedEventsMutex.Unlock()
+	return len(svc.queuedEvents)
+}
+
+// Shutdown waits for pending events to be sent to the Alby API until the context is done,
+// and returns the number of events which could not be delivered, including queued events
+func (svc *albyOAuthService) Shutdown(ctx context.Context) int {
+	done := svc.closePendingEvents()
+	// batched events would otherwise wait for the flush interval
+	svc.flushEventBatch(ctx)
+
+	select {
+	case <-done:
+		if queued := svc.queuedEventsCount(); queued > 0 {
+			svc.loggerFor(ctx).WithField("undelivered", queued).Warn("Queued Alby events were not delivered")
+			return queued
+		}
+		svc.loggerFor(ctx).Info("Delivered all pending Alby events")
+		return 0
+	case <-ctx.Done():
+		undelivered := svc.pendingEventsLen() + svc.queuedEventsCount()
+		svc.loggerFor(ctx).WithField("undelivered", undelivered).Warn("Timed out delivering pending Alby events")
+		return undelivered
+	}
+}
+
+// getHubInstanceId identifies this hub in events sent to the Alby API,
+// so events from multiple hubs linked to the same account can be told apart
+func (svc *albyOAuthService) getHubInstanceId() string {
+	if hubInstanceId := svc.cfg.GetEnv().HubInstanceId; hubInstanceId != "" {
+		return hubInstanceId
+	}
+	return svc.keys.GetNostrPublicKey()
+}
+
+// buildEventPayload reduces the detail of payment events, merges the global properties
+// into the event properties and removes the redacted ones, returning the request body
+// for the Alby events API
+func (svc *albyOAuthService) buildEventPayload(ctx context.Context, event *events.Event, globalProperties map[string]interface{}, redactedFields []string) ([]byte, error) {
+	switch event.Event {
+	case "nwc_payment_received":
+		transaction, ok := event.Properties.(*db.Transaction)
+		if !ok {
+			return nil, fmt.Errorf("failed to cast %s event properties", event.Event)
+		}
+
 		type paymentReceivedEventProperties struct {
 			PaymentHash string `json:"payment_hash"`
 		}
@@ -522,12 +2920,15 @@ func (svc *albyOAuthService) ConsumeEvent(ctx context.Context, event *events.Eve
 		event = &events.Event{
 			Event: event.Event,
 			Properties: &paymentReceivedEventProperties{
-				PaymentHash: event.Properties.(*db.Transaction).PaymentHash,
+				PaymentHash: transaction.PaymentHash,
 			},
 		}
-	}
+	case "nwc_payment_sent":
+		transaction, ok := event.Properties.(*db.Transaction)
+		if !ok {
+			return nil, fmt.Errorf("failed to cast %s event properties", event.Event)
+		}
 
-	if event.Event == "nwc_payment_sent" {
 		type paymentSentEventProperties struct {
 			PaymentHash string `json:"payment_hash"`
 			Duration    uint64 `json:"duration"`
@@ -537,17 +2938,14 @@ func (svc *albyOAuthService) ConsumeEvent(ctx context.Context, event *events.Eve
 		event = &events.Event{
 			Event: event.Event,
 			Properties: &paymentSentEventProperties{
-				PaymentHash: event.Properties.(*db.Transaction).PaymentHash,
-				Duration:    uint64(event.Properties.(*db.Transaction).SettledAt.Unix() - event.Properties.(*db.Transaction).CreatedAt.Unix()),
+				PaymentHash: transaction.PaymentHash,
+				Duration:    uint64(transaction.SettledAt.Unix() - transaction.CreatedAt.Unix()),
 			},
 		}
-	}
-
-	if event.Event == "nwc_payment_failed" {
+	case "nwc_payment_failed":
 		transaction, ok := event.Properties.(*db.Transaction)
 		if !ok {
-			logger.Logger.WithField("event", event).Error("Failed to cast event")
-			return
+			return nil, fmt.Errorf("failed to cast %s event properties", event.Event)
 		}
 
 		type paymentFailedEventProperties struct {
@@ -565,190 +2963,390 @@ func (svc *albyOAuthService) ConsumeEvent(ctx context.Context, event *events.Eve
 		}
 	}
 
-	token, err := svc.fetchUserToken(ctx)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
-		return
+	properties, err := svc.mergeGlobalProperties(ctx, event, globalProperties)
+	if err != nil {
+		return nil, err
+	}
+
+	// applied last, so global properties and the reduced payment properties can be redacted too
+	for _, field := range redactedFields {
+		delete(properties, field)
+	}
+
+	type eventWithPropertiesMap struct {
+		Event      string                 `json:"event"`
+		Properties map[string]interface{} `json:"properties"`
+	}
+
+	return json.Marshal(&eventWithPropertiesMap{
+		Event:      event.Event,
+		Properties: properties,
+	})
+}
+
+// mergeGlobalProperties returns the JSON properties of event with the global properties
+// added. If a global property has the same key as an event property, the event property is kept.
+func (svc *albyOAuthService) mergeGlobalProperties(ctx context.Context, event *events.Event, global map[string]interface{}) (map[string]interface{}, error) {
+	properties := map[string]interface{}{}
+	if event.Properties != nil {
+		// the properties are a struct, so they are converted to a map through their JSON encoding
+		propertiesBytes, err := json.Marshal(event.Properties)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode event properties: %w", err)
+		}
+		err = json.Unmarshal(propertiesBytes, &properties)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode event properties: %w", err)
+		}
+		// e.g. a nil pointer
+		if properties == nil {
+			properties = map[string]interface{}{}
+		}
+	}
+
+	for key, value := range global {
+		if _, exists := properties[key]; exists {
+			svc.loggerFor(ctx).WithField("key", key).Error("Key already exists in event properties, skipping global property")
+			continue
+		}
+		properties[key] = value
 	}
+	return properties, nil
+}
 
-	client := svc.oauthConf.Client(ctx, token)
+func (svc *albyOAuthService) backupChannels(ctx context.Context, event *events.Event) error {
+	bkpEvent, ok := event.Properties.(*events.ChannelBackupEvent)
+	if !ok {
+		return fmt.Errorf("invalid nwc_backup_channels event properties, could not cast to the expected type: %+v", event.Properties)
+	}
 
-	// encode event without global properties
-	originalEventBuffer := bytes.NewBuffer([]byte{})
-	err = json.NewEncoder(originalEventBuffer).Encode(event)
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch user token: %w", err)
+	}
 
+	channelsData := bytes.NewBuffer([]byte{})
+	err = json.NewEncoder(channelsData).Encode(bkpEvent.Channels)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to encode request payload")
-		return
+		return fmt.Errorf("failed to encode channels backup data:  %w", err)
 	}
 
-	type eventWithPropertiesMap struct {
-		Event      string                 `json:"event"`
-		Properties map[string]interface{} `json:"properties"`
+	encrypted, err := svc.encryptChannelsBackup(channelsData.String())
+	if err != nil {
+		return fmt.Errorf("failed to encrypt channels backup data: %w", err)
 	}
 
-	var eventWithGlobalProperties eventWithPropertiesMap
-	err = json.Unmarshal(originalEventBuffer.Bytes(), &eventWithGlobalProperties)
+	version, err := svc.nextChannelsBackupVersion(ctx, client)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to decode request payload")
-		return
+		return fmt.Errorf("failed to increment channels backup version: %w", err)
 	}
-	if eventWithGlobalProperties.Properties == nil {
-		eventWithGlobalProperties.Properties = map[string]interface{}{}
+
+	body := bytes.NewBuffer([]byte{})
+	err = json.NewEncoder(body).Encode(&channelsBackup{
+		Description: channelsBackupSlot(version, svc.cfg.GetEnv().AlbyBackupKeep),
+		Data:        encrypted,
+		Checksum:    channelsBackupChecksum(channelsData.String()),
+		Version:     version,
+		CreatedAt:   time.Now().Unix(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode channels backup request payload: %w", err)
 	}
 
-	// add global properties to each published event
-	for k, v := range globalProperties {
-		_, exists := eventWithGlobalProperties.Properties[k]
-		if exists {
-			logger.Logger.WithField("key", k).Error("Key already exists in event properties, skipping global property")
-			continue
+	// a local copy allows recovery even if Alby is unreachable, but must not prevent the upload
+	if localBackupDir := svc.cfg.GetEnv().LocalBackupDir; localBackupDir != "" {
+		err = writeLocalChannelsBackup(localBackupDir, svc.cfg.GetEnv().LocalBackupKeep, body.Bytes())
+		if err != nil {
+			svc.loggerFor(ctx).WithError(err).WithField("dir", localBackupDir).Error("Failed to write local channels backup")
 		}
-		eventWithGlobalProperties.Properties[k] = v
 	}
 
-	body := bytes.NewBuffer([]byte{})
-	err = json.NewEncoder(body).Encode(&eventWithGlobalProperties)
+	return client.post(ctx, "/internal/backups", json.RawMessage(body.Bytes()), nil)
+}
 
+func (svc *albyOAuthService) GetBackup(ctx context.Context, id string) (*ChannelBackup, error) {
+	client, err := svc.newAlbyAPIClient(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to encode request payload")
-		return
+		return nil, fmt.Errorf("failed to fetch user token: %w", err)
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/events", svc.cfg.GetEnv().AlbyAPIURL), body)
+	backup, err := svc.fetchChannelsBackup(ctx, client, id)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Error creating request /events")
-		return
+		return nil, err
 	}
 
-	setDefaultRequestHeaders(req)
-
-	resp, err := client.Do(req)
+	decrypted, err := svc.decryptChannelsBackup(backup.Data)
 	if err != nil {
-		logger.Logger.WithFields(logrus.Fields{
-			"event": eventWithGlobalProperties,
-		}).WithError(err).Error("Failed to send request to /events")
-		return
+		svc.loggerFor(ctx).WithError(err).WithField("id", id).Error("Failed to decrypt channels backup")
+		return nil, ErrBackupDecryptionFailed
 	}
 
-	if resp.StatusCode >= 300 {
-		logger.Logger.WithFields(logrus.Fields{
-			"event":  eventWithGlobalProperties,
-			"status": resp.StatusCode,
-		}).Error("Request to /events returned non-success status")
-		return
+	// backups uploaded before checksums were added cannot be verified
+	if backup.Checksum != "" && backup.Checksum != channelsBackupChecksum(decrypted) {
+		svc.loggerFor(ctx).WithField("id", id).Error("Channels backup checksum mismatch")
+		return nil, ErrBackupCorrupt
 	}
-}
 
-func (svc *albyOAuthService) backupChannels(ctx context.Context, event *events.Event) error {
-	bkpEvent, ok := event.Properties.(*events.ChannelBackupEvent)
-	if !ok {
-		return fmt.Errorf("invalid nwc_backup_channels event properties, could not cast to the expected type: %+v", event.Properties)
+	var channels []events.ChannelBackupInfo
+	err = json.Unmarshal([]byte(decrypted), &channels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode decrypted channels backup data: %w", err)
 	}
 
-	token, err := svc.fetchUserToken(ctx)
+	err = validateChannelsBackup(channels)
 	if err != nil {
-		return fmt.Errorf("failed to fetch user token: %w", err)
+		svc.loggerFor(ctx).WithError(err).WithField("id", id).Error("Invalid channels backup")
+		return nil, err
 	}
 
-	client := svc.oauthConf.Client(ctx, token)
+	return &ChannelBackup{
+		Description: backup.Description,
+		Version:     backup.Version,
+		Channels:    channels,
+	}, nil
+}
 
-	type channelsBackup struct {
-		Description string `json:"description"`
-		Data        string `json:"data"`
-	}
+func (svc *albyOAuthService) fetchChannelsBackup(ctx context.Context, client *albyAPIClient, id string) (*channelsBackup, error) {
+	backup := &channelsBackup{}
+	err := client.get(ctx, "/internal/backups/"+url.PathEscape(id), backup)
 
-	channelsData := bytes.NewBuffer([]byte{})
-	err = json.NewEncoder(channelsData).Encode(bkpEvent.Channels)
+	var statusErr *apiStatusError
+	if errors.As(err, &statusErr) && statusErr.statusCode == http.StatusNotFound {
+		return nil, ErrBackupNotFound
+	}
 	if err != nil {
-		return fmt.Errorf("failed to encode channels backup data:  %w", err)
+		return nil, err
 	}
+	return backup, nil
+}
 
-	// use the encrypted mnemonic as the password to encrypt the backup data
-	encryptedMnemonic, err := svc.cfg.Get("Mnemonic", "")
+// ListBackups returns the channels backups kept by the Alby API, newest first.
+// A backup from before versioning is listed last, with version 0.
+func (svc *albyOAuthService) ListBackups(ctx context.Context) ([]ChannelBackupVersion, error) {
+	client, err := svc.newAlbyAPIClient(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to fetch encryption key: %w", err)
+		return nil, fmt.Errorf("failed to fetch user token: %w", err)
 	}
+	return svc.listChannelsBackups(ctx, client)
+}
 
-	encrypted, err := config.AesGcmEncrypt(channelsData.String(), encryptedMnemonic)
-	if err != nil {
-		return fmt.Errorf("failed to encrypt channels backup data: %w", err)
+func (svc *albyOAuthService) listChannelsBackups(ctx context.Context, client *albyAPIClient) ([]ChannelBackupVersion, error) {
+	ids := []string{channelsBackupDescription}
+	for slot := 0; slot < channelsBackupKeep(svc.cfg.GetEnv().AlbyBackupKeep); slot++ {
+		ids = append(ids, fmt.Sprintf("%s-%d", channelsBackupDescription, slot))
 	}
 
-	body := bytes.NewBuffer([]byte{})
-	err = json.NewEncoder(body).Encode(&channelsBackup{
-		Description: "channels",
-		Data:        encrypted,
+	backups := []ChannelBackupVersion{}
+	for _, id := range ids {
+		backup, err := svc.fetchChannelsBackup(ctx, client, id)
+		if errors.Is(err, ErrBackupNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, ChannelBackupVersion{
+			Id:        id,
+			Version:   backup.Version,
+			CreatedAt: time.Unix(backup.CreatedAt, 0),
+		})
+	}
+
+	// versions can repeat if backups were uploaded by an older hub, then the newer one wins
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].Version != backups[j].Version {
+			return backups[i].Version > backups[j].Version
+		}
+		return backups[i].CreatedAt.After(backups[j].CreatedAt)
 	})
+	return backups, nil
+}
+
+// nextChannelsBackupVersion increments and persists the channels backup version. The first
+// backup since the hub started continues from the highest version on the server, as the
+// stored version is behind if the hub is new or was restored.
+func (svc *albyOAuthService) nextChannelsBackupVersion(ctx context.Context, client *albyAPIClient) (uint64, error) {
+	svc.backupVersionMutex.Lock()
+	defer svc.backupVersionMutex.Unlock()
+
+	value, err := svc.cfg.Get(svc.accountKey(backupVersionKey), "")
 	if err != nil {
-		return fmt.Errorf("failed to encode channels backup request payload: %w", err)
+		return 0, err
+	}
+	var version uint64
+	if value != "" {
+		version, err = strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/internal/backups", svc.cfg.GetEnv().AlbyAPIURL), body)
-	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+	account := svc.ActiveAccount()
+	if !svc.backupVersionSeeded[account] {
+		backups, err := svc.listChannelsBackups(ctx, client)
+		if err != nil {
+			svc.loggerFor(ctx).WithError(err).Warn("Failed to fetch channels backup versions, continuing from the stored version")
+		} else {
+			for _, backup := range backups {
+				version = max(version, backup.Version)
+			}
+			svc.backupVersionSeeded[account] = true
+		}
 	}
 
-	setDefaultRequestHeaders(req)
+	version++
+	svc.cfg.SetUpdate(svc.accountKey(backupVersionKey), strconv.FormatUint(version, 10), "")
+	return version, nil
+}
 
-	resp, err := client.Do(req)
+func channelsBackupKeep(keep int) int {
+	// the latest backup is always kept
+	return max(keep, 1)
+}
+
+// channelsBackupSlot returns the description the backup is stored under. Versions
+// cycle through keep descriptions, so each backup replaces the oldest one.
+func channelsBackupSlot(version uint64, keep int) string {
+	return fmt.Sprintf("%s-%d", channelsBackupDescription, version%uint64(channelsBackupKeep(keep)))
+}
+
+const channelsBackupV2Prefix = "v2:"
+
+func (svc *albyOAuthService) encryptChannelsBackup(data string) (string, error) {
+	backupEncryptionKey := svc.keys.GetBackupEncryptionKey()
+	if backupEncryptionKey == nil {
+		return "", errors.New("no backup encryption key, the hub has no mnemonic")
+	}
+
+	encrypted, err := config.AesGcmEncrypt(data, hex.EncodeToString(backupEncryptionKey))
 	if err != nil {
-		return fmt.Errorf("failed to send request to /internal/backups: %w", err)
+		return "", err
+	}
+	return channelsBackupV2Prefix + encrypted, nil
+}
+
+func (svc *albyOAuthService) decryptChannelsBackup(data string) (string, error) {
+	password := ""
+	if encrypted, found := strings.CutPrefix(data, channelsBackupV2Prefix); found {
+		backupEncryptionKey := svc.keys.GetBackupEncryptionKey()
+		if backupEncryptionKey == nil {
+			return "", errors.New("no backup encryption key, the hub has no mnemonic")
+		}
+		data = encrypted
+		password = hex.EncodeToString(backupEncryptionKey)
+	} else {
+		// backups from before v2 used the encrypted mnemonic as the password
+		encryptedMnemonic, err := svc.cfg.Get("Mnemonic", "")
+		if err != nil {
+			return "", fmt.Errorf("failed to fetch encryption key: %w", err)
+		}
+		password = encryptedMnemonic
 	}
 
-	if resp.StatusCode >= 300 {
-		return fmt.Errorf("request to /internal/backups returned non-success status: %d", resp.StatusCode)
+	// AesGcmDecrypt expects salt-nonce-ciphertext
+	if strings.Count(data, "-") != 2 {
+		return "", errors.New("invalid channels backup format")
 	}
 
-	return nil
+	return config.AesGcmDecrypt(data, password)
 }
 
-func (svc *albyOAuthService) createAlbyAccountNWCNode(ctx context.Context) (string, error) {
-	token, err := svc.fetchUserToken(ctx)
+// RestoreChannels fetches and decrypts the latest channels backup. If it cannot be
+// decrypted or is invalid, older backups are tried in turn.
+func (svc *albyOAuthService) RestoreChannels(ctx context.Context) (*events.ChannelBackupEvent, error) {
+	backups, err := svc.ListBackups(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, ErrBackupNotFound
 	}
 
-	client := svc.oauthConf.Client(ctx, token)
+	var firstErr error
+	for _, backupVersion := range backups {
+		backup, err := svc.GetBackup(ctx, backupVersion.Id)
+		if err != nil {
+			svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
+				"id":      backupVersion.Id,
+				"version": backupVersion.Version,
+			}).Warn("Failed to restore channels backup, trying an older one")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
 
-	type createNWCNodeRequest struct {
-		WalletPubkey string `json:"wallet_pubkey"`
+		return &events.ChannelBackupEvent{
+			Channels: backup.Channels,
+		}, nil
 	}
+	return nil, firstErr
+}
 
-	createNodeRequest := createNWCNodeRequest{
-		WalletPubkey: svc.keys.GetNostrPublicKey(),
+// validateChannelsBackup checks every channel has the fields needed to recover it
+func validateChannelsBackup(channels []events.ChannelBackupInfo) error {
+	if channels == nil {
+		return fmt.Errorf("%w: no channel list", ErrBackupCorrupt)
+	}
+	for i, channel := range channels {
+		if channel.ChannelID == "" || channel.PeerID == "" || channel.FundingTxID == "" {
+			return fmt.Errorf("%w: channel %d is missing its channel id, peer id or funding transaction", ErrBackupCorrupt, i)
+		}
 	}
+	return nil
+}
 
-	body := bytes.NewBuffer([]byte{})
-	err = json.NewEncoder(body).Encode(&createNodeRequest)
+// writeLocalChannelsBackup writes the encrypted backup to dir and removes
+// all but the newest keep copies. A keep of 0 keeps every copy.
+func writeLocalChannelsBackup(dir string, keep int, backup []byte) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create local backup directory: %w", err)
+	}
 
+	filename := fmt.Sprintf("%s%d.json", localChannelsBackupPrefix, time.Now().UnixNano())
+	err = os.WriteFile(filepath.Join(dir, filename), backup, 0600)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to encode request payload")
-		return "", err
+		return fmt.Errorf("failed to write local backup file: %w", err)
+	}
+
+	if keep <= 0 {
+		return nil
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/internal/nwcs", svc.cfg.GetEnv().AlbyAPIURL), body)
+	backupFiles, err := filepath.Glob(filepath.Join(dir, localChannelsBackupPrefix+"*.json"))
 	if err != nil {
-		logger.Logger.WithError(err).Error("Error creating request /internal/nwcs")
-		return "", err
+		return fmt.Errorf("failed to list local backup files: %w", err)
 	}
+	// filenames end with a fixed width timestamp, so lexical order is chronological
+	sort.Strings(backupFiles)
+	for len(backupFiles) > keep {
+		err = os.Remove(backupFiles[0])
+		if err != nil {
+			return fmt.Errorf("failed to remove old local backup file: %w", err)
+		}
+		backupFiles = backupFiles[1:]
+	}
+	return nil
+}
 
-	setDefaultRequestHeaders(req)
+func channelsBackupChecksum(data string) string {
+	checksum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(checksum[:])
+}
 
-	resp, err := client.Do(req)
+func (svc *albyOAuthService) createAlbyAccountNWCNode(ctx context.Context) (string, error) {
+	client, err := svc.newAlbyAPIClient(ctx)
 	if err != nil {
-		logger.Logger.WithFields(logrus.Fields{
-			"createNodeRequest": createNodeRequest,
-		}).WithError(err).Error("Failed to send request to /internal/nwcs")
 		return "", err
 	}
 
-	if resp.StatusCode >= 300 {
-		logger.Logger.WithFields(logrus.Fields{
-			"createNodeRequest": createNodeRequest,
-			"status":            resp.StatusCode,
-		}).Error("Request to /internal/nwcs returned non-success status")
-		return "", errors.New("request to /internal/nwcs returned non-success status")
+	type createNWCNodeRequest struct {
+		WalletPubkey string `json:"wallet_pubkey"`
+	}
+
+	createNodeRequest := createNWCNodeRequest{
+		WalletPubkey: svc.keys.GetNostrPublicKey(),
 	}
 
 	type CreateNWCNodeResponse struct {
@@ -756,13 +3354,15 @@ func (svc *albyOAuthService) createAlbyAccountNWCNode(ctx context.Context) (stri
 	}
 
 	responsePayload := &CreateNWCNodeResponse{}
-	err = json.NewDecoder(resp.Body).Decode(responsePayload)
+	err = client.post(ctx, "/internal/nwcs", &createNodeRequest, responsePayload)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to decode response payload")
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"createNodeRequest": createNodeRequest,
+		}).WithError(err).Error("Failed to send request to /internal/nwcs")
 		return "", err
 	}
 
-	logger.Logger.WithFields(logrus.Fields{
+	svc.loggerFor(ctx).WithFields(logrus.Fields{
 		"pubkey": responsePayload.Pubkey,
 	}).Info("Created alby nwc node successfully")
 
@@ -770,179 +3370,374 @@ func (svc *albyOAuthService) createAlbyAccountNWCNode(ctx context.Context) (stri
 }
 
 func (svc *albyOAuthService) destroyAlbyAccountNWCNode(ctx context.Context) error {
-	token, err := svc.fetchUserToken(ctx)
+	client, err := svc.newAlbyAPIClient(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
+		return err
 	}
 
-	client := svc.oauthConf.Client(ctx, token)
-
-	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/internal/nwcs", svc.cfg.GetEnv().AlbyAPIURL), nil)
+	err = client.delete(ctx, "/internal/nwcs", nil)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Error creating request /internal/nwcs")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to send request to /internal/nwcs")
 		return err
 	}
 
-	setDefaultRequestHeaders(req)
+	svc.loggerFor(ctx).Info("Removed alby account nwc node successfully")
+
+	return nil
+}
 
-	resp, err := client.Do(req)
+func (svc *albyOAuthService) activateAlbyAccountNWCNode(ctx context.Context) error {
+	client, err := svc.newAlbyAPIClient(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to send request to /internal/nwcs")
 		return err
 	}
 
-	if resp.StatusCode >= 300 {
-		logger.Logger.WithFields(logrus.Fields{
-			"status": resp.StatusCode,
-		}).Error("Request to /internal/nwcs returned non-success status")
-		return errors.New("request to /internal/nwcs returned non-success status")
+	err = client.put(ctx, "/internal/nwcs/activate", nil, nil)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to send request to /internal/nwcs/activate")
+		return err
 	}
 
-	logger.Logger.Info("Removed alby account nwc node successfully")
+	svc.loggerFor(ctx).Info("Activated alby nwc node successfully")
 
 	return nil
 }
 
-func (svc *albyOAuthService) activateAlbyAccountNWCNode(ctx context.Context) error {
-	token, err := svc.fetchUserToken(ctx)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
-	}
+// the suggestions endpoint occasionally returns an empty list due to transient backend issues
+var channelPeerSuggestionsRetryDelay = 1 * time.Second
 
-	client := svc.oauthConf.Client(ctx, token)
+func (svc *albyOAuthService) GetChannelPeerSuggestions(ctx context.Context) ([]ChannelPeerSuggestion, error) {
+	return svc.GetChannelPeerSuggestionsFiltered(ctx, SuggestionFilter{})
+}
 
-	req, err := http.NewRequest("PUT", fmt.Sprintf("%s/internal/nwcs/activate", svc.cfg.GetEnv().AlbyAPIURL), nil)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Error creating request /internal/nwcs/activate")
-		return err
+// GetChannelPeerSuggestionsFiltered fetches the channel peer suggestions and applies filter to them.
+// The Alby API order is kept unless filter.SortBy is set.
+func (svc *albyOAuthService) GetChannelPeerSuggestionsFiltered(ctx context.Context, filter SuggestionFilter) ([]ChannelPeerSuggestion, error) {
+	if !slices.Contains(suggestionSortOrders, filter.SortBy) {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSuggestionSort, filter.SortBy)
 	}
 
-	setDefaultRequestHeaders(req)
+	client, err := svc.newAlbyAPIClient(ctx)
+	if err != nil {
+		return nil, err
+	}
 
-	resp, err := client.Do(req)
+	suggestions, err := svc.fetchChannelPeerSuggestions(ctx, client)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to send request to /internal/nwcs/activate")
-		return err
+		return nil, err
 	}
 
-	if resp.StatusCode >= 300 {
-		logger.Logger.WithFields(logrus.Fields{
-			"status": resp.StatusCode,
-		}).Error("Request to /internal/nwcs/activate returned non-success status")
-		return errors.New("request to /internal/nwcs/activate returned non-success status")
+	maxRetries := svc.cfg.GetEnv().PeerSuggestionRetries
+	for retry := 1; len(suggestions) == 0 && retry <= maxRetries; retry++ {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(channelPeerSuggestionsRetryDelay):
+		}
+
+		suggestions, err = svc.fetchChannelPeerSuggestions(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+		if len(suggestions) > 0 {
+			svc.loggerFor(ctx).WithField("retry", retry).Info("Retry recovered non-empty channel peer suggestions")
+		}
 	}
 
-	logger.Logger.Info("Activated alby nwc node successfully")
+	svc.loggerFor(ctx).WithFields(logrus.Fields{"channel_suggestions": suggestions}).Debug("Alby channel peer suggestions response")
+	return filterChannelPeerSuggestions(suggestions, filter), nil
+}
+
+var suggestionSortOrders = []string{"", SuggestionSortName, SuggestionSortMinChannelSize, SuggestionSortMaxChannelSize}
 
-	return nil
+func filterChannelPeerSuggestions(suggestions []ChannelPeerSuggestion, filter SuggestionFilter) []ChannelPeerSuggestion {
+	filtered := make([]ChannelPeerSuggestion, 0, len(suggestions))
+	for _, suggestion := range suggestions {
+		if filter.Network != "" && !strings.EqualFold(suggestion.Network, filter.Network) {
+			continue
+		}
+		// a maximum channel size of 0 means the peer has no maximum
+		if filter.MinChannelSize > 0 && suggestion.MaximumChannelSize > 0 && suggestion.MaximumChannelSize < filter.MinChannelSize {
+			continue
+		}
+		filtered = append(filtered, suggestion)
+	}
+
+	switch filter.SortBy {
+	case SuggestionSortName:
+		slices.SortStableFunc(filtered, func(a, b ChannelPeerSuggestion) int {
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		})
+	case SuggestionSortMinChannelSize:
+		slices.SortStableFunc(filtered, func(a, b ChannelPeerSuggestion) int {
+			return cmp.Compare(a.MinimumChannelSize, b.MinimumChannelSize)
+		})
+	case SuggestionSortMaxChannelSize:
+		slices.SortStableFunc(filtered, func(a, b ChannelPeerSuggestion) int {
+			// no maximum sorts first
+			switch {
+			case a.MaximumChannelSize == b.MaximumChannelSize:
+				return 0
+			case a.MaximumChannelSize == 0:
+				return -1
+			case b.MaximumChannelSize == 0:
+				return 1
+			}
+			return cmp.Compare(b.MaximumChannelSize, a.MaximumChannelSize)
+		})
+	}
+	return filtered
 }
 
-func (svc *albyOAuthService) GetChannelPeerSuggestions(ctx context.Context) ([]ChannelPeerSuggestion, error) {
+const (
+	defaultPeerSuggestionPages = 10
+	// limits the suggestions kept in memory, whatever the number of pages
+	maxChannelPeerSuggestions = 1000
+)
 
-	token, err := svc.fetchUserToken(ctx)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
-		return nil, err
+// channelPeerSuggestionsPage is the paginated channel_suggestions response.
+// The endpoint returned a plain array before it was paginated.
+type channelPeerSuggestionsPage struct {
+	Suggestions []ChannelPeerSuggestion `json:"suggestions"`
+	NextCursor  string                  `json:"next_cursor"`
+}
+
+// fetchChannelPeerSuggestions follows the pages of the channel_suggestions endpoint
+// until there is no next cursor, PEER_SUGGESTION_MAX_PAGES pages are fetched or
+// maxChannelPeerSuggestions suggestions are collected
+func (svc *albyOAuthService) fetchChannelPeerSuggestions(ctx context.Context, client *albyAPIClient) ([]ChannelPeerSuggestion, error) {
+	maxPages := svc.cfg.GetEnv().PeerSuggestionPages
+	if maxPages <= 0 {
+		maxPages = defaultPeerSuggestionPages
 	}
 
-	client := svc.oauthConf.Client(ctx, token)
+	var suggestions []ChannelPeerSuggestion
+	cursor := ""
+	for page := 1; ; page++ {
+		path := "/internal/channel_suggestions"
+		if cursor != "" {
+			path += "?" + url.Values{"cursor": {cursor}}.Encode()
+		}
 
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/internal/channel_suggestions", svc.cfg.GetEnv().AlbyAPIURL), nil)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Error creating request to channel_suggestions endpoint")
-		return nil, err
+		var response json.RawMessage
+		err := client.get(ctx, path, &response)
+		if err != nil {
+			svc.loggerFor(ctx).WithError(err).WithField("page", page).Error("Failed to fetch channel_suggestions endpoint")
+			return nil, err
+		}
+
+		pageSuggestions, nextCursor, err := decodeChannelPeerSuggestionsPage(response)
+		if err != nil {
+			return nil, fmt.Errorf("%w from %s: %w", ErrInvalidAPIResponse, path, err)
+		}
+		suggestions = append(suggestions, pageSuggestions...)
+
+		if len(suggestions) >= maxChannelPeerSuggestions {
+			if len(suggestions) > maxChannelPeerSuggestions || nextCursor != "" {
+				svc.loggerFor(ctx).WithField("max_suggestions", maxChannelPeerSuggestions).Warn("Too many channel peer suggestions, ignoring the rest")
+			}
+			suggestions = suggestions[:maxChannelPeerSuggestions]
+			break
+		}
+		if nextCursor == "" {
+			break
+		}
+		if page >= maxPages {
+			svc.loggerFor(ctx).WithField("max_pages", maxPages).Warn("Channel peer suggestions have more pages than PEER_SUGGESTION_MAX_PAGES, ignoring the rest")
+			break
+		}
+		cursor = nextCursor
 	}
 
-	setDefaultRequestHeaders(req)
+	// TODO: remove once alby API is updated
+	if !svc.cfg.GetEnv().SkipLegacyLspFields {
+		normalizeLegacyLspFields(suggestions)
+	}
 
-	res, err := client.Do(req)
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch channel_suggestions endpoint")
-		return nil, err
+	return suggestions, nil
+}
+
+func decodeChannelPeerSuggestionsPage(response json.RawMessage) ([]ChannelPeerSuggestion, string, error) {
+	if trimmed := bytes.TrimSpace(response); len(trimmed) > 0 && trimmed[0] == '[' {
+		var suggestions []ChannelPeerSuggestion
+		err := json.Unmarshal(trimmed, &suggestions)
+		return suggestions, "", err
 	}
-	var suggestions []ChannelPeerSuggestion
-	err = json.NewDecoder(res.Body).Decode(&suggestions)
+
+	page := &channelPeerSuggestionsPage{}
+	err := json.Unmarshal(response, page)
 	if err != nil {
-		logger.Logger.WithError(err).Errorf("Failed to decode API response")
-		return nil, err
+		return nil, "", err
 	}
+	return page.Suggestions, page.NextCursor, nil
+}
 
-	// TODO: remove once alby API is updated
+// normalizeLegacyLspFields copies the snake case LSP fields still returned by older
+// versions of the Alby API, without overwriting the fields if the API already sets them
+func normalizeLegacyLspFields(suggestions []ChannelPeerSuggestion) {
 	for i, suggestion := range suggestions {
-		if suggestion.BrokenLspType != "" {
+		if suggestion.LspType == "" && suggestion.BrokenLspType != "" {
 			suggestions[i].LspType = suggestion.BrokenLspType
 		}
-		if suggestion.BrokenLspUrl != "" {
+		if suggestion.LspUrl == "" && suggestion.BrokenLspUrl != "" {
 			suggestions[i].LspUrl = suggestion.BrokenLspUrl
 		}
 	}
-
-	logger.Logger.WithFields(logrus.Fields{"channel_suggestions": suggestions}).Debug("Alby channel peer suggestions response")
-	return suggestions, nil
 }
 
-func (svc *albyOAuthService) RequestAutoChannel(ctx context.Context, lnClient lnclient.LNClient, isPublic bool) (*AutoChannelResponse, error) {
+// RequestAutoChannel orders a channel from the Alby LSP. requestedChannelSizeSat is the
+// inbound capacity to request, 0 lets the LSP decide.
+func (svc *albyOAuthService) RequestAutoChannel(ctx context.Context, lnClient lnclient.LNClient, isPublic bool, paymentMethod string, requestedChannelSizeSat uint64) (*AutoChannelResponse, error) {
+	ctx = withRequestId(ctx)
+	if paymentMethod == "" {
+		paymentMethod = AutoChannelPaymentLightning
+	}
+	if paymentMethod != AutoChannelPaymentLightning && paymentMethod != AutoChannelPaymentOnchain {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPaymentMethod, paymentMethod)
+	}
+
 	nodeInfo, err := lnClient.GetInfo(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to request own node info", err)
+		svc.loggerFor(ctx).WithError(err).Error("Failed to request own node info", err)
+		return nil, err
+	}
+	svc.setNodeNetwork(nodeInfo.Network)
+
+	requestUrl := fmt.Sprintf("%s/internal/lsp/alby/%s", svc.albyAPIURL, nodeInfo.Network)
+	lspInfoUrl := requestUrl + "/v1/get_info"
+
+	pubkey, addresses, err := svc.getLSPInfo(ctx, lspInfoUrl)
+
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to request LSP info")
+		return nil, err
+	}
+
+	// do not connect to or pay an LSP which is not the expected one
+	pinnedPubkey := svc.getPinnedLSPPubkey(nodeInfo.Network)
+	if pinnedPubkey != "" && pinnedPubkey != pubkey {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"network":       nodeInfo.Network,
+			"pubkey":        pubkey,
+			"pinned_pubkey": pinnedPubkey,
+		}).Error("LSP pubkey does not match pinned pubkey")
+		return nil, ErrLSPPubkeyMismatch
+	}
+
+	transport, err := svc.connectLSP(ctx, lnClient, pubkey, addresses)
+	if err != nil {
+		// the LSP may have moved, so fetch its URIs again next time
+		svc.invalidateLSPInfo(lspInfoUrl)
+		return nil, err
+	}
+
+	svc.loggerFor(ctx).WithFields(logrus.Fields{
+		"pubkey":         pubkey,
+		"public":         isPublic,
+		"payment_method": paymentMethod,
+		"channel_size":   requestedChannelSizeSat,
+	}).Info("Requesting auto channel")
+
+	autoChannelResponse, err := svc.requestAutoChannel(ctx, requestUrl+"/auto_channel", nodeInfo.Pubkey, isPublic, requestedChannelSizeSat, nodeInfo.Network)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to request auto channel")
 		return nil, err
 	}
+	err = selectAutoChannelPayment(autoChannelResponse, paymentMethod)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).WithField("order_id", autoChannelResponse.OrderId).Error("Failed to select auto channel payment method")
+		return nil, err
+	}
+	autoChannelResponse.Transport = transport
+	return autoChannelResponse, nil
+}
+
+// peer connections sometimes fail on the first attempt but succeed when retried
+var (
+	connectLSPAttempts   = 3
+	connectLSPRetryDelay = 2 * time.Second
+)
+
+// connectLSP tries each address in order until one connects, and returns its transport.
+// If none connects, all addresses are tried again up to connectLSPAttempts times.
+func (svc *albyOAuthService) connectLSP(ctx context.Context, lnClient lnclient.LNClient, pubkey string, addresses []lspAddress) (string, error) {
+	var err error
+	for attempt := 1; attempt <= connectLSPAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-ctx.Done():
+				return "", ctx.Err()
+			case <-time.After(connectLSPRetryDelay * time.Duration(attempt-1)):
+			}
+		}
 
-	requestUrl := fmt.Sprintf("https://api.getalby.com/internal/lsp/alby/%s", nodeInfo.Network)
+		for _, address := range addresses {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
 
-	pubkey, address, port, err := svc.getLSPInfo(ctx, requestUrl+"/v1/get_info")
+			err = connectPeer(ctx, lnClient, pubkey, address)
+			if err == nil {
+				return address.Transport, nil
+			}
 
-	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to request LSP info")
-		return nil, err
+			svc.loggerFor(ctx).WithFields(logrus.Fields{
+				"pubkey":    pubkey,
+				"address":   address.Address,
+				"port":      address.Port,
+				"transport": address.Transport,
+				"attempt":   attempt,
+			}).WithError(err).Error("Failed to connect to peer")
+		}
 	}
+	return "", err
+}
 
-	err = lnClient.ConnectPeer(ctx, &lnclient.ConnectPeerRequest{
+// connectPeer connects to the peer and checks that it is actually connected,
+// since a backend may return before the connection is established
+func connectPeer(ctx context.Context, lnClient lnclient.LNClient, pubkey string, address lspAddress) error {
+	err := lnClient.ConnectPeer(ctx, &lnclient.ConnectPeerRequest{
 		Pubkey:  pubkey,
-		Address: address,
-		Port:    port,
+		Address: address.Address,
+		Port:    address.Port,
 	})
-
 	if err != nil {
-		logger.Logger.WithFields(logrus.Fields{
-			"pubkey":  pubkey,
-			"address": address,
-			"port":    port,
-		}).WithError(err).Error("Failed to connect to peer")
-		return nil, err
+		return err
 	}
 
-	logger.Logger.WithFields(logrus.Fields{
-		"pubkey": pubkey,
-		"public": isPublic,
-	}).Info("Requesting auto channel")
-
-	autoChannelResponse, err := svc.requestAutoChannel(ctx, requestUrl+"/auto_channel", nodeInfo.Pubkey, isPublic)
+	peers, err := lnClient.ListPeers(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to request auto channel")
-		return nil, err
+		return fmt.Errorf("failed to list peers: %w", err)
 	}
-	return autoChannelResponse, nil
+	for _, peer := range peers {
+		if peer.NodeId == pubkey && peer.IsConnected {
+			return nil
+		}
+	}
+	return ErrPeerNotConnected
 }
 
-func (svc *albyOAuthService) requestAutoChannel(ctx context.Context, url string, pubkey string, isPublic bool) (*AutoChannelResponse, error) {
+func (svc *albyOAuthService) requestAutoChannel(ctx context.Context, url string, pubkey string, isPublic bool, requestedChannelSizeSat uint64, network string) (*AutoChannelResponse, error) {
 	token, err := svc.fetchUserToken(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch user token")
 	}
 
-	client := svc.oauthConf.Client(ctx, token)
-	client.Timeout = 60 * time.Second
+	client := svc.newLSPClient(ctx, token)
 
 	type autoChannelRequest struct {
 		NodePubkey      string `json:"node_pubkey"`
 		AnnounceChannel bool   `json:"announce_channel"`
+		LspBalanceSat   string `json:"lsp_balance_sat,omitempty"`
 	}
 
 	newAutoChannelRequest := autoChannelRequest{
 		NodePubkey:      pubkey,
 		AnnounceChannel: isPublic,
 	}
+	if requestedChannelSizeSat > 0 {
+		newAutoChannelRequest.LspBalanceSat = strconv.FormatUint(requestedChannelSizeSat, 10)
+	}
 
 	payloadBytes, err := json.Marshal(newAutoChannelRequest)
 	if err != nil {
@@ -950,19 +3745,19 @@ func (svc *albyOAuthService) requestAutoChannel(ctx context.Context, url string,
 	}
 	bodyReader := bytes.NewReader(payloadBytes)
 
-	req, err := http.NewRequest(http.MethodPost, url, bodyReader)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bodyReader)
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to create auto channel request")
 		return nil, err
 	}
 
-	setDefaultRequestHeaders(req)
+	svc.setDefaultRequestHeaders(req)
 
 	res, err := client.Do(req)
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to request auto channel invoice")
 		return nil, err
@@ -970,16 +3765,16 @@ func (svc *albyOAuthService) requestAutoChannel(ctx context.Context, url string,
 
 	defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
+	body, err := io.ReadAll(svc.limitBody(res.Body))
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to read response body")
-		return nil, errors.New("failed to read response body")
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	if res.StatusCode >= 300 {
-		logger.Logger.WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
 			"newLSPS1ChannelRequest": newAutoChannelRequest,
 			"body":                   string(body),
 			"statusCode":             res.StatusCode,
@@ -987,38 +3782,89 @@ func (svc *albyOAuthService) requestAutoChannel(ctx context.Context, url string,
 		return nil, fmt.Errorf("auto channel endpoint returned non-success code: %s", string(body))
 	}
 
+	autoChannelResponse, err := svc.parseAutoChannelResponse(ctx, url, body, network)
+	if err != nil {
+		return nil, err
+	}
+
+	// the channel size of LSPS1 orders waiting for payment details is not known yet
+	waitingForPayment := autoChannelResponse.Invoice == "" && autoChannelResponse.OnchainPayment == nil
+	if requestedChannelSizeSat > 0 && !waitingForPayment && autoChannelResponse.ChannelSize < requestedChannelSizeSat {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"channel_size":           autoChannelResponse.ChannelSize,
+			"requested_channel_size": requestedChannelSizeSat,
+		}).Error("LSP channel size is smaller than requested")
+		return nil, fmt.Errorf("%w: %d < %d sats", ErrChannelTooSmall, autoChannelResponse.ChannelSize, requestedChannelSizeSat)
+	}
+	return autoChannelResponse, nil
+}
+
+// parseAutoChannelResponse parses and validates an LSPS1 order returned by the LSP
+func (svc *albyOAuthService) parseAutoChannelResponse(ctx context.Context, url string, body []byte, network string) (*AutoChannelResponse, error) {
 	type newLSPS1ChannelPaymentBolt11 struct {
 		Invoice     string `json:"invoice"`
 		FeeTotalSat string `json:"fee_total_sat"`
 	}
 
+	type newLSPS1ChannelPaymentOnchain struct {
+		Address          string  `json:"address"`
+		FeeTotalSat      string  `json:"fee_total_sat"`
+		OrderTotalSat    string  `json:"order_total_sat"`
+		NetworkFeeSat    string  `json:"network_fee_sat"`
+		MinConfirmations *uint32 `json:"min_onchain_payment_confirmations"`
+	}
+
 	type newLSPS1ChannelPayment struct {
-		Bolt11 newLSPS1ChannelPaymentBolt11 `json:"bolt11"`
-		// TODO: add onchain
+		Bolt11  *newLSPS1ChannelPaymentBolt11  `json:"bolt11"`
+		Onchain *newLSPS1ChannelPaymentOnchain `json:"onchain"`
 	}
 	type autoChannelResponse struct {
+		OrderId       string                  `json:"order_id"`
+		OrderState    string                  `json:"order_state"`
 		LspBalanceSat string                  `json:"lsp_balance_sat"`
 		Payment       *newLSPS1ChannelPayment `json:"payment"`
 	}
 
 	var newAutoChannelResponse autoChannelResponse
 
-	err = json.Unmarshal(body, &newAutoChannelResponse)
+	err := json.Unmarshal(body, &newAutoChannelResponse)
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to deserialize json")
 		return nil, fmt.Errorf("failed to deserialize json %s %s", url, string(body))
 	}
 
+	if newAutoChannelResponse.OrderState == lsps1OrderStateFailed {
+		return nil, fmt.Errorf("%w: %s", ErrAutoChannelOrderFailed, newAutoChannelResponse.OrderId)
+	}
+
+	payment := newAutoChannelResponse.Payment
+	hasInvoice := payment != nil && payment.Bolt11 != nil && payment.Bolt11.Invoice != ""
+	hasOnchainAddress := payment != nil && payment.Onchain != nil && payment.Onchain.Address != ""
+
+	// LSPs using the LSPS1 order flow may only provide the payment details once the order is ready
+	if newAutoChannelResponse.OrderId != "" && !hasInvoice && !hasOnchainAddress {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"order_id":    newAutoChannelResponse.OrderId,
+			"order_state": newAutoChannelResponse.OrderState,
+		}).Info("Auto channel order created, waiting for payment details")
+		return &AutoChannelResponse{
+			OrderId:    newAutoChannelResponse.OrderId,
+			OrderState: newAutoChannelResponse.OrderState,
+		}, nil
+	}
+
 	var invoice string
 	var fee uint64
+	var invoiceDetails *AutoChannelInvoiceDetails
+	var onchainPayment *AutoChannelOnchainPayment
 
-	if newAutoChannelResponse.Payment != nil {
-		invoice = newAutoChannelResponse.Payment.Bolt11.Invoice
-		fee, err = strconv.ParseUint(newAutoChannelResponse.Payment.Bolt11.FeeTotalSat, 10, 64)
+	if payment != nil && payment.Bolt11 != nil && (hasInvoice || !hasOnchainAddress) {
+		invoice = payment.Bolt11.Invoice
+		fee, err = strconv.ParseUint(payment.Bolt11.FeeTotalSat, 10, 64)
 		if err != nil {
-			logger.Logger.WithError(err).WithFields(logrus.Fields{
+			svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 				"url": url,
 			}).Error("Failed to parse fee")
 			return nil, fmt.Errorf("failed to parse fee %v", err)
@@ -1026,123 +3872,684 @@ func (svc *albyOAuthService) requestAutoChannel(ctx context.Context, url string,
 
 		paymentRequest, err := decodepay.Decodepay(invoice)
 		if err != nil {
-			logger.Logger.WithError(err).Error("Failed to decode bolt11 invoice")
+			svc.loggerFor(ctx).WithError(err).Error("Failed to decode bolt11 invoice")
+			return nil, err
+		}
+
+		err = validateInvoiceNetwork(&paymentRequest, network)
+		if err != nil {
+			svc.loggerFor(ctx).WithError(err).Error("LSP invoice is for a different network")
 			return nil, err
 		}
 
-		if fee != uint64(paymentRequest.MSatoshi/1000) {
-			logger.Logger.WithFields(logrus.Fields{
-				"invoice_amount": paymentRequest.MSatoshi / 1000,
-				"fee":            fee,
+		// LSPS1 quotes the fee in whole sats, so compare in msat to also reject
+		// invoices with a sub-satoshi amount rather than truncating them
+		if paymentRequest.MSatoshi < 0 || uint64(paymentRequest.MSatoshi) != fee*1000 {
+			err = fmt.Errorf("%w: invoice amount %d msat, quoted fee %d msat", ErrLSPFeeMismatch, paymentRequest.MSatoshi, fee*1000)
+			svc.loggerFor(ctx).WithFields(logrus.Fields{
+				"invoice_amount_msat": paymentRequest.MSatoshi,
+				"fee_total_msat":      fee * 1000,
 			}).WithError(err).Error("Invoice amount does not match LSP fee")
-			return nil, errors.New("invoice amount does not match LSP fee")
+			return nil, err
+		}
+
+		invoiceDetails = &AutoChannelInvoiceDetails{
+			AmountSat:   uint64(paymentRequest.MSatoshi / 1000),
+			Description: paymentRequest.Description,
+			ExpiresAt:   time.Unix(int64(paymentRequest.CreatedAt+paymentRequest.Expiry), 0),
+			PayeePubkey: paymentRequest.Payee,
+		}
+	}
+
+	if hasOnchainAddress {
+		onchainPayment, err = parseAutoChannelOnchainPayment(payment.Onchain.Address, payment.Onchain.FeeTotalSat, payment.Onchain.OrderTotalSat, payment.Onchain.NetworkFeeSat, payment.Onchain.MinConfirmations, network)
+		if err != nil {
+			svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
+				"url":     url,
+				"address": payment.Onchain.Address,
+			}).Error("Failed to parse onchain payment")
+			return nil, err
 		}
 	}
 
 	channelSize, err := strconv.ParseUint(newAutoChannelResponse.LspBalanceSat, 10, 64)
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to parse lsp balance sat")
 		return nil, fmt.Errorf("failed to parse lsp balance sat %v", err)
 	}
 
+	// checked before the invoice is returned to be paid
+	maxChannelSizeSat := svc.cfg.GetEnv().AlbyMaxChannelSizeSat
+	if maxChannelSizeSat > 0 && channelSize > maxChannelSizeSat {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"channel_size":     channelSize,
+			"max_channel_size": maxChannelSizeSat,
+		}).Error("LSP channel size exceeds the configured maximum")
+		return nil, fmt.Errorf("%w: %d > %d sats", ErrChannelTooLarge, channelSize, maxChannelSizeSat)
+	}
+
 	return &AutoChannelResponse{
-		Invoice:     invoice,
-		Fee:         fee,
-		ChannelSize: channelSize,
+		Invoice:        invoice,
+		Fee:            fee,
+		ChannelSize:    channelSize,
+		InvoiceDetails: invoiceDetails,
+		OnchainPayment: onchainPayment,
+		OrderId:        newAutoChannelResponse.OrderId,
+		OrderState:     newAutoChannelResponse.OrderState,
 	}, nil
 }
 
-func (svc *albyOAuthService) getLSPInfo(ctx context.Context, url string) (pubkey string, address string, port uint16, err error) {
+func parseAutoChannelOnchainPayment(address, feeTotalSat, orderTotalSat, networkFeeSat string, minConfirmations *uint32, network string) (*AutoChannelOnchainPayment, error) {
+	err := validateOnchainAddress(address, network)
+	if err != nil {
+		return nil, err
+	}
+
+	fee, err := strconv.ParseUint(feeTotalSat, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse onchain fee %v", err)
+	}
+
+	onchainPayment := &AutoChannelOnchainPayment{
+		Address:     address,
+		FeeTotalSat: fee,
+	}
+	// the order total includes any prepaid LSP balance, not all LSPs return it
+	if orderTotalSat != "" {
+		onchainPayment.OrderTotalSat, err = strconv.ParseUint(orderTotalSat, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse onchain order total %v", err)
+		}
+	}
+	// the network fee of the funding transaction, the total fee also includes the LSP service fee
+	if networkFeeSat != "" {
+		onchainPayment.NetworkFeeSat, err = strconv.ParseUint(networkFeeSat, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse onchain network fee %v", err)
+		}
+	}
+	if minConfirmations != nil {
+		onchainPayment.MinConfirmations = *minConfirmations
+	}
+	return onchainPayment, nil
+}
+
+var onchainNetworkParams = map[string]*chaincfg.Params{
+	"bitcoin": &chaincfg.MainNetParams,
+	"mainnet": &chaincfg.MainNetParams,
+	"testnet": &chaincfg.TestNet3Params,
+	"signet":  &chaincfg.SigNetParams,
+	"regtest": &chaincfg.RegressionNetParams,
+}
+
+// validateOnchainAddress rejects addresses which cannot be paid to on network.
+// On unknown networks the address only has to be valid on one of the known ones.
+func validateOnchainAddress(address string, network string) error {
+	params, ok := onchainNetworkParams[network]
+	if !ok {
+		for _, params := range onchainNetworkParams {
+			decodedAddress, err := btcutil.DecodeAddress(address, params)
+			if err == nil && decodedAddress.IsForNet(params) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s", ErrInvalidOnchainAddress, address)
+	}
+
+	decodedAddress, err := btcutil.DecodeAddress(address, params)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidOnchainAddress, address, err)
+	}
+	if !decodedAddress.IsForNet(params) {
+		return fmt.Errorf("%w: %s is not a %s address", ErrInvalidOnchainAddress, address, network)
+	}
+	return nil
+}
+
+// selectAutoChannelPayment keeps only the payment details of paymentMethod.
+// Orders still waiting for payment details are returned as they are.
+func selectAutoChannelPayment(autoChannelResponse *AutoChannelResponse, paymentMethod string) error {
+	if autoChannelResponse.OrderId != "" && autoChannelResponse.Invoice == "" && autoChannelResponse.OnchainPayment == nil {
+		return nil
+	}
+
+	switch paymentMethod {
+	case AutoChannelPaymentOnchain:
+		if autoChannelResponse.OnchainPayment == nil {
+			return fmt.Errorf("%w: %s", ErrPaymentMethodMissing, paymentMethod)
+		}
+		autoChannelResponse.Invoice = ""
+		autoChannelResponse.InvoiceDetails = nil
+		autoChannelResponse.Fee = autoChannelResponse.OnchainPayment.FeeTotalSat
+	default:
+		if autoChannelResponse.Invoice == "" && autoChannelResponse.OnchainPayment != nil {
+			return fmt.Errorf("%w: %s", ErrPaymentMethodMissing, paymentMethod)
+		}
+		autoChannelResponse.OnchainPayment = nil
+	}
+	return nil
+}
+
+// GetAutoChannelOrderStatus polls an auto channel order which did not include
+// payment details when it was created
+func (svc *albyOAuthService) GetAutoChannelOrderStatus(ctx context.Context, lnClient lnclient.LNClient, orderId string) (*AutoChannelResponse, error) {
+	nodeInfo, err := lnClient.GetInfo(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to request own node info")
+		return nil, err
+	}
+	svc.setNodeNetwork(nodeInfo.Network)
 
 	token, err := svc.fetchUserToken(ctx)
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to fetch user token")
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch user token")
+		return nil, err
 	}
 
-	client := svc.oauthConf.Client(ctx, token)
-	client.Timeout = 60 * time.Second
+	client := svc.newLSPClient(ctx, token)
+
+	requestUrl := fmt.Sprintf("%s/internal/lsp/alby/%s/v1/get_order?order_id=%s", svc.albyAPIURL, nodeInfo.Network, url.QueryEscape(orderId))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestUrl, nil)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).WithField("url", requestUrl).Error("Failed to create auto channel order request")
+		return nil, err
+	}
+
+	svc.setDefaultRequestHeaders(req)
+
+	res, err := client.Do(req)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).WithField("url", requestUrl).Error("Failed to request auto channel order")
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(svc.limitBody(res.Body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	if res.StatusCode >= 300 {
+		svc.loggerFor(ctx).WithFields(logrus.Fields{
+			"order_id":   orderId,
+			"body":       string(body),
+			"statusCode": res.StatusCode,
+		}).Error("auto channel order endpoint returned non-success code")
+		return nil, fmt.Errorf("auto channel order endpoint returned non-success code: %s", string(body))
+	}
+
+	return svc.parseAutoChannelResponse(ctx, requestUrl, body, nodeInfo.Network)
+}
 
+// GetLSPInfo requests the LSPS1 info of the LSP at url, with every supported URI it advertises
+func (svc *albyOAuthService) GetLSPInfo(ctx context.Context, url string) (*LSPInfo, error) {
+	token, err := svc.fetchUserToken(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch user token")
+	}
+
+	client := svc.newLSPClient(ctx, token)
+
+	type lsps1Options struct {
+		MinChannelBalanceSat lsps1Sat `json:"min_channel_balance_sat"`
+		MaxChannelBalanceSat lsps1Sat `json:"max_channel_balance_sat"`
+	}
 	type lsps1LSPInfo struct {
-		URIs []string `json:"uris"`
+		URIs    []string      `json:"uris"`
+		Options *lsps1Options `json:"options"`
 	}
 	var lsps1LspInfo lsps1LSPInfo
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to create lsp info request")
-		return "", "", uint16(0), err
+		return nil, err
 	}
 
-	setDefaultRequestHeaders(req)
+	svc.setDefaultRequestHeaders(req)
 
 	res, err := client.Do(req)
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to request lsp info")
-		return "", "", uint16(0), err
+		return nil, err
 	}
 
 	defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
+	body, err := io.ReadAll(svc.limitBody(res.Body))
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to read response body")
-		return "", "", uint16(0), errors.New("failed to read response body")
+		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
 	err = json.Unmarshal(body, &lsps1LspInfo)
 	if err != nil {
-		logger.Logger.WithError(err).WithFields(logrus.Fields{
+		svc.loggerFor(ctx).WithError(err).WithFields(logrus.Fields{
 			"url": url,
 		}).Error("Failed to deserialize json")
-		return "", "", uint16(0), fmt.Errorf("failed to deserialize json %s %s", url, string(body))
+		return nil, fmt.Errorf("failed to deserialize json %s %s", url, string(body))
 	}
 
-	httpUris := utils.Filter(lsps1LspInfo.URIs, func(uri string) bool {
-		return !strings.Contains(uri, ".onion")
-	})
-	if len(httpUris) == 0 {
-		logger.Logger.WithField("uris", lsps1LspInfo.URIs).WithError(err).Error("Couldn't find HTTP URI")
+	lspInfo := &LSPInfo{
+		ClearnetURIs: []string{},
+		OnionURIs:    []string{},
+	}
+	if lsps1LspInfo.Options != nil {
+		lspInfo.MinChannelSizeSat = uint64(lsps1LspInfo.Options.MinChannelBalanceSat)
+		lspInfo.MaxChannelSizeSat = uint64(lsps1LspInfo.Options.MaxChannelBalanceSat)
+	}
+
+	for _, uri := range lsps1LspInfo.URIs {
+		uriPubkey, address, err := parseLSPUri(uri)
+		if err != nil {
+			svc.loggerFor(ctx).WithField("uri", uri).WithError(err).Debug("Skipping unsupported LSP URI")
+			continue
+		}
+		if lspInfo.Pubkey != "" && uriPubkey != lspInfo.Pubkey {
+			svc.loggerFor(ctx).WithField("uri", uri).Warn("Skipping LSP URI with a different pubkey")
+			continue
+		}
+		lspInfo.Pubkey = uriPubkey
+		if address.Transport == lspTransportTor {
+			lspInfo.OnionURIs = append(lspInfo.OnionURIs, uri)
+		} else {
+			lspInfo.ClearnetURIs = append(lspInfo.ClearnetURIs, uri)
+		}
+	}
+
+	if lspInfo.Pubkey == "" {
+		svc.loggerFor(ctx).WithField("uris", lsps1LspInfo.URIs).Error("Couldn't find a supported LSP URI")
+		return nil, errors.New("could not decode LSP URI")
+	}
+
+	return lspInfo, nil
+}
+
+// repeated auto channel requests in a session do not need to fetch the LSP info again
+var lspInfoCacheTTL = 5 * time.Minute
+
+type cachedLSPInfo struct {
+	lspInfo   *LSPInfo
+	fetchedAt time.Time
+}
+
+// getCachedLSPInfo returns the LSP info at url, fetching it if it is not cached or the cache expired
+func (svc *albyOAuthService) getCachedLSPInfo(ctx context.Context, url string) (*LSPInfo, error) {
+	svc.lspInfoCacheMutex.Lock()
+	cached, ok := svc.lspInfoCache[url]
+	svc.lspInfoCacheMutex.Unlock()
+	if ok && time.Since(cached.fetchedAt) < lspInfoCacheTTL {
+		return cached.lspInfo, nil
+	}
+
+	lspInfo, err := svc.GetLSPInfo(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+
+	svc.lspInfoCacheMutex.Lock()
+	defer svc.lspInfoCacheMutex.Unlock()
+	if svc.lspInfoCache == nil {
+		svc.lspInfoCache = map[string]cachedLSPInfo{}
+	}
+	svc.lspInfoCache[url] = cachedLSPInfo{lspInfo: lspInfo, fetchedAt: time.Now()}
+	return lspInfo, nil
+}
+
+func (svc *albyOAuthService) invalidateLSPInfo(url string) {
+	svc.lspInfoCacheMutex.Lock()
+	defer svc.lspInfoCacheMutex.Unlock()
+	delete(svc.lspInfoCache, url)
+}
+
+// getLSPInfo returns the LSP addresses this hub can connect to, in the order they should be tried
+func (svc *albyOAuthService) getLSPInfo(ctx context.Context, url string) (pubkey string, addresses []lspAddress, err error) {
+	lspInfo, err := svc.getCachedLSPInfo(ctx, url)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the cached info is shared, so it must not be appended to
+	uris := slices.Clone(lspInfo.ClearnetURIs)
+	if svc.cfg.GetEnv().SocksProxyAddr != "" {
+		uris = append(uris, lspInfo.OnionURIs...)
+	} else if len(lspInfo.OnionURIs) > 0 {
+		svc.loggerFor(ctx).WithField("uris", lspInfo.OnionURIs).Debug("Skipping onion LSP URIs, no SOCKS proxy configured")
+	}
 
-		return "", "", uint16(0), err
+	for _, uri := range uris {
+		// already validated by GetLSPInfo
+		_, address, _ := parseLSPUri(uri)
+		addresses = append(addresses, *address)
 	}
-	uri := httpUris[0]
 
-	// make sure it's a valid IPv4 URI
-	regex := regexp.MustCompile(`^([0-9a-f]+)@([0-9]+\.[0-9]+\.[0-9]+\.[0-9]+):([0-9]+)$`)
-	parts := regex.FindStringSubmatch(uri)
-	logger.Logger.WithField("parts", parts).Debug("Split URI")
-	if parts == nil || len(parts) != 4 {
-		logger.Logger.WithField("parts", parts).Error("Unsupported URI")
-		return "", "", uint16(0), errors.New("could not decode LSP URI")
+	if len(addresses) == 0 {
+		svc.invalidateLSPInfo(url)
+		svc.loggerFor(ctx).WithField("url", url).Error("Couldn't find a supported LSP URI")
+		return "", nil, errors.New("could not decode LSP URI")
 	}
 
-	portValue, err := strconv.Atoi(parts[3])
+	// try the preferred transport first
+	preferredTransport := svc.cfg.GetEnv().LSPTransport
+	if preferredTransport == "" {
+		preferredTransport = lspTransportClearnet
+	}
+	sort.SliceStable(addresses, func(i, j int) bool {
+		return addresses[i].Transport == preferredTransport && addresses[j].Transport != preferredTransport
+	})
+
+	return lspInfo.Pubkey, addresses, nil
+}
+
+// lsps1Sat is a sat amount, which LSPS1 encodes as a string but some LSPs send as a number
+type lsps1Sat uint64
+
+func (sat *lsps1Sat) UnmarshalJSON(data []byte) error {
+	value := strings.Trim(string(data), `"`)
+	if value == "" || value == "null" {
+		*sat = 0
+		return nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 64)
 	if err != nil {
-		logger.Logger.WithField("port", parts[3]).WithError(err).Error("Failed to decode port number")
+		return fmt.Errorf("invalid sat amount %s: %w", string(data), err)
+	}
+	*sat = lsps1Sat(parsed)
+	return nil
+}
+
+const lsps1OrderStateFailed = "FAILED"
+
+const (
+	lspTransportClearnet = "clearnet"
+	lspTransportTor      = "tor"
+)
+
+type lspAddress struct {
+	Transport string
+	Address   string
+	Port      uint16
+}
+
+var (
+	lspPubkeyRegex   = regexp.MustCompile(`^[0-9a-f]+$`)
+	lspOnionRegex    = regexp.MustCompile(`^[a-z2-7]{56}\.onion$`)
+	lspHostnameRegex = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$`)
+)
+
+// parseLSPUri parses a pubkey@host:port URI. The host may be IPv4, bracketed IPv6,
+// a hostname or an onion v3 address. It is returned as written, because the
+// LNClients join it with the port again when connecting.
+func parseLSPUri(uri string) (string, *lspAddress, error) {
+	pubkey, hostPort, found := strings.Cut(uri, "@")
+	if !found || !lspPubkeyRegex.MatchString(pubkey) {
+		return "", nil, errors.New("unsupported URI")
+	}
+
+	separatorIndex := strings.LastIndex(hostPort, ":")
+	if separatorIndex == -1 {
+		return "", nil, errors.New("missing port")
+	}
+	host := hostPort[:separatorIndex]
+
+	portValue, err := strconv.ParseUint(hostPort[separatorIndex+1:], 10, 16)
+	if err != nil || portValue == 0 {
+		return "", nil, fmt.Errorf("failed to decode port number: %q", hostPort[separatorIndex+1:])
+	}
+
+	transport := lspTransportClearnet
+	switch {
+	case strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]"):
+		ip := net.ParseIP(host[1 : len(host)-1])
+		if ip == nil || ip.To4() != nil {
+			return "", nil, fmt.Errorf("invalid IPv6 address: %q", host)
+		}
+	case net.ParseIP(host) != nil:
+		// without brackets the port of an IPv6 address is ambiguous
+		if strings.Contains(host, ":") {
+			return "", nil, fmt.Errorf("IPv6 address must be bracketed: %q", host)
+		}
+	case strings.HasSuffix(host, ".onion"):
+		// older onion versions are no longer reachable
+		if !lspOnionRegex.MatchString(host) {
+			return "", nil, fmt.Errorf("unsupported onion address: %q", host)
+		}
+		transport = lspTransportTor
+	case len(host) <= 253 && lspHostnameRegex.MatchString(host):
+	default:
+		return "", nil, fmt.Errorf("invalid host: %q", host)
+	}
+
+	return pubkey, &lspAddress{
+		Transport: transport,
+		Address:   host,
+		Port:      uint16(portValue),
+	}, nil
+}
+
+// getPinnedLSPPubkey returns the configured LSP pubkey for the network, if any
+func (svc *albyOAuthService) getPinnedLSPPubkey(network string) string {
+	for _, entry := range strings.Split(svc.cfg.GetEnv().AlbyLSPPubkeys, ",") {
+		pinnedNetwork, pubkey, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if found && pinnedNetwork == network {
+			return pubkey
+		}
+	}
+	return ""
+}
 
-		return "", "", uint16(0), err
+// events sent to the Alby API unless EVENTS_ALLOW_LIST is set, so new events are not sent automatically
+var defaultAllowedEvents = []string{"nwc_payment_received", "nwc_payment_sent", "nwc_payment_failed", "nwc_backup_channels"}
+
+func (svc *albyOAuthService) getAllowedEvents() []string {
+	allowList := svc.cfg.GetEnv().EventsAllowList
+	if allowList == "" {
+		return defaultAllowedEvents
+	}
+	allowedEvents := []string{}
+	for _, allowedEvent := range strings.Split(allowList, ",") {
+		if allowedEvent = strings.TrimSpace(allowedEvent); allowedEvent != "" {
+			allowedEvents = append(allowedEvents, allowedEvent)
+		}
+	}
+	return allowedEvents
+}
+
+// events which are always sent, regardless of the configured sample rate
+var unsampledEvents = []string{"nwc_backup_channels", "nwc_payment_failed"}
+
+// getEventSampleRate returns the fraction of events of this type to send to the
+// Alby API, configured as comma-separated event:rate pairs
+func (svc *albyOAuthService) getEventSampleRate(eventName string) float64 {
+	if slices.Contains(unsampledEvents, eventName) {
+		return 1
+	}
+	for _, entry := range strings.Split(svc.cfg.GetEnv().EventsSampleRates, ",") {
+		sampledEvent, rate, found := strings.Cut(strings.TrimSpace(entry), ":")
+		if !found || sampledEvent != eventName {
+			continue
+		}
+		sampleRate, err := strconv.ParseFloat(rate, 64)
+		if err != nil || sampleRate < 0 || sampleRate > 1 {
+			svc.logger.WithField("entry", entry).Warn("Ignoring invalid event sample rate")
+			return 1
+		}
+		return sampleRate
+	}
+	return 1
+}
+
+// default timeout for Alby API requests, so a hanging API cannot block callers without a deadline
+var albyAPIRequestTimeout = 30 * time.Second
+
+// newAPIClient returns an OAuth client for the Alby API. Requests should still be
+// created with ctx so cancellation propagates.
+func (svc *albyOAuthService) newAPIClient(ctx context.Context, token *oauth2.Token) *http.Client {
+	client := svc.oauthConf.Client(svc.oauthContext(ctx), token)
+	client.Timeout = albyAPIRequestTimeout
+	svc.withCircuitBreaker(client, svc.apiBreaker)
+	return client
+}
+
+// oauthContext makes the oauth2 package use the client set with WithHTTPClient,
+// unless ctx already carries a client
+func (svc *albyOAuthService) oauthContext(ctx context.Context) context.Context {
+	if svc.httpClient == nil || ctx.Value(oauth2.HTTPClient) != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, oauth2.HTTPClient, svc.httpClient)
+}
+
+// withCircuitBreaker sends the requests of client through the circuit breaker
+// and records them in the API metrics. Requests rejected by the breaker are not recorded.
+// Only the API requests are wrapped, token refreshes use their own client.
+func (svc *albyOAuthService) withCircuitBreaker(client *http.Client, breaker *circuitBreaker) {
+	if oauthTransport, ok := client.Transport.(*oauth2.Transport); ok {
+		base := oauthTransport.Base
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		oauthTransport.Base = &circuitBreakerTransport{base: &metricsTransport{base: base, svc: svc}, breaker: breaker}
+		return
 	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	client.Transport = &circuitBreakerTransport{base: &metricsTransport{base: base, svc: svc}, breaker: breaker}
+}
 
-	return parts[1], parts[2], uint16(portValue), nil
+// newLSPClient returns a client for the LSP endpoints, which can take longer to respond.
+// If a SOCKS5 proxy is configured, the requests are routed through it.
+func (svc *albyOAuthService) newLSPClient(ctx context.Context, token *oauth2.Token) *http.Client {
+	if proxyAddr := svc.cfg.GetEnv().SocksProxyAddr; proxyAddr != "" {
+		// the oauth2 client wraps the transport of the context's client
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyURL(&url.URL{Scheme: "socks5", Host: proxyAddr}),
+			},
+		})
+	}
+	client := svc.oauthConf.Client(svc.oauthContext(ctx), token)
+	client.Timeout = 60 * time.Second
+	svc.withCircuitBreaker(client, svc.lspBreaker)
+	return client
 }
 
+// setDefaultRequestHeaders is used for requests to third parties, which are not told about the node
 func setDefaultRequestHeaders(req *http.Request) {
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("User-Agent", "AlbyHub/"+version.Tag)
 }
 
-func (svc *albyOAuthService) deleteAlbyAccountApps() {
-	// delete any existing getalby.com connections so when re-linking the user only has one
-	err := svc.db.Where("name = ?", ALBY_ACCOUNT_APP_NAME).Delete(&db.App{}).Error
+// setDefaultRequestHeaders is used for requests to the Alby API. The User-Agent also
+// includes the node backend and network to help debugging API and LSP issues, and
+// X-Request-Id the correlation ID of the operation the request is part of.
+func (svc *albyOAuthService) setDefaultRequestHeaders(req *http.Request) {
+	setDefaultRequestHeaders(req)
+	if requestId := requestIdFromContext(req.Context()); requestId != "" {
+		req.Header.Set("X-Request-Id", requestId)
+	}
+	backendType, _ := svc.cfg.Get("LNBackendType", "")
+	req.Header.Set("User-Agent", userAgent(backendType, svc.getNodeNetwork()))
+}
+
+// userAgent returns e.g. AlbyHub/v1.2.0 (LDK; bitcoin), leaving out unknown details
+func userAgent(backendType string, network string) string {
+	details := []string{}
+	for _, detail := range []string{backendType, network} {
+		if detail != "" {
+			details = append(details, detail)
+		}
+	}
+	if len(details) == 0 {
+		return "AlbyHub/" + version.Tag
+	}
+	return fmt.Sprintf("AlbyHub/%s (%s)", version.Tag, strings.Join(details, "; "))
+}
+
+// getNodeNetwork returns the network of the node, or an empty string if it is not known yet
+func (svc *albyOAuthService) getNodeNetwork() string {
+	svc.nodeNetworkMutex.Lock()
+	defer svc.nodeNetworkMutex.Unlock()
+	return svc.nodeNetwork
+}
+
+func (svc *albyOAuthService) setNodeNetwork(network string) {
+	svc.nodeNetworkMutex.Lock()
+	defer svc.nodeNetworkMutex.Unlock()
+	svc.nodeNetwork = network
+}
+
+// loadNodeNetwork fetches the network of the node for the User-Agent and the
+// invoice checks if it is not known yet
+func (svc *albyOAuthService) loadNodeNetwork(ctx context.Context, lnClient lnclient.LNClient) {
+	if svc.getNodeNetwork() != "" || lnClient == nil {
+		return
+	}
+
+	nodeInfo, err := lnClient.GetInfo(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Debug("Failed to fetch node info for the User-Agent")
+		return
+	}
+	svc.setNodeNetwork(nodeInfo.Network)
+}
+
+func (svc *albyOAuthService) deleteAlbyAccountApps() error {
+	// delete any existing getalby.com connections of the account so when re-linking the user only has one
+	appIds, err := svc.albyAccountAppIds()
+	if err == nil && len(appIds) > 0 {
+		err = svc.db.Where("id IN ?", appIds).Delete(&db.App{}).Error
+	}
+	if err != nil {
+		svc.logger.WithError(err).Error("Failed to delete Alby Account apps")
+	}
+	return err
+}
+
+// every Alby Account app has the same name, the linked account it belongs to is stored in its metadata
+const albyAccountAppMetadataKey = "alby_account"
+
+func (svc *albyOAuthService) albyAccountAppMetadata() map[string]interface{} {
+	return map[string]interface{}{
+		albyAccountAppMetadataKey: svc.ActiveAccount(),
+	}
+}
+
+// albyAccountAppIds returns the IDs of the Alby Account apps of the active account, oldest
+// first. Apps created before the account was stored in their metadata belong to the default
+// account. The metadata is checked here rather than in the query, so it works on any database.
+func (svc *albyOAuthService) albyAccountAppIds() ([]uint, error) {
+	var apps []db.App
+	err := svc.db.Select("id", "metadata").Where("name = ?", ALBY_ACCOUNT_APP_NAME).Order("id").Find(&apps).Error
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to delete Alby Account apps")
+		return nil, err
+	}
+
+	account := svc.ActiveAccount()
+	appIds := []uint{}
+	for _, app := range apps {
+		appAccount := defaultAccountName
+		var metadata map[string]interface{}
+		// invalid metadata is treated like missing metadata
+		if json.Unmarshal(app.Metadata, &metadata) == nil {
+			if metadataAccount, ok := metadata[albyAccountAppMetadataKey].(string); ok {
+				appAccount = metadataAccount
+			}
+		}
+		if appAccount == account {
+			appIds = append(appIds, app.ID)
+		}
 	}
+	return appIds, nil
 }
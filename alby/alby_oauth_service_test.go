@@ -0,0 +1,3428 @@
+package alby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/getAlby/hub/config"
+	"github.com/getAlby/hub/constants"
+	"github.com/getAlby/hub/db"
+	"github.com/getAlby/hub/events"
+	"github.com/getAlby/hub/lnclient"
+	"github.com/getAlby/hub/tests"
+	"github.com/getAlby/hub/version"
+)
+
+// newEventPayloadTestService only has what the event payload is built with
+func newEventPayloadTestService() *albyOAuthService {
+	return &albyOAuthService{logger: logrus.New()}
+}
+
+func decodeEventPayload(t *testing.T, payload []byte) map[string]interface{} {
+	var decoded map[string]interface{}
+	err := json.Unmarshal(payload, &decoded)
+	assert.NoError(t, err)
+	return decoded
+}
+
+func TestBuildEventPayload_PaymentReceived(t *testing.T) {
+	payload, err := newEventPayloadTestService().buildEventPayload(context.Background(), &events.Event{
+		Event: "nwc_payment_received",
+		Properties: &db.Transaction{
+			PaymentHash:    tests.MockPaymentHash,
+			PaymentRequest: tests.MockInvoice,
+			AmountMsat:     123000,
+		},
+	}, map[string]interface{}{"node_type": "LDK"}, nil)
+	assert.NoError(t, err)
+
+	decoded := decodeEventPayload(t, payload)
+	assert.Equal(t, "nwc_payment_received", decoded["event"])
+	assert.Equal(t, map[string]interface{}{
+		"payment_hash": tests.MockPaymentHash,
+		"node_type":    "LDK",
+	}, decoded["properties"])
+}
+
+func TestBuildEventPayload_PaymentSent(t *testing.T) {
+	settledAt := tests.MockTime.Add(3 * time.Second)
+	payload, err := newEventPayloadTestService().buildEventPayload(context.Background(), &events.Event{
+		Event: "nwc_payment_sent",
+		Properties: &db.Transaction{
+			PaymentHash:    tests.MockPaymentHash,
+			PaymentRequest: tests.MockInvoice,
+			CreatedAt:      tests.MockTime,
+			SettledAt:      &settledAt,
+		},
+	}, nil, nil)
+	assert.NoError(t, err)
+
+	decoded := decodeEventPayload(t, payload)
+	assert.Equal(t, "nwc_payment_sent", decoded["event"])
+	assert.Equal(t, map[string]interface{}{
+		"payment_hash": tests.MockPaymentHash,
+		"duration":     float64(3),
+	}, decoded["properties"])
+}
+
+func TestBuildEventPayload_PaymentFailed(t *testing.T) {
+	payload, err := newEventPayloadTestService().buildEventPayload(context.Background(), &events.Event{
+		Event: "nwc_payment_failed",
+		Properties: &db.Transaction{
+			PaymentHash:    tests.MockPaymentHash,
+			PaymentRequest: tests.MockInvoice,
+			FailureReason:  "no route",
+		},
+	}, nil, nil)
+	assert.NoError(t, err)
+
+	decoded := decodeEventPayload(t, payload)
+	assert.Equal(t, "nwc_payment_failed", decoded["event"])
+	assert.Equal(t, map[string]interface{}{
+		"payment_hash": tests.MockPaymentHash,
+		"reason":       "no route",
+	}, decoded["properties"])
+}
+
+func TestMergeGlobalProperties(t *testing.T) {
+	albyOAuthSvc := newEventPayloadTestService()
+
+	type channelProperties struct {
+		ChannelId string `json:"channel_id"`
+		NodeType  string `json:"node_type"`
+	}
+
+	properties, err := albyOAuthSvc.mergeGlobalProperties(context.Background(), &events.Event{
+		Event:      "nwc_channel_ready",
+		Properties: &channelProperties{ChannelId: "abc", NodeType: "LND"},
+	}, map[string]interface{}{"hub_instance_id": "123"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"channel_id":      "abc",
+		"node_type":       "LND",
+		"hub_instance_id": "123",
+	}, properties)
+
+	// the event property wins over a global property with the same key
+	properties, err = albyOAuthSvc.mergeGlobalProperties(context.Background(), &events.Event{
+		Event:      "nwc_channel_ready",
+		Properties: &channelProperties{ChannelId: "abc", NodeType: "LND"},
+	}, map[string]interface{}{"node_type": "LDK"})
+	assert.NoError(t, err)
+	assert.Equal(t, "LND", properties["node_type"])
+
+	properties, err = albyOAuthSvc.mergeGlobalProperties(context.Background(), &events.Event{Event: "nwc_started"}, map[string]interface{}{"node_type": "LDK"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"node_type": "LDK"}, properties)
+
+	properties, err = albyOAuthSvc.mergeGlobalProperties(context.Background(), &events.Event{Event: "nwc_started", Properties: (*channelProperties)(nil)}, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, properties)
+
+	_, err = albyOAuthSvc.mergeGlobalProperties(context.Background(), &events.Event{Event: "nwc_started", Properties: "not an object"}, nil)
+	assert.Error(t, err)
+}
+
+func TestBuildEventPayload_InvalidPaymentProperties(t *testing.T) {
+	payload, err := newEventPayloadTestService().buildEventPayload(context.Background(), &events.Event{
+		Event:      "nwc_payment_failed",
+		Properties: map[string]interface{}{"payment_hash": tests.MockPaymentHash},
+	}, nil, nil)
+	assert.Error(t, err)
+	assert.Nil(t, payload)
+}
+
+func TestBuildEventPayload_RedactedFields(t *testing.T) {
+	payload, err := newEventPayloadTestService().buildEventPayload(context.Background(), &events.Event{
+		Event: "nwc_payment_sent",
+		Properties: &db.Transaction{
+			PaymentHash: tests.MockPaymentHash,
+			CreatedAt:   tests.MockTime,
+			SettledAt:   &tests.MockTime,
+		},
+	}, map[string]interface{}{"node_type": "LDK", "hub_instance_id": "123"}, []string{"payment_hash", "hub_instance_id"})
+	assert.NoError(t, err)
+
+	decoded := decodeEventPayload(t, payload)
+	assert.Equal(t, map[string]interface{}{
+		"duration":  float64(0),
+		"node_type": "LDK",
+	}, decoded["properties"])
+}
+
+func TestConsumeEvent_RedactedFields(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var payloads []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		payloads = append(payloads, string(body))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_app_created"
+	albyOAuthSvc.cfg.GetEnv().EventsRedactFields = "name, hub_instance_id"
+
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{
+		Event:      "nwc_app_created",
+		Properties: map[string]interface{}{"name": "My secret app", "id": 1},
+	}, map[string]interface{}{"node_type": "LDK"})
+
+	assert.Len(t, payloads, 1)
+	assert.NotContains(t, payloads[0], "My secret app")
+	assert.Equal(t, map[string]interface{}{
+		"id":        float64(1),
+		"node_type": "LDK",
+	}, decodeEventPayload(t, []byte(payloads[0]))["properties"])
+}
+
+func TestBuildEventPayload_GlobalPropertyCollision(t *testing.T) {
+	albyOAuthSvc := newEventPayloadTestService()
+	hook := test.NewLocal(albyOAuthSvc.logger)
+	ctx := withRequestId(context.Background())
+
+	payload, err := albyOAuthSvc.buildEventPayload(ctx, &events.Event{
+		Event: "nwc_node_started",
+		Properties: map[string]interface{}{
+			"node_type": "LND",
+		},
+	}, map[string]interface{}{
+		"node_type":   "LDK",
+		"app_version": "v1.0.0",
+	}, nil)
+	assert.NoError(t, err)
+
+	decoded := decodeEventPayload(t, payload)
+	assert.Equal(t, map[string]interface{}{
+		"node_type":   "LND",
+		"app_version": "v1.0.0",
+	}, decoded["properties"])
+
+	// the collision is logged with the request ID of the event
+	assert.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, requestIdFromContext(ctx), hook.LastEntry().Data["request_id"])
+}
+
+func TestBuildEventPayload_NoProperties(t *testing.T) {
+	payload, err := newEventPayloadTestService().buildEventPayload(context.Background(), &events.Event{
+		Event: "nwc_started",
+	}, map[string]interface{}{"app_version": "v1.0.0"}, nil)
+	assert.NoError(t, err)
+
+	decoded := decodeEventPayload(t, payload)
+	assert.Equal(t, map[string]interface{}{
+		"app_version": "v1.0.0",
+	}, decoded["properties"])
+}
+
+func createTestAlbyOAuthService(t *testing.T, albyAPIURL string) (*albyOAuthService, *tests.TestService) {
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+
+	svc.Cfg.GetEnv().AlbyAPIURL = albyAPIURL
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	})
+	return albyOAuthSvc, svc
+}
+
+type mockInvoiceWithPreimage struct {
+	invoice     string
+	preimage    string
+	paymentHash string
+}
+
+// 123 sat testnet invoices with known preimages, so payments from the shared wallet can be verified
+var mockInvoicesWithPreimage = []mockInvoiceWithPreimage{
+	{
+		invoice:     "lntb1230n1pj48ugqpp5wtxkappzcsrlkmgfs6g0zyct0hkhashh7hsaxz7e65slq9fkx7fsdq8w3jhxaqxq8zals8sqrm4vsswpmdh0l55zltytgjnpm0t82pkte0sfhuyhve6vpqzllrqjw7cth98jandj884xqu58w0y93ze2g7qex69lw8220dag04v30hcqputc3n",
+		preimage:    "0101010101010101010101010101010101010101010101010101010101010101",
+		paymentHash: "72cd6e8422c407fb6d098690f1130b7ded7ec2f7f5e1d30bd9d521f015363793",
+	},
+	{
+		invoice:     "lntb1230n1pj48ugqpp5wkrhhdqa8ya4lwz9tnnqanvdmgqp6p33vjttzn0607y4v4hwef9qdq8w3jhxaqxq8zals8sqwmundt5dm5uj5w5y3u7ntdcrv4522w7ls8l2wk9l6k7sg46cygknvcnz2wl3syn674wzjjypvmvguma2pme420dnwx907900h64p4csq79gzka",
+		preimage:    "0202020202020202020202020202020202020202020202020202020202020202",
+		paymentHash: "75877bb41d393b5fb8455ce60ecd8dda001d06316496b14dfa7f895656eeca4a",
+	},
+	{
+		invoice:     "lntb1230n1pj48ugqpp5vj92t3telvc08zhhgnvh6mkggrr6jynh5jv6p4uq70nnznk2py9sdq8w3jhxaqxq8zals8sqfx3g328t2kjpjm0gj636a2qeg2n97hk38sx6jhqllyfvzuwdksghjkrelajxg6c6fyhgqtfpzjxca7lk5ng6c2jp96t82t4jr3y78jspnvc6va",
+		preimage:    "0303030303030303030303030303030303030303030303030303030303030303",
+		paymentHash: "648aa5c579fb30f38af744d97d6ec840c7a91277a499a0d780f3e7314eca090b",
+	},
+}
+
+// payResponse returns the bolt11 endpoint response for a successful payment of one of mockInvoicesWithPreimage
+func payResponse(t *testing.T, invoice string) []byte {
+	for _, mockInvoice := range mockInvoicesWithPreimage {
+		if mockInvoice.invoice == invoice {
+			return []byte(`{"payment_preimage": "` + mockInvoice.preimage + `", "payment_hash": "` + mockInvoice.paymentHash + `"}`)
+		}
+	}
+	t.Errorf("unexpected invoice: %s", invoice)
+	return nil
+}
+
+// mockLnWithPreimage makes invoices with a known preimage, so the drained payments can be verified
+type mockLnWithPreimage struct {
+	lnclient.LNClient
+}
+
+func (mln *mockLnWithPreimage) MakeInvoice(ctx context.Context, amount int64, description string, descriptionHash string, expiry int64) (*lnclient.Transaction, error) {
+	transaction := *tests.MockLNClientTransaction
+	transaction.Invoice = mockInvoicesWithPreimage[0].invoice
+	transaction.PaymentHash = mockInvoicesWithPreimage[0].paymentHash
+	return &transaction, nil
+}
+
+func TestDrainSharedWallet_ConcurrentDrain(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	balanceRequested := make(chan struct{})
+	releaseBalance := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/lndhub/balance", r.URL.Path)
+		balanceRequested <- struct{}{}
+		<-releaseBalance
+		w.Write([]byte(`{"balance": 0, "currency": "BTC", "unit": "sat"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	firstDrainErr := make(chan error)
+	go func() {
+		_, err := albyOAuthSvc.DrainSharedWallet(context.Background(), nil, nil, nil)
+		firstDrainErr <- err
+	}()
+	<-balanceRequested
+
+	result, err := albyOAuthSvc.DrainSharedWallet(context.Background(), nil, nil, nil)
+	assert.ErrorIs(t, err, ErrDrainInProgress)
+	assert.Nil(t, result)
+
+	close(releaseBalance)
+	err = <-firstDrainErr
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrDrainInProgress)
+
+	// the in-progress state is cleared once the first drain has failed
+	go func() { <-balanceRequested }()
+	_, err = albyOAuthSvc.DrainSharedWallet(context.Background(), nil, nil, nil)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrDrainInProgress)
+}
+
+func TestGetHubInstanceId(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+	assert.NotEmpty(t, albyOAuthSvc.getHubInstanceId())
+	assert.Equal(t, albyOAuthSvc.keys.GetNostrPublicKey(), albyOAuthSvc.getHubInstanceId())
+
+	albyOAuthSvc.cfg.GetEnv().HubInstanceId = "hub-1"
+	assert.Equal(t, "hub-1", albyOAuthSvc.getHubInstanceId())
+}
+
+func TestGetBackup_ChecksumMismatch(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	plaintext := `[{"channel_id":"abc","peer_id":"02abc","funding_tx_id":"def"}]`
+	var backup channelsBackup
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/backups/1", r.URL.Path)
+		json.NewEncoder(w).Encode(&backup)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.SetUpdate("Mnemonic", "encrypted-mnemonic", "")
+
+	encrypted, err := config.AesGcmEncrypt(plaintext, "encrypted-mnemonic")
+	assert.NoError(t, err)
+	backup = channelsBackup{
+		Description: "channels",
+		Data:        encrypted,
+		Checksum:    channelsBackupChecksum(plaintext),
+	}
+
+	channelBackup, err := albyOAuthSvc.GetBackup(context.Background(), "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "channels", channelBackup.Description)
+	assert.Len(t, channelBackup.Channels, 1)
+
+	backup.Checksum = channelsBackupChecksum(`[]`)
+	channelBackup, err = albyOAuthSvc.GetBackup(context.Background(), "1")
+	assert.ErrorIs(t, err, ErrBackupCorrupt)
+	assert.Nil(t, channelBackup)
+}
+
+func TestChannelsBackupEncryption(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	plaintext := `[{"channel_id":"abc"}]`
+	mnemonic := "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about"
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, "")
+
+	// without a mnemonic there is no key to encrypt with
+	_, err := albyOAuthSvc.encryptChannelsBackup(plaintext)
+	assert.Error(t, err)
+
+	svc.Cfg.SetUpdate("Mnemonic", mnemonic, "unlock-password")
+	err = svc.Keys.Init(svc.Cfg, "unlock-password")
+	assert.NoError(t, err)
+	assert.Len(t, svc.Keys.GetBackupEncryptionKey(), 32)
+
+	encrypted, err := albyOAuthSvc.encryptChannelsBackup(plaintext)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(encrypted, channelsBackupV2Prefix))
+
+	decrypted, err := albyOAuthSvc.decryptChannelsBackup(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// backups from before v2 are encrypted with the encrypted mnemonic
+	encryptedMnemonic, err := svc.Cfg.Get("Mnemonic", "")
+	assert.NoError(t, err)
+	legacyEncrypted, err := config.AesGcmEncrypt(plaintext, encryptedMnemonic)
+	assert.NoError(t, err)
+	decrypted, err = albyOAuthSvc.decryptChannelsBackup(legacyEncrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	// changing the unlock password re-encrypts the mnemonic, which only breaks the old format
+	svc.Cfg.SetUpdate("Mnemonic", mnemonic, "new-unlock-password")
+	err = svc.Keys.Init(svc.Cfg, "new-unlock-password")
+	assert.NoError(t, err)
+
+	decrypted, err = albyOAuthSvc.decryptChannelsBackup(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, decrypted)
+
+	_, err = albyOAuthSvc.decryptChannelsBackup(legacyEncrypted)
+	assert.Error(t, err)
+}
+
+// newTestBackupServer stores channels backups by description, like the Alby API
+func newTestBackupServer(t *testing.T) (*httptest.Server, map[string][]byte) {
+	storedBackups := map[string][]byte{}
+	var storedBackupsMutex sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		storedBackupsMutex.Lock()
+		defer storedBackupsMutex.Unlock()
+
+		switch r.Method {
+		case http.MethodPost:
+			assert.Equal(t, "/internal/backups", r.URL.Path)
+			body, _ := io.ReadAll(r.Body)
+			var backup channelsBackup
+			err := json.Unmarshal(body, &backup)
+			assert.NoError(t, err)
+			storedBackups[backup.Description] = body
+		case http.MethodGet:
+			storedBackup, ok := storedBackups[strings.TrimPrefix(r.URL.Path, "/internal/backups/")]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(storedBackup)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, storedBackups
+}
+
+func createTestChannelsBackup(t *testing.T, albyOAuthSvc *albyOAuthService, channels []events.ChannelBackupInfo) {
+	err := albyOAuthSvc.backupChannels(context.Background(), &events.Event{
+		Event:      "nwc_backup_channels",
+		Properties: &events.ChannelBackupEvent{Channels: channels},
+	})
+	assert.NoError(t, err)
+}
+
+func TestRestoreChannels(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, storedBackups := newTestBackupServer(t)
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	svc.Cfg.SetUpdate("Mnemonic", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	err := svc.Keys.Init(svc.Cfg, "")
+	assert.NoError(t, err)
+
+	_, err = albyOAuthSvc.RestoreChannels(context.Background())
+	assert.ErrorIs(t, err, ErrBackupNotFound)
+
+	channels := []events.ChannelBackupInfo{
+		{
+			ChannelID:     "abc",
+			NodeID:        "02def",
+			PeerID:        "02abc",
+			ChannelSize:   100_000,
+			FundingTxID:   "def",
+			FundingTxVout: 1,
+		},
+	}
+	createTestChannelsBackup(t, albyOAuthSvc, channels)
+
+	restored, err := albyOAuthSvc.RestoreChannels(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, channels, restored.Channels)
+
+	// corrupt the ciphertext
+	var backup channelsBackup
+	err = json.Unmarshal(storedBackups["channels-0"], &backup)
+	assert.NoError(t, err)
+	lastChar := backup.Data[len(backup.Data)-1:]
+	corruptChar := "0"
+	if lastChar == "0" {
+		corruptChar = "1"
+	}
+	backup.Data = backup.Data[:len(backup.Data)-1] + corruptChar
+	storedBackups["channels-0"], err = json.Marshal(&backup)
+	assert.NoError(t, err)
+
+	restored, err = albyOAuthSvc.RestoreChannels(context.Background())
+	assert.ErrorIs(t, err, ErrBackupDecryptionFailed)
+	assert.Nil(t, restored)
+}
+
+func TestBackupChannels_Versions(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, storedBackups := newTestBackupServer(t)
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyBackupKeep = 2
+	svc.Cfg.SetUpdate("Mnemonic", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	err := svc.Keys.Init(svc.Cfg, "")
+	assert.NoError(t, err)
+
+	channel := events.ChannelBackupInfo{ChannelID: "abc", PeerID: "02abc", FundingTxID: "def"}
+	createTestChannelsBackup(t, albyOAuthSvc, []events.ChannelBackupInfo{channel})
+	createTestChannelsBackup(t, albyOAuthSvc, []events.ChannelBackupInfo{channel, channel})
+
+	backups, err := albyOAuthSvc.ListBackups(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, backups, 2)
+	assert.Equal(t, "channels-0", backups[0].Id)
+	assert.Equal(t, uint64(2), backups[0].Version)
+	assert.Equal(t, "channels-1", backups[1].Id)
+	assert.Equal(t, uint64(1), backups[1].Version)
+	assert.False(t, backups[0].CreatedAt.IsZero())
+
+	version, err := svc.Cfg.Get(accountConfigKey(backupVersionKey, defaultAccountName), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "2", version)
+
+	// the third backup replaces the oldest one
+	createTestChannelsBackup(t, albyOAuthSvc, []events.ChannelBackupInfo{channel, channel, channel})
+	assert.Len(t, storedBackups, 2)
+
+	backups, err = albyOAuthSvc.ListBackups(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{3, 2}, []uint64{backups[0].Version, backups[1].Version})
+
+	restored, err := albyOAuthSvc.RestoreChannels(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, restored.Channels, 3)
+
+	// a backup which cannot be decrypted falls back to the previous version
+	var backup channelsBackup
+	err = json.Unmarshal(storedBackups[backups[0].Id], &backup)
+	assert.NoError(t, err)
+	backup.Data = "v2:00-00-00"
+	storedBackups[backups[0].Id], err = json.Marshal(&backup)
+	assert.NoError(t, err)
+
+	restored, err = albyOAuthSvc.RestoreChannels(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, restored.Channels, 2)
+}
+
+func TestBackupChannels_VersionContinuesFromServer(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, storedBackups := newTestBackupServer(t)
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyBackupKeep = 3
+	svc.Cfg.SetUpdate("Mnemonic", "abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon abandon about", "")
+	err := svc.Keys.Init(svc.Cfg, "")
+	assert.NoError(t, err)
+
+	channel := events.ChannelBackupInfo{ChannelID: "abc", PeerID: "02abc", FundingTxID: "def"}
+	createTestChannelsBackup(t, albyOAuthSvc, []events.ChannelBackupInfo{channel})
+	createTestChannelsBackup(t, albyOAuthSvc, []events.ChannelBackupInfo{channel, channel})
+
+	// e.g. a new hub linked to the same account
+	svc.Cfg.SetUpdate(accountConfigKey(backupVersionKey, defaultAccountName), "", "")
+	albyOAuthSvc = NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+	createTestChannelsBackup(t, albyOAuthSvc, []events.ChannelBackupInfo{channel, channel, channel})
+
+	backups, err := albyOAuthSvc.ListBackups(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, storedBackups, 3)
+	assert.Equal(t, []uint64{3, 2, 1}, []uint64{backups[0].Version, backups[1].Version, backups[2].Version})
+
+	restored, err := albyOAuthSvc.RestoreChannels(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, restored.Channels, 3)
+}
+
+func TestListBackups_SameVersion(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, storedBackups := newTestBackupServer(t)
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyBackupKeep = 2
+
+	older, _ := json.Marshal(&channelsBackup{Description: "channels-0", Version: 1, CreatedAt: 1_700_000_000})
+	newer, _ := json.Marshal(&channelsBackup{Description: "channels-1", Version: 1, CreatedAt: 1_700_000_100})
+	storedBackups["channels-0"] = older
+	storedBackups["channels-1"] = newer
+
+	backups, err := albyOAuthSvc.ListBackups(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "channels-1", backups[0].Id)
+	assert.Equal(t, "channels-0", backups[1].Id)
+}
+
+func TestGetChannelPeerSuggestions_RetryOnEmpty(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	defaultRetryDelay := channelPeerSuggestionsRetryDelay
+	t.Cleanup(func() { channelPeerSuggestionsRetryDelay = defaultRetryDelay })
+	channelPeerSuggestionsRetryDelay = 0
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/channel_suggestions", r.URL.Path)
+		requests++
+		if requests == 1 {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.Write([]byte(`[{"network": "bitcoin", "pubkey": "abc", "lspType": "LSPS1"}]`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	suggestions, err := albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, suggestions)
+	assert.Equal(t, 1, requests)
+
+	requests = 0
+	albyOAuthSvc.cfg.GetEnv().PeerSuggestionRetries = 2
+	suggestions, err = albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, suggestions, 1)
+	assert.Equal(t, "LSPS1", suggestions[0].LspType)
+	assert.Equal(t, 2, requests)
+}
+
+func TestGetChannelPeerSuggestions_LegacyLspFields(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"pubkey": "1", "lsp_type": "LSPS1", "lsp_url": "https://legacy.example.com"},
+			{"pubkey": "2", "lspType": "LSPS1", "lspUrl": "https://lsp.example.com", "lsp_type": "broken", "lsp_url": "https://broken.example.com"},
+			{"pubkey": "3", "lspType": "LSPS1", "lsp_url": "https://legacy.example.com"}
+		]`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	suggestions, err := albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "LSPS1", suggestions[0].LspType)
+	assert.Equal(t, "https://legacy.example.com", suggestions[0].LspUrl)
+	// populated fields are never overwritten by the legacy ones
+	assert.Equal(t, "LSPS1", suggestions[1].LspType)
+	assert.Equal(t, "https://lsp.example.com", suggestions[1].LspUrl)
+	assert.Equal(t, "LSPS1", suggestions[2].LspType)
+	assert.Equal(t, "https://legacy.example.com", suggestions[2].LspUrl)
+
+	albyOAuthSvc.cfg.GetEnv().SkipLegacyLspFields = true
+	suggestions, err = albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, suggestions[0].LspType)
+	assert.Empty(t, suggestions[0].LspUrl)
+	assert.Equal(t, "https://lsp.example.com", suggestions[1].LspUrl)
+	assert.Empty(t, suggestions[2].LspUrl)
+}
+
+func TestGetChannelPeerSuggestions_Pagination(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var cursors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/channel_suggestions", r.URL.Path)
+		cursor := r.URL.Query().Get("cursor")
+		cursors = append(cursors, cursor)
+		switch cursor {
+		case "":
+			w.Write([]byte(`{"suggestions": [{"pubkey": "1", "lsp_type": "LSPS1"}, {"pubkey": "2"}], "next_cursor": "page 2"}`))
+		case "page 2":
+			w.Write([]byte(`{"suggestions": [{"pubkey": "3", "lsp_type": "LSPS1", "lsp_url": "https://legacy.example.com"}]}`))
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	suggestions, err := albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"", "page 2"}, cursors)
+	assert.Len(t, suggestions, 3)
+	assert.Equal(t, "3", suggestions[2].Pubkey)
+	// the legacy fields are normalized on every page
+	assert.Equal(t, "LSPS1", suggestions[0].LspType)
+	assert.Equal(t, "LSPS1", suggestions[2].LspType)
+	assert.Equal(t, "https://legacy.example.com", suggestions[2].LspUrl)
+
+	cursors = nil
+	albyOAuthSvc.cfg.GetEnv().PeerSuggestionPages = 1
+	suggestions, err = albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{""}, cursors)
+	assert.Len(t, suggestions, 2)
+}
+
+func TestGetChannelPeerSuggestions_MaxSuggestions(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		page := strings.Repeat(`{"network": "bitcoin"},`, 400)
+		w.Write([]byte(`{"suggestions": [` + strings.TrimSuffix(page, ",") + `], "next_cursor": "next"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	suggestions, err := albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, suggestions, maxChannelPeerSuggestions)
+	assert.Equal(t, 3, requests)
+}
+
+func TestGetChannelPeerSuggestionsFiltered(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"network": "bitcoin", "name": "b", "pubkey": "1", "minimumChannelSize": 200000, "maximumChannelSize": 1000000, "lsp_type": "LSPS1"},
+			{"network": "testnet", "name": "a", "pubkey": "2", "minimumChannelSize": 100000, "maximumChannelSize": 0},
+			{"network": "bitcoin", "name": "C", "pubkey": "3", "minimumChannelSize": 50000, "maximumChannelSize": 500000}
+		]`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	pubkeys := func(suggestions []ChannelPeerSuggestion) []string {
+		result := []string{}
+		for _, suggestion := range suggestions {
+			result = append(result, suggestion.Pubkey)
+		}
+		return result
+	}
+
+	suggestions, err := albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2", "3"}, pubkeys(suggestions))
+	// the broken fields are still normalized
+	assert.Equal(t, "LSPS1", suggestions[0].LspType)
+
+	suggestions, err = albyOAuthSvc.GetChannelPeerSuggestionsFiltered(context.Background(), SuggestionFilter{Network: "Bitcoin"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "3"}, pubkeys(suggestions))
+
+	suggestions, err = albyOAuthSvc.GetChannelPeerSuggestionsFiltered(context.Background(), SuggestionFilter{MinChannelSize: 600000})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, pubkeys(suggestions))
+
+	suggestions, err = albyOAuthSvc.GetChannelPeerSuggestionsFiltered(context.Background(), SuggestionFilter{SortBy: SuggestionSortName})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "1", "3"}, pubkeys(suggestions))
+
+	suggestions, err = albyOAuthSvc.GetChannelPeerSuggestionsFiltered(context.Background(), SuggestionFilter{SortBy: SuggestionSortMinChannelSize})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3", "2", "1"}, pubkeys(suggestions))
+
+	suggestions, err = albyOAuthSvc.GetChannelPeerSuggestionsFiltered(context.Background(), SuggestionFilter{SortBy: SuggestionSortMaxChannelSize})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2", "1", "3"}, pubkeys(suggestions))
+
+	_, err = albyOAuthSvc.GetChannelPeerSuggestionsFiltered(context.Background(), SuggestionFilter{SortBy: "score"})
+	assert.ErrorIs(t, err, ErrInvalidSuggestionSort)
+}
+
+func TestWriteLocalChannelsBackup_Rotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "backups")
+
+	for i := 0; i < 4; i++ {
+		err := writeLocalChannelsBackup(dir, 2, []byte(strconv.Itoa(i)))
+		assert.NoError(t, err)
+	}
+
+	backupFiles, err := filepath.Glob(filepath.Join(dir, localChannelsBackupPrefix+"*.json"))
+	assert.NoError(t, err)
+	assert.Len(t, backupFiles, 2)
+
+	sort.Strings(backupFiles)
+	newest, err := os.ReadFile(backupFiles[1])
+	assert.NoError(t, err)
+	assert.Equal(t, "3", string(newest))
+}
+
+func TestReconcileAccountScopes(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, "")
+
+	_, err := albyOAuthSvc.ReconcileAccountScopes(context.Background(), svc.LNClient)
+	assert.ErrorIs(t, err, ErrAccountNotLinked)
+
+	_, _, err = db.NewDBService(svc.DB, svc.EventPublisher).CreateApp(ALBY_ACCOUNT_APP_NAME, "", 0, "monthly", nil, []string{
+		constants.PAY_INVOICE_SCOPE,
+		constants.GET_BALANCE_SCOPE,
+		constants.NOTIFICATIONS_SCOPE,
+	}, false, nil)
+	assert.NoError(t, err)
+
+	svc.LNClient.(*tests.MockLn).SupportedNotificationTypes = &[]string{}
+
+	discrepancies, err := albyOAuthSvc.ReconcileAccountScopes(context.Background(), svc.LNClient)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		constants.GET_INFO_SCOPE,
+		constants.MAKE_INVOICE_SCOPE,
+		constants.LOOKUP_INVOICE_SCOPE,
+		constants.LIST_TRANSACTIONS_SCOPE,
+		constants.SIGN_MESSAGE_SCOPE,
+	}, discrepancies.Missing)
+	assert.Equal(t, []string{constants.NOTIFICATIONS_SCOPE}, discrepancies.Unsupported)
+}
+
+func TestTokenTimeToExpiry(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+
+	timeToExpiry, err := albyOAuthSvc.TokenTimeToExpiry(context.Background())
+	assert.NoError(t, err)
+	assert.InDelta(t, time.Hour, timeToExpiry, float64(time.Minute))
+
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+	timeToExpiry, err = albyOAuthSvc.TokenTimeToExpiry(context.Background())
+	assert.NoError(t, err)
+	assert.Negative(t, timeToExpiry)
+
+	albyOAuthSvc.cfg.SetUpdate(albyOAuthSvc.accountKey(accessTokenKey), "", "")
+	_, err = albyOAuthSvc.TokenTimeToExpiry(context.Background())
+	assert.ErrorIs(t, err, ErrNotConnected)
+}
+
+func TestConsumeEvent_AtLeastOnceDelivery(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	defaultEventRetryDelays := eventRetryDelays
+	t.Cleanup(func() { eventRetryDelays = defaultEventRetryDelays })
+	eventRetryDelays = []time.Duration{0, 0}
+	statusCodes := []int{http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusOK}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/events", r.URL.Path)
+		w.WriteHeader(statusCodes[requests])
+		requests++
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsDeliveryMode = config.EventsDeliveryAtLeastOnce
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started"
+
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Equal(t, 3, requests)
+
+	// rejected events are not retried
+	requests = 0
+	statusCodes = []int{http.StatusBadRequest, http.StatusOK}
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Equal(t, 1, requests)
+}
+
+func TestConsumeEvent_QueuesUndeliveredEvents(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	defaultEventRetryDelays := eventRetryDelays
+	t.Cleanup(func() { eventRetryDelays = defaultEventRetryDelays })
+	eventRetryDelays = []time.Duration{0}
+	outage := true
+	var delivered []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if outage {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		event := &events.Event{}
+		assert.NoError(t, json.Unmarshal(body, event))
+		delivered = append(delivered, event.Event)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsDeliveryMode = config.EventsDeliveryAtLeastOnce
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started,nwc_stopped,nwc_node_sync_failed"
+	albyOAuthSvc.cfg.GetEnv().EventsQueueSize = 2
+
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_node_sync_failed"}, nil)
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_stopped"}, nil)
+	assert.Empty(t, delivered)
+	// the oldest event is dropped once the queue is full
+	assert.Equal(t, 2, albyOAuthSvc.queuedEventsCount())
+
+	// the queued events are sent after the next delivered event
+	outage = false
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Equal(t, []string{"nwc_started", "nwc_started", "nwc_stopped"}, delivered)
+	assert.Equal(t, 0, albyOAuthSvc.Shutdown(context.Background()))
+}
+
+func TestConsumeEvent_FlushesQueuedEvents(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	defaultFlushInterval := queuedEventsFlushInterval
+	t.Cleanup(func() { queuedEventsFlushInterval = defaultFlushInterval })
+	queuedEventsFlushInterval = 10 * time.Millisecond
+
+	var outage atomic.Bool
+	outage.Store(true)
+	var delivered atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if outage.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered.Add(1)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started"
+	albyOAuthSvc.cfg.GetEnv().EventsQueueSize = 10
+
+	// events sent once are kept as well
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Equal(t, 1, albyOAuthSvc.queuedEventsCount())
+
+	// the queued event is sent without a further event
+	outage.Store(false)
+	assert.Eventually(t, func() bool {
+		return delivered.Load() == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, albyOAuthSvc.Shutdown(context.Background()))
+}
+
+func TestShutdown_SkipsNewEvents(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var received int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started"
+
+	go albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Eventually(t, func() bool {
+		return albyOAuthSvc.pendingEventsLen() == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// the pending event is not delivered before the context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, 1, albyOAuthSvc.Shutdown(ctx))
+
+	// events consumed after the shutdown started are skipped
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Equal(t, 1, albyOAuthSvc.pendingEventsLen())
+
+	close(release)
+	assert.Equal(t, 0, albyOAuthSvc.Shutdown(context.Background()))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&received))
+}
+
+func TestCalculateDrainAmount(t *testing.T) {
+	amountSat, err := CalculateDrainAmount(10_000, DefaultDrainOptions())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9810), amountSat)
+
+	// the minimum balance is kept on top of the fee reserve
+	opts := DefaultDrainOptions()
+	opts.MinBalanceSat = 500
+	amountSat, err = CalculateDrainAmount(10_000, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9310), amountSat)
+
+	_, err = CalculateDrainAmount(400, opts)
+	assert.ErrorIs(t, err, ErrDrainBalanceTooLow)
+
+	amountSat, err = CalculateDrainAmount(10_000, DrainOptions{RoutingReserveBps: 50})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9950), amountSat)
+}
+
+func TestDrainOptions_Override(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, "")
+	svc.Cfg.GetEnv().AlbyMinBalanceSat = 500
+
+	assert.Equal(t, DrainOptions{
+		ServiceFeeBps:     80,
+		RoutingReserveBps: 100,
+		FlatReserveSat:    10,
+		MinBalanceSat:     500,
+	}, albyOAuthSvc.drainOptions(nil))
+
+	// only the fields which are set replace the defaults
+	routingReserveBps := int64(0)
+	assert.Equal(t, DrainOptions{
+		ServiceFeeBps:     80,
+		RoutingReserveBps: 0,
+		FlatReserveSat:    10,
+		MinBalanceSat:     500,
+	}, albyOAuthSvc.drainOptions(&DrainOptionsOverride{RoutingReserveBps: &routingReserveBps}))
+}
+
+func TestCalculateDrainAmount_MinimumBalance(t *testing.T) {
+	// 12 sats is the smallest balance which leaves 1 sat after the default reserves
+	amountSat, err := CalculateDrainAmount(12, DefaultDrainOptions())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), amountSat)
+
+	amountSat, err = CalculateDrainAmount(11, DefaultDrainOptions())
+	assert.ErrorIs(t, err, ErrDrainBalanceTooLow)
+	assert.Equal(t, int64(0), amountSat)
+}
+
+func TestRetryAutoLink(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	autoLinkStatus, err := albyOAuthSvc.GetAutoLinkStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, AutoLinkStatusNotAttempted, autoLinkStatus)
+
+	err = albyOAuthSvc.RetryAutoLink(context.Background(), svc.LNClient)
+	assert.ErrorIs(t, err, ErrAutoLinkNotFailed)
+
+	err = albyOAuthSvc.autoLink(context.Background(), svc.LNClient)
+	assert.Error(t, err)
+	autoLinkStatus, err = albyOAuthSvc.GetAutoLinkStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, AutoLinkStatusFailed, autoLinkStatus)
+
+	// the retry fails again, so it can be retried later
+	err = albyOAuthSvc.RetryAutoLink(context.Background(), svc.LNClient)
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrAutoLinkNotFailed)
+	autoLinkStatus, err = albyOAuthSvc.GetAutoLinkStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, AutoLinkStatusFailed, autoLinkStatus)
+}
+
+// mockNWCServer stands in for the Alby API endpoints which manage the Alby Account NWC node
+type mockNWCServer struct {
+	pubkey    string
+	created   int32
+	activated int32
+	destroyed int32
+	// fails activating the node if set
+	activateFails bool
+	// called before the node is activated, if set
+	onActivate func()
+}
+
+func newMockNWCServer(t *testing.T) (*httptest.Server, *mockNWCServer) {
+	mock := &mockNWCServer{
+		pubkey: "b2e4c9d8a1f04a6c3e5d7f9b0a2c4e6f8a0b2c4d6e8f0a1b3c5d7e9f0a1b2c3d",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/internal/nwcs":
+			atomic.AddInt32(&mock.created, 1)
+			w.Write([]byte(`{"pubkey": "` + mock.pubkey + `"}`))
+		case r.Method == http.MethodPut && r.URL.Path == "/internal/nwcs/activate":
+			atomic.AddInt32(&mock.activated, 1)
+			if mock.onActivate != nil {
+				mock.onActivate()
+			}
+			if mock.activateFails {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		case r.Method == http.MethodDelete && r.URL.Path == "/internal/nwcs":
+			atomic.AddInt32(&mock.destroyed, 1)
+		default:
+			t.Errorf("unexpected request: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	return server, mock
+}
+
+func TestAutoLink_Budget(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, _ := newMockNWCServer(t)
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	err := albyOAuthSvc.autoLink(context.Background(), svc.LNClient)
+	assert.NoError(t, err)
+	permission := db.AppPermission{}
+	assert.NoError(t, svc.DB.Joins("App").Where("App.name = ?", ALBY_ACCOUNT_APP_NAME).First(&permission).Error)
+	assert.Equal(t, 1_000_000, permission.MaxAmountSat)
+	assert.Equal(t, constants.BUDGET_RENEWAL_MONTHLY, permission.BudgetRenewal)
+
+	svc.Cfg.GetEnv().AutoLinkBudgetSat = 21_000
+	svc.Cfg.GetEnv().AutoLinkRenewal = constants.BUDGET_RENEWAL_WEEKLY
+	err = albyOAuthSvc.autoLink(context.Background(), svc.LNClient)
+	assert.NoError(t, err)
+	permission = db.AppPermission{}
+	assert.NoError(t, svc.DB.Joins("App").Where("App.name = ?", ALBY_ACCOUNT_APP_NAME).First(&permission).Error)
+	assert.Equal(t, 21_000, permission.MaxAmountSat)
+	assert.Equal(t, constants.BUDGET_RENEWAL_WEEKLY, permission.BudgetRenewal)
+
+	svc.Cfg.GetEnv().AutoLinkRenewal = "fortnightly"
+	err = albyOAuthSvc.autoLink(context.Background(), svc.LNClient)
+	assert.ErrorIs(t, err, ErrInvalidBudgetRenewal)
+	autoLinkStatus, err := albyOAuthSvc.GetAutoLinkStatus()
+	assert.NoError(t, err)
+	assert.Equal(t, AutoLinkStatusFailed, autoLinkStatus)
+}
+
+func TestLinkAccount_Concurrent(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, mock := newMockNWCServer(t)
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 1_000_000, constants.BUDGET_RENEWAL_MONTHLY)
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	var count int64
+	svc.DB.Model(&db.App{}).Where("name = ?", ALBY_ACCOUNT_APP_NAME).Count(&count)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mock.created))
+
+	// a different budget links the account again
+	err := albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 21_000, constants.BUDGET_RENEWAL_MONTHLY)
+	assert.NoError(t, err)
+	svc.DB.Model(&db.App{}).Where("name = ?", ALBY_ACCOUNT_APP_NAME).Count(&count)
+	assert.Equal(t, int64(1), count)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&mock.created))
+}
+
+func TestLinkAccount_Rollback(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, mock := newMockNWCServer(t)
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	// CreateApp rejects the invalid pubkey
+	mock.pubkey = "invalid"
+	err := albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 1_000_000, constants.BUDGET_RENEWAL_MONTHLY)
+	assert.ErrorContains(t, err, "invalid public key format")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mock.created))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&mock.activated))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mock.destroyed))
+
+	mock.pubkey = "b2e4c9d8a1f04a6c3e5d7f9b0a2c4e6f8a0b2c4d6e8f0a1b3c5d7e9f0a1b2c3d"
+	mock.activateFails = true
+	err = albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 1_000_000, constants.BUDGET_RENEWAL_MONTHLY)
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&mock.activated))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&mock.destroyed))
+
+	var count int64
+	svc.DB.Model(&db.App{}).Where("name = ?", ALBY_ACCOUNT_APP_NAME).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestLinkAccount_KeepExistingBudget(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, mock := newMockNWCServer(t)
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	payInvoicePermission := func() db.AppPermission {
+		permission := db.AppPermission{}
+		assert.NoError(t, svc.DB.Joins("App").Where("App.name = ? AND app_permissions.scope = ?", ALBY_ACCOUNT_APP_NAME, constants.PAY_INVOICE_SCOPE).First(&permission).Error)
+		return permission
+	}
+
+	// without an existing app the default budget is used
+	err := albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 0, BudgetRenewalKeepExisting)
+	assert.NoError(t, err)
+	permission := payInvoicePermission()
+	assert.Equal(t, defaultAutoLinkBudgetSat, permission.MaxAmountSat)
+	assert.Equal(t, defaultAutoLinkRenewal, permission.BudgetRenewal)
+
+	err = albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 21_000, constants.BUDGET_RENEWAL_WEEKLY)
+	assert.NoError(t, err)
+
+	// different scopes, so the account is linked again with a new app
+	svc.LNClient.(*tests.MockLn).SupportedNotificationTypes = &[]string{}
+	err = albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 1_000_000, BudgetRenewalKeepExisting)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&mock.created))
+	permission = payInvoicePermission()
+	assert.Equal(t, 21_000, permission.MaxAmountSat)
+	assert.Equal(t, constants.BUDGET_RENEWAL_WEEKLY, permission.BudgetRenewal)
+
+	// an explicit budget overrides the existing one
+	err = albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 50_000, constants.BUDGET_RENEWAL_DAILY)
+	assert.NoError(t, err)
+	permission = payInvoicePermission()
+	assert.Equal(t, 50_000, permission.MaxAmountSat)
+	assert.Equal(t, constants.BUDGET_RENEWAL_DAILY, permission.BudgetRenewal)
+
+	var count int64
+	svc.DB.Model(&db.App{}).Where("name = ?", ALBY_ACCOUNT_APP_NAME).Count(&count)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestRotateNWCConnection(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, mock := newMockNWCServer(t)
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	err := albyOAuthSvc.RotateNWCConnection(context.Background(), svc.LNClient)
+	assert.ErrorIs(t, err, ErrAccountNotLinked)
+
+	err = albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 21_000, constants.BUDGET_RENEWAL_WEEKLY)
+	assert.NoError(t, err)
+	oldApp := db.App{}
+	assert.NoError(t, svc.DB.Where("name = ?", ALBY_ACCOUNT_APP_NAME).First(&oldApp).Error)
+
+	mock.pubkey = "c3f5d0e9b2a15b7d4f6e8a0c1b3d5f7a9b1c3d5e7f9a1b2c4d6e8f0a1b2c3d4e"
+	mock.onActivate = func() {
+		// the old app is kept until the new node is active
+		var count int64
+		svc.DB.Model(&db.App{}).Where("name = ?", ALBY_ACCOUNT_APP_NAME).Count(&count)
+		assert.Equal(t, int64(2), count)
+		assert.NoError(t, svc.DB.First(&db.App{}, oldApp.ID).Error)
+	}
+	err = albyOAuthSvc.RotateNWCConnection(context.Background(), svc.LNClient)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&mock.activated))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&mock.destroyed))
+
+	var apps []db.App
+	svc.DB.Where("name = ?", ALBY_ACCOUNT_APP_NAME).Find(&apps)
+	assert.Len(t, apps, 1)
+	assert.Equal(t, mock.pubkey, apps[0].NostrPubkey)
+	assert.NotEqual(t, oldApp.ID, apps[0].ID)
+
+	// the budget of the old app is kept
+	permission := db.AppPermission{}
+	assert.NoError(t, svc.DB.Where("app_id = ? AND scope = ?", apps[0].ID, constants.PAY_INVOICE_SCOPE).First(&permission).Error)
+	assert.Equal(t, 21_000, permission.MaxAmountSat)
+	assert.Equal(t, constants.BUDGET_RENEWAL_WEEKLY, permission.BudgetRenewal)
+}
+
+func TestRotateNWCConnection_ActivationFails(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, mock := newMockNWCServer(t)
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	err := albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 21_000, constants.BUDGET_RENEWAL_WEEKLY)
+	assert.NoError(t, err)
+	oldApp := db.App{}
+	assert.NoError(t, svc.DB.Where("name = ?", ALBY_ACCOUNT_APP_NAME).First(&oldApp).Error)
+
+	mock.pubkey = "c3f5d0e9b2a15b7d4f6e8a0c1b3d5f7a9b1c3d5e7f9a1b2c4d6e8f0a1b2c3d4e"
+	mock.activateFails = true
+	err = albyOAuthSvc.RotateNWCConnection(context.Background(), svc.LNClient)
+	assert.Error(t, err)
+
+	// the current connection is kept
+	var apps []db.App
+	svc.DB.Where("name = ?", ALBY_ACCOUNT_APP_NAME).Find(&apps)
+	assert.Len(t, apps, 1)
+	assert.Equal(t, oldApp.ID, apps[0].ID)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&mock.destroyed))
+}
+
+func TestGetBalance_Unit(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var balanceResponse string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(balanceResponse))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	balanceResponse = `{"balance": 21000, "currency": "BTC", "unit": "sat"}`
+	balance, err := albyOAuthSvc.GetBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), balance.Balance)
+
+	balanceResponse = `{"balance": 21000000, "currency": "BTC", "unit": "msat"}`
+	balance, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), balance.Balance)
+	assert.Equal(t, "sat", balance.Unit)
+
+	balanceResponse = `{"balance": 21, "currency": "USD", "unit": "cents"}`
+	balance, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.ErrorIs(t, err, ErrUnexpectedBalanceUnit)
+	assert.Nil(t, balance)
+}
+
+func TestAlbyBalance_Units(t *testing.T) {
+	for _, sats := range []int64{0, 1, 21000, 2_100_000_000_000_000} {
+		balance := AlbyBalance{Balance: sats, Unit: "sat", Currency: "BTC"}
+		assert.Equal(t, sats, balance.BalanceSat())
+		assert.Equal(t, sats*1000, balance.BalanceMsat())
+	}
+
+	// msat balances are rounded down to whole sats
+	balance := AlbyBalance{Balance: 21999, Unit: "msat", Currency: "BTC"}
+	assert.NoError(t, normalizeBalanceUnit(&balance))
+	assert.Equal(t, int64(21), balance.BalanceSat())
+	assert.Equal(t, int64(21000), balance.BalanceMsat())
+}
+
+func TestGetEventSampleRate(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+	albyOAuthSvc.cfg.GetEnv().EventsSampleRates = "nwc_payment_received:0.1, nwc_payment_failed:0, nwc_payment_sent:2"
+
+	assert.Equal(t, 0.1, albyOAuthSvc.getEventSampleRate("nwc_payment_received"))
+	assert.Equal(t, float64(1), albyOAuthSvc.getEventSampleRate("nwc_node_started"))
+	// critical events are always sent
+	assert.Equal(t, float64(1), albyOAuthSvc.getEventSampleRate("nwc_payment_failed"))
+	// invalid rates are ignored
+	assert.Equal(t, float64(1), albyOAuthSvc.getEventSampleRate("nwc_payment_sent"))
+}
+
+func TestSendPayments_PartialSuccess(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/lndhub/bolt11", r.URL.Path)
+		var payRequest AlbyPayRequest
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payRequest))
+		if payRequest.Invoice == mockInvoicesWithPreimage[1].invoice {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": true, "code": 10, "message": "no route"}`))
+			return
+		}
+		if payRequest.Invoice == mockInvoicesWithPreimage[2].invoice {
+			paymentHash := mockInvoicesWithPreimage[2].paymentHash
+			w.Write([]byte(`{"payment_preimage": "` + mockInvoicesWithPreimage[2].preimage + `", "payment_hash": "` + paymentHash + `", "payment_route": {"total_fees": 3}}`))
+			return
+		}
+		w.Write(payResponse(t, payRequest.Invoice))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	results := albyOAuthSvc.SendPayments(context.Background(), []string{
+		mockInvoicesWithPreimage[0].invoice,
+		mockInvoicesWithPreimage[1].invoice,
+		mockInvoicesWithPreimage[2].invoice,
+	})
+	assert.Len(t, results, 3)
+
+	assert.Equal(t, mockInvoicesWithPreimage[0].invoice, results[0].Invoice)
+	assert.Equal(t, mockInvoicesWithPreimage[0].preimage, results[0].Preimage)
+	assert.NoError(t, results[0].Err)
+
+	assert.Equal(t, mockInvoicesWithPreimage[1].invoice, results[1].Invoice)
+	assert.Empty(t, results[1].Preimage)
+	assert.EqualError(t, results[1].Err, "no route")
+	assert.Equal(t, "no route", results[1].Error)
+
+	assert.Equal(t, mockInvoicesWithPreimage[2].preimage, results[2].Preimage)
+	assert.Equal(t, int64(3), results[2].FeeSat)
+
+	assert.Equal(t, []string{mockInvoicesWithPreimage[1].invoice}, FailedInvoices(results))
+}
+
+func TestGetLSPInfo_PreferredTransport(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	onionHost := strings.Repeat("a", 56) + ".onion"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"uris": []string{
+				"02abc@" + onionHost + ":9735",
+				"02abc@[2001:db8::1]:9735",
+				"02abc@203.0.113.1:9735",
+			},
+		})
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	proxyAddr, _ := startTestSocksProxy(t)
+	albyOAuthSvc.cfg.GetEnv().SocksProxyAddr = proxyAddr
+
+	pubkey, addresses, err := albyOAuthSvc.getLSPInfo(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "02abc", pubkey)
+	assert.Equal(t, []lspAddress{
+		{Transport: lspTransportClearnet, Address: "[2001:db8::1]", Port: 9735},
+		{Transport: lspTransportClearnet, Address: "203.0.113.1", Port: 9735},
+		{Transport: lspTransportTor, Address: onionHost, Port: 9735},
+	}, addresses)
+
+	albyOAuthSvc.cfg.GetEnv().LSPTransport = lspTransportTor
+	_, addresses, err = albyOAuthSvc.getLSPInfo(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, lspTransportTor, addresses[0].Transport)
+	assert.Equal(t, lspTransportClearnet, addresses[1].Transport)
+}
+
+func TestGetLSPInfo(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	pubkey := "0364913d18a19c671bb36dd04d6ad5be0fe8f2894314c36a9db3f03c2d414907e1"
+	onionHost := "llvm4yzsrg3jmj2uzayuavzjs6spy3zn7gh3bo3nfajmldgukj6cn4id.onion"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// LSPS1 get_info response, as returned by the Alby LSP
+		w.Write([]byte(`{
+			"uris": [
+				"` + pubkey + `@52.88.33.119:9735",
+				"` + pubkey + `@[2600:1f14:1b85:a800::10]:9735",
+				"` + pubkey + `@` + onionHost + `:9735"
+			],
+			"options": {
+				"min_required_channel_confirmations": 0,
+				"min_funding_confirms_within_blocks": 6,
+				"min_onchain_payment_confirmations": null,
+				"supports_zero_channel_reserve": false,
+				"min_onchain_payment_size_sat": null,
+				"max_channel_expiry_blocks": 20160,
+				"min_initial_client_balance_sat": "0",
+				"max_initial_client_balance_sat": "0",
+				"min_initial_lsp_balance_sat": "150000",
+				"max_initial_lsp_balance_sat": "10000000",
+				"min_channel_balance_sat": "150000",
+				"max_channel_balance_sat": 10000000
+			}
+		}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	lspInfo, err := albyOAuthSvc.GetLSPInfo(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, &LSPInfo{
+		Pubkey: pubkey,
+		ClearnetURIs: []string{
+			pubkey + "@52.88.33.119:9735",
+			pubkey + "@[2600:1f14:1b85:a800::10]:9735",
+		},
+		OnionURIs:         []string{pubkey + "@" + onionHost + ":9735"},
+		MinChannelSizeSat: 150_000,
+		MaxChannelSizeSat: 10_000_000,
+	}, lspInfo)
+
+	// without a SOCKS proxy only the clearnet addresses are used to connect
+	lspPubkey, addresses, err := albyOAuthSvc.getLSPInfo(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, pubkey, lspPubkey)
+	assert.Equal(t, []lspAddress{
+		{Transport: lspTransportClearnet, Address: "52.88.33.119", Port: 9735},
+		{Transport: lspTransportClearnet, Address: "[2600:1f14:1b85:a800::10]", Port: 9735},
+	}, addresses)
+}
+
+func TestParseLSPUri(t *testing.T) {
+	onionHost := strings.Repeat("a", 56) + ".onion"
+
+	testCases := []struct {
+		name    string
+		uri     string
+		pubkey  string
+		address *lspAddress
+	}{
+		{
+			name:    "IPv4",
+			uri:     "02abc@203.0.113.1:9735",
+			pubkey:  "02abc",
+			address: &lspAddress{Transport: lspTransportClearnet, Address: "203.0.113.1", Port: 9735},
+		},
+		{
+			name:    "IPv6",
+			uri:     "02abc@[2001:db8::1]:9735",
+			pubkey:  "02abc",
+			address: &lspAddress{Transport: lspTransportClearnet, Address: "[2001:db8::1]", Port: 9735},
+		},
+		{
+			name:    "hostname",
+			uri:     "02abc@lsp.example.com:9736",
+			pubkey:  "02abc",
+			address: &lspAddress{Transport: lspTransportClearnet, Address: "lsp.example.com", Port: 9736},
+		},
+		{
+			name:    "onion v3",
+			uri:     "02abc@" + onionHost + ":9735",
+			pubkey:  "02abc",
+			address: &lspAddress{Transport: lspTransportTor, Address: onionHost, Port: 9735},
+		},
+		{name: "onion v2", uri: "02abc@" + strings.Repeat("a", 16) + ".onion:9735"},
+		{name: "unbracketed IPv6", uri: "02abc@2001:db8::1:9735"},
+		{name: "bracketed IPv4", uri: "02abc@[203.0.113.1]:9735"},
+		{name: "missing pubkey", uri: "203.0.113.1:9735"},
+		{name: "invalid pubkey", uri: "xyz@203.0.113.1:9735"},
+		{name: "missing port", uri: "02abc@203.0.113.1"},
+		{name: "invalid port", uri: "02abc@203.0.113.1:99999"},
+		{name: "zero port", uri: "02abc@203.0.113.1:0"},
+		{name: "invalid hostname", uri: "02abc@lsp_example.com:9735"},
+		{name: "empty host", uri: "02abc@:9735"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pubkey, address, err := parseLSPUri(tc.uri)
+			if tc.address == nil {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.pubkey, pubkey)
+			assert.Equal(t, tc.address, address)
+		})
+	}
+}
+
+// startTestSocksProxy starts a minimal SOCKS5 proxy supporting unauthenticated CONNECT,
+// and returns its address and the number of connections it proxied
+func startTestSocksProxy(t *testing.T) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	var connections int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&connections, 1)
+			go func() {
+				defer conn.Close()
+				// greeting: version, number of methods, methods
+				header := make([]byte, 2)
+				if _, err := io.ReadFull(conn, header); err != nil {
+					return
+				}
+				if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+					return
+				}
+				conn.Write([]byte{0x05, 0x00})
+
+				// request: version, command, reserved, address type
+				request := make([]byte, 4)
+				if _, err := io.ReadFull(conn, request); err != nil {
+					return
+				}
+				var host string
+				switch request[3] {
+				case 0x01:
+					ip := make([]byte, 4)
+					io.ReadFull(conn, ip)
+					host = net.IP(ip).String()
+				case 0x03:
+					length := make([]byte, 1)
+					io.ReadFull(conn, length)
+					domain := make([]byte, length[0])
+					io.ReadFull(conn, domain)
+					host = string(domain)
+				default:
+					return
+				}
+				port := make([]byte, 2)
+				if _, err := io.ReadFull(conn, port); err != nil {
+					return
+				}
+
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+				if err != nil {
+					conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+
+				go io.Copy(target, conn)
+				io.Copy(conn, target)
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), &connections
+}
+
+func TestGetLSPInfo_OnionRequiresProxy(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	onionHost := strings.Repeat("a", 56) + ".onion"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"uris": []string{"02abc@" + onionHost + ":9735"},
+		})
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	_, _, err := albyOAuthSvc.getLSPInfo(context.Background(), server.URL)
+	assert.EqualError(t, err, "could not decode LSP URI")
+
+	proxyAddr, proxyConnections := startTestSocksProxy(t)
+	albyOAuthSvc.cfg.GetEnv().SocksProxyAddr = proxyAddr
+
+	pubkey, addresses, err := albyOAuthSvc.getLSPInfo(context.Background(), server.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "02abc", pubkey)
+	assert.Equal(t, []lspAddress{
+		{Transport: lspTransportTor, Address: onionHost, Port: 9735},
+	}, addresses)
+	assert.Equal(t, int32(1), atomic.LoadInt32(proxyConnections))
+}
+
+// mockLnFlakyPeer fails to connect to peers the first failures times
+type mockLnFlakyPeer struct {
+	lnclient.LNClient
+	failures  int
+	connects  int
+	connected []string
+}
+
+func (mln *mockLnFlakyPeer) ConnectPeer(ctx context.Context, connectPeerRequest *lnclient.ConnectPeerRequest) error {
+	mln.connects++
+	if mln.connects <= mln.failures {
+		return errors.New("connection refused")
+	}
+	mln.connected = append(mln.connected, connectPeerRequest.Pubkey)
+	return nil
+}
+
+func (mln *mockLnFlakyPeer) ListPeers(ctx context.Context) ([]lnclient.PeerDetails, error) {
+	peers := []lnclient.PeerDetails{}
+	for _, pubkey := range mln.connected {
+		peers = append(peers, lnclient.PeerDetails{NodeId: pubkey, IsConnected: true})
+	}
+	return peers, nil
+}
+
+func TestConnectLSP_Retry(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	defaultRetryDelay := connectLSPRetryDelay
+	t.Cleanup(func() { connectLSPRetryDelay = defaultRetryDelay })
+	connectLSPRetryDelay = 0
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+	addresses := []lspAddress{{Transport: lspTransportClearnet, Address: "203.0.113.1", Port: 9735}}
+
+	lnClient := &mockLnFlakyPeer{failures: 1}
+	transport, err := albyOAuthSvc.connectLSP(context.Background(), lnClient, "lsppubkey", addresses)
+	assert.NoError(t, err)
+	assert.Equal(t, lspTransportClearnet, transport)
+	assert.Equal(t, 2, lnClient.connects)
+
+	lnClient = &mockLnFlakyPeer{failures: connectLSPAttempts}
+	_, err = albyOAuthSvc.connectLSP(context.Background(), lnClient, "lsppubkey", addresses)
+	assert.Error(t, err)
+	assert.Equal(t, connectLSPAttempts, lnClient.connects)
+
+	// a connection to another peer does not count
+	lnClient = &mockLnFlakyPeer{connected: []string{"otherpubkey"}}
+	_, err = albyOAuthSvc.connectLSP(context.Background(), &mockLnOtherPeer{lnClient}, "lsppubkey", addresses)
+	assert.ErrorIs(t, err, ErrPeerNotConnected)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	lnClient = &mockLnFlakyPeer{}
+	_, err = albyOAuthSvc.connectLSP(ctx, lnClient, "lsppubkey", addresses)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 0, lnClient.connects)
+}
+
+// mockLnOtherPeer connects without the peer showing up in the peer list
+type mockLnOtherPeer struct {
+	*mockLnFlakyPeer
+}
+
+func (mln *mockLnOtherPeer) ConnectPeer(ctx context.Context, connectPeerRequest *lnclient.ConnectPeerRequest) error {
+	mln.connects++
+	return nil
+}
+
+func TestSendPayment_BalanceCheck(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	balanceResponse := `{"balance": 100, "currency": "BTC", "unit": "sat"}`
+	paymentRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/lndhub/balance":
+			w.Write([]byte(balanceResponse))
+		case "/internal/lndhub/bolt11":
+			paymentRequests++
+			w.Write(payResponse(t, mockInvoicesWithPreimage[0].invoice))
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyPayBalanceCheck = true
+
+	// the 123 sat invoice plus the fee estimate exceeds the balance
+	_, err := albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.ErrorIs(t, err, ErrInsufficientBalance)
+	assert.Equal(t, 0, paymentRequests)
+
+	balanceResponse = `{"balance": 1000, "currency": "BTC", "unit": "sat"}`
+	_, err = albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, paymentRequests)
+}
+
+func TestSendPayment_NetworkMismatch(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	paymentRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paymentRequests++
+		w.Write(payResponse(t, mockInvoicesWithPreimage[0].invoice))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	// a testnet invoice on a mainnet hub
+	albyOAuthSvc.setNodeNetwork("bitcoin")
+	_, err := albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.ErrorIs(t, err, ErrNetworkMismatch)
+
+	results := albyOAuthSvc.SendPayments(context.Background(), []string{mockInvoicesWithPreimage[0].invoice})
+	assert.ErrorIs(t, results[0].Err, ErrNetworkMismatch)
+	assert.Equal(t, 0, paymentRequests)
+
+	albyOAuthSvc.setNodeNetwork("testnet")
+	_, err = albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, paymentRequests)
+}
+
+func TestValidateInvoiceNetwork(t *testing.T) {
+	paymentRequest, err := decodepay.Decodepay(tests.MockInvoice)
+	assert.NoError(t, err)
+
+	assert.NoError(t, validateInvoiceNetwork(&paymentRequest, "testnet"))
+	assert.NoError(t, validateInvoiceNetwork(&paymentRequest, "unknown"))
+	assert.ErrorIs(t, validateInvoiceNetwork(&paymentRequest, "signet"), ErrNetworkMismatch)
+	assert.ErrorIs(t, validateInvoiceNetwork(&paymentRequest, "bitcoin"), ErrNetworkMismatch)
+	assert.ErrorIs(t, validateInvoiceNetwork(&paymentRequest, "regtest"), ErrNetworkMismatch)
+
+	// decodepay reports the HRP of the invoice as currency, lntbs for signet
+	signetPaymentRequest := decodepay.Bolt11{Currency: "tbs"}
+	assert.NoError(t, validateInvoiceNetwork(&signetPaymentRequest, "signet"))
+	assert.ErrorIs(t, validateInvoiceNetwork(&signetPaymentRequest, "testnet"), ErrNetworkMismatch)
+}
+
+func TestParseAutoChannelResponse_OrderFlow(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+
+	autoChannelResponse, err := albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{"order_id": "order-1", "order_state": "CREATED", "lsp_balance_sat": "1000000"}`), "testnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "order-1", autoChannelResponse.OrderId)
+	assert.Equal(t, "CREATED", autoChannelResponse.OrderState)
+	assert.Empty(t, autoChannelResponse.Invoice)
+
+	autoChannelResponse, err = albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{
+		"order_id": "order-1",
+		"order_state": "CREATED",
+		"lsp_balance_sat": "1000000",
+		"payment": {"bolt11": {"invoice": "`+tests.MockInvoice+`", "fee_total_sat": "123"}}
+	}`), "testnet")
+	assert.NoError(t, err)
+	assert.Equal(t, tests.MockInvoice, autoChannelResponse.Invoice)
+	assert.Equal(t, uint64(123), autoChannelResponse.Fee)
+	assert.Equal(t, uint64(1000000), autoChannelResponse.ChannelSize)
+
+	_, err = albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{"order_id": "order-1", "order_state": "FAILED"}`), "testnet")
+	assert.ErrorIs(t, err, ErrAutoChannelOrderFailed)
+}
+
+func TestRequestAutoChannel_ChannelSize(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var requestBody map[string]interface{}
+	lspBalanceSat := "1000000"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestBody = nil
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&requestBody))
+		w.Write([]byte(`{
+			"lsp_balance_sat": "` + lspBalanceSat + `",
+			"payment": {"bolt11": {"invoice": "` + tests.MockInvoice + `", "fee_total_sat": "123"}}
+		}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+
+	// the LSP decides
+	autoChannelResponse, err := albyOAuthSvc.requestAutoChannel(context.Background(), server.URL, "123pubkey", false, 0, "testnet")
+	assert.NoError(t, err)
+	assert.NotContains(t, requestBody, "lsp_balance_sat")
+	assert.Equal(t, uint64(1000000), autoChannelResponse.ChannelSize)
+
+	autoChannelResponse, err = albyOAuthSvc.requestAutoChannel(context.Background(), server.URL, "123pubkey", false, 500000, "testnet")
+	assert.NoError(t, err)
+	assert.Equal(t, "500000", requestBody["lsp_balance_sat"])
+	assert.Equal(t, uint64(1000000), autoChannelResponse.ChannelSize)
+
+	lspBalanceSat = "400000"
+	_, err = albyOAuthSvc.requestAutoChannel(context.Background(), server.URL, "123pubkey", false, 500000, "testnet")
+	assert.ErrorIs(t, err, ErrChannelTooSmall)
+	assert.ErrorContains(t, err, "400000 < 500000 sats")
+}
+
+func TestRequestAutoChannel_CachesLSPInfo(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	defaultRetryDelay := connectLSPRetryDelay
+	t.Cleanup(func() { connectLSPRetryDelay = defaultRetryDelay })
+	connectLSPRetryDelay = 0
+	lspPubkey := "0364913d18a19c671bb36dd04d6ad5be0fe8f2894314c36a9db3f03c2d414907e1"
+	var getInfoRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/lsp/alby/testnet/v1/get_info":
+			atomic.AddInt32(&getInfoRequests, 1)
+			w.Write([]byte(`{"uris": ["` + lspPubkey + `@52.88.33.119:9735"]}`))
+		case "/internal/lsp/alby/testnet/auto_channel":
+			w.Write([]byte(`{
+				"lsp_balance_sat": "1000000",
+				"payment": {"bolt11": {"invoice": "` + tests.MockInvoice + `", "fee_total_sat": "123"}}
+			}`))
+		default:
+			t.Errorf("unexpected request: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	lnClient := &mockLnFlakyPeer{LNClient: svc.LNClient}
+
+	_, err := albyOAuthSvc.RequestAutoChannel(context.Background(), lnClient, false, "", 0)
+	assert.NoError(t, err)
+	_, err = albyOAuthSvc.RequestAutoChannel(context.Background(), lnClient, false, "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&getInfoRequests))
+
+	// a failed connection invalidates the cached info
+	lnClient = &mockLnFlakyPeer{LNClient: svc.LNClient, failures: connectLSPAttempts}
+	_, err = albyOAuthSvc.RequestAutoChannel(context.Background(), lnClient, false, "", 0)
+	assert.Error(t, err)
+	lnClient = &mockLnFlakyPeer{LNClient: svc.LNClient}
+	_, err = albyOAuthSvc.RequestAutoChannel(context.Background(), lnClient, false, "", 0)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&getInfoRequests))
+}
+
+func TestParseAutoChannelResponse_FeeMismatch(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+
+	_, err := albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{
+		"lsp_balance_sat": "1000000",
+		"payment": {"bolt11": {"invoice": "`+tests.MockInvoice+`", "fee_total_sat": "100"}}
+	}`), "testnet")
+	assert.ErrorIs(t, err, ErrLSPFeeMismatch)
+	assert.ErrorContains(t, err, "invoice amount 123000 msat, quoted fee 100000 msat")
+}
+
+func TestParseAutoChannelResponse_SubSatInvoiceAmount(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+
+	// 123.5 sats
+	invoice := "lntb1235n1pj48ugqpp5qyqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqdq8w3jhxaqxq8zals8sqt5u6hdrf9tdlygrg47ckt4lftnzvyrg4waj7qq6mauvc9jeyjgps8vzhxwrjcam3yhwxkk2lc563guy7e9q32v8tyut6mstmmlqup3cqsle3hs"
+
+	_, err := albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{
+		"lsp_balance_sat": "1000000",
+		"payment": {"bolt11": {"invoice": "`+invoice+`", "fee_total_sat": "123"}}
+	}`), "testnet")
+	assert.ErrorIs(t, err, ErrLSPFeeMismatch)
+	assert.ErrorContains(t, err, "invoice amount 123500 msat, quoted fee 123000 msat")
+
+	_, err = albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{
+		"lsp_balance_sat": "1000000",
+		"payment": {"bolt11": {"invoice": "`+invoice+`", "fee_total_sat": "124"}}
+	}`), "testnet")
+	assert.ErrorIs(t, err, ErrLSPFeeMismatch)
+	assert.ErrorContains(t, err, "invoice amount 123500 msat, quoted fee 124000 msat")
+}
+
+func TestParseAutoChannelResponse_Onchain(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+
+	autoChannelResponse, err := albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{
+		"order_id": "order-1",
+		"order_state": "CREATED",
+		"lsp_balance_sat": "1000000",
+		"payment": {
+			"bolt11": {"invoice": "`+tests.MockInvoice+`", "fee_total_sat": "123"},
+			"onchain": {
+				"state": "EXPECT_PAYMENT",
+				"fee_total_sat": "5000",
+				"order_total_sat": "5000",
+				"network_fee_sat": "1500",
+				"address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+				"min_onchain_payment_confirmations": 1
+			}
+		}
+	}`), "testnet")
+	assert.NoError(t, err)
+	assert.Equal(t, tests.MockInvoice, autoChannelResponse.Invoice)
+	assert.Equal(t, &AutoChannelOnchainPayment{
+		Address:          "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",
+		FeeTotalSat:      5000,
+		OrderTotalSat:    5000,
+		NetworkFeeSat:    1500,
+		MinConfirmations: 1,
+	}, autoChannelResponse.OnchainPayment)
+
+	assert.NoError(t, selectAutoChannelPayment(autoChannelResponse, AutoChannelPaymentOnchain))
+	assert.Empty(t, autoChannelResponse.Invoice)
+	assert.Nil(t, autoChannelResponse.InvoiceDetails)
+	// the fee includes the LSP service fee, the network fee is only part of it
+	assert.Equal(t, uint64(5000), autoChannelResponse.Fee)
+
+	// onchain only
+	autoChannelResponse, err = albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{
+		"order_id": "order-1",
+		"lsp_balance_sat": "1000000",
+		"payment": {
+			"bolt11": {"invoice": "", "fee_total_sat": "123"},
+			"onchain": {"fee_total_sat": "5000", "address": "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", "min_onchain_payment_confirmations": null}
+		}
+	}`), "testnet")
+	assert.NoError(t, err)
+	assert.Empty(t, autoChannelResponse.Invoice)
+	assert.Equal(t, uint32(0), autoChannelResponse.OnchainPayment.MinConfirmations)
+	// not all LSPs return the network fee
+	assert.Zero(t, autoChannelResponse.OnchainPayment.NetworkFeeSat)
+	assert.NoError(t, selectAutoChannelPayment(autoChannelResponse, AutoChannelPaymentOnchain))
+	assert.Equal(t, uint64(5000), autoChannelResponse.Fee)
+	assert.ErrorIs(t, selectAutoChannelPayment(autoChannelResponse, AutoChannelPaymentLightning), ErrPaymentMethodMissing)
+
+	// mainnet address on testnet
+	_, err = albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{
+		"lsp_balance_sat": "1000000",
+		"payment": {"onchain": {"fee_total_sat": "5000", "address": "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"}}
+	}`), "testnet")
+	assert.ErrorIs(t, err, ErrInvalidOnchainAddress)
+
+	_, err = albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", []byte(`{
+		"lsp_balance_sat": "1000000",
+		"payment": {"onchain": {"fee_total_sat": "5000", "address": "not-an-address"}}
+	}`), "testnet")
+	assert.ErrorIs(t, err, ErrInvalidOnchainAddress)
+}
+
+func TestSelectAutoChannelPayment_Lightning(t *testing.T) {
+	autoChannelResponse := &AutoChannelResponse{
+		Invoice:        tests.MockInvoice,
+		Fee:            123,
+		OnchainPayment: &AutoChannelOnchainPayment{Address: "tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx", FeeTotalSat: 5000},
+	}
+	assert.NoError(t, selectAutoChannelPayment(autoChannelResponse, AutoChannelPaymentLightning))
+	assert.Equal(t, tests.MockInvoice, autoChannelResponse.Invoice)
+	assert.Equal(t, uint64(123), autoChannelResponse.Fee)
+	assert.Nil(t, autoChannelResponse.OnchainPayment)
+
+	assert.ErrorIs(t, selectAutoChannelPayment(&AutoChannelResponse{Invoice: tests.MockInvoice}, AutoChannelPaymentOnchain), ErrPaymentMethodMissing)
+	// orders without payment details yet are polled later
+	assert.NoError(t, selectAutoChannelPayment(&AutoChannelResponse{OrderId: "order-1"}, AutoChannelPaymentOnchain))
+}
+
+func TestParseAutoChannelResponse_MaxChannelSize(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+	albyOAuthSvc.cfg.GetEnv().AlbyMaxChannelSizeSat = 500_000
+
+	body := []byte(`{
+		"lsp_balance_sat": "1000000",
+		"payment": {"bolt11": {"invoice": "` + tests.MockInvoice + `", "fee_total_sat": "123"}}
+	}`)
+
+	autoChannelResponse, err := albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", body, "testnet")
+	assert.ErrorIs(t, err, ErrChannelTooLarge)
+	assert.Nil(t, autoChannelResponse)
+
+	albyOAuthSvc.cfg.GetEnv().AlbyMaxChannelSizeSat = 1_000_000
+	autoChannelResponse, err = albyOAuthSvc.parseAutoChannelResponse(context.Background(), "", body, "testnet")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1_000_000), autoChannelResponse.ChannelSize)
+}
+
+func TestDrainSharedWallet_FeeAdjustment(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	paymentRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/lndhub/balance":
+			w.Write([]byte(`{"balance": 10000, "currency": "BTC", "unit": "sat"}`))
+		case "/internal/lndhub/bolt11":
+			paymentRequests++
+			if paymentRequests == 1 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error": true, "code": 10, "message": "FAILURE_REASON_NO_ROUTE"}`))
+				return
+			}
+			w.Write(payResponse(t, mockInvoicesWithPreimage[0].invoice))
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyDrainMaxFeePct = 3
+
+	result, err := albyOAuthSvc.DrainSharedWallet(context.Background(), &mockLnWithPreimage{svc.LNClient}, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, paymentRequests)
+	// retried with a 2% routing fee reserve
+	assert.Equal(t, int64(9710), result.AttemptedSat)
+	assert.Equal(t, int64(9710), result.DrainedSat)
+	assert.Equal(t, 1, result.PartsCompleted)
+	assert.Equal(t, []string{mockInvoicesWithPreimage[0].preimage}, result.Preimages)
+}
+
+func TestDrainSharedWallet_Memo(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/lndhub/balance":
+			w.Write([]byte(`{"balance": 10000, "currency": "BTC", "unit": "sat"}`))
+		case "/internal/lndhub/bolt11":
+			w.Write(payResponse(t, mockInvoicesWithPreimage[0].invoice))
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	_, err := albyOAuthSvc.DrainSharedWallet(context.Background(), &mockLnWithPreimage{svc.LNClient}, nil, &DrainMemo{
+		Description: "Monthly sweep",
+		Metadata:    map[string]interface{}{"reference": "2024-03"},
+	})
+	assert.NoError(t, err)
+
+	var transaction db.Transaction
+	assert.NoError(t, svc.DB.Last(&transaction).Error)
+	assert.Equal(t, "Monthly sweep", transaction.Description)
+	assert.JSONEq(t, `{"reference": "2024-03"}`, string(transaction.Metadata))
+
+	_, err = albyOAuthSvc.DrainSharedWallet(context.Background(), &mockLnWithPreimage{svc.LNClient}, nil, nil)
+	assert.NoError(t, err)
+	transaction = db.Transaction{}
+	assert.NoError(t, svc.DB.Last(&transaction).Error)
+	assert.Equal(t, "Send shared wallet funds to Alby Hub", transaction.Description)
+	assert.Empty(t, transaction.Metadata)
+}
+
+func TestIsFeeRelatedPaymentError(t *testing.T) {
+	assert.True(t, isFeeRelatedPaymentError(newSendPaymentError(10, "FAILURE_REASON_NO_ROUTE")))
+	assert.True(t, isFeeRelatedPaymentError(fmt.Errorf("part 1: %w", newSendPaymentError(10, "fee limit exceeded"))))
+	assert.True(t, isFeeRelatedPaymentError(newSendPaymentError(2, "not enough balance")))
+	assert.False(t, isFeeRelatedPaymentError(newSendPaymentError(10, "invoice expired")))
+	assert.False(t, isFeeRelatedPaymentError(errors.New("FAILURE_REASON_NO_ROUTE")))
+}
+
+func TestUnlinkAccount_ClearsConfigKeys(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	for _, key := range accountConfigKeys {
+		albyOAuthSvc.cfg.SetUpdate(albyOAuthSvc.accountKey(key), "value", "")
+	}
+	// a valid token, so the NWC node can be destroyed
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	})
+	albyOAuthSvc.cfg.SetUpdate(autoLinkStatusKey, AutoLinkStatusSucceeded, "")
+	albyOAuthSvc.cfg.SetUpdate(albyOAuthSvc.accountKey(backupVersionKey), "5", "")
+	// kept when the legacy keys were migrated to the default account
+	albyOAuthSvc.cfg.SetUpdate(userIdentifierKey, "legacy-user", "")
+
+	err := albyOAuthSvc.UnlinkAccount(context.Background(), true)
+	assert.NoError(t, err)
+
+	assert.Contains(t, albyOAuthSvc.ConfigKeys(), accountConfigKey(accessTokenKey, defaultAccountName))
+	for _, key := range albyOAuthSvc.ConfigKeys() {
+		value, err := albyOAuthSvc.cfg.Get(key, "")
+		assert.NoError(t, err)
+		if key == accountConfigKey(backupVersionKey, defaultAccountName) {
+			// new backups must not reuse the versions of existing ones
+			assert.Equal(t, "5", value)
+			continue
+		}
+		assert.Empty(t, value, key)
+	}
+	legacyUserIdentifier, err := albyOAuthSvc.cfg.Get(userIdentifierKey, "")
+	assert.NoError(t, err)
+	assert.Empty(t, legacyUserIdentifier)
+}
+
+func TestUnlinkAccount_RemoteCleanupFails(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodDelete, r.Method)
+		assert.Equal(t, "/internal/nwcs", r.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	err := albyOAuthSvc.UnlinkAccount(context.Background(), true)
+	assert.ErrorIs(t, err, ErrUnlinkIncomplete)
+	var statusErr *apiStatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusInternalServerError, statusErr.statusCode)
+
+	// the account is unlinked locally, so it can be linked again
+	accessToken, err := albyOAuthSvc.cfg.Get(albyOAuthSvc.accountKey(accessTokenKey), "")
+	assert.NoError(t, err)
+	assert.Empty(t, accessToken)
+}
+
+func TestSwitchActiveAccount(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+
+	accounts, err := albyOAuthSvc.ListLinkedAccounts()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{defaultAccountName}, accounts)
+
+	err = albyOAuthSvc.SwitchActiveAccount("business:1")
+	assert.ErrorIs(t, err, ErrInvalidAccountName)
+
+	err = albyOAuthSvc.SwitchActiveAccount("business")
+	assert.NoError(t, err)
+	assert.Equal(t, "business", albyOAuthSvc.ActiveAccount())
+	assert.False(t, albyOAuthSvc.IsConnected(context.Background()))
+
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "business-access-token",
+		RefreshToken: "business-refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	})
+	accounts, err = albyOAuthSvc.ListLinkedAccounts()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{defaultAccountName, "business"}, accounts)
+
+	token, err := albyOAuthSvc.fetchUserToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "business-access-token", token.AccessToken)
+
+	err = albyOAuthSvc.SwitchActiveAccount(defaultAccountName)
+	assert.NoError(t, err)
+	token, err = albyOAuthSvc.fetchUserToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token", token.AccessToken)
+}
+
+func TestLinkAccount_AppsPerAccount(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, mock := newMockNWCServer(t)
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	accountApps := func() map[string]string {
+		var apps []db.App
+		assert.NoError(t, svc.DB.Where("name = ?", ALBY_ACCOUNT_APP_NAME).Find(&apps).Error)
+		pubkeys := map[string]string{}
+		for _, app := range apps {
+			var metadata map[string]interface{}
+			assert.NoError(t, json.Unmarshal(app.Metadata, &metadata))
+			pubkeys[metadata[albyAccountAppMetadataKey].(string)] = app.NostrPubkey
+		}
+		return pubkeys
+	}
+
+	err := albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 21_000, constants.BUDGET_RENEWAL_WEEKLY)
+	assert.NoError(t, err)
+	defaultPubkey := mock.pubkey
+
+	err = albyOAuthSvc.SwitchActiveAccount("business")
+	assert.NoError(t, err)
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "business-access-token",
+		RefreshToken: "business-refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	})
+	mock.pubkey = "c3f5d0e9b2a15b7d4f6e8a0c1b3d5f7a9b1c3d5e7f9a1b2c4d6e8f0a1b2c3d4e"
+	err = albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 50_000, constants.BUDGET_RENEWAL_DAILY)
+	assert.NoError(t, err)
+
+	// linking one account keeps the app of the other
+	assert.Equal(t, map[string]string{defaultAccountName: defaultPubkey, "business": mock.pubkey}, accountApps())
+
+	err = albyOAuthSvc.UnlinkAccount(context.Background(), true)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{defaultAccountName: defaultPubkey}, accountApps())
+}
+
+func TestLinkAccount_SameBudgetOtherAccount(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server, mock := newMockNWCServer(t)
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	err := albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 21_000, constants.BUDGET_RENEWAL_WEEKLY)
+	assert.NoError(t, err)
+
+	err = albyOAuthSvc.SwitchActiveAccount("business")
+	assert.NoError(t, err)
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "business-access-token",
+		RefreshToken: "business-refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	})
+	mock.pubkey = "c3f5d0e9b2a15b7d4f6e8a0c1b3d5f7a9b1c3d5e7f9a1b2c4d6e8f0a1b2c3d4e"
+
+	// the app of the default account does not link the business account
+	err = albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 21_000, constants.BUDGET_RENEWAL_WEEKLY)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&mock.created))
+
+	// linking the business account again is skipped
+	err = albyOAuthSvc.LinkAccount(context.Background(), svc.LNClient, 21_000, constants.BUDGET_RENEWAL_WEEKLY)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&mock.created))
+
+	var count int64
+	svc.DB.Model(&db.App{}).Where("name = ?", ALBY_ACCOUNT_APP_NAME).Count(&count)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestMigrateLegacyAccountKeys(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+
+	svc.Cfg.SetUpdate(accessTokenKey, "legacy-access-token", "")
+	svc.Cfg.SetUpdate(accessTokenExpiryKey, strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10), "")
+	svc.Cfg.SetUpdate(refreshTokenKey, "legacy-refresh-token", "")
+	svc.Cfg.SetUpdate(userIdentifierKey, "legacy-user", "")
+
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+
+	token, err := albyOAuthSvc.fetchUserToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy-access-token", token.AccessToken)
+
+	userIdentifier, err := albyOAuthSvc.GetUserIdentifier()
+	assert.NoError(t, err)
+	assert.Equal(t, "legacy-user", userIdentifier)
+
+	accounts, err := albyOAuthSvc.ListLinkedAccounts()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{defaultAccountName}, accounts)
+
+	legacyAccessToken, err := svc.Cfg.Get(accessTokenKey, "")
+	assert.NoError(t, err)
+	assert.Empty(t, legacyAccessToken)
+}
+
+func TestFetchUserToken_RetriesTransientRefreshFailures(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/oauth/token", r.URL.Path)
+		tokenRequests++
+		if tokenRequests <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token": "new-access-token", "refresh_token": "new-refresh-token", "token_type": "bearer", "expires_in": 7200}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	svc.Cfg.GetEnv().TokenRefreshRetries = 3
+	svc.Cfg.GetEnv().TokenRefreshBackoffMs = 0
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+
+	token, err := albyOAuthSvc.fetchUserToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, tokenRequests)
+	assert.Equal(t, "new-access-token", token.AccessToken)
+
+	refreshToken, err := svc.Cfg.Get(albyOAuthSvc.accountKey(refreshTokenKey), "")
+	assert.NoError(t, err)
+	assert.Equal(t, "new-refresh-token", refreshToken)
+}
+
+func TestFetchUserToken_DoesNotRetryInvalidGrant(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	svc.Cfg.GetEnv().TokenRefreshRetries = 3
+	svc.Cfg.GetEnv().TokenRefreshBackoffMs = 0
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+
+	token, err := albyOAuthSvc.fetchUserToken(context.Background())
+	assert.Error(t, err)
+	assert.Nil(t, token)
+	assert.Equal(t, 1, tokenRequests)
+}
+
+func TestFetchUserToken_RefreshDisabled(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/oauth/token", r.URL.Path)
+		tokenRequests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(fmt.Sprintf(`{"access_token": "access-token-%d", "refresh_token": "refresh-token", "token_type": "bearer", "expires_in": 7200}`, tokenRequests)))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	svc.Cfg.GetEnv().DisableTokenRefresh = true
+	expiredToken := &oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Hour),
+	}
+	albyOAuthSvc.saveToken(expiredToken)
+
+	token, err := albyOAuthSvc.fetchUserToken(context.Background())
+	assert.ErrorIs(t, err, ErrTokenExpired)
+	assert.Nil(t, token)
+	assert.Equal(t, 0, tokenRequests)
+
+	// refreshing on demand
+	err = albyOAuthSvc.RefreshToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tokenRequests)
+	token, err = albyOAuthSvc.fetchUserToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token-1", token.AccessToken)
+
+	// automatic refresh
+	svc.Cfg.GetEnv().DisableTokenRefresh = false
+	albyOAuthSvc.saveToken(expiredToken)
+	token, err = albyOAuthSvc.fetchUserToken(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "access-token-2", token.AccessToken)
+	assert.Equal(t, 2, tokenRequests)
+}
+
+type recordingEventConsumer struct {
+	events chan *events.Event
+}
+
+func (consumer *recordingEventConsumer) ConsumeEvent(ctx context.Context, event *events.Event, globalProperties map[string]interface{}) {
+	consumer.events <- event
+}
+
+func TestFetchUserToken_PublishesAuthExpired(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	tokenStatus := http.StatusServiceUnavailable
+	tokenError := "invalid_grant"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(tokenStatus)
+		w.Write([]byte(`{"error": "` + tokenError + `"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	svc.Cfg.GetEnv().TokenRefreshRetries = 0
+	svc.Cfg.SetUpdate(albyOAuthSvc.accountKey(userIdentifierKey), "123", "")
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+
+	consumer := &recordingEventConsumer{events: make(chan *events.Event, 10)}
+	svc.EventPublisher.RegisterSubscriber(consumer)
+
+	// transient failures do not mean the link is broken
+	_, err := albyOAuthSvc.fetchUserToken(context.Background())
+	assert.Error(t, err)
+
+	// neither do other errors of the token endpoint
+	tokenStatus = http.StatusUnauthorized
+	tokenError = "invalid_client"
+	_, err = albyOAuthSvc.fetchUserToken(context.Background())
+	assert.Error(t, err)
+
+	tokenStatus = http.StatusBadRequest
+	tokenError = "invalid_grant"
+	for i := 0; i < 3; i++ {
+		_, err = albyOAuthSvc.fetchUserToken(context.Background())
+		assert.Error(t, err)
+	}
+
+	select {
+	case event := <-consumer.events:
+		assert.Equal(t, "alby_auth_expired", event.Event)
+		assert.Equal(t, map[string]interface{}{
+			"account":         defaultAccountName,
+			"user_identifier": "123",
+		}, event.Properties)
+	case <-time.After(time.Second):
+		t.Fatal("alby_auth_expired was not published")
+	}
+
+	select {
+	case event := <-consumer.events:
+		t.Fatalf("unexpected event: %s", event.Event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestGetInvoices(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "3", r.URL.Query().Get("limit"))
+		switch r.URL.Path {
+		case "/internal/lndhub/invoices":
+			w.Write([]byte(`[
+				{"payment_hash": "in1", "amount": 1000, "description": "first", "is_paid": true, "created_at": "2024-01-01T00:00:00Z", "settled_at": "2024-01-01T00:01:00Z"},
+				{"payment_hash": "in2", "amount": 2000, "description": "unpaid", "is_paid": false, "created_at": "2024-01-03T00:00:00Z"}
+			]`))
+		case "/internal/lndhub/payments":
+			w.Write([]byte(`[
+				{"payment_hash": "out1", "amount": 500, "fee": 2, "description": "second", "is_paid": true, "created_at": "2024-01-02T00:00:00Z", "settled_at": "2024-01-02T00:00:05Z"}
+			]`))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	transactions, err := albyOAuthSvc.GetInvoices(context.Background(), AlbyTransactionsParams{Limit: 2, Offset: 1})
+	assert.NoError(t, err)
+	assert.Len(t, transactions, 2)
+
+	assert.Equal(t, "out1", transactions[0].PaymentHash)
+	assert.Equal(t, constants.TRANSACTION_TYPE_OUTGOING, transactions[0].Type)
+	assert.Equal(t, int64(2), transactions[0].FeeSat)
+	assert.NotNil(t, transactions[0].SettledAt)
+
+	assert.Equal(t, "in1", transactions[1].PaymentHash)
+	assert.Equal(t, constants.TRANSACTION_TYPE_INCOMING, transactions[1].Type)
+	assert.Equal(t, "first", transactions[1].Memo)
+}
+
+func TestGetTransactions(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/lndhub/invoices":
+			w.Write([]byte(`[
+				{"payment_hash": "in1", "amount": 1000, "is_paid": true, "created_at": "2024-01-01T00:00:00Z", "settled_at": "2024-01-01T00:01:00Z"},
+				{"payment_hash": "in2", "amount": 2000, "is_paid": false, "created_at": "2024-01-03T00:00:00Z"},
+				{"payment_hash": "in3", "amount": 3000, "is_paid": true, "created_at": "2024-01-03T00:00:00Z", "settled_at": "2024-01-03T00:00:01Z"}
+			]`))
+		case "/internal/lndhub/payments":
+			w.Write([]byte(`[
+				{"payment_hash": "out1", "amount": 500, "fee": 2, "is_paid": true, "created_at": "2024-01-02T00:00:00Z", "settled_at": "2024-01-02T00:00:05Z"}
+			]`))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	for _, transaction := range []db.Transaction{
+		{ID: 1, State: constants.TRANSACTION_STATE_SETTLED, CreatedAt: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC).Local()},
+		// created at the same time as out1
+		{ID: 2, State: constants.TRANSACTION_STATE_SETTLED, CreatedAt: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC).Local()},
+		{ID: 3, State: constants.TRANSACTION_STATE_SETTLED, CreatedAt: time.Date(2024, 1, 4, 0, 0, 0, 0, time.UTC).Local()},
+		{ID: 4, State: constants.TRANSACTION_STATE_PENDING, CreatedAt: time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC).Local()},
+	} {
+		transaction.Type = constants.TRANSACTION_TYPE_INCOMING
+		transaction.AmountMsat = 21000
+		assert.NoError(t, svc.DB.Create(&transaction).Error)
+	}
+
+	ids := func(page *TransactionHistoryPage) []string {
+		result := []string{}
+		for _, transaction := range page.Transactions {
+			result = append(result, transaction.Source+":"+transaction.Id)
+		}
+		return result
+	}
+
+	page, err := albyOAuthSvc.GetTransactions(context.Background(), TransactionHistoryParams{Limit: 10})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hub:3", "alby:in3", "alby:out1", "hub:2", "hub:1", "alby:in1"}, ids(page))
+	assert.Equal(t, int64(21), page.Transactions[0].AmountSat)
+	assert.Empty(t, page.NextCursor)
+	assert.Empty(t, page.PrevCursor)
+
+	page1, err := albyOAuthSvc.GetTransactions(context.Background(), TransactionHistoryParams{Limit: 2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hub:3", "alby:in3"}, ids(page1))
+	assert.Empty(t, page1.PrevCursor)
+
+	page2, err := albyOAuthSvc.GetTransactions(context.Background(), TransactionHistoryParams{Limit: 2, Cursor: page1.NextCursor})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alby:out1", "hub:2"}, ids(page2))
+
+	page3, err := albyOAuthSvc.GetTransactions(context.Background(), TransactionHistoryParams{Limit: 2, Cursor: page2.NextCursor})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"hub:1", "alby:in1"}, ids(page3))
+	assert.Empty(t, page3.NextCursor)
+
+	// and back again
+	page, err = albyOAuthSvc.GetTransactions(context.Background(), TransactionHistoryParams{Limit: 2, Cursor: page3.PrevCursor, Newer: true})
+	assert.NoError(t, err)
+	assert.Equal(t, ids(page2), ids(page))
+	assert.Equal(t, page2.NextCursor, page.NextCursor)
+
+	page, err = albyOAuthSvc.GetTransactions(context.Background(), TransactionHistoryParams{Limit: 2, Cursor: page.PrevCursor, Newer: true})
+	assert.NoError(t, err)
+	assert.Equal(t, ids(page1), ids(page))
+	assert.Empty(t, page.PrevCursor)
+	assert.Equal(t, page1.NextCursor, page.NextCursor)
+
+	_, err = albyOAuthSvc.GetTransactions(context.Background(), TransactionHistoryParams{Cursor: "not-a-cursor"})
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestHistoryCursor_RoundTrip(t *testing.T) {
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	for _, transaction := range []HistoryTransaction{
+		{Source: TransactionSourceHub, Id: "42", CreatedAt: createdAt},
+		{Source: TransactionSourceAlby, Id: "abcd", CreatedAt: createdAt},
+	} {
+		cursor, err := decodeHistoryCursor(newHistoryCursor(&transaction).encode())
+		assert.NoError(t, err)
+		assert.Equal(t, newHistoryCursor(&transaction), *cursor)
+		assert.Equal(t, createdAt.UnixNano(), cursor.CreatedAt)
+	}
+
+	_, err := decodeHistoryCursor(historyCursor{Source: "other", Id: "1"}.encode())
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+	_, err = decodeHistoryCursor(historyCursor{Source: TransactionSourceHub, Id: "abcd"}.encode())
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestPreviewLinkAccount(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, "")
+
+	preview, err := albyOAuthSvc.PreviewLinkAccount(context.Background(), svc.LNClient)
+	assert.NoError(t, err)
+
+	scopes, err := albyAccountScopes(svc.LNClient)
+	assert.NoError(t, err)
+	assert.Equal(t, scopes, preview.Scopes)
+	assert.Equal(t, svc.LNClient.GetSupportedNIP47NotificationTypes(), preview.NotificationTypes)
+	assert.True(t, preview.NotificationsEnabled)
+
+	// the preview must not create the Alby Account app
+	var count int64
+	svc.DB.Model(&db.App{}).Where("name = ?", ALBY_ACCOUNT_APP_NAME).Count(&count)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestConsumeEvent_AllowList(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	sentEvents := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload := map[string]interface{}{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		sentEvents = append(sentEvents, payload["event"].(string))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+
+	// new event types are not forwarded by default
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_new_event"}, nil)
+	// payment events are reduced to less detail before being forwarded
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{
+		Event: "nwc_payment_failed",
+		Properties: &db.Transaction{
+			PaymentHash:   tests.MockPaymentHash,
+			FailureReason: "no route",
+		},
+	}, nil)
+	assert.Equal(t, []string{"nwc_payment_failed"}, sentEvents)
+
+	sentEvents = []string{}
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_payment_failed, nwc_new_event"
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_new_event"}, nil)
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_payment_received"}, nil)
+	assert.Equal(t, []string{"nwc_new_event"}, sentEvents)
+}
+
+func TestGetMe_Cache(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	meRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// unlinking also destroys the Alby Account NWC node
+		if r.URL.Path != "/internal/users" {
+			return
+		}
+		meRequests++
+		w.Write([]byte(`{"identifier": "user", "lightning_address": "user@getalby.com"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyMeCacheSeconds = 60
+
+	me, err := albyOAuthSvc.GetMe(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "user", me.Identifier)
+
+	// modifying the response must not modify the cache
+	me.Identifier = "modified"
+	me, err = albyOAuthSvc.GetMe(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "user", me.Identifier)
+	assert.Equal(t, 1, meRequests)
+
+	_, err = albyOAuthSvc.GetMeFresh(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 2, meRequests)
+
+	err = albyOAuthSvc.UnlinkAccount(context.Background(), true)
+	assert.NoError(t, err)
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	})
+	_, err = albyOAuthSvc.GetMe(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, meRequests)
+
+	// a zero TTL disables the cache
+	albyOAuthSvc.cfg.GetEnv().AlbyMeCacheSeconds = 0
+	_, err = albyOAuthSvc.GetMe(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 4, meRequests)
+}
+
+func TestGetSubscriptionTier(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	meResponse := `{"identifier": "user", "lightning_address": "user@getalby.com", "subscription": {"plan_code": "buzz"}}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(meResponse))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyMeCacheSeconds = 0
+
+	me, err := albyOAuthSvc.GetMe(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "buzz", me.Subscription.PlanCode)
+	tier, err := albyOAuthSvc.GetSubscriptionTier(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, SubscriptionTierBuzz, tier)
+
+	// accounts without a subscription have no subscription field
+	meResponse = `{"identifier": "user", "lightning_address": "user@getalby.com"}`
+	me, err = albyOAuthSvc.GetMe(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, me.Subscription.PlanCode)
+	tier, err = albyOAuthSvc.GetSubscriptionTier(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, SubscriptionTierFree, tier)
+}
+
+func TestGetMe_LightningAddressNotProvisioned(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	defaultRetryDelay := meLightningAddressRetryDelay
+	t.Cleanup(func() { meLightningAddressRetryDelay = defaultRetryDelay })
+	meLightningAddressRetryDelay = 0
+	meResponses := []string{
+		`{"identifier": "user"}`,
+		`{"identifier": "user", "lightning_address": ""}`,
+		`{"identifier": "user", "lightning_address": "user@getalby.com"}`,
+	}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(meResponses[min(requests, len(meResponses)-1)]))
+		requests++
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	// only the login waits for the address
+	me, err := albyOAuthSvc.GetMeFresh(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, me.LightningAddress)
+	assert.Equal(t, 1, requests)
+
+	requests = 0
+	me, err = albyOAuthSvc.getMeAfterLogin(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "user@getalby.com", me.LightningAddress)
+	assert.Equal(t, 3, requests)
+	lightningAddress, err := albyOAuthSvc.GetLightningAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "user@getalby.com", lightningAddress)
+
+	// a known address is kept if the account has none after the retries
+	requests = 0
+	meResponses = []string{`{"identifier": "user"}`}
+	me, err = albyOAuthSvc.getMeAfterLogin(context.Background())
+	assert.NoError(t, err)
+	assert.Empty(t, me.LightningAddress)
+	assert.Equal(t, 1+meLightningAddressRetries, requests)
+	lightningAddress, err = albyOAuthSvc.GetLightningAddress()
+	assert.NoError(t, err)
+	assert.Equal(t, "user@getalby.com", lightningAddress)
+}
+
+func TestSetDefaultRequestHeaders_UserAgent(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var requestUserAgent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestUserAgent = r.Header.Get("User-Agent")
+		w.Write([]byte(`{"balance": 1000, "currency": "BTC", "unit": "sat"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+
+	// the node is not known yet
+	_, err := albyOAuthSvc.GetBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "AlbyHub/"+version.Tag, requestUserAgent)
+
+	svc.Cfg.SetUpdate("LNBackendType", "LDK", "")
+	albyOAuthSvc.loadNodeNetwork(context.Background(), svc.LNClient)
+	_, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "AlbyHub/"+version.Tag+" (LDK; testnet)", requestUserAgent)
+
+	assert.Equal(t, "AlbyHub/"+version.Tag+" (bitcoin)", userAgent("", "bitcoin"))
+}
+
+func TestGetBalance_ContextCancelled(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	requestReceived := make(chan struct{})
+	releaseRequest := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requestReceived)
+		<-releaseRequest
+	}))
+	defer server.Close()
+	defer close(releaseRequest)
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requestReceived
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := albyOAuthSvc.GetBalance(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestSendPayment_VerifiesPreimage(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	response := payResponse(t, mockInvoicesWithPreimage[0].invoice)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(response)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	payment, err := albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.NoError(t, err)
+	assert.Equal(t, mockInvoicesWithPreimage[0].preimage, payment.Preimage)
+	// the response has no payment route
+	assert.Zero(t, payment.FeeSat)
+
+	// tampered preimage
+	response = []byte(`{"payment_preimage": "` + mockInvoicesWithPreimage[1].preimage + `", "payment_hash": "` + mockInvoicesWithPreimage[0].paymentHash + `"}`)
+	payment, err = albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.ErrorIs(t, err, ErrInvalidPreimage)
+	assert.Nil(t, payment)
+
+	// proof of payment for a different invoice
+	response = payResponse(t, mockInvoicesWithPreimage[1].invoice)
+	_, err = albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.ErrorIs(t, err, ErrPaymentHashMismatch)
+}
+
+func TestSendKeysend(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	destination := "03cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c"
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/lndhub/keysend", r.URL.Path)
+
+		var keysendRequest struct {
+			Amount        uint64            `json:"amount"`
+			Destination   string            `json:"destination"`
+			CustomRecords map[string]string `json:"customRecords"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&keysendRequest)
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(21), keysendRequest.Amount)
+		assert.Equal(t, destination, keysendRequest.Destination)
+		assert.Equal(t, map[string]string{"696969": "0123"}, keysendRequest.CustomRecords)
+
+		w.Write([]byte(`{"payment_preimage": "` + mockInvoicesWithPreimage[0].preimage + `", "payment_hash": "` + mockInvoicesWithPreimage[0].paymentHash + `"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	result, err := albyOAuthSvc.SendKeysend(context.Background(), destination, 21_000, map[uint64]string{696969: "0123"})
+	assert.NoError(t, err)
+	assert.Equal(t, mockInvoicesWithPreimage[0].preimage, result.Preimage)
+	assert.Equal(t, mockInvoicesWithPreimage[0].paymentHash, result.PaymentHash)
+}
+
+func TestSendKeysend_InvalidDestination(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	for _, destination := range []string{
+		"",
+		"not-a-pubkey",
+		// 32 bytes
+		"cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c",
+		// invalid prefix
+		"05cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c",
+	} {
+		_, err := albyOAuthSvc.SendKeysend(context.Background(), destination, 21_000, nil)
+		assert.ErrorIs(t, err, ErrInvalidDestination)
+	}
+	assert.Equal(t, 0, requests)
+}
+
+func TestSendKeysend_PaymentFailed(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": true, "code": 10, "message": "FAILURE_REASON_NO_ROUTE"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	_, err := albyOAuthSvc.SendKeysend(context.Background(), "03cbd788f5b22bd56e2714bff756372d2293504c064e03250ed16a4dd80ad70e2c", 21_000, nil)
+	assert.Equal(t, SendPaymentErrorRouteNotFound, sendPaymentErrorClass(err))
+}
+
+func TestGetAccountSummary_Concurrent(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	latency := 200 * time.Millisecond
+	var inFlight, maxInFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(latency)
+
+		switch r.URL.Path {
+		case "/internal/users":
+			w.Write([]byte(`{"identifier": "123", "lightning_address": "hub@getalby.com"}`))
+		case "/internal/lndhub/balance":
+			w.Write([]byte(`{"balance": 1000, "currency": "BTC", "unit": "sat"}`))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	start := time.Now()
+	summary, err := albyOAuthSvc.GetAccountSummary(context.Background())
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 2*latency)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxInFlight))
+
+	assert.Equal(t, "hub@getalby.com", summary.Me.LightningAddress)
+	assert.Equal(t, int64(1000), summary.Balance.Balance)
+	assert.NoError(t, summary.MeErr)
+	assert.NoError(t, summary.BalanceErr)
+}
+
+func TestGetAccountSummary_PartialFailure(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/users":
+			w.Write([]byte(`{"identifier": "123", "lightning_address": "hub@getalby.com"}`))
+		case "/internal/lndhub/balance":
+			w.Write([]byte(`{"balance": 1000, "currency": "USD", "unit": "cents"}`))
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	summary, err := albyOAuthSvc.GetAccountSummary(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "hub@getalby.com", summary.Me.LightningAddress)
+	assert.Nil(t, summary.Balance)
+	assert.ErrorIs(t, summary.BalanceErr, ErrUnexpectedBalanceUnit)
+	assert.NotEmpty(t, summary.BalanceError)
+}
+
+func TestGetNodeAndAccountInfo(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected request: %s", r.URL.Path)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	svc.Cfg.SetUpdate(albyOAuthSvc.accountKey(userIdentifierKey), "123", "")
+	svc.Cfg.SetUpdate(albyOAuthSvc.accountKey(lightningAddressKey), "hub@getalby.com", "")
+
+	info, err := albyOAuthSvc.GetNodeAndAccountInfo(context.Background(), svc.LNClient)
+	assert.NoError(t, err)
+	assert.Equal(t, tests.MockNodeInfo, *info.Node)
+	assert.True(t, info.AlbyConnected)
+	assert.Equal(t, defaultAccountName, info.AlbyAccount)
+	assert.Equal(t, "123", info.UserIdentifier)
+	assert.Equal(t, "hub@getalby.com", info.LightningAddress)
+
+	_, err = albyOAuthSvc.GetNodeAndAccountInfo(context.Background(), nil)
+	assert.Error(t, err)
+}
+
+func TestGetNodeAndAccountInfo_Unlinked(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+
+	info, err := albyOAuthSvc.GetNodeAndAccountInfo(context.Background(), svc.LNClient)
+	assert.NoError(t, err)
+	assert.Equal(t, tests.MockNodeInfo, *info.Node)
+	assert.False(t, info.AlbyConnected)
+	assert.Empty(t, info.AlbyAccount)
+	assert.Empty(t, info.UserIdentifier)
+	assert.Empty(t, info.LightningAddress)
+}
+
+func TestGetBalance_CoalescesConcurrentRequests(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var balanceRequests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&balanceRequests, 1)
+		// keep the request in flight until every caller has joined it
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte(`{"balance": 1000, "currency": "BTC", "unit": "sat"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			balance, err := albyOAuthSvc.GetBalance(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1000), balance.Balance)
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&balanceRequests))
+}
+
+func TestGetLastKnownBalance(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"balance": 1000, "currency": "BTC", "unit": "sat"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	_, _, err := albyOAuthSvc.GetLastKnownBalance()
+	assert.ErrorIs(t, err, ErrNoLastKnownBalance)
+
+	before := time.Now().Truncate(time.Second)
+	_, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.NoError(t, err)
+
+	failing.Store(true)
+	_, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.Error(t, err)
+
+	balance, updatedAt, err := albyOAuthSvc.GetLastKnownBalance()
+	assert.NoError(t, err)
+	assert.Equal(t, &AlbyBalance{Balance: 1000, Currency: "BTC", Unit: "sat"}, balance)
+	assert.False(t, updatedAt.Before(before))
+	assert.False(t, updatedAt.After(time.Now()))
+}
+
+func TestGetAuthUrl_Scopes(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+	svc.Cfg.GetEnv().AlbyClientId = "client-id"
+	svc.Cfg.GetEnv().AlbyClientSecret = "client-secret"
+
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+	authUrl, err := url.Parse(albyOAuthSvc.GetAuthUrl())
+	assert.NoError(t, err)
+	assert.Equal(t, "account:read balance:read payments:send", authUrl.Query().Get("scope"))
+
+	svc.Cfg.GetEnv().AlbyOAuthScopes = "account:read, balance:read invoices:read,transactions:read"
+	albyOAuthSvc = NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+	authUrl, err = url.Parse(albyOAuthSvc.GetAuthUrl())
+	assert.NoError(t, err)
+	assert.Equal(t, "account:read balance:read invoices:read transactions:read", authUrl.Query().Get("scope"))
+}
+
+func TestGetAuthUrlWithState(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+	_, err = albyOAuthSvc.GetAuthUrlWithState("state")
+	assert.ErrorIs(t, err, ErrNoOAuthCredentials)
+	// the process must keep running
+	assert.Empty(t, albyOAuthSvc.GetAuthUrl())
+
+	svc.Cfg.GetEnv().AlbyClientId = "client-id"
+	svc.Cfg.GetEnv().AlbyClientSecret = "client-secret"
+	albyOAuthSvc = NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+
+	_, err = albyOAuthSvc.GetAuthUrlWithState("")
+	assert.ErrorIs(t, err, ErrOAuthStateMissing)
+
+	rawAuthUrl, err := albyOAuthSvc.GetAuthUrlWithState("csrf-state")
+	assert.NoError(t, err)
+	authUrl, err := url.Parse(rawAuthUrl)
+	assert.NoError(t, err)
+	assert.Equal(t, "csrf-state", authUrl.Query().Get("state"))
+	assert.Equal(t, "client-id", authUrl.Query().Get("client_id"))
+}
+
+func TestCallbackHandler_State(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth/token":
+			tokenRequests++
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"access_token": "access-token", "refresh_token": "refresh-token", "expires_in": 3600, "token_type": "bearer"}`))
+		case "/internal/users":
+			w.Write([]byte(`{"identifier": "user-1", "lightning_address": "user@getalby.com"}`))
+		default:
+			t.Errorf("unexpected path: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+	svc.Cfg.GetEnv().AlbyAPIURL = server.URL
+	svc.Cfg.GetEnv().AlbyClientId = "client-id"
+	svc.Cfg.GetEnv().AlbyClientSecret = "client-secret"
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+
+	authUrl, err := url.Parse(albyOAuthSvc.GetAuthUrl())
+	assert.NoError(t, err)
+	state := authUrl.Query().Get("state")
+	assert.Len(t, state, 32)
+	// requesting the auth URL again does not replace the state
+	authUrl, err = url.Parse(albyOAuthSvc.GetAuthUrl())
+	assert.NoError(t, err)
+	assert.Equal(t, state, authUrl.Query().Get("state"))
+
+	err = albyOAuthSvc.CallbackHandler(context.Background(), "code", "other-state", svc.LNClient)
+	assert.ErrorIs(t, err, ErrOAuthStateMismatch)
+	err = albyOAuthSvc.CallbackHandler(context.Background(), "code", "", svc.LNClient)
+	assert.ErrorIs(t, err, ErrOAuthStateMismatch)
+	assert.Equal(t, 0, tokenRequests)
+
+	err = albyOAuthSvc.CallbackHandler(context.Background(), "code", state, svc.LNClient)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, tokenRequests)
+	userIdentifier, err := albyOAuthSvc.GetUserIdentifier()
+	assert.NoError(t, err)
+	assert.Equal(t, "user-1", userIdentifier)
+
+	// states can only be used once
+	err = albyOAuthSvc.CallbackHandler(context.Background(), "code", state, svc.LNClient)
+	assert.ErrorIs(t, err, ErrOAuthStateMismatch)
+
+	oauthStateTTL = 0
+	defer func() { oauthStateTTL = 10 * time.Minute }()
+	authUrl, err = url.Parse(albyOAuthSvc.GetAuthUrl())
+	assert.NoError(t, err)
+	err = albyOAuthSvc.CallbackHandler(context.Background(), "code", authUrl.Query().Get("state"), svc.LNClient)
+	assert.ErrorIs(t, err, ErrOAuthStateExpired)
+	assert.Equal(t, 1, tokenRequests)
+}
+
+func TestHealthCheck_Healthy(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/users", r.URL.Path)
+		assert.Equal(t, "Bearer access-token", r.Header.Get("Authorization"))
+		w.Write([]byte(`{"identifier": "123", "lightning_address": "hub@getalby.com"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	svc.Cfg.SetUpdate(albyOAuthSvc.accountKey(grantedScopesKey), "account:read balance:read payments:send", "")
+
+	health, err := albyOAuthSvc.HealthCheck(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, health.Healthy)
+	assert.True(t, health.TokenPresent)
+	assert.False(t, health.TokenExpired)
+	assert.Greater(t, health.TokenExpiresInSeconds, int64(3500))
+	assert.True(t, health.APIReachable)
+	assert.True(t, health.Authenticated)
+	assert.True(t, health.ScopesSufficient)
+	assert.Empty(t, health.MissingScopes)
+	assert.Empty(t, health.ProbeError)
+
+	// the probe must not update the account like GetMe does
+	lightningAddress, err := albyOAuthSvc.GetLightningAddress()
+	assert.NoError(t, err)
+	assert.Empty(t, lightningAddress)
+}
+
+func TestHealthCheck_TokenMissing(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+	svc.Cfg.GetEnv().AlbyAPIURL = server.URL
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+
+	health, err := albyOAuthSvc.HealthCheck(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, health.Healthy)
+	assert.False(t, health.TokenPresent)
+	assert.False(t, health.APIReachable)
+	assert.Equal(t, []string{"account:read", "balance:read", "payments:send"}, health.MissingScopes)
+	assert.Equal(t, 0, requests)
+}
+
+func TestGetTokenStatus(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+	svc.Cfg.GetEnv().AlbyAPIURL = server.URL
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+
+	status, err := albyOAuthSvc.GetTokenStatus()
+	assert.NoError(t, err)
+	assert.False(t, status.TokenPresent)
+	assert.False(t, status.HasRefreshToken)
+	assert.Nil(t, status.ExpiresAt)
+	assert.Empty(t, status.GrantedScopes)
+
+	// near expiry
+	albyOAuthSvc.saveToken((&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(30 * time.Second),
+	}).WithExtra(map[string]interface{}{"scope": "account:read balance:read"}))
+	status, err = albyOAuthSvc.GetTokenStatus()
+	assert.NoError(t, err)
+	assert.True(t, status.TokenPresent)
+	assert.True(t, status.HasRefreshToken)
+	assert.False(t, status.Expired)
+	assert.InDelta(t, 30, status.ExpiresInSeconds, 2)
+	assert.Equal(t, []string{"account:read", "balance:read"}, status.GrantedScopes)
+
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+	status, err = albyOAuthSvc.GetTokenStatus()
+	assert.NoError(t, err)
+	assert.True(t, status.TokenPresent)
+	assert.False(t, status.HasRefreshToken)
+	assert.True(t, status.Expired)
+	assert.InDelta(t, -3600, status.ExpiresInSeconds, 2)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), *status.ExpiresAt, 2*time.Second)
+
+	// the token is not refreshed
+	assert.Equal(t, 0, requests)
+}
+
+func TestHealthCheck_APIUnreachable(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	albyOAuthSvc, svc := createTestAlbyOAuthService(t, server.URL)
+	svc.Cfg.SetUpdate(albyOAuthSvc.accountKey(grantedScopesKey), "account:read balance:read payments:send", "")
+
+	health, err := albyOAuthSvc.HealthCheck(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, health.Healthy)
+	assert.True(t, health.TokenPresent)
+	assert.False(t, health.APIReachable)
+	assert.False(t, health.Authenticated)
+	assert.NotEmpty(t, health.ProbeError)
+}
+
+// capturingTransport records all requests and answers them without a server
+type capturingTransport struct {
+	requests []*http.Request
+	respond  func(req *http.Request) string
+}
+
+func (transport *capturingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport.requests = append(transport.requests, req)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(transport.respond(req))),
+		Request:    req,
+	}, nil
+}
+
+func TestWithHTTPClient(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	transport := &capturingTransport{
+		respond: func(req *http.Request) string {
+			if req.URL.Path == "/oauth/token" {
+				return `{"access_token": "new-access-token", "refresh_token": "new-refresh-token", "token_type": "bearer", "expires_in": 7200}`
+			}
+			return `{"balance": 1000, "currency": "BTC", "unit": "sat"}`
+		},
+	}
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "https://api.alby.test")
+	WithHTTPClient(&http.Client{Transport: transport})(albyOAuthSvc)
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(-time.Hour),
+	})
+
+	balance, err := albyOAuthSvc.GetBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), balance.Balance)
+
+	// both the token refresh and the API request use the injected transport
+	assert.Len(t, transport.requests, 2)
+	assert.Equal(t, "https://api.alby.test/oauth/token", transport.requests[0].URL.String())
+	assert.Equal(t, "https://api.alby.test/internal/lndhub/balance", transport.requests[1].URL.String())
+	assert.Equal(t, "Bearer new-access-token", transport.requests[1].Header.Get("Authorization"))
+}
@@ -0,0 +1,114 @@
+package alby
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+var ErrInvalidAPIResponse = errors.New("invalid Alby API response")
+
+// apiStatusError is returned for non-success responses of the Alby API. The body is
+// kept so endpoints with their own error payload, e.g. payments, can decode it.
+type apiStatusError struct {
+	path       string
+	statusCode int
+	body       []byte
+}
+
+func (err *apiStatusError) Error() string {
+	return fmt.Sprintf("request to %s returned non-success status: %d", err.path, err.statusCode)
+}
+
+// retryable is false if the API rejected the request itself, as sending it again would fail the same way
+func (err *apiStatusError) retryable() bool {
+	return err.statusCode >= 500 || err.statusCode == http.StatusTooManyRequests
+}
+
+// albyAPIClient sends JSON requests to the Alby API on behalf of the active account.
+// It sets the default headers, checks the response status and limits and decodes
+// the response body. LSP requests are not sent through it, as the LSP responses
+// are parsed differently.
+type albyAPIClient struct {
+	svc    *albyOAuthService
+	client *http.Client
+}
+
+// newAlbyAPIClient fetches the user token, so the requests of one operation share it
+func (svc *albyOAuthService) newAlbyAPIClient(ctx context.Context) (*albyAPIClient, error) {
+	token, err := svc.fetchUserToken(ctx)
+	if err != nil {
+		svc.loggerFor(ctx).WithError(err).Error("Failed to fetch user token")
+		return nil, err
+	}
+
+	return &albyAPIClient{
+		svc:    svc,
+		client: svc.newAPIClient(ctx, token),
+	}, nil
+}
+
+func (client *albyAPIClient) get(ctx context.Context, path string, response interface{}) error {
+	return client.do(ctx, http.MethodGet, path, nil, response)
+}
+
+func (client *albyAPIClient) post(ctx context.Context, path string, request interface{}, response interface{}) error {
+	return client.do(ctx, http.MethodPost, path, request, response)
+}
+
+func (client *albyAPIClient) put(ctx context.Context, path string, request interface{}, response interface{}) error {
+	return client.do(ctx, http.MethodPut, path, request, response)
+}
+
+func (client *albyAPIClient) delete(ctx context.Context, path string, response interface{}) error {
+	return client.do(ctx, http.MethodDelete, path, nil, response)
+}
+
+// do sends request as JSON body and decodes the response body into response.
+// Either can be nil if the endpoint has no body.
+func (client *albyAPIClient) do(ctx context.Context, method string, path string, request interface{}, response interface{}) error {
+	var body io.Reader
+	if request != nil {
+		payload, err := json.Marshal(request)
+		if err != nil {
+			return fmt.Errorf("failed to encode request payload for %s: %w", path, err)
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, client.svc.albyAPIURL+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request %s: %w", path, err)
+	}
+
+	client.svc.setDefaultRequestHeaders(req)
+
+	res, err := client.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request to %s: %w", path, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		// the error payload only adds details, so a partial read is fine
+		errorBody, _ := io.ReadAll(client.svc.limitBody(res.Body))
+		return &apiStatusError{
+			path:       path,
+			statusCode: res.StatusCode,
+			body:       errorBody,
+		}
+	}
+
+	if response == nil {
+		return nil
+	}
+	err = json.NewDecoder(client.svc.limitBody(res.Body)).Decode(response)
+	if err != nil {
+		return fmt.Errorf("%w from %s: %w", ErrInvalidAPIResponse, path, err)
+	}
+	return nil
+}
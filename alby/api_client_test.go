@@ -0,0 +1,80 @@
+package alby
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getAlby/hub/tests"
+)
+
+func TestAlbyAPIClient(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	type payload struct {
+		Value string `json:"value"`
+	}
+
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.RequestURI()+" "+string(body))
+		assert.Equal(t, "Bearer access-token", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		switch r.URL.Path {
+		case "/echo":
+			w.Write(body)
+		case "/ok":
+			w.Write([]byte(`{"value": "ok"}`))
+		case "/invalid":
+			w.Write([]byte(`{"value": `))
+		case "/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message": "not found"}`))
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	client, err := albyOAuthSvc.newAlbyAPIClient(context.Background())
+	assert.NoError(t, err)
+
+	response := &payload{}
+	err = client.get(context.Background(), "/ok?limit=1", response)
+	assert.NoError(t, err)
+	assert.Equal(t, "ok", response.Value)
+
+	response = &payload{}
+	err = client.post(context.Background(), "/echo", &payload{Value: "posted"}, response)
+	assert.NoError(t, err)
+	assert.Equal(t, "posted", response.Value)
+
+	// endpoints without a response body
+	assert.NoError(t, client.put(context.Background(), "/ok", nil, nil))
+	assert.NoError(t, client.delete(context.Background(), "/ok", nil))
+
+	assert.Equal(t, []string{
+		"GET /ok?limit=1 ",
+		`POST /echo {"value":"posted"}`,
+		"PUT /ok ",
+		"DELETE /ok ",
+	}, requests)
+
+	err = client.get(context.Background(), "/missing", &payload{})
+	var statusErr *apiStatusError
+	assert.True(t, errors.As(err, &statusErr))
+	assert.Equal(t, http.StatusNotFound, statusErr.statusCode)
+	assert.EqualError(t, err, "request to /missing returned non-success status: 404")
+	assert.Equal(t, `{"message": "not found"}`, string(statusErr.body))
+	assert.False(t, statusErr.retryable())
+
+	err = client.get(context.Background(), "/invalid", &payload{})
+	assert.ErrorIs(t, err, ErrInvalidAPIResponse)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+}
@@ -0,0 +1,120 @@
+package alby
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("circuit breaker is open, not sending request")
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// circuitBreaker stops requests to the Alby API or the LSP after threshold consecutive failures.
+// Once cooldown has passed, a single request is let through to probe whether the API
+// recovered, which closes the circuit again if it succeeds.
+type circuitBreaker struct {
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+
+	mutex    sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     CircuitClosed,
+	}
+}
+
+// allow returns ErrCircuitOpen if a request must not be sent
+func (cb *circuitBreaker) allow() error {
+	if cb.threshold <= 0 {
+		return nil
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return ErrCircuitOpen
+		}
+		cb.state = CircuitHalfOpen
+		return nil
+	case CircuitHalfOpen:
+		// a probe is already in flight
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+// record updates the breaker with the outcome of a request let through by allow
+func (cb *circuitBreaker) record(success bool) {
+	if cb.threshold <= 0 {
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if success {
+		cb.state = CircuitClosed
+		cb.failures = 0
+		return
+	}
+
+	cb.failures++
+	if cb.state == CircuitHalfOpen || cb.failures >= cb.threshold {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+	}
+}
+
+// release ends a request without an outcome, e.g. because it was cancelled by the caller
+func (cb *circuitBreaker) release() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == CircuitHalfOpen {
+		// let the next request probe instead
+		cb.state = CircuitOpen
+	}
+}
+
+func (cb *circuitBreaker) State() string {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.cooldown {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+type circuitBreakerTransport struct {
+	base    http.RoundTripper
+	breaker *circuitBreaker
+}
+
+func (transport *circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	err := transport.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := transport.base.RoundTrip(req)
+	if err != nil && req.Context().Err() != nil {
+		transport.breaker.release()
+		return res, err
+	}
+	// rejected requests still show the API is up, only server errors and throttling count as failures
+	transport.breaker.record(err == nil && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests)
+	return res, err
+}
@@ -0,0 +1,131 @@
+package alby
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/getAlby/hub/tests"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestCircuitBreaker_TripsAndRecovers(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var failing atomic.Bool
+	failing.Store(true)
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"balance": 1000, "currency": "BTC", "unit": "sat"}`))
+	}))
+	defer server.Close()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+	svc.Cfg.GetEnv().AlbyAPIURL = server.URL
+	svc.Cfg.GetEnv().AlbyBreakerThreshold = 3
+	svc.Cfg.GetEnv().AlbyBreakerCooldownMs = 100
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+	albyOAuthSvc.saveToken(&oauth2.Token{
+		AccessToken:  "access-token",
+		RefreshToken: "refresh-token",
+		Expiry:       time.Now().Add(time.Hour),
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err = albyOAuthSvc.GetBalance(context.Background())
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrCircuitOpen)
+	}
+	assert.Equal(t, CircuitOpen, albyOAuthSvc.apiBreaker.State())
+
+	// requests are short-circuited while the breaker is open
+	_, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// a failed probe opens the breaker again
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, CircuitHalfOpen, albyOAuthSvc.apiBreaker.State())
+	_, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.NotErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+	_, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	// a successful probe closes it
+	failing.Store(false)
+	time.Sleep(150 * time.Millisecond)
+	balance, err := albyOAuthSvc.GetBalance(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000), balance.Balance)
+	assert.Equal(t, CircuitClosed, albyOAuthSvc.apiBreaker.State())
+
+	health, err := albyOAuthSvc.HealthCheck(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, CircuitClosed, health.CircuitState)
+}
+
+func TestCircuitBreaker_LSPSeparate(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+	svc.Cfg.GetEnv().AlbyAPIURL = server.URL
+	svc.Cfg.GetEnv().AlbyBreakerThreshold = 3
+	svc.Cfg.GetEnv().AlbyBreakerCooldownMs = 60_000
+	albyOAuthSvc := NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+
+	// e.g. a third-party LSP which is down
+	client := albyOAuthSvc.newLSPClient(context.Background(), &oauth2.Token{
+		AccessToken: "access-token",
+		Expiry:      time.Now().Add(time.Hour),
+	})
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(server.URL)
+		assert.NoError(t, err)
+		res.Body.Close()
+	}
+	_, err = client.Get(server.URL)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+
+	assert.Equal(t, CircuitOpen, albyOAuthSvc.lspBreaker.State())
+	assert.Equal(t, CircuitClosed, albyOAuthSvc.apiBreaker.State())
+}
+
+func TestCircuitBreaker_SingleProbe(t *testing.T) {
+	breaker := newCircuitBreaker(1, 0)
+	assert.NoError(t, breaker.allow())
+	breaker.record(false)
+
+	// only one request probes the API while half open
+	assert.NoError(t, breaker.allow())
+	assert.ErrorIs(t, breaker.allow(), ErrCircuitOpen)
+
+	breaker.record(true)
+	assert.NoError(t, breaker.allow())
+	assert.NoError(t, breaker.allow())
+}
+
+func TestCircuitBreaker_Disabled(t *testing.T) {
+	breaker := newCircuitBreaker(0, time.Minute)
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, breaker.allow())
+		breaker.record(false)
+	}
+	assert.Equal(t, CircuitClosed, breaker.State())
+}
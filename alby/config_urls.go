@@ -0,0 +1,81 @@
+package alby
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/getAlby/hub/config"
+)
+
+var ErrInvalidAlbyURL = errors.New("invalid Alby URL")
+
+// albyURLs are the URLs the Alby OAuth service builds its requests from
+type albyURLs struct {
+	apiURL  string
+	authURL string
+	baseURL string
+}
+
+// configuredAlbyURLs returns the configured URLs as they are
+func configuredAlbyURLs(appConfig *config.AppConfig) *albyURLs {
+	return &albyURLs{
+		apiURL:  appConfig.AlbyAPIURL,
+		authURL: appConfig.AlbyOAuthAuthUrl,
+		baseURL: appConfig.BaseUrl,
+	}
+}
+
+// normalizeAlbyURLs checks the configured URLs and returns them without their trailing
+// slashes, as the API paths are appended to them. The config itself is not changed, and
+// no URL is returned if any of them is invalid.
+// BASE_URL is optional, it is only used as redirect URL of custom OAuth clients.
+func normalizeAlbyURLs(appConfig *config.AppConfig) (*albyURLs, error) {
+	urls := configuredAlbyURLs(appConfig)
+	var errs []error
+	for _, field := range []struct {
+		name     string
+		value    *string
+		optional bool
+	}{
+		{name: "ALBY_API_URL", value: &urls.apiURL},
+		{name: "ALBY_OAUTH_AUTH_URL", value: &urls.authURL},
+		{name: "BASE_URL", value: &urls.baseURL, optional: true},
+	} {
+		if *field.value == "" && field.optional {
+			continue
+		}
+		normalized, err := normalizeAlbyURL(*field.value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%w %s: %w", ErrInvalidAlbyURL, field.name, err))
+			continue
+		}
+		*field.value = normalized
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return urls, nil
+}
+
+func normalizeAlbyURL(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", errors.New("url is empty")
+	}
+	parsed, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", fmt.Errorf("unsupported scheme %q", parsed.Scheme)
+	}
+	if parsed.Host == "" {
+		return "", errors.New("url has no host")
+	}
+	if parsed.RawQuery != "" || parsed.Fragment != "" {
+		return "", errors.New("url must not have a query or fragment")
+	}
+	return strings.TrimRight(value, "/"), nil
+}
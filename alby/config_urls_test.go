@@ -0,0 +1,75 @@
+package alby
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getAlby/hub/config"
+	"github.com/getAlby/hub/tests"
+)
+
+func TestNewAlbyOAuthServiceWithError(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+	svc.Cfg.GetEnv().AlbyAPIURL = "https://api.getalby.com/"
+	svc.Cfg.GetEnv().AlbyOAuthAuthUrl = " https://getalby.com/oauth// "
+	svc.Cfg.GetEnv().BaseUrl = ""
+
+	albyOAuthSvc, err := NewAlbyOAuthServiceWithError(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://api.getalby.com", albyOAuthSvc.albyAPIURL)
+	assert.Equal(t, "https://api.getalby.com/oauth/token", albyOAuthSvc.oauthConf.Endpoint.TokenURL)
+	assert.Equal(t, "https://getalby.com/oauth", albyOAuthSvc.oauthConf.Endpoint.AuthURL)
+
+	// the config is shared with the rest of the hub, so it is not changed
+	assert.Equal(t, "https://api.getalby.com/", svc.Cfg.GetEnv().AlbyAPIURL)
+	assert.Equal(t, " https://getalby.com/oauth// ", svc.Cfg.GetEnv().AlbyOAuthAuthUrl)
+}
+
+func TestNormalizeAlbyURLs_InvalidField(t *testing.T) {
+	// valid URLs are not returned normalized if another one is invalid
+	urls, err := normalizeAlbyURLs(&config.AppConfig{
+		AlbyAPIURL:       "https://api.getalby.com/",
+		AlbyOAuthAuthUrl: "getalby.com/oauth",
+	})
+	assert.ErrorIs(t, err, ErrInvalidAlbyURL)
+	assert.ErrorContains(t, err, "ALBY_OAUTH_AUTH_URL")
+	assert.Nil(t, urls)
+}
+
+func TestNewAlbyOAuthServiceWithError_InvalidURLs(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+
+	for name, appConfig := range map[string]struct {
+		apiURL  string
+		authURL string
+		baseURL string
+	}{
+		"empty api url":      {apiURL: "", authURL: "https://getalby.com/oauth"},
+		"api url not a url":  {apiURL: "api.getalby.com", authURL: "https://getalby.com/oauth"},
+		"api url bad scheme": {apiURL: "ftp://api.getalby.com", authURL: "https://getalby.com/oauth"},
+		"api url with query": {apiURL: "https://api.getalby.com?a=b", authURL: "https://getalby.com/oauth"},
+		"unparsable url":     {apiURL: "https://api.getalby.com", authURL: "https://getalby.com:port/oauth"},
+		"empty auth url":     {apiURL: "https://api.getalby.com", authURL: ""},
+		"invalid base url":   {apiURL: "https://api.getalby.com", authURL: "https://getalby.com/oauth", baseURL: "localhost:8080"},
+	} {
+		svc.Cfg.GetEnv().AlbyAPIURL = appConfig.apiURL
+		svc.Cfg.GetEnv().AlbyOAuthAuthUrl = appConfig.authURL
+		svc.Cfg.GetEnv().BaseUrl = appConfig.baseURL
+
+		albyOAuthSvc, err := NewAlbyOAuthServiceWithError(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+		assert.ErrorIs(t, err, ErrInvalidAlbyURL, name)
+		assert.Nil(t, albyOAuthSvc, name)
+
+		// the service is still created with the configured URLs, it only logs the error
+		albyOAuthSvc = NewAlbyOAuthService(svc.DB, svc.Cfg, svc.Keys, svc.EventPublisher)
+		assert.NotNil(t, albyOAuthSvc, name)
+		assert.Equal(t, appConfig.apiURL, albyOAuthSvc.albyAPIURL, name)
+	}
+}
@@ -0,0 +1,129 @@
+package alby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the events API endpoint which accepts an array of events
+const eventsBatchPath = "/events/batch"
+
+const (
+	defaultEventsBatchSize     = 50
+	defaultEventsBatchInterval = 1 * time.Second
+)
+
+// eventBatch buffers the events delivered in batch mode until the batch is full
+// or the flush interval has passed
+type eventBatch struct {
+	mutex    sync.Mutex
+	payloads [][]byte
+	timer    *time.Timer
+
+	// serializes flushes, so batches are sent in the order their events were consumed
+	flushMutex sync.Mutex
+	// set once the events API has no batch endpoint, the events are then sent one by one
+	unsupported atomic.Bool
+}
+
+// batchEvent adds an event to the current batch. The event is pending until its batch is flushed.
+// It is called while consuming the event, so the event is still tracked even if Shutdown
+// started in the meantime, the batch is then flushed right away.
+func (svc *albyOAuthService) batchEvent(ctx context.Context, payload []byte) {
+	svc.pendingEventsMutex.Lock()
+	svc.pendingEventsCount++
+	closed := svc.pendingEventsClosed
+	svc.pendingEventsMutex.Unlock()
+
+	batchSize := svc.cfg.GetEnv().EventsBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultEventsBatchSize
+	}
+	interval := time.Duration(svc.cfg.GetEnv().EventsBatchIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		interval = defaultEventsBatchInterval
+	}
+
+	svc.eventBatch.mutex.Lock()
+	svc.eventBatch.payloads = append(svc.eventBatch.payloads, payload)
+	full := len(svc.eventBatch.payloads) >= batchSize || closed
+	if !full && svc.eventBatch.timer == nil {
+		svc.eventBatch.timer = time.AfterFunc(interval, func() {
+			svc.flushEventBatch(context.Background())
+		})
+	}
+	svc.eventBatch.mutex.Unlock()
+
+	if full {
+		svc.flushEventBatch(ctx)
+	}
+}
+
+// flushEventBatch sends the buffered events, if there are any
+func (svc *albyOAuthService) flushEventBatch(ctx context.Context) {
+	svc.eventBatch.flushMutex.Lock()
+	defer svc.eventBatch.flushMutex.Unlock()
+
+	svc.eventBatch.mutex.Lock()
+	payloads := svc.eventBatch.payloads
+	svc.eventBatch.payloads = nil
+	if svc.eventBatch.timer != nil {
+		svc.eventBatch.timer.Stop()
+		svc.eventBatch.timer = nil
+	}
+	svc.eventBatch.mutex.Unlock()
+
+	if len(payloads) == 0 {
+		return
+	}
+
+	defer svc.donePendingEvents(len(payloads))
+
+	defer func() {
+		// ensure the app cannot panic if firing events to Alby API fails
+		if r := recover(); r != nil {
+			svc.loggerFor(ctx).WithField("r", r).Error("Failed to flush event batch in alby oauth service")
+		}
+	}()
+
+	err := svc.sendEventBatch(ctx, payloads)
+	if err != nil {
+		svc.loggerFor(ctx).WithField("events", len(payloads)).WithError(err).Error("Failed to send event batch to alby events API")
+	}
+}
+
+func (svc *albyOAuthService) sendEventBatch(ctx context.Context, payloads [][]byte) error {
+	if !svc.eventBatch.unsupported.Load() {
+		client, err := svc.newAlbyAPIClient(ctx)
+		if err != nil {
+			return err
+		}
+
+		batch := make([]json.RawMessage, 0, len(payloads))
+		for _, payload := range payloads {
+			batch = append(batch, payload)
+		}
+
+		err = client.post(ctx, eventsBatchPath, batch, nil)
+		var statusErr *apiStatusError
+		if !errors.As(err, &statusErr) || (statusErr.statusCode != http.StatusNotFound && statusErr.statusCode != http.StatusMethodNotAllowed) {
+			return err
+		}
+		svc.loggerFor(ctx).WithField("status", statusErr.statusCode).Info("Events batch endpoint is not available, sending events one by one")
+		svc.eventBatch.unsupported.Store(true)
+	}
+
+	var errs []error
+	for _, payload := range payloads {
+		err := svc.sendEvent(ctx, payload)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
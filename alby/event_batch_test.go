@@ -0,0 +1,139 @@
+package alby
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getAlby/hub/config"
+	"github.com/getAlby/hub/db"
+	"github.com/getAlby/hub/events"
+	"github.com/getAlby/hub/tests"
+)
+
+// eventsServer records the events received by the single and batch events endpoints
+type eventsServer struct {
+	mutex             sync.Mutex
+	batchSupported    bool
+	batches           [][]string
+	singles           []string
+	batchRequestCount int
+}
+
+func (server *eventsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	body, _ := io.ReadAll(r.Body)
+
+	switch r.URL.Path {
+	case eventsBatchPath:
+		server.batchRequestCount++
+		if !server.batchSupported {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var batch []events.Event
+		json.Unmarshal(body, &batch)
+		names := []string{}
+		for _, event := range batch {
+			names = append(names, event.Event)
+		}
+		server.batches = append(server.batches, names)
+	case "/events":
+		var event events.Event
+		json.Unmarshal(body, &event)
+		server.singles = append(server.singles, event.Event)
+	}
+}
+
+func (server *eventsServer) received() ([][]string, []string) {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return server.batches, server.singles
+}
+
+func createBatchingTestService(t *testing.T, server *eventsServer) *albyOAuthService {
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, httpServer.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsDeliveryMode = config.EventsDeliveryBatch
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started,nwc_stopped,nwc_payment_received"
+	return albyOAuthSvc
+}
+
+func TestConsumeEvent_Batch(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := &eventsServer{batchSupported: true}
+	albyOAuthSvc := createBatchingTestService(t, server)
+	albyOAuthSvc.cfg.GetEnv().EventsBatchSize = 3
+	albyOAuthSvc.cfg.GetEnv().EventsBatchIntervalMs = int(time.Hour.Milliseconds())
+
+	for i := 0; i < 7; i++ {
+		albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+		albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_stopped"}, nil)
+	}
+	batches, singles := server.received()
+	assert.Equal(t, [][]string{
+		{"nwc_started", "nwc_stopped", "nwc_started"},
+		{"nwc_stopped", "nwc_started", "nwc_stopped"},
+		{"nwc_started", "nwc_stopped", "nwc_started"},
+		{"nwc_stopped", "nwc_started", "nwc_stopped"},
+	}, batches)
+	assert.Empty(t, singles)
+
+	// the remaining events are flushed on shutdown
+	assert.Equal(t, 0, albyOAuthSvc.Shutdown(context.Background()))
+	batches, _ = server.received()
+	assert.Len(t, batches, 5)
+	assert.Equal(t, []string{"nwc_started", "nwc_stopped"}, batches[4])
+}
+
+func TestConsumeEvent_BatchFlushInterval(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := &eventsServer{batchSupported: true}
+	albyOAuthSvc := createBatchingTestService(t, server)
+	albyOAuthSvc.cfg.GetEnv().EventsBatchSize = 100
+	albyOAuthSvc.cfg.GetEnv().EventsBatchIntervalMs = 200
+
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_stopped"}, nil)
+	batches, _ := server.received()
+	assert.Empty(t, batches)
+
+	assert.Eventually(t, func() bool {
+		batches, _ := server.received()
+		return len(batches) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	batches, _ = server.received()
+	assert.Equal(t, []string{"nwc_started", "nwc_stopped"}, batches[0])
+}
+
+func TestConsumeEvent_BatchEndpointUnavailable(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := &eventsServer{batchSupported: false}
+	albyOAuthSvc := createBatchingTestService(t, server)
+	albyOAuthSvc.cfg.GetEnv().EventsBatchSize = 2
+
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_stopped"}, nil)
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_payment_received", Properties: &db.Transaction{PaymentHash: tests.MockPaymentHash}}, nil)
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+
+	batches, singles := server.received()
+	assert.Empty(t, batches)
+	assert.Equal(t, []string{"nwc_started", "nwc_stopped", "nwc_payment_received", "nwc_started"}, singles)
+	// the batch endpoint is only tried once
+	assert.Equal(t, 1, server.batchRequestCount)
+}
@@ -0,0 +1,93 @@
+package alby
+
+import (
+	"context"
+	"maps"
+	"sync"
+	"sync/atomic"
+
+	"github.com/getAlby/hub/events"
+)
+
+const defaultEventsWorkerQueue = 100
+
+// eventWorkers consume the events published while EVENTS_WORKERS is set, so a slow
+// Alby API does not hold up the event publisher. The workers are started with the
+// first event and stop once Shutdown started and the queued events are consumed.
+type eventWorkers struct {
+	start   sync.Once
+	queue   chan *workerEvent
+	dropped atomic.Uint64
+}
+
+type workerEvent struct {
+	ctx              context.Context
+	event            *events.Event
+	globalProperties map[string]interface{}
+}
+
+// enqueueEvent hands the event to the workers. The event is pending until a worker
+// consumed it. If the queue is full the event is dropped, unless EVENTS_WORKER_BLOCK
+// is set, then the caller waits for space. The event publisher calls every consumer in
+// its own goroutine, so it is not blocked itself, but the waiting events are not bounded.
+// The caller already skipped the events which are not sent, see acceptEvent.
+func (svc *albyOAuthService) enqueueEvent(ctx context.Context, event *events.Event, globalProperties map[string]interface{}) {
+	svc.eventWorkers.start.Do(func() {
+		queueSize := svc.cfg.GetEnv().EventsWorkerQueue
+		if queueSize <= 0 {
+			queueSize = defaultEventsWorkerQueue
+		}
+		svc.eventWorkers.queue = make(chan *workerEvent, queueSize)
+		for i := 0; i < svc.cfg.GetEnv().EventsWorkers; i++ {
+			go svc.runEventWorker()
+		}
+	})
+
+	if !svc.addPendingEvent() {
+		svc.loggerFor(ctx).WithField("event", event.Event).Warn("Alby OAuth service is shutting down, skipping event")
+		return
+	}
+	queued := &workerEvent{
+		ctx:   ctx,
+		event: event,
+		// the global properties are shared with the other consumers
+		globalProperties: maps.Clone(globalProperties),
+	}
+
+	if svc.cfg.GetEnv().EventsWorkerBlock {
+		select {
+		case svc.eventWorkers.queue <- queued:
+			return
+		case <-ctx.Done():
+		}
+	} else {
+		select {
+		case svc.eventWorkers.queue <- queued:
+			return
+		default:
+		}
+	}
+
+	svc.donePendingEvents(1)
+	dropped := svc.observeDroppedEvent(event.Event)
+	svc.loggerFor(ctx).WithField("event", event.Event).WithField("dropped_events", dropped).Warn("Event worker queue is full, dropped the event")
+}
+
+func (svc *albyOAuthService) runEventWorker() {
+	for {
+		select {
+		// queued events are pending, so they are all consumed once the pending events are done
+		case <-svc.pendingEventsDone:
+			return
+		case queued := <-svc.eventWorkers.queue:
+			// consumeEvent recovers from panics, so one event cannot stop the worker
+			svc.consumeEvent(queued.ctx, queued.event, queued.globalProperties)
+			svc.donePendingEvents(1)
+		}
+	}
+}
+
+// DroppedEvents returns the number of events dropped because the event worker queue was full
+func (svc *albyOAuthService) DroppedEvents() uint64 {
+	return svc.eventWorkers.dropped.Load()
+}
@@ -0,0 +1,158 @@
+package alby
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getAlby/hub/events"
+	"github.com/getAlby/hub/tests"
+)
+
+func TestConsumeEvent_Workers(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	latency := 200 * time.Millisecond
+	var inFlight, maxInFlight, received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+				break
+			}
+		}
+		time.Sleep(latency)
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started,nwc_stopped"
+	albyOAuthSvc.cfg.GetEnv().EventsWorkers = 4
+
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	}
+	// the events are consumed by the workers
+	assert.Less(t, time.Since(start), latency)
+
+	assert.Equal(t, 0, albyOAuthSvc.Shutdown(context.Background()))
+	assert.Less(t, time.Since(start), 2*latency)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&received))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&maxInFlight))
+	assert.Zero(t, albyOAuthSvc.DroppedEvents())
+}
+
+func TestConsumeEvent_WorkerQueueFull(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var inFlight, received int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&inFlight, 1)
+		<-release
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started,nwc_stopped"
+	albyOAuthSvc.cfg.GetEnv().EventsWorkers = 1
+	albyOAuthSvc.cfg.GetEnv().EventsWorkerQueue = 1
+	collector := &fakeMetricsCollector{}
+	albyOAuthSvc.SetMetricsCollector(collector)
+
+	// the only worker waits for the API
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&inFlight) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// events which are not sent do not take up space in the queue
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_payment_received"}, nil)
+
+	// the second event fills the queue, the third one is dropped
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_stopped"}, nil)
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Equal(t, uint64(1), albyOAuthSvc.DroppedEvents())
+	assert.Contains(t, collector.observations, "dropped nwc_started")
+
+	close(release)
+	assert.Equal(t, 0, albyOAuthSvc.Shutdown(context.Background()))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&received))
+	assert.Equal(t, uint64(1), albyOAuthSvc.DroppedEvents())
+}
+
+func TestConsumeEvent_WorkerQueueBlocks(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var received int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started,nwc_stopped"
+	albyOAuthSvc.cfg.GetEnv().EventsWorkers = 1
+	albyOAuthSvc.cfg.GetEnv().EventsWorkerQueue = 1
+	albyOAuthSvc.cfg.GetEnv().EventsWorkerBlock = true
+
+	published := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+		}
+		close(published)
+	}()
+
+	// the caller waits until the worker picks up the queued event
+	select {
+	case <-published:
+		t.Fatal("publisher did not wait for the worker queue")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	<-published
+	assert.Equal(t, 0, albyOAuthSvc.Shutdown(context.Background()))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&received))
+	assert.Zero(t, albyOAuthSvc.DroppedEvents())
+}
+
+func TestConsumeEvent_WorkersStopOnShutdown(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// idle keep-alive connections would also be counted as goroutines
+		w.Header().Set("Connection", "close")
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().LogEvents = true
+	albyOAuthSvc.cfg.GetEnv().EventsAllowList = "nwc_started"
+	albyOAuthSvc.cfg.GetEnv().EventsWorkers = 2
+
+	goroutines := runtime.NumGoroutine()
+	albyOAuthSvc.ConsumeEvent(context.Background(), &events.Event{Event: "nwc_started"}, nil)
+	assert.Equal(t, 0, albyOAuthSvc.Shutdown(context.Background()))
+
+	assert.Eventually(t, func() bool {
+		return runtime.NumGoroutine() <= goroutines
+	}, 2*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,139 @@
+package alby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	decodepay "github.com/nbd-wtf/ln-decodepay"
+)
+
+var (
+	ErrInvalidLightningAddress = errors.New("invalid lightning address")
+	ErrAmountBelowMinSendable  = errors.New("amount is below the minimum sendable amount")
+	ErrAmountAboveMaxSendable  = errors.New("amount is above the maximum sendable amount")
+	ErrInvoiceAmountMismatch   = errors.New("invoice amount does not match the requested amount")
+	ErrNoLightningAddress      = errors.New("the Alby account has no lightning address")
+)
+
+// LUD-06 payRequest response
+type lnurlPayParams struct {
+	Tag            string `json:"tag"`
+	Callback       string `json:"callback"`
+	MinSendable    uint64 `json:"minSendable"`
+	MaxSendable    uint64 `json:"maxSendable"`
+	Metadata       string `json:"metadata"`
+	CommentAllowed int    `json:"commentAllowed"`
+}
+
+type lnurlPayInvoice struct {
+	PaymentRequest string `json:"pr"`
+	Status         string `json:"status"`
+	Reason         string `json:"reason"`
+}
+
+// lnurl requests go to third party servers, so the Alby OAuth client must not be used
+var lnurlClient = &http.Client{Timeout: 60 * time.Second}
+
+// lightningAddressToLNURLPayUrl converts name@domain to its LUD-16 well-known URL
+func lightningAddressToLNURLPayUrl(lightningAddress string) (string, error) {
+	name, domain, found := strings.Cut(strings.TrimSpace(lightningAddress), "@")
+	if !found || name == "" || domain == "" {
+		return "", ErrInvalidLightningAddress
+	}
+	return fmt.Sprintf("https://%s/.well-known/lnurlp/%s", domain, url.PathEscape(strings.ToLower(name))), nil
+}
+
+func fetchLNURLPayParams(ctx context.Context, lnurlPayUrl string) (*lnurlPayParams, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, lnurlPayUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create lnurl-pay request: %w", err)
+	}
+	setDefaultRequestHeaders(req)
+
+	res, err := lnurlClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request lnurl-pay params: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return nil, fmt.Errorf("lnurl-pay endpoint returned non-success status: %d", res.StatusCode)
+	}
+
+	params := &lnurlPayParams{}
+	err = json.NewDecoder(limitResponseBody(res.Body, defaultMaxResponseBytes)).Decode(params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode lnurl-pay params: %w", err)
+	}
+
+	if params.Tag != "payRequest" || params.Callback == "" {
+		return nil, fmt.Errorf("unexpected lnurl-pay response: tag=%q", params.Tag)
+	}
+
+	return params, nil
+}
+
+// fetchLNURLPayInvoice requests an invoice from the lnurl-pay callback and checks
+// the invoice is for exactly the requested amount, as required by LUD-06
+func fetchLNURLPayInvoice(ctx context.Context, params *lnurlPayParams, amountMsat uint64, comment string) (string, error) {
+	if amountMsat < params.MinSendable {
+		return "", fmt.Errorf("%w: %d < %d msat", ErrAmountBelowMinSendable, amountMsat, params.MinSendable)
+	}
+	if params.MaxSendable > 0 && amountMsat > params.MaxSendable {
+		return "", fmt.Errorf("%w: %d > %d msat", ErrAmountAboveMaxSendable, amountMsat, params.MaxSendable)
+	}
+
+	callbackUrl, err := url.Parse(params.Callback)
+	if err != nil {
+		return "", fmt.Errorf("invalid lnurl-pay callback: %w", err)
+	}
+	query := callbackUrl.Query()
+	query.Set("amount", strconv.FormatUint(amountMsat, 10))
+	if comment != "" && params.CommentAllowed > 0 {
+		if len(comment) > params.CommentAllowed {
+			comment = comment[:params.CommentAllowed]
+		}
+		query.Set("comment", comment)
+	}
+	callbackUrl.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, callbackUrl.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create lnurl-pay callback request: %w", err)
+	}
+	setDefaultRequestHeaders(req)
+
+	res, err := lnurlClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request lnurl-pay invoice: %w", err)
+	}
+	defer res.Body.Close()
+
+	invoice := &lnurlPayInvoice{}
+	err = json.NewDecoder(limitResponseBody(res.Body, defaultMaxResponseBytes)).Decode(invoice)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode lnurl-pay invoice response: %w", err)
+	}
+
+	if invoice.Status == "ERROR" {
+		return "", fmt.Errorf("lnurl-pay callback returned an error: %s", invoice.Reason)
+	}
+
+	paymentRequest, err := decodepay.Decodepay(invoice.PaymentRequest)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode lnurl-pay invoice: %w", err)
+	}
+
+	if uint64(paymentRequest.MSatoshi) != amountMsat {
+		return "", fmt.Errorf("%w: invoice %d msat, requested %d msat", ErrInvoiceAmountMismatch, paymentRequest.MSatoshi, amountMsat)
+	}
+
+	return invoice.PaymentRequest, nil
+}
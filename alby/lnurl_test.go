@@ -0,0 +1,66 @@
+package alby
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getAlby/hub/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLightningAddressInvoice(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var callbackQueries []string
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/lnurlp/hub":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"tag":            "payRequest",
+				"callback":       server.URL + "/lnurlp/hub/callback",
+				"minSendable":    1000,
+				"maxSendable":    1_000_000_000,
+				"metadata":       `[["text/plain","Sats for hub"]]`,
+				"commentAllowed": 10,
+			})
+		case "/lnurlp/hub/callback":
+			callbackQueries = append(callbackQueries, r.URL.RawQuery)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"pr":     tests.MockInvoice,
+				"routes": []string{},
+			})
+		default:
+			t.Errorf("unexpected request: %s", r.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	defaultLnurlClient := lnurlClient
+	lnurlClient = server.Client()
+	defer func() { lnurlClient = defaultLnurlClient }()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, "")
+
+	_, err := albyOAuthSvc.RequestLightningAddressInvoice(context.Background(), 123, "")
+	assert.ErrorIs(t, err, ErrNoLightningAddress)
+
+	albyOAuthSvc.cfg.SetUpdate(albyOAuthSvc.accountKey(lightningAddressKey), "hub@"+strings.TrimPrefix(server.URL, "https://"), "")
+
+	invoice, err := albyOAuthSvc.RequestLightningAddressInvoice(context.Background(), 123, "thanks for the sats")
+	assert.NoError(t, err)
+	assert.Equal(t, tests.MockInvoice, invoice)
+	// the comment is truncated to commentAllowed
+	assert.Equal(t, []string{"amount=123000&comment=thanks+for"}, callbackQueries)
+
+	// the invoice is for 123 sats
+	_, err = albyOAuthSvc.RequestLightningAddressInvoice(context.Background(), 100, "")
+	assert.ErrorIs(t, err, ErrInvoiceAmountMismatch)
+
+	_, err = albyOAuthSvc.RequestLightningAddressInvoice(context.Background(), 2_000_000, "")
+	assert.ErrorIs(t, err, ErrAmountAboveMaxSendable)
+}
@@ -0,0 +1,146 @@
+package alby
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// status classes of Alby API requests, see MetricsCollector
+const (
+	StatusClass2xx     = "2xx"
+	StatusClass3xx     = "3xx"
+	StatusClass4xx     = "4xx"
+	StatusClass5xx     = "5xx"
+	StatusClassNetwork = "network" // no response, e.g. a timeout
+)
+
+// MetricsCollector records the requests sent to the Alby API, e.g. to export them to Prometheus.
+// endpoint is the method and path of the request, with IDs replaced by placeholders.
+type MetricsCollector interface {
+	ObserveAPIRequest(endpoint string, statusClass string, latency time.Duration)
+	// ObserveDroppedEvent is called for each event dropped because the event worker queue was full
+	ObserveDroppedEvent(event string)
+}
+
+// APIEndpointMetrics are the requests to an Alby API endpoint since the hub started
+type APIEndpointMetrics struct {
+	Requests     uint64            `json:"requests"`
+	Errors       map[string]uint64 `json:"errors"` // by status class, 4xx, 5xx or network
+	TotalLatency time.Duration     `json:"totalLatency"`
+	MaxLatency   time.Duration     `json:"maxLatency"`
+}
+
+// apiMetrics is the built-in collector returned by Metrics
+type apiMetrics struct {
+	mutex     sync.Mutex
+	endpoints map[string]*APIEndpointMetrics
+}
+
+func newAPIMetrics() *apiMetrics {
+	return &apiMetrics{
+		endpoints: map[string]*APIEndpointMetrics{},
+	}
+}
+
+func (metrics *apiMetrics) ObserveAPIRequest(endpoint string, statusClass string, latency time.Duration) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	endpointMetrics, ok := metrics.endpoints[endpoint]
+	if !ok {
+		endpointMetrics = &APIEndpointMetrics{Errors: map[string]uint64{}}
+		metrics.endpoints[endpoint] = endpointMetrics
+	}
+	endpointMetrics.Requests++
+	if statusClass != StatusClass2xx && statusClass != StatusClass3xx {
+		endpointMetrics.Errors[statusClass]++
+	}
+	endpointMetrics.TotalLatency += latency
+	endpointMetrics.MaxLatency = max(endpointMetrics.MaxLatency, latency)
+}
+
+func (metrics *apiMetrics) snapshot() map[string]APIEndpointMetrics {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	snapshot := make(map[string]APIEndpointMetrics, len(metrics.endpoints))
+	for endpoint, endpointMetrics := range metrics.endpoints {
+		errors := make(map[string]uint64, len(endpointMetrics.Errors))
+		for statusClass, count := range endpointMetrics.Errors {
+			errors[statusClass] = count
+		}
+		snapshot[endpoint] = APIEndpointMetrics{
+			Requests:     endpointMetrics.Requests,
+			Errors:       errors,
+			TotalLatency: endpointMetrics.TotalLatency,
+			MaxLatency:   endpointMetrics.MaxLatency,
+		}
+	}
+	return snapshot
+}
+
+// Metrics returns the Alby API requests by endpoint since the hub started
+func (svc *albyOAuthService) Metrics() map[string]APIEndpointMetrics {
+	return svc.apiMetrics.snapshot()
+}
+
+// SetMetricsCollector sets a collector which records the Alby API requests in
+// addition to the built-in one, pass nil to remove it
+func (svc *albyOAuthService) SetMetricsCollector(collector MetricsCollector) {
+	svc.metricsCollectorMutex.Lock()
+	defer svc.metricsCollectorMutex.Unlock()
+	svc.metricsCollector = collector
+}
+
+func (svc *albyOAuthService) observeAPIRequest(endpoint string, statusClass string, latency time.Duration) {
+	svc.apiMetrics.ObserveAPIRequest(endpoint, statusClass, latency)
+	svc.metricsCollectorMutex.Lock()
+	collector := svc.metricsCollector
+	svc.metricsCollectorMutex.Unlock()
+	if collector != nil {
+		collector.ObserveAPIRequest(endpoint, statusClass, latency)
+	}
+}
+
+// observeDroppedEvent counts the dropped event, see DroppedEvents, and returns the new total
+func (svc *albyOAuthService) observeDroppedEvent(event string) uint64 {
+	dropped := svc.eventWorkers.dropped.Add(1)
+	svc.metricsCollectorMutex.Lock()
+	collector := svc.metricsCollector
+	svc.metricsCollectorMutex.Unlock()
+	if collector != nil {
+		collector.ObserveDroppedEvent(event)
+	}
+	return dropped
+}
+
+// apiEndpoint returns the metrics label of the request, so requests for different
+// resources of the same endpoint are counted together
+func apiEndpoint(req *http.Request) string {
+	path := req.URL.Path
+	if i := strings.Index(path, "/internal/backups/"); i >= 0 {
+		path = path[:i] + "/internal/backups/:id"
+	}
+	return req.Method + " " + path
+}
+
+func statusClass(statusCode int) string {
+	return fmt.Sprintf("%dxx", statusCode/100)
+}
+
+type metricsTransport struct {
+	base http.RoundTripper
+	svc  *albyOAuthService
+}
+
+func (transport *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	res, err := transport.base.RoundTrip(req)
+	class := StatusClassNetwork
+	if err == nil {
+		class = statusClass(res.StatusCode)
+	}
+	transport.svc.observeAPIRequest(apiEndpoint(req), class, time.Since(start))
+	return res, err
+}
@@ -0,0 +1,79 @@
+package alby
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/getAlby/hub/tests"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeMetricsCollector struct {
+	mutex        sync.Mutex
+	observations []string
+}
+
+func (collector *fakeMetricsCollector) ObserveAPIRequest(endpoint string, statusClass string, latency time.Duration) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.observations = append(collector.observations, endpoint+" "+statusClass)
+}
+
+func (collector *fakeMetricsCollector) ObserveDroppedEvent(event string) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+	collector.observations = append(collector.observations, "dropped "+event)
+}
+
+func TestMetrics(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	failing := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"balance": 1000, "currency": "BTC", "unit": "sat"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	collector := &fakeMetricsCollector{}
+	albyOAuthSvc.SetMetricsCollector(collector)
+
+	_, err := albyOAuthSvc.GetBalance(context.Background())
+	assert.NoError(t, err)
+	failing = true
+	_, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.Error(t, err)
+
+	assert.Equal(t, []string{
+		"GET /internal/lndhub/balance 2xx",
+		"GET /internal/lndhub/balance 5xx",
+	}, collector.observations)
+
+	metrics := albyOAuthSvc.Metrics()["GET /internal/lndhub/balance"]
+	assert.Equal(t, uint64(2), metrics.Requests)
+	assert.Equal(t, map[string]uint64{StatusClass5xx: 1}, metrics.Errors)
+	assert.Positive(t, metrics.TotalLatency)
+	assert.LessOrEqual(t, metrics.MaxLatency, metrics.TotalLatency)
+
+	// requests which do not reach the API
+	server.Close()
+	_, err = albyOAuthSvc.GetBalance(context.Background())
+	assert.Error(t, err)
+	assert.Equal(t, "GET /internal/lndhub/balance network", collector.observations[2])
+}
+
+func TestAPIEndpoint(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "https://api.getalby.com/internal/backups/42?x=1", nil)
+	assert.Equal(t, "GET /internal/backups/:id", apiEndpoint(req))
+
+	req = httptest.NewRequest(http.MethodPost, "https://api.getalby.com/internal/lndhub/bolt11", nil)
+	assert.Equal(t, "POST /internal/lndhub/bolt11", apiEndpoint(req))
+}
@@ -2,6 +2,7 @@ package alby
 
 import (
 	"context"
+	"time"
 
 	"github.com/getAlby/hub/events"
 	"github.com/getAlby/hub/lnclient"
@@ -10,57 +11,295 @@ import (
 type AlbyOAuthService interface {
 	events.EventSubscriber
 	GetChannelPeerSuggestions(ctx context.Context) ([]ChannelPeerSuggestion, error)
+	GetChannelPeerSuggestionsFiltered(ctx context.Context, filter SuggestionFilter) ([]ChannelPeerSuggestion, error)
 	GetAuthUrl() string
+	GetAuthUrlWithState(state string) (string, error)
+	RedirectURL() string
+	ConfigKeys() []string
+	ActiveAccount() string
+	ListLinkedAccounts() ([]string, error)
+	SwitchActiveAccount(name string) error
 	GetUserIdentifier() (string, error)
 	GetLightningAddress() (string, error)
+	GrantedScopes() ([]string, error)
+	GetTokenStatus() (*TokenStatus, error)
 	IsConnected(ctx context.Context) bool
+	RefreshToken(ctx context.Context) error
+	TokenTimeToExpiry(ctx context.Context) (time.Duration, error)
+	HealthCheck(ctx context.Context) (*AlbyHealth, error)
+	Metrics() map[string]APIEndpointMetrics
+	SetMetricsCollector(collector MetricsCollector)
+	DroppedEvents() uint64
 	LinkAccount(ctx context.Context, lnClient lnclient.LNClient, budget uint64, renewal string) error
-	CallbackHandler(ctx context.Context, code string, lnClient lnclient.LNClient) error
+	RotateNWCConnection(ctx context.Context, lnClient lnclient.LNClient) error
+	PreviewLinkAccount(ctx context.Context, lnClient lnclient.LNClient) (*LinkAccountPreview, error)
+	GetAutoLinkStatus() (string, error)
+	RetryAutoLink(ctx context.Context, lnClient lnclient.LNClient) error
+	ReconcileAccountScopes(ctx context.Context, lnClient lnclient.LNClient) (*AlbyAccountScopeDiscrepancies, error)
+	CallbackHandler(ctx context.Context, code string, state string, lnClient lnclient.LNClient) error
 	GetBalance(ctx context.Context) (*AlbyBalance, error)
+	GetLastKnownBalance() (*AlbyBalance, time.Time, error)
+	GetAccountSummary(ctx context.Context) (*AccountSummary, error)
+	GetNodeAndAccountInfo(ctx context.Context, lnClient lnclient.LNClient) (*NodeAccountInfo, error)
+	GetBalanceWithFiat(ctx context.Context, currency string) (*AlbyBalanceWithFiat, error)
+	GetInvoices(ctx context.Context, params AlbyTransactionsParams) ([]AlbyTransaction, error)
+	GetTransactions(ctx context.Context, params TransactionHistoryParams) (*TransactionHistoryPage, error)
 	GetMe(ctx context.Context) (*AlbyMe, error)
-	SendPayment(ctx context.Context, invoice string) error
-	DrainSharedWallet(ctx context.Context, lnClient lnclient.LNClient) error
-	UnlinkAccount(ctx context.Context) error
-	RequestAutoChannel(ctx context.Context, lnClient lnclient.LNClient, isPublic bool) (*AutoChannelResponse, error)
+	GetSubscriptionTier(ctx context.Context) (string, error)
+	GetMeFresh(ctx context.Context) (*AlbyMe, error)
+	SendPayment(ctx context.Context, invoice string) (*AlbyPayResponse, error)
+	SendPayments(ctx context.Context, invoices []string) []PayResult
+	SendKeysend(ctx context.Context, destination string, amountMsat uint64, tlvRecords map[uint64]string) (*KeysendResult, error)
+	SendToLightningAddress(ctx context.Context, lightningAddress string, amountSat uint64, comment string) error
+	RequestLightningAddressInvoice(ctx context.Context, amountSat uint64, comment string) (string, error)
+	PreviewDrainSharedWallet(ctx context.Context) (*DrainSharedWalletPreview, error)
+	DrainSharedWallet(ctx context.Context, lnClient lnclient.LNClient, override *DrainOptionsOverride, memo *DrainMemo) (*DrainSharedWalletResult, error)
+	UnlinkAccount(ctx context.Context, confirmed bool) error
+	GetLSPInfo(ctx context.Context, url string) (*LSPInfo, error)
+	RequestAutoChannel(ctx context.Context, lnClient lnclient.LNClient, isPublic bool, paymentMethod string, requestedChannelSizeSat uint64) (*AutoChannelResponse, error)
+	GetAutoChannelOrderStatus(ctx context.Context, lnClient lnclient.LNClient, orderId string) (*AutoChannelResponse, error)
+	GetBackup(ctx context.Context, id string) (*ChannelBackup, error)
+	ListBackups(ctx context.Context) ([]ChannelBackupVersion, error)
+	RestoreChannels(ctx context.Context) (*events.ChannelBackupEvent, error)
+	Shutdown(ctx context.Context) int
 }
 
 type AlbyBalanceResponse struct {
 	Sats int64 `json:"sats"`
 }
 
+type AlbyAuthUrlResponse struct {
+	Url string `json:"url"`
+}
+
+type AlbyLastKnownBalanceResponse struct {
+	Sats      int64     `json:"sats"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
 type AlbyPayRequest struct {
 	Invoice string `json:"invoice"`
 }
 
+type AlbyPayResponse struct {
+	Preimage string `json:"preimage"`
+	FeeSat   int64  `json:"feeSat"` // routing fee charged by the shared wallet, 0 if unknown
+}
+
+type KeysendResult struct {
+	Preimage    string `json:"preimage"`
+	PaymentHash string `json:"paymentHash"`
+}
+
+type AlbyHealth struct {
+	Healthy               bool     `json:"healthy"`
+	TokenPresent          bool     `json:"tokenPresent"`
+	TokenExpired          bool     `json:"tokenExpired"`
+	TokenExpiresInSeconds int64    `json:"tokenExpiresInSeconds"`
+	APIReachable          bool     `json:"apiReachable"`
+	Authenticated         bool     `json:"authenticated"` // the API accepted the token
+	ProbeLatencyMs        int64    `json:"probeLatencyMs"`
+	ProbeError            string   `json:"probeError,omitempty"`
+	GrantedScopes         []string `json:"grantedScopes"`
+	MissingScopes         []string `json:"missingScopes"`
+	ScopesSufficient      bool     `json:"scopesSufficient"`
+	CircuitState          string   `json:"circuitState"`    // state of the Alby API circuit breaker
+	LSPCircuitState       string   `json:"lspCircuitState"` // state of the LSP circuit breaker
+}
+
+// TokenStatus describes the stored Alby OAuth token, see GetTokenStatus
+type TokenStatus struct {
+	TokenPresent     bool       `json:"tokenPresent"`
+	ExpiresAt        *time.Time `json:"expiresAt"`
+	ExpiresInSeconds int64      `json:"expiresInSeconds"` // negative once expired
+	Expired          bool       `json:"expired"`
+	HasRefreshToken  bool       `json:"hasRefreshToken"`
+	GrantedScopes    []string   `json:"grantedScopes"` // empty if no scopes were stored
+}
+
+// AccountSummary combines the Alby account and the shared wallet balance.
+// A field is nil if its request failed, with the failure in the matching error field.
+type AccountSummary struct {
+	Me           *AlbyMe      `json:"me"`
+	MeError      string       `json:"meError,omitempty"`
+	MeErr        error        `json:"-"`
+	Balance      *AlbyBalance `json:"balance"`
+	BalanceError string       `json:"balanceError,omitempty"`
+	BalanceErr   error        `json:"-"`
+}
+
+type NodeAccountInfo struct {
+	Node             *lnclient.NodeInfo `json:"node"`
+	AlbyConnected    bool               `json:"albyConnected"`
+	AlbyAccount      string             `json:"albyAccount,omitempty"`
+	UserIdentifier   string             `json:"userIdentifier,omitempty"`
+	LightningAddress string             `json:"lightningAddress,omitempty"`
+}
+
+type PayResult struct {
+	Invoice  string `json:"invoice"`
+	Preimage string `json:"preimage,omitempty"`
+	FeeSat   int64  `json:"feeSat,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Err      error  `json:"-"`
+}
+
+// FailedInvoices returns the invoices which were not paid, so only those are retried
+func FailedInvoices(results []PayResult) []string {
+	failedInvoices := []string{}
+	for _, result := range results {
+		if result.Err != nil {
+			failedInvoices = append(failedInvoices, result.Invoice)
+		}
+	}
+	return failedInvoices
+}
+
 type AlbyLinkAccountRequest struct {
 	Budget  uint64 `json:"budget"`
-	Renewal string `json:"renewal"`
+	Renewal string `json:"renewal"` // BudgetRenewalKeepExisting keeps the current budget and ignores Budget
+}
+
+type LinkAccountPreview struct {
+	Scopes               []string `json:"scopes"`
+	NotificationTypes    []string `json:"notificationTypes"`
+	NotificationsEnabled bool     `json:"notificationsEnabled"`
+}
+
+type AlbyUnlinkAccountRequest struct {
+	Confirm bool `json:"confirm"`
+}
+
+type AlbyLinkedAccountsResponse struct {
+	Accounts      []string `json:"accounts"`
+	ActiveAccount string   `json:"activeAccount"`
+}
+
+type AlbySwitchAccountRequest struct {
+	Name string `json:"name"`
+}
+
+type AlbyAccountScopeDiscrepancies struct {
+	Missing     []string `json:"missing"`     // supported by the LNClient but not granted to the app
+	Unsupported []string `json:"unsupported"` // granted to the app but not supported by the LNClient
+}
+
+type AlbyAutoLinkStatusResponse struct {
+	Status string `json:"status"`
 }
 
+const (
+	AutoChannelPaymentLightning = "lightning"
+	AutoChannelPaymentOnchain   = "onchain"
+)
+
 type AutoChannelRequest struct {
-	IsPublic bool `json:"isPublic"`
+	IsPublic       bool   `json:"isPublic"`
+	PaymentMethod  string `json:"paymentMethod"`  // lightning (default) or onchain
+	ChannelSizeSat uint64 `json:"channelSizeSat"` // inbound capacity to request, 0 lets the LSP decide
+}
+
+// LSPInfo is the LSPS1 info of an LSP. Channel sizes are 0 if the LSP does not advertise them.
+type LSPInfo struct {
+	Pubkey            string   `json:"pubkey"`
+	ClearnetURIs      []string `json:"clearnetUris"`
+	OnionURIs         []string `json:"onionUris"`
+	MinChannelSizeSat uint64   `json:"minChannelSizeSat"`
+	MaxChannelSizeSat uint64   `json:"maxChannelSizeSat"`
 }
 
 type AutoChannelResponse struct {
-	Invoice     string `json:"invoice"`
-	ChannelSize uint64 `json:"channelSize"`
-	Fee         uint64 `json:"fee"`
+	Invoice        string                     `json:"invoice"`
+	ChannelSize    uint64                     `json:"channelSize"`
+	Fee            uint64                     `json:"fee"`
+	InvoiceDetails *AutoChannelInvoiceDetails `json:"invoiceDetails,omitempty"`
+	OnchainPayment *AutoChannelOnchainPayment `json:"onchainPayment,omitempty"`
+	Transport      string                     `json:"transport"` // used to connect to the LSP
+	// set by LSPs using the LSPS1 order flow, the invoice may only be available once the order is ready
+	OrderId    string `json:"orderId,omitempty"`
+	OrderState string `json:"orderState,omitempty"`
+}
+
+// decoded from the LSP invoice, so the user can check what they are about to pay
+type AutoChannelInvoiceDetails struct {
+	AmountSat   uint64    `json:"amountSat"`
+	Description string    `json:"description"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+	PayeePubkey string    `json:"payeePubkey"`
+}
+
+// paid instead of the invoice when the order is paid onchain
+type AutoChannelOnchainPayment struct {
+	Address          string `json:"address"`
+	FeeTotalSat      uint64 `json:"feeTotalSat"`
+	OrderTotalSat    uint64 `json:"orderTotalSat"`
+	NetworkFeeSat    uint64 `json:"networkFeeSat"`
+	MinConfirmations uint32 `json:"minConfirmations"`
+}
+
+type DrainSharedWalletPreview struct {
+	AmountSat    int64 `json:"amountSat"`
+	RemainingSat int64 `json:"remainingSat"`
+}
+
+// fee reserves deducted from the shared wallet balance when draining it
+type DrainOptions struct {
+	ServiceFeeBps     int64 `json:"serviceFeeBps"`
+	RoutingReserveBps int64 `json:"routingReserveBps"`
+	FlatReserveSat    int64 `json:"flatReserveSat"`
+	MinBalanceSat     int64 `json:"minBalanceSat"`
+}
+
+// DrainOptionsOverride replaces single fee reserves of the drain, the fields which are nil keep their default
+type DrainOptionsOverride struct {
+	ServiceFeeBps     *int64 `json:"serviceFeeBps,omitempty"`
+	RoutingReserveBps *int64 `json:"routingReserveBps,omitempty"`
+	FlatReserveSat    *int64 `json:"flatReserveSat,omitempty"`
+	MinBalanceSat     *int64 `json:"minBalanceSat,omitempty"`
+}
+
+// DrainMemo tags the hub invoices created by a drain, e.g. for accounting
+type DrainMemo struct {
+	Description string                 `json:"description"` // empty for the default description
+	Metadata    map[string]interface{} `json:"metadata"`
+}
+
+type DrainSharedWalletResult struct {
+	AttemptedSat   int64 `json:"attemptedSat"`
+	DrainedSat     int64 `json:"drainedSat"`
+	PartsCompleted int   `json:"partsCompleted"`
+	PartsTotal     int   `json:"partsTotal"`
+	// proof of payment for each completed part
+	Preimages []string `json:"preimages"`
 }
 
 type AlbyMeHub struct {
 	LatestVersion string `json:"latest_version"`
 	Name          string `json:"name"`
 }
+
+// known Alby subscription tiers, see GetSubscriptionTier
+const (
+	SubscriptionTierFree = "free" // no paid subscription
+	SubscriptionTierBuzz = "buzz" // Alby Hub subscription, e.g. for the hosted cloud hub
+)
+
+// AlbyMeSubscription is omitted by the Alby API for accounts without a subscription
+type AlbyMeSubscription struct {
+	PlanCode string `json:"plan_code"`
+}
+
 type AlbyMe struct {
-	Identifier       string    `json:"identifier"`
-	NPub             string    `json:"nostr_pubkey"`
-	LightningAddress string    `json:"lightning_address"`
-	Email            string    `json:"email"`
-	Name             string    `json:"name"`
-	Avatar           string    `json:"avatar"`
-	KeysendPubkey    string    `json:"keysend_pubkey"`
-	SharedNode       bool      `json:"shared_node"`
-	Hub              AlbyMeHub `json:"hub"`
+	Identifier       string             `json:"identifier"`
+	NPub             string             `json:"nostr_pubkey"`
+	LightningAddress string             `json:"lightning_address"`
+	Email            string             `json:"email"`
+	Name             string             `json:"name"`
+	Avatar           string             `json:"avatar"`
+	KeysendPubkey    string             `json:"keysend_pubkey"`
+	SharedNode       bool               `json:"shared_node"`
+	Hub              AlbyMeHub          `json:"hub"`
+	Subscription     AlbyMeSubscription `json:"subscription"`
 }
 
 type AlbyBalance struct {
@@ -69,6 +308,78 @@ type AlbyBalance struct {
 	Currency string `json:"currency"`
 }
 
+// BalanceSat returns the balance in sats. Balances fetched from the Alby API
+// are always normalized to sats, see normalizeBalanceUnit.
+func (balance *AlbyBalance) BalanceSat() int64 {
+	return balance.Balance
+}
+
+// BalanceMsat returns the balance in millisats
+func (balance *AlbyBalance) BalanceMsat() int64 {
+	return balance.Balance * 1000
+}
+
+type AlbyBalanceWithFiat struct {
+	AlbyBalance
+	FiatCurrency  string    `json:"fiatCurrency"`
+	FiatBalance   float64   `json:"fiatBalance"`
+	Rate          float64   `json:"rate"` // price of one bitcoin in FiatCurrency
+	RateFetchedAt time.Time `json:"rateFetchedAt"`
+}
+
+type AlbyTransactionsParams struct {
+	Limit  uint64 // 0 for no limit
+	Offset uint64
+}
+
+type AlbyTransaction struct {
+	Type        string     `json:"type"` // incoming or outgoing
+	AmountSat   int64      `json:"amountSat"`
+	FeeSat      int64      `json:"feeSat"`
+	PaymentHash string     `json:"paymentHash"`
+	Memo        string     `json:"memo"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	SettledAt   *time.Time `json:"settledAt"` // nil if not settled
+}
+
+// sortTime orders transactions by when they settled, falling back to creation time
+func (transaction *AlbyTransaction) sortTime() time.Time {
+	if transaction.SettledAt != nil {
+		return *transaction.SettledAt
+	}
+	return transaction.CreatedAt
+}
+
+const (
+	TransactionSourceHub  = "hub"
+	TransactionSourceAlby = "alby"
+)
+
+// a settled transaction of either the hub or the Alby shared wallet
+type HistoryTransaction struct {
+	Source      string     `json:"source"` // hub or alby
+	Id          string     `json:"id"`     // hub transaction ID or Alby payment hash
+	Type        string     `json:"type"`   // incoming or outgoing
+	AmountSat   int64      `json:"amountSat"`
+	FeeSat      int64      `json:"feeSat"`
+	PaymentHash string     `json:"paymentHash"`
+	Description string     `json:"description"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	SettledAt   *time.Time `json:"settledAt"`
+}
+
+type TransactionHistoryParams struct {
+	Limit  uint64 `json:"limit"`
+	Cursor string `json:"cursor"` // NextCursor or PrevCursor of a previous page, empty for the newest transactions
+	Newer  bool   `json:"newer"`  // list the transactions newer than Cursor instead of older ones
+}
+
+type TransactionHistoryPage struct {
+	Transactions []HistoryTransaction `json:"transactions"` // newest first
+	NextCursor   string               `json:"nextCursor"`   // older transactions, empty on the last page
+	PrevCursor   string               `json:"prevCursor"`   // newer transactions, empty on the first page
+}
+
 type ChannelPeerSuggestion struct {
 	Network            string `json:"network"`
 	PaymentMethod      string `json:"paymentMethod"`
@@ -84,6 +395,31 @@ type ChannelPeerSuggestion struct {
 	LspType            string `json:"lspType"`
 }
 
+const (
+	SuggestionSortName           = "name"
+	SuggestionSortMinChannelSize = "minimumChannelSize" // smallest minimum first
+	SuggestionSortMaxChannelSize = "maximumChannelSize" // largest maximum first, peers without a maximum before all others
+)
+
+// SuggestionFilter narrows down channel peer suggestions. Zero values do not filter.
+type SuggestionFilter struct {
+	Network        string `json:"network"`
+	MinChannelSize uint64 `json:"minChannelSize"` // only peers which allow a channel of at least this size
+	SortBy         string `json:"sortBy"`
+}
+
+type ChannelBackup struct {
+	Description string                     `json:"description"`
+	Version     uint64                     `json:"version"`
+	Channels    []events.ChannelBackupInfo `json:"channels"`
+}
+
+type ChannelBackupVersion struct {
+	Id        string    `json:"id"`
+	Version   uint64    `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
 type ErrorResponse struct {
 	Message string `json:"message"`
 }
@@ -0,0 +1,88 @@
+package alby
+
+import (
+	"errors"
+	"strings"
+)
+
+type SendPaymentErrorClass string
+
+const (
+	SendPaymentErrorUnknown             SendPaymentErrorClass = "unknown"
+	SendPaymentErrorUnauthorized        SendPaymentErrorClass = "unauthorized"
+	SendPaymentErrorInsufficientBalance SendPaymentErrorClass = "insufficient_balance"
+	SendPaymentErrorInvalidInvoice      SendPaymentErrorClass = "invalid_invoice"
+	SendPaymentErrorRouteNotFound       SendPaymentErrorClass = "route_not_found"
+	SendPaymentErrorServer              SendPaymentErrorClass = "server_error"
+)
+
+// lndhub error codes, see https://github.com/getAlby/lndhub.go/blob/main/lib/responses/errors.go
+const (
+	lndhubErrorCodeBadAuth          = 1
+	lndhubErrorCodeNotEnoughBalance = 2
+	lndhubErrorCodeInvalidInvoice   = 4
+	lndhubErrorCodeServerError      = 6
+	lndhubErrorCodeBadArguments     = 8
+	lndhubErrorCodePaymentFailed    = 10
+)
+
+// SendPaymentError is returned when the shared wallet rejects or fails a payment
+type SendPaymentError struct {
+	Code    int
+	Message string
+	Class   SendPaymentErrorClass
+}
+
+func (err *SendPaymentError) Error() string {
+	return err.Message
+}
+
+// sendPaymentErrorResponse is the error payload of the lndhub payment endpoints
+type sendPaymentErrorResponse struct {
+	Error   bool   `json:"error"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func newSendPaymentError(code int, message string) *SendPaymentError {
+	return &SendPaymentError{
+		Code:    code,
+		Message: message,
+		Class:   classifySendPaymentError(code, message),
+	}
+}
+
+func classifySendPaymentError(code int, message string) SendPaymentErrorClass {
+	switch code {
+	case lndhubErrorCodeBadAuth:
+		return SendPaymentErrorUnauthorized
+	case lndhubErrorCodeNotEnoughBalance:
+		return SendPaymentErrorInsufficientBalance
+	case lndhubErrorCodeInvalidInvoice, lndhubErrorCodeBadArguments:
+		return SendPaymentErrorInvalidInvoice
+	case lndhubErrorCodeServerError:
+		return SendPaymentErrorServer
+	case lndhubErrorCodePaymentFailed:
+		// payments fail for many reasons, only some of which are routing related
+		if isRouteNotFoundMessage(message) {
+			return SendPaymentErrorRouteNotFound
+		}
+	}
+	return SendPaymentErrorUnknown
+}
+
+// isRouteNotFoundMessage guesses from the Alby API error message whether a
+// payment failed because the fee limit was too low to find a route
+func isRouteNotFoundMessage(message string) bool {
+	message = strings.ToLower(message)
+	return strings.Contains(message, "fee") || strings.Contains(message, "no route") || strings.Contains(message, "no_route")
+}
+
+// sendPaymentErrorClass returns the class of err, or SendPaymentErrorUnknown if it is not a SendPaymentError
+func sendPaymentErrorClass(err error) SendPaymentErrorClass {
+	var sendPaymentErr *SendPaymentError
+	if errors.As(err, &sendPaymentErr) {
+		return sendPaymentErr.Class
+	}
+	return SendPaymentErrorUnknown
+}
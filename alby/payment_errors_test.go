@@ -0,0 +1,45 @@
+package alby
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getAlby/hub/tests"
+)
+
+func TestClassifySendPaymentError(t *testing.T) {
+	assert.Equal(t, SendPaymentErrorUnauthorized, classifySendPaymentError(1, "bad auth"))
+	assert.Equal(t, SendPaymentErrorInsufficientBalance, classifySendPaymentError(2, "not enough balance. Make sure you have at least 1% reserved for potential fees"))
+	assert.Equal(t, SendPaymentErrorInvalidInvoice, classifySendPaymentError(4, "invalid invoice"))
+	assert.Equal(t, SendPaymentErrorInvalidInvoice, classifySendPaymentError(8, "Bad arguments"))
+	assert.Equal(t, SendPaymentErrorServer, classifySendPaymentError(6, "Something went wrong. Please try again later"))
+	assert.Equal(t, SendPaymentErrorRouteNotFound, classifySendPaymentError(10, "FAILURE_REASON_NO_ROUTE"))
+	assert.Equal(t, SendPaymentErrorUnknown, classifySendPaymentError(10, "FAILURE_REASON_INCORRECT_PAYMENT_DETAILS"))
+	assert.Equal(t, SendPaymentErrorUnknown, classifySendPaymentError(99, "unexpected"))
+}
+
+func TestSendPayment_StructuredError(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": true, "code": 2, "message": "not enough balance"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+
+	_, err := albyOAuthSvc.SendPayment(context.Background(), tests.MockInvoice)
+	var sendPaymentErr *SendPaymentError
+	assert.True(t, errors.As(err, &sendPaymentErr))
+	assert.Equal(t, 2, sendPaymentErr.Code)
+	assert.Equal(t, SendPaymentErrorInsufficientBalance, sendPaymentErr.Class)
+	assert.Equal(t, "not enough balance", err.Error())
+	assert.Equal(t, SendPaymentErrorInsufficientBalance, sendPaymentErrorClass(fmt.Errorf("wrapped: %w", err)))
+}
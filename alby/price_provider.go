@@ -0,0 +1,149 @@
+package alby
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PriceProvider returns the price of one bitcoin in the given fiat currency
+type PriceProvider interface {
+	RateFor(ctx context.Context, currency string) (float64, error)
+	// RateWithFetchTime also returns when the rate was fetched, which is only older
+	// than now if the provider caches rates
+	RateWithFetchTime(ctx context.Context, currency string) (float64, time.Time, error)
+}
+
+var ErrUnsupportedCurrency = errors.New("unsupported currency")
+
+// ISO 4217 currency codes
+var currencyCodeRegex = regexp.MustCompile("^[A-Za-z]{3}$")
+
+type AlbyOAuthServiceOption func(svc *albyOAuthService)
+
+// WithPriceProvider replaces the default Alby rates API used for fiat conversion
+func WithPriceProvider(priceProvider PriceProvider) AlbyOAuthServiceOption {
+	return func(svc *albyOAuthService) {
+		svc.priceProvider = priceProvider
+	}
+}
+
+const albyRatesUrl = "https://getalby.com/api/rates"
+
+type albyPriceProvider struct {
+	ratesUrl string
+}
+
+func NewAlbyPriceProvider(ratesUrl string) *albyPriceProvider {
+	return &albyPriceProvider{
+		ratesUrl: ratesUrl,
+	}
+}
+
+func (provider *albyPriceProvider) RateFor(ctx context.Context, currency string) (float64, error) {
+	if !currencyCodeRegex.MatchString(currency) {
+		return 0, fmt.Errorf("%w: %q", ErrUnsupportedCurrency, currency)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s.json", provider.ratesUrl, url.PathEscape(strings.ToLower(currency))), nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create rates request: %w", err)
+	}
+
+	setDefaultRequestHeaders(req)
+
+	// the rates API is public, so no OAuth client is needed
+	client := &http.Client{Timeout: 10 * time.Second}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to request rate: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return 0, fmt.Errorf("%w: %q", ErrUnsupportedCurrency, currency)
+	}
+	if res.StatusCode >= 300 {
+		return 0, fmt.Errorf("rates endpoint returned non-success status: %d", res.StatusCode)
+	}
+
+	type rateResponse struct {
+		RateFloat float64 `json:"rate_float"`
+	}
+
+	rate := &rateResponse{}
+	err = json.NewDecoder(limitResponseBody(res.Body, defaultMaxResponseBytes)).Decode(rate)
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode rate response: %w", err)
+	}
+
+	if rate.RateFloat <= 0 {
+		return 0, fmt.Errorf("invalid rate for %s: %f", currency, rate.RateFloat)
+	}
+
+	return rate.RateFloat, nil
+}
+
+func (provider *albyPriceProvider) RateWithFetchTime(ctx context.Context, currency string) (float64, time.Time, error) {
+	rate, err := provider.RateFor(ctx, currency)
+	return rate, time.Now(), err
+}
+
+type cachedRate struct {
+	rate      float64
+	fetchedAt time.Time
+}
+
+type cachingPriceProvider struct {
+	priceProvider PriceProvider
+	ttl           time.Duration
+	rates         map[string]cachedRate
+	ratesMutex    sync.Mutex
+}
+
+// NewCachingPriceProvider wraps priceProvider so each currency is fetched at most once per ttl
+func NewCachingPriceProvider(priceProvider PriceProvider, ttl time.Duration) *cachingPriceProvider {
+	return &cachingPriceProvider{
+		priceProvider: priceProvider,
+		ttl:           ttl,
+		rates:         map[string]cachedRate{},
+	}
+}
+
+func (provider *cachingPriceProvider) RateFor(ctx context.Context, currency string) (float64, error) {
+	rate, _, err := provider.RateWithFetchTime(ctx, currency)
+	return rate, err
+}
+
+func (provider *cachingPriceProvider) RateWithFetchTime(ctx context.Context, currency string) (float64, time.Time, error) {
+	currency = strings.ToUpper(currency)
+
+	provider.ratesMutex.Lock()
+	cached, ok := provider.rates[currency]
+	provider.ratesMutex.Unlock()
+	if ok && time.Since(cached.fetchedAt) < provider.ttl {
+		return cached.rate, cached.fetchedAt, nil
+	}
+
+	rate, err := provider.priceProvider.RateFor(ctx, currency)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+
+	fetchedAt := time.Now()
+	provider.ratesMutex.Lock()
+	provider.rates[currency] = cachedRate{
+		rate:      rate,
+		fetchedAt: fetchedAt,
+	}
+	provider.ratesMutex.Unlock()
+
+	return rate, fetchedAt, nil
+}
@@ -0,0 +1,104 @@
+package alby
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getAlby/hub/tests"
+)
+
+type stubPriceProvider struct {
+	rate  float64
+	calls int
+}
+
+func (provider *stubPriceProvider) RateFor(ctx context.Context, currency string) (float64, error) {
+	provider.calls++
+	return provider.rate, nil
+}
+
+func (provider *stubPriceProvider) RateWithFetchTime(ctx context.Context, currency string) (float64, time.Time, error) {
+	rate, err := provider.RateFor(ctx, currency)
+	return rate, time.Now(), err
+}
+
+func TestCachingPriceProvider(t *testing.T) {
+	stub := &stubPriceProvider{rate: 50_000}
+	priceProvider := NewCachingPriceProvider(stub, time.Hour)
+
+	for i := 0; i < 3; i++ {
+		rate, err := priceProvider.RateFor(context.Background(), "usd")
+		assert.NoError(t, err)
+		assert.Equal(t, float64(50_000), rate)
+	}
+	assert.Equal(t, 1, stub.calls)
+
+	_, err := priceProvider.RateFor(context.Background(), "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, stub.calls)
+}
+
+func TestGetBalanceWithFiat(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/internal/lndhub/balance", r.URL.Path)
+		w.Write([]byte(`{"balance": 21000, "currency": "BTC", "unit": "sat"}`))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	WithPriceProvider(&stubPriceProvider{rate: 100_000})(albyOAuthSvc)
+
+	balance, err := albyOAuthSvc.GetBalanceWithFiat(context.Background(), "usd")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(21000), balance.Balance)
+	assert.Equal(t, "USD", balance.FiatCurrency)
+	assert.InDelta(t, 21.0, balance.FiatBalance, 0.0001)
+	assert.Equal(t, float64(100_000), balance.Rate)
+	assert.False(t, balance.RateFetchedAt.IsZero())
+}
+
+func TestGetBalanceWithFiat_RatesEndpoint(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"balance": 21000, "currency": "BTC", "unit": "sat"}`))
+	}))
+	defer server.Close()
+
+	rateRequests := 0
+	ratesServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/eur.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rateRequests++
+		w.Write([]byte(`{"code": "EUR", "rate_float": 50000.5}`))
+	}))
+	defer ratesServer.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	WithPriceProvider(NewCachingPriceProvider(NewAlbyPriceProvider(ratesServer.URL), time.Hour))(albyOAuthSvc)
+
+	balance, err := albyOAuthSvc.GetBalanceWithFiat(context.Background(), "EUR")
+	assert.NoError(t, err)
+	assert.Equal(t, 50000.5, balance.Rate)
+	assert.InDelta(t, 10.500105, balance.FiatBalance, 0.0001)
+
+	// the cached rate keeps the time it was fetched
+	cachedBalance, err := albyOAuthSvc.GetBalanceWithFiat(context.Background(), "eur")
+	assert.NoError(t, err)
+	assert.Equal(t, balance.RateFetchedAt, cachedBalance.RateFetchedAt)
+	assert.Equal(t, 1, rateRequests)
+
+	_, err = albyOAuthSvc.GetBalanceWithFiat(context.Background(), "XYZ")
+	assert.ErrorIs(t, err, ErrUnsupportedCurrency)
+	_, err = albyOAuthSvc.GetBalanceWithFiat(context.Background(), "../usd")
+	assert.ErrorIs(t, err, ErrUnsupportedCurrency)
+}
@@ -0,0 +1,39 @@
+package alby
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+
+	"github.com/sirupsen/logrus"
+)
+
+type requestIdContextKey struct{}
+
+// withRequestId returns a context with a new correlation ID for an operation, which is
+// attached to its log entries and sent to the Alby API as X-Request-Id. Operations
+// started by another operation keep the ID of the outer one.
+func withRequestId(ctx context.Context) context.Context {
+	if requestIdFromContext(ctx) != "" {
+		return ctx
+	}
+	idBytes := make([]byte, 8)
+	// crypto/rand does not fail on supported platforms
+	cryptorand.Read(idBytes)
+	return context.WithValue(ctx, requestIdContextKey{}, hex.EncodeToString(idBytes))
+}
+
+// requestIdFromContext returns the correlation ID of the operation, or an empty string
+func requestIdFromContext(ctx context.Context) string {
+	requestId, _ := ctx.Value(requestIdContextKey{}).(string)
+	return requestId
+}
+
+// loggerFor returns the service logger with the correlation ID of the operation in ctx
+func (svc *albyOAuthService) loggerFor(ctx context.Context) *logrus.Entry {
+	requestId := requestIdFromContext(ctx)
+	if requestId == "" {
+		return logrus.NewEntry(svc.logger)
+	}
+	return svc.logger.WithField("request_id", requestId)
+}
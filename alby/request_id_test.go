@@ -0,0 +1,56 @@
+package alby
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getAlby/hub/tests"
+)
+
+func TestSendPayment_RequestId(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	var requestIds []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestIds = append(requestIds, r.Header.Get("X-Request-Id"))
+		switch r.URL.Path {
+		case "/internal/lndhub/balance":
+			w.Write([]byte(`{"balance": 1000, "currency": "BTC", "unit": "sat"}`))
+		case "/internal/lndhub/bolt11":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": true, "message": "no route"}`))
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyPayBalanceCheck = true
+	hook := test.NewLocal(albyOAuthSvc.logger)
+
+	_, err := albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.Error(t, err)
+
+	// the balance check and the payment are one operation
+	assert.Len(t, requestIds, 2)
+	assert.NotEmpty(t, requestIds[0])
+	assert.Equal(t, requestIds[0], requestIds[1])
+	assert.NotEmpty(t, hook.AllEntries())
+	for _, entry := range hook.AllEntries() {
+		assert.Equal(t, requestIds[0], entry.Data["request_id"])
+	}
+
+	_, err = albyOAuthSvc.SendPayment(context.Background(), mockInvoicesWithPreimage[0].invoice)
+	assert.Error(t, err)
+	assert.Len(t, requestIds, 4)
+	assert.Equal(t, requestIds[2], requestIds[3])
+	assert.NotEqual(t, requestIds[0], requestIds[2])
+
+	// an operation started by another one keeps its ID
+	ctx := withRequestId(context.Background())
+	assert.Equal(t, requestIdFromContext(ctx), requestIdFromContext(withRequestId(ctx)))
+}
@@ -0,0 +1,52 @@
+package alby
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrResponseTooLarge = errors.New("response body exceeds the maximum size")
+
+// responses of third party servers, e.g. lnurl-pay endpoints, are always limited to this size
+const defaultMaxResponseBytes = 4 << 20
+
+// maxSizeReader fails with ErrResponseTooLarge once more than remaining bytes are read,
+// so an oversized response is rejected rather than truncated into a different document
+type maxSizeReader struct {
+	reader    io.Reader
+	remaining int64
+	maxSize   int64
+}
+
+func limitResponseBody(body io.Reader, maxSize int64) io.Reader {
+	return &maxSizeReader{reader: body, remaining: maxSize, maxSize: maxSize}
+}
+
+func (r *maxSizeReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		// only fail if there is more data than allowed
+		var probe [1]byte
+		n, err := r.reader.Read(probe[:])
+		if n > 0 {
+			return 0, fmt.Errorf("%w of %d bytes", ErrResponseTooLarge, r.maxSize)
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.reader.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// limitBody limits a response body of the Alby API or the LSP to ALBY_MAX_RESPONSE_BYTES
+func (svc *albyOAuthService) limitBody(body io.Reader) io.Reader {
+	maxSize := svc.cfg.GetEnv().AlbyMaxResponseBytes
+	if maxSize <= 0 {
+		maxSize = defaultMaxResponseBytes
+	}
+	return limitResponseBody(body, maxSize)
+}
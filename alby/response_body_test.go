@@ -0,0 +1,139 @@
+package alby
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/getAlby/hub/tests"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+)
+
+func TestLimitResponseBody(t *testing.T) {
+	body, err := io.ReadAll(limitResponseBody(strings.NewReader("12345"), 5))
+	assert.NoError(t, err)
+	assert.Equal(t, "12345", string(body))
+
+	_, err = io.ReadAll(limitResponseBody(strings.NewReader("123456"), 5))
+	assert.ErrorIs(t, err, ErrResponseTooLarge)
+}
+
+func TestGetChannelPeerSuggestions_ResponseTooLarge(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a valid JSON array of about 230 KB
+		suggestions := strings.Repeat(`{"network": "bitcoin"},`, 10_000)
+		w.Write([]byte("[" + strings.TrimSuffix(suggestions, ",") + "]"))
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	albyOAuthSvc.cfg.GetEnv().AlbyMaxResponseBytes = 64 * 1024
+
+	_, err := albyOAuthSvc.GetChannelPeerSuggestions(context.Background())
+	assert.ErrorIs(t, err, ErrResponseTooLarge)
+}
+
+// closeTrackingTransport counts the response bodies which are not closed yet
+type closeTrackingTransport struct {
+	mutex sync.Mutex
+	open  int
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	transport *closeTrackingTransport
+	once      sync.Once
+}
+
+func (body *trackedBody) Close() error {
+	body.once.Do(func() {
+		body.transport.mutex.Lock()
+		defer body.transport.mutex.Unlock()
+		body.transport.open--
+	})
+	return body.ReadCloser.Close()
+}
+
+func (transport *closeTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.open++
+	res.Body = &trackedBody{ReadCloser: res.Body, transport: transport}
+	return res, nil
+}
+
+func (transport *closeTrackingTransport) openBodies() int {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	return transport.open
+}
+
+func TestResponseBodiesClosed(t *testing.T) {
+	defer tests.RemoveTestService()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/internal/users":
+			w.Write([]byte(`{"identifier": "123", "lightning_address": "hub@getalby.com"}`))
+		case "/internal/lndhub/balance":
+			w.Write([]byte(`{"balance": 1000, "currency": "BTC", "unit": "sat"}`))
+		case "/internal/lndhub/bolt11":
+			w.Write(payResponse(t, mockInvoicesWithPreimage[0].invoice))
+		case "/internal/nwcs":
+			w.Write([]byte(`{"pubkey": "abc"}`))
+		case "/internal/channel_suggestions":
+			w.Write([]byte(`[]`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer server.Close()
+
+	albyOAuthSvc, _ := createTestAlbyOAuthService(t, server.URL)
+	transport := &closeTrackingTransport{}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: transport})
+
+	calls := map[string]func() error{
+		"GetMeFresh": func() error {
+			_, err := albyOAuthSvc.GetMeFresh(ctx)
+			return err
+		},
+		"GetBalance": func() error {
+			_, err := albyOAuthSvc.GetBalance(ctx)
+			return err
+		},
+		"SendPayment": func() error {
+			_, err := albyOAuthSvc.SendPayment(ctx, mockInvoicesWithPreimage[0].invoice)
+			return err
+		},
+		"createAlbyAccountNWCNode": func() error {
+			_, err := albyOAuthSvc.createAlbyAccountNWCNode(ctx)
+			return err
+		},
+		"activateAlbyAccountNWCNode": func() error {
+			return albyOAuthSvc.activateAlbyAccountNWCNode(ctx)
+		},
+		"destroyAlbyAccountNWCNode": func() error {
+			return albyOAuthSvc.destroyAlbyAccountNWCNode(ctx)
+		},
+		"GetChannelPeerSuggestions": func() error {
+			_, err := albyOAuthSvc.GetChannelPeerSuggestions(ctx)
+			return err
+		},
+	}
+	for name, call := range calls {
+		assert.NoError(t, call(), name)
+		assert.Zero(t, transport.openBodies(), name)
+	}
+}
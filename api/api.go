@@ -662,7 +662,7 @@ func (api *api) GetInfo(ctx context.Context) (*InfoResponse, error) {
 	}
 	info.Running = api.svc.GetLNClient() != nil
 	info.BackendType = backendType
-	info.AlbyAuthUrl = api.albyOAuthSvc.GetAuthUrl()
+	info.AlbyRedirectUrl = api.albyOAuthSvc.RedirectURL()
 	info.OAuthRedirect = !api.cfg.GetEnv().IsDefaultClientId()
 	info.Version = version.Tag
 	info.EnableAdvancedSetup = api.cfg.GetEnv().EnableAdvancedSetup
@@ -157,7 +157,7 @@ type InfoResponse struct {
 	OAuthRedirect        bool      `json:"oauthRedirect"`
 	Running              bool      `json:"running"`
 	Unlocked             bool      `json:"unlocked"`
-	AlbyAuthUrl          string    `json:"albyAuthUrl"`
+	AlbyRedirectUrl      string    `json:"albyRedirectUrl"`
 	NextBackupReminder   string    `json:"nextBackupReminder"`
 	AlbyUserIdentifier   string    `json:"albyUserIdentifier"`
 	AlbyAccountConnected bool      `json:"albyAccountConnected"`
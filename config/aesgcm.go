@@ -5,6 +5,7 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"strings"
 
 	"golang.org/x/crypto/argon2"
@@ -71,6 +72,11 @@ func AesGcmDecrypt(ciphertext string, password string) (string, error) {
 		return "", err
 	}
 
+	// Open panics on a nonce of the wrong size
+	if len(nonce) != aesgcm.NonceSize() {
+		return "", errors.New("invalid nonce size")
+	}
+
 	plaintext, err := aesgcm.Open(nil, nonce, data, nil)
 	if err != nil {
 		return "", err
@@ -1,5 +1,7 @@
 package config
 
+import "strings"
+
 const (
 	LNDBackendType        = "LND"
 	GreenlightBackendType = "GREENLIGHT"
@@ -13,6 +15,14 @@ const (
 	OnchainAddressKey = "OnchainAddress"
 )
 
+// how events are delivered to the Alby API
+const (
+	EventsDeliverySync          = "sync"
+	EventsDeliveryFireAndForget = "fire-and-forget"
+	EventsDeliveryAtLeastOnce   = "at-least-once"
+	EventsDeliveryBatch         = "batch"
+)
+
 type AppConfig struct {
 	Relay                 string `envconfig:"RELAY" default:"wss://relay.getalby.com/v1"`
 	LNBackendType         string `envconfig:"LN_BACKEND_TYPE"`
@@ -28,15 +38,55 @@ type AppConfig struct {
 	LDKEsploraServer      string `envconfig:"LDK_ESPLORA_SERVER" default:"https://electrs.getalbypro.com"` // TODO: remove LDK prefix
 	LDKGossipSource       string `envconfig:"LDK_GOSSIP_SOURCE"`
 	LDKLogLevel           string `envconfig:"LDK_LOG_LEVEL" default:"3"`
+	AlbyLogLevel          string `envconfig:"ALBY_LOG_LEVEL"`
+	TokenRefreshRetries   int    `envconfig:"TOKEN_REFRESH_RETRIES" default:"3"`
+	TokenRefreshBackoffMs int    `envconfig:"TOKEN_REFRESH_BACKOFF_MS" default:"1000"`
+	DisableTokenRefresh   bool   `envconfig:"DISABLE_TOKEN_REFRESH" default:"false"` // expired tokens are only refreshed by RefreshToken
 	MempoolApi            string `envconfig:"MEMPOOL_API" default:"https://mempool.space/api"`
 	AlbyAPIURL            string `envconfig:"ALBY_API_URL" default:"https://api.getalby.com"`
 	AlbyClientId          string `envconfig:"ALBY_OAUTH_CLIENT_ID" default:"J2PbXS1yOf"`
 	AlbyClientSecret      string `envconfig:"ALBY_OAUTH_CLIENT_SECRET" default:"rABK2n16IWjLTZ9M1uKU"`
 	AlbyOAuthAuthUrl      string `envconfig:"ALBY_OAUTH_AUTH_URL" default:"https://getalby.com/oauth"`
+	AlbyOAuthScopes       string `envconfig:"ALBY_OAUTH_SCOPES"` // space or comma separated, empty for the default scopes
+	AlbyMeCacheSeconds    int    `envconfig:"ALBY_ME_CACHE_SECONDS" default:"60"`
+	AlbyBreakerThreshold  int    `envconfig:"ALBY_BREAKER_THRESHOLD" default:"5"` // consecutive failures, 0 disables the breaker
+	AlbyBreakerCooldownMs int    `envconfig:"ALBY_BREAKER_COOLDOWN_MS" default:"30000"`
+	AlbyMaxResponseBytes  int64  `envconfig:"ALBY_MAX_RESPONSE_BYTES" default:"4194304"` // responses of the Alby API and LSP
 	BaseUrl               string `envconfig:"BASE_URL"`
 	FrontendUrl           string `envconfig:"FRONTEND_URL"`
 	LogEvents             bool   `envconfig:"LOG_EVENTS" default:"true"`
+	LogEventsMaxSize      int    `envconfig:"LOG_EVENTS_MAX_SIZE" default:"65536"` // bytes, 0 for no limit
+	EventsDeliveryMode    string `envconfig:"EVENTS_DELIVERY_MODE" default:"sync"`
+	EventsQueueSize       int    `envconfig:"EVENTS_QUEUE_SIZE" default:"100"` // undelivered sync and at-least-once events kept for a later retry, 0 to drop them
+	EventsBatchSize       int    `envconfig:"EVENTS_BATCH_SIZE" default:"50"`
+	EventsBatchIntervalMs int    `envconfig:"EVENTS_BATCH_INTERVAL_MS" default:"1000"`
+	EventsWorkers         int    `envconfig:"EVENTS_WORKERS" default:"0"`          // consume events on a worker pool, 0 to consume them when published
+	EventsWorkerQueue     int    `envconfig:"EVENTS_WORKER_QUEUE" default:"100"`   // events waiting for a worker
+	EventsWorkerBlock     bool   `envconfig:"EVENTS_WORKER_BLOCK" default:"false"` // wait for space instead of dropping events when the worker queue is full
+	WebhookUrl            string `envconfig:"WEBHOOK_URL"`
+	WebhookSecret         string `envconfig:"WEBHOOK_SECRET"`
+	EventsAllowList       string `envconfig:"EVENTS_ALLOW_LIST"`    // comma-separated, empty for the default list
+	EventsSampleRates     string `envconfig:"EVENTS_SAMPLE_RATES"`  // comma-separated event:rate pairs, e.g. nwc_payment_received:0.1
+	EventsRedactFields    string `envconfig:"EVENTS_REDACT_FIELDS"` // comma-separated property keys removed from events sent to the Alby API and the webhook
 	AutoLinkAlbyAccount   bool   `envconfig:"AUTO_LINK_ALBY_ACCOUNT" default:"true"`
+	AutoLinkBudgetSat     uint64 `envconfig:"AUTO_LINK_BUDGET_SAT" default:"1000000"`
+	AutoLinkRenewal       string `envconfig:"AUTO_LINK_RENEWAL" default:"monthly"` // daily, weekly, monthly, yearly or never
+	AlbyUnlinkConfirm     bool   `envconfig:"ALBY_UNLINK_CONFIRM" default:"false"`
+	AlbyDrainMaxPartSat   uint64 `envconfig:"ALBY_DRAIN_MAX_PART_SAT" default:"0"`
+	AlbyDrainMaxFeePct    int    `envconfig:"ALBY_DRAIN_MAX_FEE_PCT" default:"3"`
+	AlbyMinBalanceSat     uint64 `envconfig:"ALBY_MIN_BALANCE_SAT" default:"0"`
+	AlbyPayBalanceCheck   bool   `envconfig:"ALBY_PAY_BALANCE_CHECK" default:"false"`
+	AlbyBackupKeep        int    `envconfig:"ALBY_BACKUP_KEEP" default:"3"` // channels backups kept by the Alby API
+	AlbyMaxChannelSizeSat uint64 `envconfig:"ALBY_MAX_CHANNEL_SIZE_SAT" default:"0"`
+	LSPTransport          string `envconfig:"LSP_TRANSPORT" default:"clearnet"`       // clearnet or tor, tried first when the LSP supports both
+	SocksProxyAddr        string `envconfig:"SOCKS_PROXY_ADDR"`                       // host:port of a SOCKS5 proxy such as Tor, required for onion LSPs
+	AlbyLSPPubkeys        string `envconfig:"ALBY_LSP_PUBKEYS"`                       // comma-separated network:pubkey pairs
+	PeerSuggestionRetries int    `envconfig:"PEER_SUGGESTION_RETRIES" default:"0"`    // retries when the suggestions list is empty
+	PeerSuggestionPages   int    `envconfig:"PEER_SUGGESTION_MAX_PAGES" default:"10"` // pages followed if the suggestions are paginated
+	SkipLegacyLspFields   bool   `envconfig:"SKIP_LEGACY_LSP_FIELDS" default:"false"` // ignore lsp_url and lsp_type in channel peer suggestions
+	HubInstanceId         string `envconfig:"HUB_INSTANCE_ID"`                        // defaults to the hub's nostr pubkey
+	LocalBackupDir        string `envconfig:"LOCAL_BACKUP_DIR"`
+	LocalBackupKeep       int    `envconfig:"LOCAL_BACKUP_KEEP" default:"5"` // 0 keeps every copy
 	PhoenixdAddress       string `envconfig:"PHOENIXD_ADDRESS"`
 	PhoenixdAuthorization string `envconfig:"PHOENIXD_AUTHORIZATION"`
 	GoProfilerAddr        string `envconfig:"GO_PROFILER_ADDR"`
@@ -45,6 +95,17 @@ type AppConfig struct {
 	AutoUnlockPassword    string `envconfig:"AUTO_UNLOCK_PASSWORD"`
 }
 
+// GetEventsRedactFields returns the event property keys set in EVENTS_REDACT_FIELDS
+func (c *AppConfig) GetEventsRedactFields() []string {
+	redactedFields := []string{}
+	for _, field := range strings.Split(c.EventsRedactFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			redactedFields = append(redactedFields, field)
+		}
+	}
+	return redactedFields
+}
+
 func (c *AppConfig) IsDefaultClientId() bool {
 	return c.AlbyClientId == "J2PbXS1yOf"
 }
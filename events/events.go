@@ -55,6 +55,22 @@ func (ep *eventPublisher) Publish(event *Event) {
 	}
 }
 
+// PublishSync publishes the event and waits until all listeners consumed it
+func (ep *eventPublisher) PublishSync(event *Event) {
+	ep.subscriberMtx.Lock()
+	defer ep.subscriberMtx.Unlock()
+	logger.Logger.WithFields(logrus.Fields{"event": event, "global": ep.globalProperties}).Debug("Publishing event synchronously")
+	var wg sync.WaitGroup
+	for _, listener := range ep.listeners {
+		wg.Add(1)
+		go func(listener EventSubscriber) {
+			defer wg.Done()
+			listener.ConsumeEvent(context.Background(), event, ep.globalProperties)
+		}(listener)
+	}
+	wg.Wait()
+}
+
 func (ep *eventPublisher) SetGlobalProperty(key string, value interface{}) {
 	ep.globalProperties[key] = value
 }
@@ -0,0 +1,248 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/getAlby/hub/logger"
+	"github.com/getAlby/hub/version"
+	"github.com/sirupsen/logrus"
+)
+
+const webhookSignatureHeader = "X-Hub-Signature-256"
+
+// events waiting to be delivered, further events are dropped while the queue is full
+const webhookQueueSize = 100
+
+// default delays between delivery attempts
+var defaultWebhookRetryDelays = []time.Duration{1 * time.Second, 5 * time.Second, 30 * time.Second}
+
+// event properties which are never sent to the webhook endpoint, e.g. the preimage proves
+// a payment was made and the payment request could be paid by anyone who receives it
+var webhookRedactedProperties = []string{"Preimage", "PaymentRequest"}
+
+// WebhookConsumer posts events to a self-hosted HTTP endpoint, as an alternative to the Alby events API
+type WebhookConsumer struct {
+	url    string
+	secret string
+	client *http.Client
+	queue  chan *webhookDelivery
+	done   chan struct{}
+	// delays between delivery attempts
+	retryDelays []time.Duration
+	// property keys removed in addition to webhookRedactedProperties, e.g. from EVENTS_REDACT_FIELDS
+	redactedFields []string
+	// guards queue against sends after it was closed on shutdown
+	queueMutex sync.Mutex
+	closed     bool
+}
+
+// webhookDelivery is a queued event, the name is kept so failures can be logged without the payload
+type webhookDelivery struct {
+	event   string
+	payload []byte
+}
+
+type webhookPayload struct {
+	Event      string                 `json:"event"`
+	Properties interface{}            `json:"properties,omitempty"`
+	Global     map[string]interface{} `json:"global"`
+}
+
+type WebhookConsumerOption func(*WebhookConsumer)
+
+// WithWebhookRetryDelays sets the delays between delivery attempts, no attempt is retried without delays
+func WithWebhookRetryDelays(retryDelays ...time.Duration) WebhookConsumerOption {
+	return func(consumer *WebhookConsumer) {
+		consumer.retryDelays = retryDelays
+	}
+}
+
+// WithWebhookRedactedFields removes the given keys from the event and global properties sent to the endpoint
+func WithWebhookRedactedFields(redactedFields []string) WebhookConsumerOption {
+	return func(consumer *WebhookConsumer) {
+		consumer.redactedFields = redactedFields
+	}
+}
+
+func NewWebhookConsumer(url string, secret string, opts ...WebhookConsumerOption) *WebhookConsumer {
+	consumer := &WebhookConsumer{
+		url:         url,
+		secret:      secret,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *webhookDelivery, webhookQueueSize),
+		done:        make(chan struct{}),
+		retryDelays: defaultWebhookRetryDelays,
+	}
+	for _, opt := range opts {
+		opt(consumer)
+	}
+	go consumer.deliver()
+	return consumer
+}
+
+func (consumer *WebhookConsumer) ConsumeEvent(ctx context.Context, event *Event, globalProperties map[string]interface{}) {
+	if strings.HasPrefix(event.Event, "nwc_lnclient_") {
+		// don't consume internal LNClient events
+		return
+	}
+	if event.Event == "nwc_backup_channels" {
+		// channel backups are only sent encrypted to the Alby API
+		return
+	}
+
+	properties, err := consumer.redactProperties(event.Properties)
+	if err != nil {
+		logger.Logger.WithField("event", event.Event).WithError(err).Error("Failed to redact webhook event properties")
+		return
+	}
+
+	global := map[string]interface{}{}
+	for key, value := range globalProperties {
+		if !consumer.isRedacted(key) {
+			global[key] = value
+		}
+	}
+
+	payload, err := json.Marshal(&webhookPayload{
+		Event:      event.Event,
+		Properties: properties,
+		Global:     global,
+	})
+	if err != nil {
+		logger.Logger.WithField("event", event.Event).WithError(err).Error("Failed to encode webhook payload")
+		return
+	}
+
+	consumer.queueMutex.Lock()
+	defer consumer.queueMutex.Unlock()
+	if consumer.closed {
+		return
+	}
+
+	// a slow endpoint must not block event publishing
+	select {
+	case consumer.queue <- &webhookDelivery{event: event.Event, payload: payload}:
+	default:
+		logger.Logger.WithField("event", event.Event).Warn("Webhook queue is full, dropping event")
+	}
+}
+
+// Shutdown stops accepting events and waits for queued events to be delivered until the context is done
+func (consumer *WebhookConsumer) Shutdown(ctx context.Context) {
+	consumer.queueMutex.Lock()
+	if !consumer.closed {
+		consumer.closed = true
+		close(consumer.queue)
+	}
+	consumer.queueMutex.Unlock()
+
+	select {
+	case <-consumer.done:
+	case <-ctx.Done():
+		logger.Logger.WithField("pending", len(consumer.queue)).Warn("Timed out delivering webhook events")
+	}
+}
+
+func (consumer *WebhookConsumer) deliver() {
+	defer close(consumer.done)
+	for delivery := range consumer.queue {
+		for attempt := 0; ; attempt++ {
+			status, retryable, err := consumer.send(delivery.payload)
+			if err == nil {
+				break
+			}
+			if !retryable || attempt >= len(consumer.retryDelays) {
+				// the payload is not logged, it may contain amounts, descriptions or global properties
+				logger.Logger.WithFields(logrus.Fields{
+					"event":    delivery.event,
+					"status":   status,
+					"attempts": attempt + 1,
+				}).WithError(err).Error("Failed to deliver webhook event")
+				break
+			}
+			time.Sleep(consumer.retryDelays[attempt])
+		}
+	}
+}
+
+// redactProperties returns the JSON properties of an event without the redacted ones.
+// Properties which are not a JSON object are returned unchanged.
+func (consumer *WebhookConsumer) redactProperties(properties interface{}) (interface{}, error) {
+	if properties == nil {
+		return nil, nil
+	}
+	// the properties are usually a struct, so they are converted to a map through their JSON encoding
+	propertiesBytes, err := json.Marshal(properties)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode event properties: %w", err)
+	}
+	var decoded interface{}
+	err = json.Unmarshal(propertiesBytes, &decoded)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode event properties: %w", err)
+	}
+	propertiesMap, ok := decoded.(map[string]interface{})
+	if !ok {
+		return decoded, nil
+	}
+
+	for key := range propertiesMap {
+		if consumer.isRedacted(key) {
+			delete(propertiesMap, key)
+		}
+	}
+	return propertiesMap, nil
+}
+
+// isRedacted matches keys regardless of case and underscores, as struct properties are
+// encoded with their field names, e.g. payment_request matches PaymentRequest
+func (consumer *WebhookConsumer) isRedacted(key string) bool {
+	normalize := func(key string) string {
+		return strings.ToLower(strings.ReplaceAll(key, "_", ""))
+	}
+	return slices.ContainsFunc(slices.Concat(webhookRedactedProperties, consumer.redactedFields), func(field string) bool {
+		return normalize(field) == normalize(key)
+	})
+}
+
+// send posts payload to the endpoint and returns the response status, which is 0 if there was no response
+func (consumer *WebhookConsumer) send(payload []byte) (status int, retryable bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, consumer.url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "AlbyHub/"+version.Tag)
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(consumer.secret, payload))
+
+	res, err := consumer.client.Do(req)
+	if err != nil {
+		return 0, true, fmt.Errorf("failed to send webhook request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		// if the endpoint rejected the event itself, sending it again would fail the same way
+		retryable := res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests
+		return res.StatusCode, retryable, fmt.Errorf("webhook endpoint returned non-success status: %d", res.StatusCode)
+	}
+	return res.StatusCode, false, nil
+}
+
+// signWebhookPayload returns the HMAC-SHA256 of payload in the "sha256=<hex>" format used by GitHub webhooks
+func signWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,162 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/getAlby/hub/logger"
+)
+
+func TestWebhookConsumer_SignsPayload(t *testing.T) {
+	type request struct {
+		signature string
+		body      []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		requests <- request{signature: r.Header.Get(webhookSignatureHeader), body: body}
+	}))
+	defer server.Close()
+
+	consumer := NewWebhookConsumer(server.URL, "secret")
+	consumer.ConsumeEvent(context.Background(), &Event{Event: "nwc_started"}, map[string]interface{}{"version": "v1.0.0"})
+
+	select {
+	case received := <-requests:
+		assert.Equal(t, signWebhookPayload("secret", received.body), received.signature)
+		assert.NotEqual(t, signWebhookPayload("other-secret", received.body), received.signature)
+
+		payload := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(received.body, &payload))
+		assert.Equal(t, "nwc_started", payload["event"])
+		assert.Equal(t, map[string]interface{}{"version": "v1.0.0"}, payload["global"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	consumer.Shutdown(ctx)
+}
+
+func TestSignWebhookPayload(t *testing.T) {
+	// echo -n '{"event":"nwc_started"}' | openssl dgst -sha256 -hmac secret
+	assert.Equal(t, "sha256=30f49b05ce292eb05a578fe7cfc841543207d4d4102f34d5e0132da68fce6b53", signWebhookPayload("secret", []byte(`{"event":"nwc_started"}`)))
+}
+
+func TestWebhookConsumer_SkipsInternalEvents(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+	}))
+	defer server.Close()
+
+	consumer := NewWebhookConsumer(server.URL, "secret")
+	consumer.ConsumeEvent(context.Background(), &Event{Event: "nwc_lnclient_started"}, nil)
+	consumer.ConsumeEvent(context.Background(), &Event{Event: "nwc_backup_channels"}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	consumer.Shutdown(ctx)
+	assert.Equal(t, int32(0), requests.Load())
+
+	// events consumed after shutdown are dropped
+	consumer.ConsumeEvent(context.Background(), &Event{Event: "nwc_started"}, nil)
+}
+
+func TestWebhookConsumer_RetriesServerErrors(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	consumer := NewWebhookConsumer(server.URL, "secret", WithWebhookRetryDelays(0, 0))
+	consumer.ConsumeEvent(context.Background(), &Event{Event: "nwc_started"}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	consumer.Shutdown(ctx)
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestWebhookConsumer_LogsFailuresWithoutPayload(t *testing.T) {
+	logger.Init("")
+	hook := test.NewLocal(logger.Logger)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	consumer := NewWebhookConsumer(server.URL, "secret")
+	consumer.ConsumeEvent(context.Background(), &Event{
+		Event:      "nwc_payment_received",
+		Properties: map[string]interface{}{"description": "coffee"},
+	}, map[string]interface{}{"node_alias": "my node"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	consumer.Shutdown(ctx)
+
+	entry := hook.LastEntry()
+	assert.NotNil(t, entry)
+	assert.Equal(t, "nwc_payment_received", entry.Data["event"])
+	assert.Equal(t, http.StatusBadRequest, entry.Data["status"])
+	assert.NotContains(t, entry.Data, "payload")
+}
+
+func TestWebhookConsumer_RedactsProperties(t *testing.T) {
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		bodies <- body
+	}))
+	defer server.Close()
+
+	type transaction struct {
+		PaymentHash    string
+		PaymentRequest string
+		Preimage       *string
+		Description    string
+	}
+	preimage := "preimage"
+	consumer := NewWebhookConsumer(server.URL, "secret", WithWebhookRedactedFields([]string{"description", "node_type"}))
+	consumer.ConsumeEvent(context.Background(), &Event{
+		Event: "nwc_payment_received",
+		Properties: &transaction{
+			PaymentHash:    "hash",
+			PaymentRequest: "lnbc1",
+			Preimage:       &preimage,
+			Description:    "coffee",
+		},
+	}, map[string]interface{}{"version": "v1.0.0", "node_type": "LDK"})
+
+	select {
+	case body := <-bodies:
+		payload := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal(body, &payload))
+		assert.Equal(t, map[string]interface{}{"PaymentHash": "hash"}, payload["properties"])
+		assert.Equal(t, map[string]interface{}{"version": "v1.0.0"}, payload["global"])
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	consumer.Shutdown(ctx)
+}
@@ -43,11 +43,16 @@ function AuthCodeForm({ url }: AuthCodeFormProps) {
     e.preventDefault();
     setLoading(true);
     try {
-      await request(`/api/alby/callback?code=${authCode}`, {
-        headers: {
-          "Content-Type": "application/json",
-        },
-      });
+      // the state issued with the auth URL must be passed back to the callback
+      const state = new URL(url).searchParams.get("state") ?? "";
+      await request(
+        `/api/alby/callback?code=${authCode}&state=${encodeURIComponent(state)}`,
+        {
+          headers: {
+            "Content-Type": "application/json",
+          },
+        }
+      );
       await refetchInfo();
       navigate("/");
     } catch (error) {
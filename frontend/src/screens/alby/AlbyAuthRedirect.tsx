@@ -3,26 +3,51 @@ import { useLocation } from "react-router-dom";
 import AuthCodeForm from "src/components/AuthCodeForm";
 
 import Loading from "src/components/Loading";
+import { useToast } from "src/components/ui/use-toast";
 import { useInfo } from "src/hooks/useInfo";
+import { AlbyAuthUrlResponse } from "src/types";
+import { handleRequestError } from "src/utils/handleRequestError";
+import { request } from "src/utils/request";
 
 export default function AlbyAuthRedirect() {
   const { data: info } = useInfo();
+  const { toast } = useToast();
   const location = useLocation();
   const queryParams = new URLSearchParams(location.search);
   const forceLogin = !!queryParams.get("force_login");
-  const url = info?.albyAuthUrl
-    ? (() => {
-        const _url = new URL(info.albyAuthUrl);
-        if (forceLogin) {
-          _url.searchParams.append("force_login", "true");
-        }
-        if (info.albyUserIdentifier) {
-          _url.searchParams.append("identifier", info.albyUserIdentifier);
-        }
+  const [albyAuthUrl, setAlbyAuthUrl] = React.useState<string>();
 
-        return _url.toString();
-      })()
-    : undefined;
+  // the auth URL issues a new OAuth state, so it is only requested once the login starts
+  React.useEffect(() => {
+    (async () => {
+      try {
+        const response = await request<AlbyAuthUrlResponse>(
+          "/api/alby/auth-url",
+          {
+            method: "POST",
+          }
+        );
+        setAlbyAuthUrl(response?.url);
+      } catch (error) {
+        handleRequestError(toast, "Failed to start the Alby login", error);
+      }
+    })();
+  }, [toast]);
+
+  const url =
+    info && albyAuthUrl
+      ? (() => {
+          const _url = new URL(albyAuthUrl);
+          if (forceLogin) {
+            _url.searchParams.append("force_login", "true");
+          }
+          if (info.albyUserIdentifier) {
+            _url.searchParams.append("identifier", info.albyUserIdentifier);
+          }
+
+          return _url.toString();
+        })()
+      : undefined;
 
   React.useEffect(() => {
     if (!info || !url) {
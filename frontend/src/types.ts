@@ -141,7 +141,7 @@ export interface InfoResponse {
   oauthRedirect: boolean;
   albyAccountConnected: boolean;
   running: boolean;
-  albyAuthUrl: string;
+  albyRedirectUrl: string;
   nextBackupReminder: string;
   albyUserIdentifier: string;
   network?: Network;
@@ -334,6 +334,13 @@ export type AlbyMe = {
     latest_version: string;
     name?: string;
   };
+  subscription?: {
+    plan_code: string;
+  };
+};
+
+export type AlbyAuthUrlResponse = {
+  url: string;
 };
 
 export type AlbyBalance = {
@@ -355,13 +362,31 @@ export type LSPOrderResponse = {
   outgoingLiquidity: number;
 };
 
+export type AlbyTokenStatus = {
+  tokenPresent: boolean;
+  expiresAt?: string;
+  expiresInSeconds: number;
+  expired: boolean;
+  hasRefreshToken: boolean;
+  grantedScopes: string[];
+};
+
 export type AutoChannelRequest = {
   isPublic: boolean;
+  paymentMethod?: "lightning" | "onchain";
+  channelSizeSat?: number;
 };
 export type AutoChannelResponse = {
   invoice?: string;
   fee?: number;
   channelSize: number;
+  onchainPayment?: {
+    address: string;
+    feeTotalSat: number;
+    orderTotalSat: number;
+    networkFeeSat: number;
+    minConfirmations: number;
+  };
 };
 
 export type RedeemOnchainFundsResponse = {
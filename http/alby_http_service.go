@@ -30,11 +30,24 @@ func (albyHttpSvc *AlbyHttpService) RegisterSharedRoutes(restrictedGroup *echo.G
 	e.GET("/api/alby/callback", albyHttpSvc.albyCallbackHandler)
 	restrictedGroup.GET("/api/alby/me", albyHttpSvc.albyMeHandler)
 	restrictedGroup.GET("/api/alby/balance", albyHttpSvc.albyBalanceHandler)
+	restrictedGroup.GET("/api/alby/balance/last-known", albyHttpSvc.albyLastKnownBalanceHandler)
+	restrictedGroup.GET("/api/alby/summary", albyHttpSvc.albySummaryHandler)
+	restrictedGroup.GET("/api/alby/node-info", albyHttpSvc.albyNodeInfoHandler)
+	restrictedGroup.GET("/api/alby/health", albyHttpSvc.albyHealthHandler)
+	restrictedGroup.GET("/api/alby/token-status", albyHttpSvc.albyTokenStatusHandler)
+	restrictedGroup.POST("/api/alby/auth-url", albyHttpSvc.albyAuthUrlHandler)
 	restrictedGroup.POST("/api/alby/pay", albyHttpSvc.albyPayHandler)
 	restrictedGroup.POST("/api/alby/drain", albyHttpSvc.albyDrainHandler)
 	restrictedGroup.POST("/api/alby/link-account", albyHttpSvc.albyLinkAccountHandler)
+	restrictedGroup.GET("/api/alby/link-account/preview", albyHttpSvc.albyPreviewLinkAccountHandler)
+	restrictedGroup.POST("/api/alby/rotate-nwc", albyHttpSvc.albyRotateNWCHandler)
+	restrictedGroup.GET("/api/alby/auto-link", albyHttpSvc.albyAutoLinkStatusHandler)
+	restrictedGroup.POST("/api/alby/auto-link/retry", albyHttpSvc.albyRetryAutoLinkHandler)
 	restrictedGroup.POST("/api/alby/auto-channel", albyHttpSvc.autoChannelHandler)
+	restrictedGroup.GET("/api/alby/auto-channel/:orderId", albyHttpSvc.autoChannelOrderStatusHandler)
 	restrictedGroup.POST("/api/alby/unlink-account", albyHttpSvc.unlinkHandler)
+	restrictedGroup.GET("/api/alby/accounts", albyHttpSvc.albyLinkedAccountsHandler)
+	restrictedGroup.POST("/api/alby/accounts/switch", albyHttpSvc.albySwitchAccountHandler)
 }
 
 func (albyHttpSvc *AlbyHttpService) autoChannelHandler(c echo.Context) error {
@@ -47,7 +60,7 @@ func (albyHttpSvc *AlbyHttpService) autoChannelHandler(c echo.Context) error {
 		})
 	}
 
-	autoChannelResponseResponse, err := albyHttpSvc.albyOAuthSvc.RequestAutoChannel(ctx, albyHttpSvc.svc.GetLNClient(), autoChannelRequest.IsPublic)
+	autoChannelResponseResponse, err := albyHttpSvc.albyOAuthSvc.RequestAutoChannel(ctx, albyHttpSvc.svc.GetLNClient(), autoChannelRequest.IsPublic, autoChannelRequest.PaymentMethod, autoChannelRequest.ChannelSizeSat)
 
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{
@@ -58,10 +71,42 @@ func (albyHttpSvc *AlbyHttpService) autoChannelHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, autoChannelResponseResponse)
 }
 
+func (albyHttpSvc *AlbyHttpService) autoChannelOrderStatusHandler(c echo.Context) error {
+	autoChannelResponse, err := albyHttpSvc.albyOAuthSvc.GetAutoChannelOrderStatus(c.Request().Context(), albyHttpSvc.svc.GetLNClient(), c.Param("orderId"))
+
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to get auto channel order status: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, autoChannelResponse)
+}
+
 func (albyHttpSvc *AlbyHttpService) unlinkHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	err := albyHttpSvc.albyOAuthSvc.UnlinkAccount(ctx)
+	var unlinkAccountRequest alby.AlbyUnlinkAccountRequest
+	if err := c.Bind(&unlinkAccountRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Message: fmt.Sprintf("Bad request: %s", err.Error()),
+		})
+	}
+
+	err := albyHttpSvc.albyOAuthSvc.UnlinkAccount(ctx, unlinkAccountRequest.Confirm)
+
+	if errors.Is(err, alby.ErrConfirmationRequired) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Message: err.Error(),
+		})
+	}
+
+	// the account is unlinked, but the user should know about the remaining connection
+	if errors.Is(err, alby.ErrUnlinkIncomplete) {
+		return c.JSON(http.StatusBadGateway, ErrorResponse{
+			Message: err.Error(),
+		})
+	}
 
 	if err != nil {
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{
@@ -74,8 +119,14 @@ func (albyHttpSvc *AlbyHttpService) unlinkHandler(c echo.Context) error {
 
 func (albyHttpSvc *AlbyHttpService) albyCallbackHandler(c echo.Context) error {
 	code := c.QueryParam("code")
+	state := c.QueryParam("state")
 
-	err := albyHttpSvc.albyOAuthSvc.CallbackHandler(c.Request().Context(), code, albyHttpSvc.svc.GetLNClient())
+	err := albyHttpSvc.albyOAuthSvc.CallbackHandler(c.Request().Context(), code, state, albyHttpSvc.svc.GetLNClient())
+	if errors.Is(err, alby.ErrOAuthStateMismatch) || errors.Is(err, alby.ErrOAuthStateExpired) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Message: err.Error(),
+		})
+	}
 	if err != nil {
 		logger.Logger.WithError(err).Error("Failed to handle Alby OAuth callback")
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{
@@ -124,7 +175,89 @@ func (albyHttpSvc *AlbyHttpService) albyBalanceHandler(c echo.Context) error {
 	}
 
 	return c.JSON(http.StatusOK, &alby.AlbyBalanceResponse{
-		Sats: balance.Balance,
+		Sats: balance.BalanceSat(),
+	})
+}
+
+func (albyHttpSvc *AlbyHttpService) albyLastKnownBalanceHandler(c echo.Context) error {
+	balance, updatedAt, err := albyHttpSvc.albyOAuthSvc.GetLastKnownBalance()
+	if errors.Is(err, alby.ErrNoLastKnownBalance) {
+		return c.JSON(http.StatusNotFound, ErrorResponse{
+			Message: err.Error(),
+		})
+	}
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to get last known alby balance")
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to get last known alby balance: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, &alby.AlbyLastKnownBalanceResponse{
+		Sats:      balance.BalanceSat(),
+		UpdatedAt: updatedAt,
+	})
+}
+
+func (albyHttpSvc *AlbyHttpService) albySummaryHandler(c echo.Context) error {
+	summary, err := albyHttpSvc.albyOAuthSvc.GetAccountSummary(c.Request().Context())
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to request alby account summary")
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to request alby account summary: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, summary)
+}
+
+func (albyHttpSvc *AlbyHttpService) albyNodeInfoHandler(c echo.Context) error {
+	info, err := albyHttpSvc.albyOAuthSvc.GetNodeAndAccountInfo(c.Request().Context(), albyHttpSvc.svc.GetLNClient())
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to get node and alby account info")
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to get node and alby account info: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, info)
+}
+
+func (albyHttpSvc *AlbyHttpService) albyHealthHandler(c echo.Context) error {
+	health, err := albyHttpSvc.albyOAuthSvc.HealthCheck(c.Request().Context())
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to check alby health")
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to check alby health: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, health)
+}
+
+func (albyHttpSvc *AlbyHttpService) albyTokenStatusHandler(c echo.Context) error {
+	tokenStatus, err := albyHttpSvc.albyOAuthSvc.GetTokenStatus()
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to get alby token status")
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to get alby token status: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, tokenStatus)
+}
+
+// albyAuthUrlHandler starts the login flow, every auth URL carries a persisted OAuth state
+func (albyHttpSvc *AlbyHttpService) albyAuthUrlHandler(c echo.Context) error {
+	authUrl := albyHttpSvc.albyOAuthSvc.GetAuthUrl()
+	if authUrl == "" {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: "Failed to get alby auth url",
+		})
+	}
+
+	return c.JSON(http.StatusOK, &alby.AlbyAuthUrlResponse{
+		Url: authUrl,
 	})
 }
 
@@ -136,7 +269,7 @@ func (albyHttpSvc *AlbyHttpService) albyPayHandler(c echo.Context) error {
 		})
 	}
 
-	err := albyHttpSvc.albyOAuthSvc.SendPayment(c.Request().Context(), payRequest.Invoice)
+	payResponse, err := albyHttpSvc.albyOAuthSvc.SendPayment(c.Request().Context(), payRequest.Invoice)
 	if err != nil {
 		logger.Logger.WithError(err).Error("Failed to request alby pay endpoint")
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{
@@ -144,21 +277,34 @@ func (albyHttpSvc *AlbyHttpService) albyPayHandler(c echo.Context) error {
 		})
 	}
 
-	return c.NoContent(http.StatusNoContent)
+	return c.JSON(http.StatusOK, payResponse)
 }
 
 func (albyHttpSvc *AlbyHttpService) albyDrainHandler(c echo.Context) error {
+	// the memo is optional, an empty body drains with the default description
+	var drainMemo alby.DrainMemo
+	if err := c.Bind(&drainMemo); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Message: fmt.Sprintf("Bad request: %s", err.Error()),
+		})
+	}
 
-	err := albyHttpSvc.albyOAuthSvc.DrainSharedWallet(c.Request().Context(), albyHttpSvc.svc.GetLNClient())
+	drainResult, err := albyHttpSvc.albyOAuthSvc.DrainSharedWallet(c.Request().Context(), albyHttpSvc.svc.GetLNClient(), nil, &drainMemo)
+
+	if errors.Is(err, alby.ErrDrainInProgress) {
+		return c.JSON(http.StatusConflict, ErrorResponse{
+			Message: err.Error(),
+		})
+	}
 
 	if err != nil {
-		logger.Logger.WithError(err).Error("Failed to drain shared wallet")
+		logger.Logger.WithError(err).WithField("result", drainResult).Error("Failed to drain shared wallet")
 		return c.JSON(http.StatusInternalServerError, ErrorResponse{
 			Message: fmt.Sprintf("Failed to drain shared wallet: %s", err.Error()),
 		})
 	}
 
-	return c.NoContent(http.StatusNoContent)
+	return c.JSON(http.StatusOK, drainResult)
 }
 
 func (albyHttpSvc *AlbyHttpService) albyLinkAccountHandler(c echo.Context) error {
@@ -177,3 +323,102 @@ func (albyHttpSvc *AlbyHttpService) albyLinkAccountHandler(c echo.Context) error
 
 	return c.NoContent(http.StatusNoContent)
 }
+
+func (albyHttpSvc *AlbyHttpService) albyRotateNWCHandler(c echo.Context) error {
+	err := albyHttpSvc.albyOAuthSvc.RotateNWCConnection(c.Request().Context(), albyHttpSvc.svc.GetLNClient())
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to rotate alby account nwc connection")
+		status := http.StatusInternalServerError
+		if errors.Is(err, alby.ErrAccountNotLinked) {
+			status = http.StatusBadRequest
+		}
+		return c.JSON(status, ErrorResponse{
+			Message: fmt.Sprintf("Failed to rotate alby account nwc connection: %s", err.Error()),
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (albyHttpSvc *AlbyHttpService) albyPreviewLinkAccountHandler(c echo.Context) error {
+	preview, err := albyHttpSvc.albyOAuthSvc.PreviewLinkAccount(c.Request().Context(), albyHttpSvc.svc.GetLNClient())
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to preview alby account link")
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to preview alby account link: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, preview)
+}
+
+func (albyHttpSvc *AlbyHttpService) albyAutoLinkStatusHandler(c echo.Context) error {
+	autoLinkStatus, err := albyHttpSvc.albyOAuthSvc.GetAutoLinkStatus()
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to get auto-link status")
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to get auto-link status: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, &alby.AlbyAutoLinkStatusResponse{
+		Status: autoLinkStatus,
+	})
+}
+
+func (albyHttpSvc *AlbyHttpService) albyRetryAutoLinkHandler(c echo.Context) error {
+	err := albyHttpSvc.albyOAuthSvc.RetryAutoLink(c.Request().Context(), albyHttpSvc.svc.GetLNClient())
+
+	if errors.Is(err, alby.ErrAutoLinkNotFailed) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Message: err.Error(),
+		})
+	}
+
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to retry auto-link: %s", err.Error()),
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (albyHttpSvc *AlbyHttpService) albyLinkedAccountsHandler(c echo.Context) error {
+	accounts, err := albyHttpSvc.albyOAuthSvc.ListLinkedAccounts()
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to list linked accounts: %s", err.Error()),
+		})
+	}
+
+	return c.JSON(http.StatusOK, &alby.AlbyLinkedAccountsResponse{
+		Accounts:      accounts,
+		ActiveAccount: albyHttpSvc.albyOAuthSvc.ActiveAccount(),
+	})
+}
+
+func (albyHttpSvc *AlbyHttpService) albySwitchAccountHandler(c echo.Context) error {
+	var switchAccountRequest alby.AlbySwitchAccountRequest
+	if err := c.Bind(&switchAccountRequest); err != nil {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Message: fmt.Sprintf("Bad request: %s", err.Error()),
+		})
+	}
+
+	err := albyHttpSvc.albyOAuthSvc.SwitchActiveAccount(switchAccountRequest.Name)
+
+	if errors.Is(err, alby.ErrInvalidAccountName) {
+		return c.JSON(http.StatusBadRequest, ErrorResponse{
+			Message: err.Error(),
+		})
+	}
+
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, ErrorResponse{
+			Message: fmt.Sprintf("Failed to switch account: %s", err.Error()),
+		})
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
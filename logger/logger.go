@@ -28,6 +28,27 @@ func Init(logLevel string) {
 	Logger.SetLevel(logrus.Level(logrusLogLevel))
 }
 
+// NewComponentLogger returns a logger which shares the output, formatter and hooks
+// of the main logger but has its own level. The main logger is used if no level is set.
+func NewComponentLogger(logLevel string) *logrus.Logger {
+	if logLevel == "" {
+		return Logger
+	}
+	componentLogLevel, err := strconv.Atoi(logLevel)
+	if err != nil {
+		Logger.WithField("logLevel", logLevel).Error("Invalid component log level, using default log level")
+		return Logger
+	}
+	return &logrus.Logger{
+		Out:          Logger.Out,
+		Hooks:        Logger.Hooks,
+		Formatter:    Logger.Formatter,
+		ReportCaller: Logger.ReportCaller,
+		ExitFunc:     Logger.ExitFunc,
+		Level:        logrus.Level(componentLogLevel),
+	}
+}
+
 func AddFileLogger(workdir string) error {
 	logFilePath = filepath.Join(workdir, logDir, logFilename)
 	fileLoggerHook, err := lumberjackrus.NewHook(
@@ -1,22 +1,34 @@
 package keys
 
 import (
+	"crypto/sha256"
+	"io"
+
 	"github.com/getAlby/hub/config"
 	"github.com/getAlby/hub/logger"
 	"github.com/nbd-wtf/go-nostr"
+	"github.com/tyler-smith/go-bip39"
+	"golang.org/x/crypto/hkdf"
 )
 
+// HKDF info of the channels backup encryption key, change it to rotate the key for new backups
+const backupEncryptionKeyInfo = "alby-hub/channels-backup/v2"
+
 type Keys interface {
 	Init(cfg config.Config, encryptionKey string) error
 	// Wallet Service Nostr pubkey
 	GetNostrPublicKey() string
 	// Wallet Service Nostr secret key
 	GetNostrSecretKey() string
+	// Channels backup encryption key, derived from the master seed so it does not
+	// change with the unlock password. Nil if the hub has no mnemonic.
+	GetBackupEncryptionKey() []byte
 }
 
 type keys struct {
-	nostrSecretKey string
-	nostrPublicKey string
+	nostrSecretKey      string
+	nostrPublicKey      string
+	backupEncryptionKey []byte
 }
 
 func NewKeys() *keys {
@@ -37,9 +49,33 @@ func (keys *keys) Init(cfg config.Config, encryptionKey string) error {
 	}
 	keys.nostrSecretKey = nostrSecretKey
 	keys.nostrPublicKey = nostrPublicKey
+
+	mnemonic, err := cfg.Get("Mnemonic", encryptionKey)
+	if err != nil {
+		logger.Logger.WithError(err).Error("Failed to fetch mnemonic")
+		return err
+	}
+	if mnemonic != "" {
+		backupEncryptionKey, err := deriveBackupEncryptionKey(mnemonic)
+		if err != nil {
+			logger.Logger.WithError(err).Error("Failed to derive backup encryption key")
+			return err
+		}
+		keys.backupEncryptionKey = backupEncryptionKey
+	}
 	return nil
 }
 
+func deriveBackupEncryptionKey(mnemonic string) ([]byte, error) {
+	seed := bip39.NewSeed(mnemonic, "")
+	backupEncryptionKey := make([]byte, 32)
+	_, err := io.ReadFull(hkdf.New(sha256.New, seed, nil, []byte(backupEncryptionKeyInfo)), backupEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return backupEncryptionKey, nil
+}
+
 func (keys *keys) GetNostrPublicKey() string {
 	if keys.nostrPublicKey == "" {
 		logger.Logger.Fatal("keys not initialized")
@@ -53,3 +89,7 @@ func (keys *keys) GetNostrSecretKey() string {
 	}
 	return keys.nostrSecretKey
 }
+
+func (keys *keys) GetBackupEncryptionKey() []byte {
+	return keys.backupEncryptionKey
+}
@@ -37,6 +37,7 @@ type service struct {
 	lnClient            lnclient.LNClient
 	transactionsService transactions.TransactionsService
 	albyOAuthSvc        alby.AlbyOAuthService
+	webhookConsumer     *events.WebhookConsumer
 	eventPublisher      events.EventPublisher
 	ctx                 context.Context
 	wg                  *sync.WaitGroup
@@ -108,6 +109,11 @@ func NewService(ctx context.Context) (*service, error) {
 	eventPublisher.RegisterSubscriber(svc.nip47Service)
 	eventPublisher.RegisterSubscriber(svc.albyOAuthSvc)
 
+	if appConfig.WebhookUrl != "" {
+		svc.webhookConsumer = events.NewWebhookConsumer(appConfig.WebhookUrl, appConfig.WebhookSecret, events.WithWebhookRedactedFields(appConfig.GetEventsRedactFields()))
+		eventPublisher.RegisterSubscriber(svc.webhookConsumer)
+	}
+
 	eventPublisher.Publish(&events.Event{
 		Event: "nwc_started",
 		Properties: map[string]interface{}{
@@ -208,9 +214,17 @@ func finishRestoreNode(workDir string) {
 
 func (svc *service) Shutdown() {
 	svc.StopApp()
-	svc.eventPublisher.Publish(&events.Event{
+	// the Alby OAuth service does not accept events once its shutdown started
+	svc.eventPublisher.PublishSync(&events.Event{
 		Event: "nwc_stopped",
 	})
+	// give pending events a bounded time to reach the Alby API
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	svc.albyOAuthSvc.Shutdown(ctx)
+	if svc.webhookConsumer != nil {
+		svc.webhookConsumer.Shutdown(ctx)
+	}
 	db.Stop(svc.db)
 	// wait for any remaining events
 	time.Sleep(1 * time.Second)
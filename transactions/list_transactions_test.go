@@ -216,3 +216,51 @@ func TestListTransactions_FromUntil(t *testing.T) {
 	assert.Equal(t, 1, len(incomingTransactions))
 	assert.Equal(t, "second", incomingTransactions[0].Description)
 }
+
+func TestListTransactionsPage(t *testing.T) {
+	ctx := context.TODO()
+
+	defer tests.RemoveTestService()
+	svc, err := tests.CreateTestService()
+	assert.NoError(t, err)
+
+	createdAt := time.Now().Add(-time.Hour)
+	// 2 and 3 are created at the same time
+	for i, offset := range []time.Duration{0, time.Minute, time.Minute, 2 * time.Minute} {
+		svc.DB.Create(&db.Transaction{
+			ID:         uint(i + 1),
+			State:      constants.TRANSACTION_STATE_SETTLED,
+			Type:       constants.TRANSACTION_TYPE_INCOMING,
+			AmountMsat: 1000,
+			CreatedAt:  createdAt.Add(offset),
+		})
+	}
+	svc.DB.Create(&db.Transaction{
+		ID:        5,
+		State:     constants.TRANSACTION_STATE_PENDING,
+		Type:      constants.TRANSACTION_TYPE_INCOMING,
+		CreatedAt: createdAt.Add(time.Hour),
+	})
+
+	transactionsService := NewTransactionsService(svc.DB, svc.EventPublisher)
+
+	ids := func(transactions []Transaction) []uint {
+		result := []uint{}
+		for _, transaction := range transactions {
+			result = append(result, transaction.ID)
+		}
+		return result
+	}
+
+	transactions, err := transactionsService.ListTransactionsPage(ctx, nil, false, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{4, 3, 2, 1}, ids(transactions))
+
+	transactions, err = transactionsService.ListTransactionsPage(ctx, &TransactionsCursor{CreatedAt: transactions[1].CreatedAt, ID: 3}, false, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{2, 1}, ids(transactions))
+
+	transactions, err = transactionsService.ListTransactionsPage(ctx, &TransactionsCursor{CreatedAt: transactions[0].CreatedAt, ID: 2}, true, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint{3, 4}, ids(transactions))
+}
@@ -36,6 +36,7 @@ type TransactionsService interface {
 	MakeInvoice(ctx context.Context, amount int64, description string, descriptionHash string, expiry int64, metadata map[string]interface{}, lnClient lnclient.LNClient, appId *uint, requestEventId *uint) (*Transaction, error)
 	LookupTransaction(ctx context.Context, paymentHash string, transactionType *string, lnClient lnclient.LNClient, appId *uint) (*Transaction, error)
 	ListTransactions(ctx context.Context, from, until, limit, offset uint64, unpaid bool, transactionType *string, lnClient lnclient.LNClient, appId *uint) (transactions []Transaction, err error)
+	ListTransactionsPage(ctx context.Context, cursor *TransactionsCursor, newer bool, limit uint64) (transactions []Transaction, err error)
 	SendPaymentSync(ctx context.Context, payReq string, lnClient lnclient.LNClient, appId *uint, requestEventId *uint) (*Transaction, error)
 	SendKeysend(ctx context.Context, amount uint64, destination string, customRecords []lnclient.TLVRecord, preimage string, lnClient lnclient.LNClient, appId *uint, requestEventId *uint) (*Transaction, error)
 }
@@ -48,6 +49,13 @@ const (
 
 type Transaction = db.Transaction
 
+// TransactionsCursor is the position of a transaction in the list of settled transactions,
+// which is ordered by creation time and ID
+type TransactionsCursor struct {
+	CreatedAt time.Time
+	ID        uint
+}
+
 type Boostagram struct {
 	AppName        string `json:"app_name"`
 	Name           string `json:"name"`
@@ -529,6 +537,37 @@ func (svc *transactionsService) ListTransactions(ctx context.Context, from, unti
 	return transactions, nil
 }
 
+// ListTransactionsPage lists up to limit settled transactions older than cursor, newest first.
+// If newer is set, the transactions newer than cursor are listed instead, oldest first.
+// A nil cursor starts at the newest or oldest transaction.
+func (svc *transactionsService) ListTransactionsPage(ctx context.Context, cursor *TransactionsCursor, newer bool, limit uint64) (transactions []Transaction, err error) {
+	tx := svc.db.WithContext(ctx).Where("state == ?", constants.TRANSACTION_STATE_SETTLED)
+
+	if newer {
+		tx = tx.Order("created_at asc, id asc")
+		if cursor != nil {
+			tx = tx.Where("created_at > ? OR (created_at == ? AND id > ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+		}
+	} else {
+		tx = tx.Order("created_at desc, id desc")
+		if cursor != nil {
+			tx = tx.Where("created_at < ? OR (created_at == ? AND id < ?)", cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+		}
+	}
+
+	if limit > 0 {
+		tx = tx.Limit(int(limit))
+	}
+
+	result := tx.Find(&transactions)
+	if result.Error != nil {
+		logger.Logger.WithError(result.Error).Error("Failed to list DB transactions page")
+		return nil, result.Error
+	}
+
+	return transactions, nil
+}
+
 func (svc *transactionsService) checkUnsettledTransactions(ctx context.Context, lnClient lnclient.LNClient) {
 	// Only check unsettled transactions for clients that don't support async events
 	// checkUnsettledTransactions does not work for keysend payments!
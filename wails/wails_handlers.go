@@ -37,8 +37,13 @@ func (app *WailsApp) WailsRequestRouter(route string, method string, body string
 	switch {
 	case len(authCodeMatch) > 1:
 		code := authCodeMatch[1]
+		var state string
+		callbackUrl, err := url.Parse(route)
+		if err == nil {
+			state = callbackUrl.Query().Get("state")
+		}
 
-		err := app.svc.GetAlbyOAuthSvc().CallbackHandler(ctx, code, app.svc.GetLNClient())
+		err = app.svc.GetAlbyOAuthSvc().CallbackHandler(ctx, code, state, app.svc.GetLNClient())
 		if err != nil {
 			logger.Logger.WithFields(logrus.Fields{
 				"route":  route,
@@ -260,6 +265,21 @@ func (app *WailsApp) WailsRequestRouter(route string, method string, body string
 		return WailsRequestRouterResponse{Body: paymentResponse, Error: ""}
 	}
 
+	autoChannelOrderRegex := regexp.MustCompile(
+		`/api/alby/auto-channel/([^/]+)`,
+	)
+	autoChannelOrderMatch := autoChannelOrderRegex.FindStringSubmatch(route)
+
+	switch {
+	case len(autoChannelOrderMatch) > 1:
+		orderId := autoChannelOrderMatch[1]
+		autoChannelResponse, err := app.svc.GetAlbyOAuthSvc().GetAutoChannelOrderStatus(ctx, app.svc.GetLNClient(), orderId)
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: autoChannelResponse, Error: ""}
+	}
+
 	switch route {
 	case "/api/alby/me":
 		me, err := app.svc.GetAlbyOAuthSvc().GetMe(ctx)
@@ -283,16 +303,111 @@ func (app *WailsApp) WailsRequestRouter(route string, method string, body string
 			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
 		}
 		return WailsRequestRouterResponse{Body: &alby.AlbyBalanceResponse{
-			Sats: balance.Balance,
+			Sats: balance.BalanceSat(),
 		}, Error: ""}
+	case "/api/alby/balance/last-known":
+		balance, updatedAt, err := app.svc.GetAlbyOAuthSvc().GetLastKnownBalance()
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: &alby.AlbyLastKnownBalanceResponse{
+			Sats:      balance.BalanceSat(),
+			UpdatedAt: updatedAt,
+		}, Error: ""}
+	case "/api/alby/health":
+		health, err := app.svc.GetAlbyOAuthSvc().HealthCheck(ctx)
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: health, Error: ""}
+	case "/api/alby/auth-url":
+		authUrl := app.svc.GetAlbyOAuthSvc().GetAuthUrl()
+		if authUrl == "" {
+			return WailsRequestRouterResponse{Body: nil, Error: "Failed to get alby auth url"}
+		}
+		return WailsRequestRouterResponse{Body: &alby.AlbyAuthUrlResponse{
+			Url: authUrl,
+		}, Error: ""}
+	case "/api/alby/token-status":
+		tokenStatus, err := app.svc.GetAlbyOAuthSvc().GetTokenStatus()
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: tokenStatus, Error: ""}
+	case "/api/alby/summary":
+		summary, err := app.svc.GetAlbyOAuthSvc().GetAccountSummary(ctx)
+		if err != nil {
+			logger.Logger.WithFields(logrus.Fields{
+				"route":  route,
+				"method": method,
+				"body":   body,
+			}).WithError(err).Error("Failed to decode request to wails router")
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: summary, Error: ""}
+	case "/api/alby/node-info":
+		info, err := app.svc.GetAlbyOAuthSvc().GetNodeAndAccountInfo(ctx, app.svc.GetLNClient())
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: info, Error: ""}
 	case "/api/alby/drain":
-		err := app.svc.GetAlbyOAuthSvc().DrainSharedWallet(ctx, app.svc.GetLNClient())
+		drainMemo := &alby.DrainMemo{}
+		if body != "" {
+			err := json.Unmarshal([]byte(body), drainMemo)
+			if err != nil {
+				logger.Logger.WithFields(logrus.Fields{
+					"route":  route,
+					"method": method,
+					"body":   body,
+				}).WithError(err).Error("Failed to decode request to wails router")
+				return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+			}
+		}
+		drainResult, err := app.svc.GetAlbyOAuthSvc().DrainSharedWallet(ctx, app.svc.GetLNClient(), nil, drainMemo)
 		if err != nil {
 			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
 		}
-		return WailsRequestRouterResponse{Body: nil, Error: ""}
+		return WailsRequestRouterResponse{Body: drainResult, Error: ""}
 	case "/api/alby/unlink-account":
-		err := app.svc.GetAlbyOAuthSvc().UnlinkAccount(ctx)
+		unlinkAccountRequest := &alby.AlbyUnlinkAccountRequest{}
+		if body != "" {
+			err := json.Unmarshal([]byte(body), unlinkAccountRequest)
+			if err != nil {
+				logger.Logger.WithFields(logrus.Fields{
+					"route":  route,
+					"method": method,
+					"body":   body,
+				}).WithError(err).Error("Failed to decode request to wails router")
+				return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+			}
+		}
+		err := app.svc.GetAlbyOAuthSvc().UnlinkAccount(ctx, unlinkAccountRequest.Confirm)
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: nil, Error: ""}
+	case "/api/alby/accounts":
+		accounts, err := app.svc.GetAlbyOAuthSvc().ListLinkedAccounts()
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: &alby.AlbyLinkedAccountsResponse{
+			Accounts:      accounts,
+			ActiveAccount: app.svc.GetAlbyOAuthSvc().ActiveAccount(),
+		}, Error: ""}
+	case "/api/alby/accounts/switch":
+		switchAccountRequest := &alby.AlbySwitchAccountRequest{}
+		err := json.Unmarshal([]byte(body), switchAccountRequest)
+		if err != nil {
+			logger.Logger.WithFields(logrus.Fields{
+				"route":  route,
+				"method": method,
+				"body":   body,
+			}).WithError(err).Error("Failed to decode request to wails router")
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		err = app.svc.GetAlbyOAuthSvc().SwitchActiveAccount(switchAccountRequest.Name)
 		if err != nil {
 			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
 		}
@@ -308,11 +423,11 @@ func (app *WailsApp) WailsRequestRouter(route string, method string, body string
 			}).WithError(err).Error("Failed to decode request to wails router")
 			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
 		}
-		err = app.svc.GetAlbyOAuthSvc().SendPayment(ctx, payRequest.Invoice)
+		payResponse, err := app.svc.GetAlbyOAuthSvc().SendPayment(ctx, payRequest.Invoice)
 		if err != nil {
 			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
 		}
-		return WailsRequestRouterResponse{Body: nil, Error: ""}
+		return WailsRequestRouterResponse{Body: payResponse, Error: ""}
 	case "/api/apps":
 		switch method {
 		case "GET":
@@ -537,7 +652,7 @@ func (app *WailsApp) WailsRequestRouter(route string, method string, body string
 			}).WithError(err).Error("Failed to decode request to wails router")
 			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
 		}
-		autoChannelResponse, err := app.svc.GetAlbyOAuthSvc().RequestAutoChannel(ctx, app.svc.GetLNClient(), newAutoChannelRequest.IsPublic)
+		autoChannelResponse, err := app.svc.GetAlbyOAuthSvc().RequestAutoChannel(ctx, app.svc.GetLNClient(), newAutoChannelRequest.IsPublic, newAutoChannelRequest.PaymentMethod, newAutoChannelRequest.ChannelSizeSat)
 		if err != nil {
 			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
 		}
@@ -560,6 +675,32 @@ func (app *WailsApp) WailsRequestRouter(route string, method string, body string
 		}
 		res := WailsRequestRouterResponse{Error: ""}
 		return res
+	case "/api/alby/rotate-nwc":
+		err := app.svc.GetAlbyOAuthSvc().RotateNWCConnection(ctx, app.svc.GetLNClient())
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: nil, Error: ""}
+	case "/api/alby/link-account/preview":
+		preview, err := app.svc.GetAlbyOAuthSvc().PreviewLinkAccount(ctx, app.svc.GetLNClient())
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: *preview, Error: ""}
+	case "/api/alby/auto-link":
+		autoLinkStatus, err := app.svc.GetAlbyOAuthSvc().GetAutoLinkStatus()
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: &alby.AlbyAutoLinkStatusResponse{
+			Status: autoLinkStatus,
+		}, Error: ""}
+	case "/api/alby/auto-link/retry":
+		err := app.svc.GetAlbyOAuthSvc().RetryAutoLink(ctx, app.svc.GetLNClient())
+		if err != nil {
+			return WailsRequestRouterResponse{Body: nil, Error: err.Error()}
+		}
+		return WailsRequestRouterResponse{Body: nil, Error: ""}
 	case "/api/mnemonic":
 		mnemonicRequest := &api.MnemonicRequest{}
 		err := json.Unmarshal([]byte(body), mnemonicRequest)